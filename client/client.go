@@ -0,0 +1,256 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+A client of the geto server's HTTP API
+
+	c := client.New("https://geto.example.com:11103", token, nil)
+	reply, err := c.FollowOutput(id, true, func(chunk task.OutputChunk) {
+		os.Stdout.Write(chunk.Data)
+	})
+*/
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/task"
+	"github.com/bgmerrell/geto/server"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default address of the geto server's HTTP API
+const DEFAULT_SERVER_URL = "http://localhost:11103"
+
+// The longest Server-Sent Event line accepted, enough for a base64-encoded
+// task.TAIL_CHUNK_SIZE chunk
+const MAX_EVENT_LINE = 1 << 20
+
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Return a client of the server at baseURL that authenticates with token
+// ("" for none) and, for https URLs, uses tlsConfig (nil for the defaults)
+func New(baseURL string, token string, tlsConfig *tls.Config) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}}
+}
+
+// Send a request for path and return the response, which is an error unless
+// its status is 2xx
+func (c *Client) do(method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var reply struct{ Error string }
+		if json.NewDecoder(resp.Body).Decode(&reply) != nil || reply.Error == "" {
+			reply.Error = resp.Status
+		}
+		return nil, errors.New(reply.Error)
+	}
+	return resp, nil
+}
+
+// Send a GET request for path and return the response, which is an error
+// unless its status is 2xx
+func (c *Client) get(path string) (*http.Response, error) {
+	return c.do(http.MethodGet, path, "", nil)
+}
+
+// Send a request for path and decode the JSON reply into v
+func (c *Client) doJSON(method string, path string, contentType string, body io.Reader, v interface{}) error {
+	resp, err := c.do(method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.New("Invalid reply: " + err.Error())
+	}
+	return nil
+}
+
+// Return the hosts that the client may use
+func (c *Client) ListHosts() ([]server.HostReply, error) {
+	var hosts []server.HostReply
+	return hosts, c.doJSON(http.MethodGet, "/hosts", "", nil, &hosts)
+}
+
+// Test the server's connection to a host, "" for every host that the client
+// may use
+func (c *Client) TestHosts(hostName string) ([]server.HostConnectionReply, error) {
+	path := "/hosts/test"
+	if hostName != "" {
+		path += "?host=" + url.QueryEscape(hostName)
+	}
+	var results []server.HostConnectionReply
+	return results, c.doJSON(http.MethodGet, path, "", nil, &results)
+}
+
+// Submit a task, uploading the local files at depPaths as its dependency
+// files (args.DepFiles must be empty)
+func (c *Client) SubmitTask(args server.SubmitTaskArgs, depPaths []string) (*server.TaskReply, error) {
+	content, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(depPaths) == 0 {
+		return c.doTask(http.MethodPost, "/tasks", "application/json", bytes.NewReader(content))
+	}
+
+	// The form is streamed so that large files aren't held in memory
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		err := form.WriteField("task", string(content))
+		for _, path := range depPaths {
+			if err != nil {
+				break
+			}
+			err = writeFormFile(form, "deps", path)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+	return c.doTask(http.MethodPost, "/tasks", form.FormDataContentType(), pr)
+}
+
+// Send a request for path that replies with a task
+func (c *Client) doTask(method string, path string, contentType string, body io.Reader) (*server.TaskReply, error) {
+	var reply server.TaskReply
+	if err := c.doJSON(method, path, contentType, body, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Add the file at path to a multipart form
+func writeFormFile(form *multipart.Writer, field string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := form.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Return the status of a task, waiting up to wait seconds (0 to not wait) for
+// it to be done
+func (c *Client) GetTask(id string, wait uint32) (*server.TaskReply, error) {
+	path := "/tasks/" + url.PathEscape(id)
+	if wait > 0 {
+		path += fmt.Sprintf("?wait=%d", wait)
+	}
+	return c.doTask(http.MethodGet, path, "", nil)
+}
+
+// Cancel a task
+func (c *Client) CancelTask(id string) (*server.TaskReply, error) {
+	return c.doTask(http.MethodDelete, "/tasks/"+url.PathEscape(id), "", nil)
+}
+
+// Pass each chunk of a task's stdout and stderr to onChunk, following the
+// output until the task is done if follow is set.  The task's TaskReply is
+// returned once it's done, nil if the output ended before that.
+func (c *Client) FollowOutput(id string, follow bool, onChunk func(task.OutputChunk)) (*server.TaskReply, error) {
+	path := fmt.Sprintf("/tasks/%s/output", url.PathEscape(id))
+	if !follow {
+		path += "?follow=false"
+	}
+	resp, err := c.get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), MAX_EVENT_LINE)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && event == "output":
+			var chunk task.OutputChunk
+			if err = json.Unmarshal([]byte(data), &chunk); err != nil {
+				return nil, errors.New("Invalid output event: " + err.Error())
+			}
+			onChunk(chunk)
+			event, data = "", ""
+		case line == "" && event == "done":
+			var reply server.TaskReply
+			if err = json.Unmarshal([]byte(data), &reply); err != nil {
+				return nil, errors.New("Invalid done event: " + err.Error())
+			}
+			return &reply, nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// Query the history of the tasks on the server
+func (c *Client) History(args server.HistoryArgs) (*server.HistoryReply, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"state": args.State, "host": args.Host, "script_name": args.ScriptName} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if args.Since != nil {
+		query.Set("since", args.Since.Format(time.RFC3339))
+	}
+	if args.Until != nil {
+		query.Set("until", args.Until.Format(time.RFC3339))
+	}
+	if args.ExitCode != nil {
+		query.Set("exit_code", strconv.Itoa(*args.ExitCode))
+	}
+	var reply server.HistoryReply
+	if err := c.doJSON(http.MethodGet, "/history?"+query.Encode(), "", nil, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
@@ -0,0 +1,162 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"github.com/bgmerrell/geto/lib/ssh/sshtest"
+	"github.com/bgmerrell/geto/lib/task"
+	"github.com/bgmerrell/geto/server"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Start an SSH server for the configured hosts and a geto server's HTTP API.
+// The returned function stops both.
+func startServer(t *testing.T) (*httptest.Server, func()) {
+	if _, err := config.ParseConfig("../test/data/geto-sshtest.ini"); err != nil {
+		t.Fatalf("Failed to parse test config: %s", err.Error())
+	}
+	s, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start SSH server: %s", err.Error())
+	}
+	// The hosts share the config's backing array
+	hosts := config.GetParsedConfig().Hosts
+	for i := range hosts {
+		hosts[i].PortNum = s.Port
+		hosts[i].Password = &s.Password
+	}
+	httpServer := httptest.NewServer(server.NewHTTPHandler(server.NewGetoRPC(ssh.New())))
+	return httpServer, func() {
+		httpServer.Close()
+		s.Close()
+	}
+}
+
+func submitTask(t *testing.T, serverURL string, args server.SubmitTaskArgs) string {
+	body, _ := json.Marshal(args)
+	resp, err := http.Post(serverURL+"/tasks", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to submit task: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	var reply server.TaskReply
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil || reply.Id == "" {
+		t.Fatalf("Unexpected submission reply: %#v (%v)", reply, err)
+	}
+	return reply.Id
+}
+
+func TestFollowOutput(t *testing.T) {
+	httpServer, stop := startServer(t)
+	defer stop()
+	id := submitTask(t, httpServer.URL, server.SubmitTaskArgs{
+		ScriptName: "test-logs", Script: "echo one\nsleep 2\necho two\necho oops >&2"})
+
+	c := New(httpServer.URL, "", nil)
+	for _, follow := range []bool{true, false} {
+		streams := map[string]string{}
+		reply, err := c.FollowOutput(id, follow, func(chunk task.OutputChunk) {
+			if chunk.Offset != int64(len(streams[chunk.Stream])) {
+				t.Errorf("Unexpected %s chunk offset: %d", chunk.Stream, chunk.Offset)
+			}
+			streams[chunk.Stream] += string(chunk.Data)
+		})
+		if err != nil {
+			t.Fatalf("Failed to follow output: %s", err.Error())
+		}
+		if streams[task.STDOUT] != "one\ntwo\n" || streams[task.STDERR] != "oops\n" {
+			t.Errorf("Unexpected output: %#v", streams)
+		}
+		// The task is done by the time its output is followed to the end
+		if reply == nil || reply.State != "succeeded" {
+			t.Errorf("Expected the task to be done, got %#v", reply)
+		}
+	}
+
+	if _, err := c.FollowOutput("no-such-task", true, func(task.OutputChunk) {}); err == nil ||
+		err.Error() != "No such task" {
+		t.Errorf("Expected an unknown task error, got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	httpServer, stop := startServer(t)
+	defer stop()
+	id := submitTask(t, httpServer.URL, server.SubmitTaskArgs{ScriptName: "test-history", Script: "exit 1"})
+
+	c := New(httpServer.URL, "", nil)
+	if _, err := c.FollowOutput(id, true, func(task.OutputChunk) {}); err != nil {
+		t.Fatalf("Failed to wait for the task: %s", err.Error())
+	}
+	exitCode := 1
+	reply, err := c.History(server.HistoryArgs{ScriptName: "test-history", ExitCode: &exitCode})
+	if err != nil {
+		t.Fatalf("Failed to query history: %s", err.Error())
+	}
+	if len(reply.Tasks) != 1 || reply.Tasks[0].Id != id || reply.Total.Failed != 1 {
+		t.Errorf("Unexpected history: %#v", reply)
+	}
+	exitCode = 0
+	if reply, err = c.History(server.HistoryArgs{ExitCode: &exitCode}); err != nil || len(reply.Tasks) != 0 {
+		t.Errorf("Expected no tasks, got %#v (%v)", reply, err)
+	}
+}
+
+func TestSubmitAndCancelTask(t *testing.T) {
+	httpServer, stop := startServer(t)
+	defer stop()
+	dirPath, err := ioutil.TempDir("", "geto-client")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+	depPath := filepath.Join(dirPath, "data.txt")
+	if err = ioutil.WriteFile(depPath, []byte("a\nb\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c := New(httpServer.URL, "", nil)
+	submitted, err := c.SubmitTask(server.SubmitTaskArgs{
+		ScriptName: "test-client", Script: "wc -l < DEPS/data.txt"}, []string{depPath})
+	if err != nil {
+		t.Fatalf("Failed to submit task: %s", err.Error())
+	}
+	reply, err := c.GetTask(submitted.Id, 30)
+	if err != nil || reply.State != "succeeded" || strings.TrimSpace(reply.Result.Stdout) != "2" {
+		t.Errorf("Unexpected task: %#v (%v)", reply, err)
+	}
+	if _, err = c.CancelTask(submitted.Id); err == nil || err.Error() != "Task is already done" {
+		t.Errorf("Expected a done task to not be cancelled, got %v", err)
+	}
+
+	if submitted, err = c.SubmitTask(server.SubmitTaskArgs{ScriptName: "test-client", Script: "sleep 30"}, nil); err != nil {
+		t.Fatalf("Failed to submit task: %s", err.Error())
+	}
+	if _, err = c.CancelTask(submitted.Id); err != nil {
+		t.Fatalf("Failed to cancel task: %s", err.Error())
+	}
+	if reply, err = c.GetTask(submitted.Id, 30); err != nil || reply.State != "cancelled" {
+		t.Errorf("Expected the task to be cancelled, got %#v (%v)", reply, err)
+	}
+
+	hosts, err := c.ListHosts()
+	if err != nil || len(hosts) != 1 || hosts[0].Name != "server1" {
+		t.Errorf("Unexpected hosts: %#v (%v)", hosts, err)
+	}
+	results, err := c.TestHosts("")
+	if err != nil || len(results) != 1 || !results[0].Ok {
+		t.Errorf("Unexpected connection test results: %#v (%v)", results, err)
+	}
+}
@@ -0,0 +1,227 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The commands that work on many hosts at once, outside of tasks: exec, push
+and pull
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/fleet"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The flags that select the hosts and how they're worked on
+type fleetFlags struct {
+	hostNames   stringList
+	groups      stringList
+	concurrency *int
+	timeout     *uint
+	json        *bool
+}
+
+func addFleetFlags(flags *flag.FlagSet) *fleetFlags {
+	f := &fleetFlags{}
+	flags.Var(&f.hostNames, "host", "Host to work on (repeatable, default every host)")
+	flags.Var(&f.groups, "group", "Work on the hosts in the group (repeatable)")
+	f.concurrency = flags.Int("concurrency", fleet.DEFAULT_CONCURRENCY, "The most hosts worked on at once")
+	f.timeout = flags.Uint("timeout", 0, "Seconds before giving up on a host, 0 for no limit")
+	f.json = flags.Bool("json", false, "Print the results as JSON")
+	return f
+}
+
+func (f *fleetFlags) getOptions() fleet.Options {
+	return fleet.Options{Concurrency: *f.concurrency, Timeout: uint32(*f.timeout)}
+}
+
+// An ExecResult as it's printed with -json
+type execReply struct {
+	Host     string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Why the command failed, "" if it exited with 0
+	Error string
+	// In seconds
+	Duration float64
+}
+
+// Print lines to w, each prefixed with the host's name
+func printPrefixed(w *os.File, hostName string, lines string) {
+	if lines == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(lines, "\n"), "\n") {
+		fmt.Fprintf(w, "%s: %s\n", hostName, line)
+	}
+}
+
+// Return why the command failed on a host, for the summary
+func describeFailure(result fleet.ExecResult) string {
+	if result.ExitCode > 0 {
+		return fmt.Sprintf("exit code %d", result.ExitCode)
+	}
+	return result.Err.Error()
+}
+
+// Run a command on the hosts, print each host's output and exit with status
+// 1 if the command failed on any of them
+func execCommand(args []string) {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+	ff := addFleetFlags(flags)
+	prefix := flags.Bool("prefix", false, "Prefix each line of output with the host's name, instead of grouping it by host")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		failUsage("geto exec [-host HOST]... [-group GROUP]... [-concurrency N] [-timeout SECONDS] " +
+			"[-prefix] [-json] [--] <command>")
+	}
+	command := strings.Join(flags.Args(), " ")
+
+	loadConfig()
+	hosts := selectHosts(ff.hostNames, ff.groups)
+	var onResult func(fleet.ExecResult)
+	switch {
+	case *ff.json:
+	case *prefix:
+		onResult = func(result fleet.ExecResult) {
+			printPrefixed(os.Stdout, result.Host, result.Stdout)
+			printPrefixed(os.Stderr, result.Host, result.Stderr)
+		}
+	default:
+		onResult = func(result fleet.ExecResult) {
+			status := "ok"
+			if result.Err != nil {
+				status = describeFailure(result)
+			}
+			fmt.Printf("==> %s (%s, %s) <==\n", result.Host, status, result.Duration.Round(time.Millisecond))
+			os.Stdout.WriteString(result.Stdout)
+			os.Stderr.WriteString(result.Stderr)
+			fmt.Println()
+		}
+	}
+	results := fleet.Exec(ssh.New(), hosts, command, ff.getOptions(), onResult)
+	failed := fleet.Failed(results)
+
+	if *ff.json {
+		replies := make([]execReply, len(results))
+		for i, result := range results {
+			replies[i] = execReply{
+				Host:     result.Host,
+				Stdout:   result.Stdout,
+				Stderr:   result.Stderr,
+				ExitCode: result.ExitCode,
+				Duration: result.Duration.Seconds()}
+			if result.Err != nil {
+				replies[i].Error = result.Err.Error()
+			}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(replies)
+	} else {
+		fmt.Fprintf(os.Stderr, "%d host(s): %d succeeded, %d failed\n",
+			len(results), len(results)-len(failed), len(failed))
+		for _, result := range failed {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", result.Host, describeFailure(result))
+		}
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// A CopyResult as it's printed with -json
+type copyReply struct {
+	Host    string
+	Path    string
+	Skipped bool
+	SHA256  string
+	// Why the copy failed, "" if it didn't
+	Error string
+	// In seconds
+	Duration float64
+}
+
+// Copy a file to or from the hosts with doCopy, print each host's result and
+// exit with status 1 if the copy failed on any of them
+func copyFiles(name string, usage string, args []string,
+	doCopy func(hosts []host.Host, from string, to string, opts fleet.Options) []fleet.CopyResult) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	ff := addFleetFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		failUsage(usage)
+	}
+
+	loadConfig()
+	results := doCopy(selectHosts(ff.hostNames, ff.groups), flags.Arg(0), flags.Arg(1), ff.getOptions())
+	failed := fleet.FailedCopies(results)
+
+	if *ff.json {
+		replies := make([]copyReply, len(results))
+		for i, result := range results {
+			replies[i] = copyReply{
+				Host:     result.Host,
+				Path:     result.Path,
+				Skipped:  result.Skipped,
+				SHA256:   result.SHA256,
+				Duration: result.Duration.Seconds()}
+			if result.Err != nil {
+				replies[i].Error = result.Err.Error()
+			}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(replies)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tRESULT\tPATH\tDURATION")
+		for _, result := range results {
+			status := "copied"
+			switch {
+			case result.Err != nil:
+				status = result.Err.Error()
+			case result.Skipped:
+				status = "unchanged"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Host, status, result.Path,
+				result.Duration.Round(time.Millisecond))
+		}
+		w.Flush()
+		fmt.Fprintf(os.Stderr, "%d host(s): %d copied or unchanged, %d failed\n",
+			len(results), len(results)-len(failed), len(failed))
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Copy a local file to the hosts and exit
+func pushFile(args []string) {
+	copyFiles("push", "geto push [-host HOST]... [-group GROUP]... [-concurrency N] [-timeout SECONDS] "+
+		"[-json] <local file> <remote path>", args,
+		func(hosts []host.Host, localPath string, remotePath string, opts fleet.Options) []fleet.CopyResult {
+			return fleet.Push(ssh.New(), hosts, localPath, remotePath, opts)
+		})
+}
+
+// Copy a file from the hosts, into a directory per host, and exit
+func pullFile(args []string) {
+	copyFiles("pull", "geto pull [-host HOST]... [-group GROUP]... [-concurrency N] [-timeout SECONDS] "+
+		"[-json] <remote path> <local directory>", args,
+		func(hosts []host.Host, remotePath string, localDirPath string, opts fleet.Options) []fleet.CopyResult {
+			return fleet.Pull(ssh.New(), hosts, remotePath, localDirPath, opts)
+		})
+}
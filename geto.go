@@ -6,14 +6,59 @@
 Geto's main package
 
 Parse command line arguments and let the fun begin!
+
+	geto [-config-path PATH] <command> [arguments]
+
+"geto serve" (or geto without a command) runs the server until it's sent
+SIGTERM or SIGINT, then stops accepting connections and waits up to
+shutdown_timeout seconds for the running tasks before it exits (a second
+signal stops it right away).  The other commands are:
+
+	run [flags] <script>         Run a script on a host and print its output
+	status <task id>             Print the status of a task
+	cancel <task id>             Cancel a task
+	logs [-f] <task id>          Print the output of a task
+	history [flags]              List the tasks and sum them up
+	hosts [list|test|facts]      List, test or probe the hosts
+	locks [-release] [host...]   List or release the hosts' remote runner locks
+	exec [flags] <command>       Run a command on many hosts (see fleet.Exec)
+	push [flags] <file> <path>   Copy a file to many hosts (see fleet.Push)
+	pull [flags] <path> <dir>    Copy a file from many hosts (see fleet.Pull)
+	gc                           Sweep the task directories (see task.CollectGarbage)
+	config check                 Check the config file
+
+run, status, cancel and "hosts list|test" work either directly against the
+configured hosts or, given -server (or $GETO_SERVER), as a client of a geto
+server's HTTP API, which needs no config file.  logs and history only work
+against a server (by default, the one at client.DEFAULT_SERVER_URL).  hosts
+facts, locks, exec, push, pull, gc and config check only work directly.
+
+Directly, run runs the script on a host itself, while status and cancel look
+the task up in the server's task store (task_store_path), so they work for
+tasks submitted to a server even while it's down.
 */
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"github.com/bgmerrell/geto/client"
 	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/fleet"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"github.com/bgmerrell/geto/lib/task"
 	"github.com/bgmerrell/geto/server"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 /* Variables set by command line parsing */
@@ -22,17 +67,223 @@ var configPath string
 func parseCommandLine() {
 	/* TODO: look for a system-wide config file in a portable manner */
 	flag.StringVar(&configPath, "config-path", "geto.ini", "Configuration file path")
+	flag.Usage = usage
 	flag.Parse()
 }
 
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: geto [-config-path PATH] <command> [arguments]
+
+Commands:
+  serve                        Run the geto server (the default)
+  run [flags] <script>         Run a script on a host and print its output
+  status <task id>             Print the status of a task
+  cancel <task id>             Cancel a task
+  logs [-f] <task id>          Print the output of a task (server only)
+  history [flags]              List the tasks and sum them up (server only)
+  hosts [list|test|facts]      List, test or probe the hosts
+  locks [-release] [host...]   List or release the hosts' remote runner locks
+  exec [flags] <command>       Run a command on many hosts
+  push [flags] <file> <path>   Copy a file to many hosts
+  pull [flags] <path> <dir>    Copy a file from many hosts, into a directory per host
+  gc                           Sweep the task directories
+  config check                 Check the config file
+
+run, status, cancel and "hosts list|test" talk to a geto server if -server
+(or $GETO_SERVER) is set, and otherwise work directly from the config file.
+Run "geto <command> -h" for a command's flags.
+`)
+}
+
 func main() {
 	parseCommandLine()
+	command, args := flag.Arg(0), []string{}
+	if flag.NArg() > 0 {
+		args = flag.Args()[1:]
+	}
+	switch command {
+	case "", "serve":
+		loadConfig()
+		serve()
+	case "run":
+		runTask(args)
+	case "status":
+		printStatus(args)
+	case "cancel":
+		cancelTask(args)
+	case "logs":
+		printLogs(args)
+	case "history":
+		printHistory(args)
+	case "hosts":
+		manageHosts(args)
+	case "locks":
+		manageLocks(args)
+	case "exec":
+		execCommand(args)
+	case "push":
+		pushFile(args)
+	case "pull":
+		pullFile(args)
+	case "gc":
+		loadConfig()
+		collectGarbage()
+	case "config":
+		if len(args) != 1 || args[0] != "check" {
+			fmt.Fprintln(os.Stderr, "usage: geto [-config-path PATH] config check")
+			os.Exit(2)
+		}
+		checkConfig()
+	default:
+		fmt.Fprintf(os.Stderr, "geto: unknown command %q\n\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+// Parse the config file, exiting if it can't be
+func loadConfig() {
 	if _, err := config.ParseConfig(configPath); err != nil {
 		os.Exit(1)
 	}
-	if server.Serve() {
-		os.Exit(0)
-	} else {
+}
+
+// Print an error and exit
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "geto: "+err.Error())
+	os.Exit(1)
+}
+
+// Print a command's usage and exit
+func failUsage(usage string) {
+	fmt.Fprintln(os.Stderr, "usage: "+usage)
+	os.Exit(2)
+}
+
+// Run the server until it's sent SIGTERM or SIGINT (or fails), then shut it
+// down and exit
+func serve() {
+	s := server.NewServer(ssh.New())
+	if err := s.Start(); err != nil {
+		log.Print("Failed to start server: ", err.Error())
+		os.Exit(1)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	status := 0
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v", sig)
+	case err := <-s.Err():
+		log.Print(err.Error())
+		status = 1
+	}
+	// A second signal stops the server without waiting
+	signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+	timeout := time.Duration(config.GetParsedConfig().ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Print("Shutdown: ", err.Error())
+		status = 1
+	}
+	os.Exit(status)
+}
+
+// Sweep the task directories, print the ones deleted and exit
+func collectGarbage() {
+	removed, err := task.CollectGarbage(ssh.New())
+	for _, path := range removed {
+		fmt.Println(path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
+	os.Exit(0)
+}
+
+// Check that the config file parses and that the files it names can be
+// loaded, print a summary of it and exit
+func checkConfig() {
+	conf, err := config.ParseConfig(configPath)
+	if err != nil {
+		fail(err)
+	}
+	if _, err = server.GetTLSConfig(); err != nil {
+		fail(err)
+	}
+	var hostNames, clientNames []string
+	for _, h := range conf.Hosts {
+		hostNames = append(hostNames, h.Name)
+	}
+	for _, c := range conf.Clients {
+		clientNames = append(clientNames, c.Name)
+	}
+	orNone := func(s string, none string) string {
+		if s == "" {
+			return none
+		}
+		return s
+	}
+	fmt.Printf("%s: OK\n", configPath)
+	fmt.Printf("  hosts:        %s\n", orNone(strings.Join(hostNames, ", "), "none"))
+	fmt.Printf("  clients:      %s\n", orNone(strings.Join(clientNames, ", "),
+		"none (anyone who can connect may use the server)"))
+	fmt.Printf("  RPC listener: %s\n", conf.RPCListenAddr)
+	fmt.Printf("  HTTP API:     %s\n", orNone(conf.HTTPListenAddr, "disabled"))
+	fmt.Printf("  TLS:          %s\n", orNone(conf.TLSCertPath, "disabled"))
+	fmt.Printf("  task store:   %s\n", orNone(conf.TaskStorePath, "disabled"))
+	os.Exit(0)
+}
+
+// Return the configured hosts that are named or in one of the groups, all of
+// them if there are no names or groups, exiting if one isn't configured
+func selectHosts(names []string, groups []string) []host.Host {
+	hosts, err := fleet.SelectHosts(config.GetParsedConfig().Hosts, names, groups)
+	if err != nil {
+		fail(err)
+	}
+	return hosts
+}
+
+// The flags of the commands that talk to a geto server
+type clientFlags struct {
+	serverURL  *string
+	token      *string
+	caCertPath *string
+}
+
+// Add the flags of a geto server to flags, defaulting to the server at
+// $GETO_SERVER and otherwise to defaultURL ("" to work without a server)
+func addClientFlags(flags *flag.FlagSet, defaultURL string) clientFlags {
+	if url := os.Getenv("GETO_SERVER"); url != "" {
+		defaultURL = url
+	}
+	return clientFlags{
+		serverURL:  flags.String("server", defaultURL, "URL of the geto server's HTTP API (default $GETO_SERVER)"),
+		token:      flags.String("token", os.Getenv("GETO_TOKEN"), "Authentication token (default $GETO_TOKEN)"),
+		caCertPath: flags.String("ca-cert", "", "CA certificate of the server, for https")}
+}
+
+// Report whether the command talks to a geto server, rather than working
+// directly from the config file
+func (f clientFlags) useServer() bool {
+	return *f.serverURL != ""
+}
+
+// Return a client of the server that the flags name, exiting if the CA
+// certificate can't be read
+func (f clientFlags) newClient() *client.Client {
+	var tlsConfig *tls.Config
+	if *f.caCertPath != "" {
+		pem, err := ioutil.ReadFile(*f.caCertPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		tlsConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+		tlsConfig.RootCAs.AppendCertsFromPEM(pem)
+	}
+	return client.New(*f.serverURL, *f.token, tlsConfig)
 }
@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The history command, e.g., "geto history -state failed -host server2 -since
+12h", which lists the tasks on a geto server and sums them up per script name
+and host
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/bgmerrell/geto/client"
+	"github.com/bgmerrell/geto/server"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Parse a time of geto history: a duration before now (e.g., "12h") or an
+// RFC 3339 time
+func parseHistoryTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		t := time.Now().Add(-d)
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid time %q: expected a duration (e.g., 12h) or an RFC 3339 time", s))
+	}
+	return &t, nil
+}
+
+// Format a duration in seconds for geto history
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds * float64(time.Second))).Round(time.Millisecond).String()
+}
+
+// Print the statistics of a history report, per group
+func printStats(w io.Writer, title string, byGroup map[string]server.StatsReply) {
+	var names []string
+	for name := range byGroup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "%s\tTASKS\tSUCCEEDED\tFAILED\tCANCELLED\tSUCCESS RATE\tP50\tP95\n", title)
+	for _, name := range names {
+		stats := byGroup[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.1f%%\t%s\t%s\n", name,
+			stats.Tasks, stats.Succeeded, stats.Failed, stats.Cancelled,
+			stats.SuccessRate*100, formatSeconds(stats.P50Duration), formatSeconds(stats.P95Duration))
+	}
+}
+
+// Print the history of the tasks on a geto server and exit
+func printHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	state := flags.String("state", "", "Only tasks in the state (e.g., failed)")
+	hostName := flags.String("host", "", "Only tasks on the host")
+	scriptName := flags.String("script", "", "Only tasks of the script name")
+	since := flags.String("since", "", "Only tasks submitted since a duration ago (e.g., 12h) or an RFC 3339 time")
+	until := flags.String("until", "", "Only tasks submitted before a duration ago or an RFC 3339 time")
+	exitCode := flags.String("exit-code", "", "Only tasks whose script exited with the code")
+	statsOnly := flags.Bool("stats", false, "Only print the statistics")
+	cf := addClientFlags(flags, client.DEFAULT_SERVER_URL)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: geto history [-state STATE] [-host HOST] [-script NAME] "+
+			"[-since TIME] [-until TIME] [-exit-code CODE] [-stats] [-server URL] [-token TOKEN] [-ca-cert PATH]")
+		os.Exit(2)
+	}
+
+	historyArgs := server.HistoryArgs{State: *state, Host: *hostName, ScriptName: *scriptName}
+	var err error
+	if historyArgs.Since, err = parseHistoryTime(*since); err == nil {
+		historyArgs.Until, err = parseHistoryTime(*until)
+	}
+	if err == nil && *exitCode != "" {
+		var code int
+		if code, err = strconv.Atoi(*exitCode); err == nil {
+			historyArgs.ExitCode = &code
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	reply, err := cf.newClient().History(historyArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !*statsOnly {
+		fmt.Fprintln(w, "ID\tSCRIPT\tHOST\tSTATE\tEXIT CODE\tSUBMITTED\tDURATION")
+		for _, t := range reply.Tasks {
+			exit, duration := "-", "-"
+			// As in task.HistoryQuery, the exit code is only
+			// meaningful if the script ran until it exited
+			if r := t.Result; r != nil && (r.Error == "" || r.LimitHit != "" || r.ErrorPhase == "collect") {
+				exit = strconv.Itoa(t.Result.ExitCode)
+			}
+			if t.Started != nil && t.Finished != nil {
+				duration = t.Finished.Sub(*t.Started).Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.Id, t.ScriptName, t.Host,
+				t.State, exit, t.Submitted.Local().Format(time.RFC3339), duration)
+		}
+		fmt.Fprintln(w)
+	}
+	printStats(w, "SCRIPT", reply.ByScriptName)
+	fmt.Fprintln(w)
+	printStats(w, "HOST", reply.ByHost)
+	fmt.Fprintln(w)
+	printStats(w, "TOTAL", map[string]server.StatsReply{"all": reply.Total})
+	w.Flush()
+	os.Exit(0)
+}
@@ -0,0 +1,186 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The commands that look after the hosts: hosts and locks
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/fleet"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"github.com/bgmerrell/geto/lib/task"
+	"github.com/bgmerrell/geto/server"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// List, test or probe the hosts and exit
+func manageHosts(args []string) {
+	const usage = "geto hosts [list|test|facts] [-server URL] [-token TOKEN] [-ca-cert PATH] [host...]"
+	action := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("hosts "+action, flag.ExitOnError)
+	cf := addClientFlags(flags, "")
+	flags.Parse(args)
+
+	switch {
+	case action != "list" && action != "test" && action != "facts":
+		failUsage(usage)
+	case action == "facts" && cf.useServer():
+		fail(errors.New("hosts facts only works directly against the hosts, not with -server"))
+	case cf.useServer() && action == "list":
+		listServerHosts(cf, flags.Args())
+	case cf.useServer():
+		testServerHosts(cf, flags.Args())
+	}
+
+	loadConfig()
+	hosts := selectHosts(flags.Args(), nil)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	status := 0
+	switch action {
+	case "list":
+		fmt.Fprintln(w, "NAME\tADDRESS\tPORT\tUSER\tGROUPS")
+		for _, h := range hosts {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", h.Name, h.Addr, h.PortNum, h.Username, strings.Join(h.Groups, ","))
+		}
+	case "test":
+		conn := ssh.New()
+		errs := make([]error, len(hosts))
+		fleet.ForEachHost(hosts, 0, func(i int, h host.Host) { errs[i] = conn.TestConnection(h) })
+		fmt.Fprintln(w, "HOST\tRESULT")
+		for i, h := range hosts {
+			if errs[i] != nil {
+				fmt.Fprintf(w, "%s\t%s\n", h.Name, errs[i].Error())
+				status = 1
+			} else {
+				fmt.Fprintf(w, "%s\tok\n", h.Name)
+			}
+		}
+	case "facts":
+		conn := ssh.New()
+		facts := make([]task.HostFacts, len(hosts))
+		errs := make([]error, len(hosts))
+		fleet.ForEachHost(hosts, 0, func(i int, h host.Host) { facts[i], errs[i] = task.GetHostFacts(conn, h) })
+		fmt.Fprintln(w, "HOST\tSYSTEM\tCPUS\tCAPABILITIES")
+		for i, h := range hosts {
+			if errs[i] != nil {
+				fmt.Fprintf(w, "%s\t%s\t\t\n", h.Name, errs[i].Error())
+				status = 1
+			} else {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", h.Name, facts[i].System, facts[i].CPUs,
+					strings.Join(facts[i].Names(), ","))
+			}
+		}
+	}
+	w.Flush()
+	os.Exit(status)
+}
+
+// List the hosts of a geto server and exit
+func listServerHosts(cf clientFlags, names []string) {
+	hosts, err := cf.newClient().ListHosts()
+	if err != nil {
+		fail(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tPORT\tUSER")
+	for _, h := range hosts {
+		if len(names) == 0 || containsString(names, h.Name) {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", h.Name, h.Addr, h.Port, h.Username)
+		}
+	}
+	w.Flush()
+	os.Exit(0)
+}
+
+// Test a geto server's connections to its hosts and exit
+func testServerHosts(cf clientFlags, names []string) {
+	c := cf.newClient()
+	var results []server.HostConnectionReply
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	for _, name := range names {
+		hostResults, err := c.TestHosts(name)
+		if err != nil {
+			fail(err)
+		}
+		results = append(results, hostResults...)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	status := 0
+	fmt.Fprintln(w, "HOST\tRESULT")
+	for _, result := range results {
+		if result.Ok {
+			fmt.Fprintf(w, "%s\tok\n", result.Host)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\n", result.Host, result.Error)
+			status = 1
+		}
+	}
+	w.Flush()
+	os.Exit(status)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// List the remote runner locks of the hosts, or release them, and exit
+func manageLocks(args []string) {
+	flags := flag.NewFlagSet("locks", flag.ExitOnError)
+	release := flags.Bool("release", false,
+		"Release the locks of the hosts, e.g., ones left behind by a geto process that was killed")
+	flags.Parse(args)
+	if *release && flags.NArg() == 0 {
+		failUsage("geto locks -release <host>...")
+	}
+
+	loadConfig()
+	conn := ssh.New()
+	hosts := selectHosts(flags.Args(), nil)
+	locks := make([]task.LockStatus, len(hosts))
+	errs := make([]error, len(hosts))
+	fleet.ForEachHost(hosts, 0, func(i int, h host.Host) {
+		if locks[i], errs[i] = task.GetRemoteRunnerLock(conn, h); errs[i] == nil && *release && locks[i].Held {
+			task.ReleaseRemoteRunnerLock(conn, h, locks[i].Owner)
+		}
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	status := 0
+	fmt.Fprintln(w, "HOST\tLOCK\tOWNER\tSINCE")
+	for i, h := range hosts {
+		switch {
+		case errs[i] != nil:
+			fmt.Fprintf(w, "%s\t%s\t\t\n", h.Name, errs[i].Error())
+			status = 1
+		case !locks[i].Held:
+			fmt.Fprintf(w, "%s\tfree\t\t\n", h.Name)
+		case *release:
+			fmt.Fprintf(w, "%s\treleased\t%s\t%s\n", h.Name, locks[i].Owner,
+				locks[i].Since.Local().Format(time.RFC3339))
+		default:
+			fmt.Fprintf(w, "%s\theld\t%s\t%s\n", h.Name, locks[i].Owner,
+				locks[i].Since.Local().Format(time.RFC3339))
+		}
+	}
+	w.Flush()
+	os.Exit(status)
+}
@@ -0,0 +1,195 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Stream directories to and from the target hosts as gzip-compressed tar
+archives.
+
+The local end of a transfer is done in Go, so geto doesn't need tar on the
+machine it runs on; the remote end is a tar and gzip pipeline run by the
+host's shell (see GetExtractCommand and GetCreateCommand).
+*/
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/shell"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Write a gzip-compressed tar archive of localPath to w.  The archive's
+// entries are relative to the parent directory of localPath, so extracting
+// the archive in a directory creates filepath.Base(localPath) there, like a
+// recursive copy would.
+func Write(w io.Writer, localPath string) (err error) {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	parentPath := filepath.Dir(localPath)
+	err = filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(parentPath, path)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf(
+			"Failed to archive %s: %s", localPath, err.Error()))
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// Return the path that an archive entry is extracted to in dirPath, or an
+// error if the entry would be extracted outside of dirPath
+func getEntryPath(dirPath string, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(fmt.Sprintf(
+			"Archive entry %q is outside of the directory", name))
+	}
+	return filepath.Join(dirPath, rel), nil
+}
+
+// Extract a gzip-compressed tar archive from r into dirPath.  Only regular
+// files and directories are extracted.
+func Extract(r io.Reader, dirPath string) (err error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.New("Failed to read archive: " + err.Error())
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.New("Failed to read archive: " + err.Error())
+		}
+		path, err := getEntryPath(dirPath, header.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err = extractFile(tr, path, mode); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Write the current archive entry to path
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, r); err != nil {
+		return errors.New(fmt.Sprintf(
+			"Failed to extract %s: %s", path, err.Error()))
+	}
+	return nil
+}
+
+// Return the command that extracts an archive from its stdin into dirPath on
+// a target host
+func GetExtractCommand(dirPath string) string {
+	return fmt.Sprintf("mkdir -p %[1]s && cd %[1]s && gzip -dc | tar -xf -",
+		shell.Quote(dirPath))
+}
+
+// Return the command that writes an archive of relPaths, relative to dirPath,
+// to its stdout on a target host
+func GetCreateCommand(dirPath string, relPaths []string) string {
+	// Prefixing the paths keeps tar from taking any of them as options
+	words := []string{"tar", "-cf", "-"}
+	for _, relPath := range relPaths {
+		words = append(words, "./"+relPath)
+	}
+	return fmt.Sprintf("cd %s && %s | gzip -c",
+		shell.Quote(dirPath), shell.Join(words))
+}
+
+// Copy localPath into remoteDirPath on a target host.  run runs a command on
+// the host with the given stdin.
+func Upload(localPath string, remoteDirPath string,
+	run func(command string, stdin io.Reader) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Write(pw, localPath))
+	}()
+	err := run(GetExtractCommand(remoteDirPath), pr)
+	// Unblock the writer if the command stopped reading early
+	pr.Close()
+	return err
+}
+
+// Copy relPaths, relative to remoteDirPath on a target host, into
+// localDirPath.  run runs a command on the host with the given stdout.
+func Download(remoteDirPath string, relPaths []string, localDirPath string,
+	run func(command string, stdout io.Writer) error) error {
+	pr, pw := io.Pipe()
+	ch := make(chan error, 1)
+	go func() {
+		err := run(GetCreateCommand(remoteDirPath, relPaths), pw)
+		pw.CloseWithError(err)
+		ch <- err
+	}()
+	err := Extract(pr, localDirPath)
+	// Unblock the command if the extraction stopped reading early
+	pr.CloseWithError(err)
+	if runErr := <-ch; runErr != nil {
+		return runErr
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// The files of the test directory, relative path to content
+var testFiles = map[string]string{
+	"a.txt":         "a\n",
+	"sub/b.txt":     "b\n",
+	"sub/deep/c.sh": "#!/bin/sh\n",
+}
+
+// Create a directory with the test files in a new temporary directory
+func createTestDir(t *testing.T) (tmpDirPath string, dirPath string) {
+	tmpDirPath, err := ioutil.TempDir("", "geto-archive")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	dirPath = filepath.Join(tmpDirPath, "src")
+	for relPath, content := range testFiles {
+		path := filepath.Join(dirPath, relPath)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err = os.Chmod(filepath.Join(dirPath, "sub/deep/c.sh"), 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return tmpDirPath, dirPath
+}
+
+// Check that dirPath has the test files
+func checkTestFiles(t *testing.T, dirPath string) {
+	for relPath, content := range testFiles {
+		actual, err := ioutil.ReadFile(filepath.Join(dirPath, relPath))
+		if err != nil {
+			t.Errorf("Missing %s: %s", relPath, err.Error())
+		} else if string(actual) != content {
+			t.Errorf("Expected %q in %s, got %q", content, relPath, actual)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dirPath, "sub/deep/c.sh"))
+	if err == nil && info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755 for c.sh, got %v", info.Mode().Perm())
+	}
+}
+
+// Run a command with the local shell
+func runLocal(command string, stdin io.Reader, stdout io.Writer) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	return cmd.Run()
+}
+
+func TestWriteAndExtract(t *testing.T) {
+	tmpDirPath, dirPath := createTestDir(t)
+	defer os.RemoveAll(tmpDirPath)
+	var buf bytes.Buffer
+	if err := Write(&buf, dirPath); err != nil {
+		t.Fatalf(err.Error())
+	}
+	destDirPath := filepath.Join(tmpDirPath, "dest")
+	if err := Extract(&buf, destDirPath); err != nil {
+		t.Fatalf(err.Error())
+	}
+	checkTestFiles(t, filepath.Join(destDirPath, "src"))
+}
+
+func TestExtractOutsideOfDirectory(t *testing.T) {
+	tmpDirPath, err := ioutil.TempDir("", "geto-archive")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(tmpDirPath)
+	for _, name := range []string{"../escape", "/etc/escape", "a/../../escape"} {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+		tw.Write([]byte("x"))
+		tw.Close()
+		gw.Close()
+		if err = Extract(&buf, filepath.Join(tmpDirPath, "dest")); err == nil {
+			t.Errorf("Expected extracting %q to fail", name)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(tmpDirPath, "escape")); err == nil {
+		t.Errorf("An archive entry was extracted outside of the directory")
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	tmpDirPath, dirPath := createTestDir(t)
+	defer os.RemoveAll(tmpDirPath)
+
+	// The "remote" end is tar and gzip run by the local shell
+	remoteDirPath := filepath.Join(tmpDirPath, "remote dir")
+	err := Upload(dirPath, remoteDirPath, func(command string, stdin io.Reader) error {
+		return runLocal(command, stdin, nil)
+	})
+	if err != nil {
+		t.Fatalf("Upload failed: %s", err.Error())
+	}
+	checkTestFiles(t, filepath.Join(remoteDirPath, "src"))
+
+	localDirPath := filepath.Join(tmpDirPath, "local")
+	err = Download(filepath.Join(remoteDirPath, "src"), []string{"a.txt", "sub/deep/c.sh"}, localDirPath,
+		func(command string, stdout io.Writer) error {
+			return runLocal(command, nil, stdout)
+		})
+	if err != nil {
+		t.Fatalf("Download failed: %s", err.Error())
+	}
+	for _, relPath := range []string{"a.txt", "sub/deep/c.sh"} {
+		if _, err = os.Stat(filepath.Join(localDirPath, relPath)); err != nil {
+			t.Errorf("Expected %s to be downloaded", relPath)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(localDirPath, "sub/b.txt")); err == nil {
+		t.Errorf("Expected only the given files to be downloaded")
+	}
+}
@@ -0,0 +1,175 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Parse the clients of the geto server and what they may do.
+
+The clients section maps each client's name to its authentication token:
+
+	[clients]
+	alice=3f0c9b1e6f2d4a7c8e5b
+	; no token, alice-ci authenticates with a TLS client certificate
+	; whose common name is alice-ci
+	alice-ci=
+
+A client may have a client:<name> section that limits the hosts it may use,
+by the groups option of the host sections, and the scripts it may run, by
+name pattern (see path.Match).  The scripts are those in the directory that
+the scripts_path option of the geto section names:
+
+	[client:alice]
+	host_groups=build, test
+	scripts=build-*, lint
+
+Without these options, a client may use any host and run any script.
+*/
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/robfig/config"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A client of the geto server
+type Client struct {
+	Name string
+	// The client's authentication token, "" if the client can only
+	// authenticate with a TLS client certificate
+	Token string
+	// The groups of the hosts that the client may use, nil for any host
+	HostGroups []string
+	// Patterns of the names of the scripts in scripts_path that the client
+	// may run, nil for any script.  A client with patterns can't submit
+	// the content of a script, only the names of the server's scripts.
+	Scripts []string
+}
+
+// Tokens are compared against what clients send, so short ones are easy to
+// guess
+const MIN_TOKEN_LENGTH = 16
+
+// The host group that every host is in
+const ALL_HOSTS_GROUP = "*"
+
+// Group and client names are limited to the characters of host names
+var validName *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// Parse an optional comma-separated list option of a section, checking each
+// item with validate
+func parseListOption(c *config.Config, section string, option string,
+	validate func(string) bool) (items []string, err error) {
+	value, err := c.String(section, option)
+	if err != nil {
+		return nil, nil
+	}
+	items = []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !validate(item) {
+			return nil, errors.New(fmt.Sprintf("Invalid %s: %q", option, item))
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Parse the optional groups option of a host section
+func parseHostGroups(c *config.Config, hostname string) ([]string, error) {
+	return parseListOption(c, hostname, "groups", validName.MatchString)
+}
+
+func isValidHostGroup(group string) bool {
+	return group == ALL_HOSTS_GROUP || validName.MatchString(group)
+}
+
+func isValidScriptPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// Parse the optional clients section.  A client without a token needs a TLS
+// client CA to authenticate with.
+func parseClients(c *config.Config, tlsClientCAPath string, scriptsPath string) (clients []Client, err error) {
+	if !c.HasSection("clients") {
+		return nil, nil
+	}
+	names, err := c.Options("clients")
+	if err != nil {
+		return nil, err
+	}
+	tokens := map[string]bool{}
+	for _, name := range names {
+		client := Client{Name: name}
+		if !validName.MatchString(name) {
+			return nil, errors.New(fmt.Sprintf("Invalid client name: %q", name))
+		}
+		if client.Token, err = c.String("clients", name); err != nil {
+			return nil, err
+		}
+		switch {
+		case client.Token == "" && tlsClientCAPath == "":
+			return nil, errors.New(fmt.Sprintf(
+				"Client %s has no token and tls_client_ca_path isn't set", name))
+		case client.Token != "" && len(client.Token) < MIN_TOKEN_LENGTH:
+			return nil, errors.New(fmt.Sprintf(
+				"Token of client %s is shorter than %d characters", name, MIN_TOKEN_LENGTH))
+		case client.Token != "" && tokens[client.Token]:
+			return nil, errors.New(fmt.Sprintf("Token of client %s isn't unique", name))
+		}
+		tokens[client.Token] = true
+
+		section := "client:" + name
+		if client.HostGroups, err = parseListOption(c, section, "host_groups", isValidHostGroup); err != nil {
+			return nil, err
+		}
+		if client.Scripts, err = parseListOption(c, section, "scripts", isValidScriptPattern); err != nil {
+			return nil, err
+		}
+		if client.Scripts != nil && scriptsPath == "" {
+			return nil, errors.New(fmt.Sprintf(
+				"Client %s may only run some scripts but scripts_path isn't set", name))
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// Report whether the client may use the host
+func (c Client) MayUseHost(h host.Host) bool {
+	if c.HostGroups == nil {
+		return true
+	}
+	for _, group := range c.HostGroups {
+		if group == ALL_HOSTS_GROUP {
+			return true
+		}
+		for _, hostGroup := range h.Groups {
+			if group == hostGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Report whether the client may run scripts with the name
+func (c Client) MayRunScript(name string) bool {
+	if c.Scripts == nil {
+		return true
+	}
+	for _, pattern := range c.Scripts {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
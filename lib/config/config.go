@@ -9,12 +9,16 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"github.com/bgmerrell/geto/lib/host"
 	"github.com/bgmerrell/geto/lib/ssh"
 	"github.com/robfig/config"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 var conf Config
@@ -30,7 +34,50 @@ type Config struct {
 	RemoteWorkPath string
 	LocalWorkPath  string
 	RemoteLockPath string
-	Hosts          []host.Host
+	// The directory of the dependency cache on the target hosts, "" if
+	// dependencies aren't cached
+	RemoteCachePath string
+	// The size, in bytes, that the dependency cache is kept under
+	RemoteCacheMaxSize uint64
+	// Whether to delete a task's remote directory once the results of the
+	// task have been collected, if the task succeeded
+	DeleteOnSuccess bool
+	// The number of days that the directories of other finished tasks are
+	// kept for
+	KeepFailedDays uint64
+	// The size, in bytes, that each work directory is kept under by
+	// garbage collection, 0 for no limit
+	MaxWorkSize uint64
+	// The address that the geto server listens on for JSON RPC
+	// connections, a TCP address or "unix:" and the path of a Unix socket
+	RPCListenAddr string
+	// The address that the geto server listens on for HTTP requests, ""
+	// if the HTTP API is disabled
+	HTTPListenAddr string
+	// The number of seconds that the geto server waits for running tasks
+	// when it's shut down
+	ShutdownTimeout uint64
+	// The directory that the geto server records its tasks in, "" if
+	// they aren't recorded
+	TaskStorePath string
+	// The most finished tasks that the geto server keeps in memory, and
+	// the number of hours that it keeps each for, 0 for no limit; older
+	// tasks are only served from the task store, if any
+	MaxFinishedTasks  uint64
+	FinishedTaskHours uint64
+	// The certificate and key that the geto server's listeners use for
+	// TLS, "" if they don't use TLS
+	TLSCertPath string
+	TLSKeyPath  string
+	// The CA that the certificates of clients must be signed by, "" if
+	// clients don't need certificates
+	TLSClientCAPath string
+	// The directory of the scripts that clients can run by name, "" if
+	// there are none (see Client.Scripts)
+	ScriptsPath string
+	// The clients that may use the geto server, nil if any client may
+	Clients []Client
+	Hosts   []host.Host
 }
 
 // Parse the config file
@@ -73,6 +120,71 @@ func ParseConfig(configPath string) (Config, error) {
 		return conf, err
 	}
 
+	if conf.RemoteCachePath, err = c.String("geto", "remote_cache_path"); err != nil {
+		conf.RemoteCachePath = ""
+	}
+
+	for _, option := range []struct {
+		name         string
+		value        *uint64
+		defaultValue uint64
+	}{
+		{"remote_cache_max_size", &conf.RemoteCacheMaxSize, DEFAULT_REMOTE_CACHE_MAX_SIZE},
+		{"keep_failed_days", &conf.KeepFailedDays, DEFAULT_KEEP_FAILED_DAYS},
+		{"max_work_size", &conf.MaxWorkSize, 0},
+		{"shutdown_timeout", &conf.ShutdownTimeout, DEFAULT_SHUTDOWN_TIMEOUT},
+		{"max_finished_tasks", &conf.MaxFinishedTasks, DEFAULT_MAX_FINISHED_TASKS},
+		{"finished_task_hours", &conf.FinishedTaskHours, DEFAULT_FINISHED_TASK_HOURS},
+	} {
+		if *option.value, err = parseUintOption(c, option.name, option.defaultValue); err != nil {
+			log.Print("Failed to parse \"geto\" section: ", err.Error())
+			return conf, err
+		}
+	}
+
+	if conf.DeleteOnSuccess, err = c.Bool("geto", "delete_on_success"); err != nil {
+		if value, missing := c.String("geto", "delete_on_success"); missing == nil {
+			err = errors.New("Invalid delete_on_success: " + value)
+			log.Print("Failed to parse \"geto\" section: ", err.Error())
+			return conf, err
+		}
+		conf.DeleteOnSuccess = true
+	}
+
+	if conf.RPCListenAddr, err = c.String("geto", "rpc_listen_addr"); err != nil {
+		conf.RPCListenAddr = DEFAULT_RPC_LISTEN_ADDR
+	}
+	// The HTTP API is only served if the config says where
+	conf.HTTPListenAddr, _ = c.String("geto", "http_listen_addr")
+	// An empty task_store_path disables the task store
+	if conf.TaskStorePath, err = c.String("geto", "task_store_path"); err != nil {
+		conf.TaskStorePath = DEFAULT_TASK_STORE_PATH
+	}
+
+	if err = parseTLSOptions(c); err != nil {
+		log.Print("Failed to parse \"geto\" section: ", err.Error())
+		return conf, err
+	}
+	conf.ScriptsPath, _ = c.String("geto", "scripts_path")
+	if conf.Clients, err = parseClients(c, conf.TLSClientCAPath, conf.ScriptsPath); err != nil {
+		log.Print("Failed to parse clients: ", err.Error())
+		return conf, err
+	}
+
+	remotePaths := map[string]string{
+		"remote_work_path": conf.RemoteWorkPath,
+		"remote_lock_path": conf.RemoteLockPath,
+	}
+	if conf.RemoteCachePath != "" {
+		remotePaths["remote_cache_path"] = conf.RemoteCachePath
+	}
+	for option, path := range remotePaths {
+		if err = validateRemotePath(option, path); err != nil {
+			log.Print("Failed to parse \"geto\" section: ", err.Error())
+			return conf, err
+		}
+	}
+
 	var opts []string
 	if opts, err = c.Options("hosts"); err != nil {
 		log.Print("Could not find \"hosts\" section: ", err.Error())
@@ -120,9 +232,33 @@ func ParseConfig(configPath string) (Config, error) {
 		} else {
 			portNum = ssh.DEFAULT_SSH_PORT
 		}
+		var sudoCommand []string
+		if sudoCommand, err = parseSudoCommand(c, hostname); err != nil {
+			log.Print("Failed to parse \"", hostname, "\" section: ", err.Error())
+			return conf, err
+		}
+		var runAsUsers []string
+		if runAsUsers, err = parseRunAsUsers(c, hostname); err != nil {
+			log.Print("Failed to parse \"", hostname, "\" section: ", err.Error())
+			return conf, err
+		}
+		var groups []string
+		if groups, err = parseHostGroups(c, hostname); err != nil {
+			log.Print("Failed to parse \"", hostname, "\" section: ", err.Error())
+			return conf, err
+		}
 		conf.Hosts = append(
 			conf.Hosts,
-			host.Host{hostname, addr, username, password, uint16(portNum)})
+			host.Host{
+				Name:        hostname,
+				Addr:        addr,
+				Username:    username,
+				Password:    password,
+				PortNum:     uint16(portNum),
+				SudoCommand: sudoCommand,
+				RunAsUsers:  runAsUsers,
+				Groups:      groups,
+			})
 	}
 
 	conf.FilePath = configPath
@@ -130,6 +266,115 @@ func ParseConfig(configPath string) (Config, error) {
 	return conf, nil
 }
 
+// Remote paths end up in commands run by the shell on the target hosts (and
+// in scp destinations), so they must be absolute and only contain characters
+// that the shell doesn't treat specially.
+var validRemotePath *regexp.Regexp = regexp.MustCompile(`^/[A-Za-z0-9_./+-]*$`)
+
+// Return an error if path isn't a valid remote path for the option
+func validateRemotePath(option string, path string) error {
+	if !validRemotePath.MatchString(path) || filepath.Clean(path) != path {
+		return errors.New(fmt.Sprintf("Invalid %s: %q", option, path))
+	}
+	return nil
+}
+
+// The size that the dependency cache on each target host is kept under when
+// the config doesn't set remote_cache_max_size (10 GiB)
+const DEFAULT_REMOTE_CACHE_MAX_SIZE = 10 << 30
+
+// The number of days that finished tasks that didn't succeed are kept for
+// when the config doesn't set keep_failed_days
+const DEFAULT_KEEP_FAILED_DAYS = 7
+
+// The address that the geto server listens on when the config doesn't set
+// rpc_listen_addr
+const DEFAULT_RPC_LISTEN_ADDR = ":11102"
+
+// The number of seconds that the geto server waits for running tasks when
+// it's shut down and the config doesn't set shutdown_timeout
+const DEFAULT_SHUTDOWN_TIMEOUT = 60
+
+// The directory that the geto server records its tasks in when the config
+// doesn't set task_store_path
+const DEFAULT_TASK_STORE_PATH = "/var/lib/geto/tasks"
+
+// The most finished tasks that the geto server keeps in memory, and the
+// number of hours that it keeps each for, when the config doesn't set
+// max_finished_tasks and finished_task_hours
+const DEFAULT_MAX_FINISHED_TASKS = 1000
+const DEFAULT_FINISHED_TASK_HOURS = 24
+
+// Parse the optional TLS options of the geto section into conf
+func parseTLSOptions(c *config.Config) error {
+	conf.TLSCertPath, _ = c.String("geto", "tls_cert_path")
+	conf.TLSKeyPath, _ = c.String("geto", "tls_key_path")
+	conf.TLSClientCAPath, _ = c.String("geto", "tls_client_ca_path")
+	if (conf.TLSCertPath == "") != (conf.TLSKeyPath == "") {
+		return errors.New("tls_cert_path and tls_key_path must be set together")
+	}
+	if conf.TLSClientCAPath != "" && conf.TLSCertPath == "" {
+		return errors.New("tls_client_ca_path requires tls_cert_path")
+	}
+	return nil
+}
+
+// Parse an optional unsigned integer option of the geto section
+func parseUintOption(c *config.Config, option string, defaultValue uint64) (uint64, error) {
+	s, err := c.String("geto", option)
+	if err != nil {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid %s: %s", option, s))
+	}
+	return value, nil
+}
+
+// The command used to run tasks as another user when a host section has no
+// sudo_command option.  -n makes sudo fail instead of prompting for a
+// password.
+const DEFAULT_SUDO_COMMAND = "sudo -n"
+
+// Parse the optional sudo_command option of a host section
+func parseSudoCommand(c *config.Config, hostname string) ([]string, error) {
+	sudoCommand, err := c.String(hostname, "sudo_command")
+	if err != nil {
+		sudoCommand = DEFAULT_SUDO_COMMAND
+	}
+	words := strings.Fields(sudoCommand)
+	if len(words) == 0 {
+		return nil, errors.New("Invalid sudo_command: empty command")
+	}
+	return words, nil
+}
+
+// User names end up in commands run by the shell on the target hosts, so
+// they are limited to the characters that are safe there.
+var validUserName *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// Parse the optional run_as_users option of a host section, a comma-separated
+// list of the users that tasks may run as on the host
+func parseRunAsUsers(c *config.Config, hostname string) (users []string, err error) {
+	option, err := c.String(hostname, "run_as_users")
+	if err != nil {
+		return nil, nil
+	}
+	for _, user := range strings.Split(option, ",") {
+		user = strings.TrimSpace(user)
+		if user == "" {
+			continue
+		}
+		if !validUserName.MatchString(user) {
+			return nil, errors.New(fmt.Sprintf(
+				"Invalid run_as_users user: %q", user))
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
 // Return the parsed Config object.
 // Panic if the config has not been parsed
 // ParseConfig should be called before this function
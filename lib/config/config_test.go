@@ -6,6 +6,7 @@ package config
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -84,6 +85,91 @@ func TestParseConfigWithNoRemoteLockPath(t *testing.T) {
 	}
 }
 
+func TestParseConfigWithHostileRemotePath(t *testing.T) {
+	if _, err = ParseConfig("../../test/data/config-hostile-remote-path.ini"); err == nil {
+		t.Errorf("Parsing a config with shell metacharacters in a remote path should fail")
+		return
+	}
+	if err.Error() != "Invalid remote_work_path: \"/tmp/geto; rm -rf $HOME\"" {
+		t.Errorf("Expected to fail for invalid remote work path, got: %s", err.Error())
+	}
+}
+
+func TestValidateRemotePath(t *testing.T) {
+	for _, path := range []string{"/tmp/geto", "/var/tmp/geto_lock", "/srv/geto-1.0/work"} {
+		if err := validateRemotePath("remote_work_path", path); err != nil {
+			t.Errorf("Expected %q to be valid: %s", path, err.Error())
+		}
+	}
+	for _, path := range []string{
+		"", "tmp/geto", "/tmp/with space", "/tmp/$(reboot)", "/tmp/`id`",
+		"/tmp/a'b", "/tmp/a\"b", "/tmp/a\nb", "/tmp/../etc", "/tmp/geto/"} {
+		if err := validateRemotePath("remote_work_path", path); err == nil {
+			t.Errorf("Expected %q to be invalid", path)
+		}
+	}
+}
+
+func TestParseConfigWithBadRunAsUser(t *testing.T) {
+	if _, err = ParseConfig("../../test/data/config-bad-run-as-user.ini"); err == nil {
+		t.Errorf("Parsing a config with an invalid run_as_users user should fail")
+		return
+	}
+	if err.Error() != "Invalid run_as_users user: \"$(reboot)\"" {
+		t.Errorf("Expected to fail for invalid run_as_users user, got: %s", err.Error())
+	}
+}
+
+func TestParseConfigWithBadCacheSize(t *testing.T) {
+	if _, err = ParseConfig("../../test/data/config-bad-cache-size.ini"); err == nil {
+		t.Errorf("Parsing a config with an invalid cache size should fail")
+		return
+	}
+	if err.Error() != "Invalid remote_cache_max_size: 10GB" {
+		t.Errorf("Expected to fail for invalid cache size, got: %s", err.Error())
+	}
+}
+
+func TestParseConfigWithBadDeleteOnSuccess(t *testing.T) {
+	if _, err = ParseConfig("../../test/data/config-bad-delete-on-success.ini"); err == nil {
+		t.Errorf("Parsing a config with an invalid delete_on_success should fail")
+		return
+	}
+	if err.Error() != "Invalid delete_on_success: sometimes" {
+		t.Errorf("Expected to fail for invalid delete_on_success, got: %s", err.Error())
+	}
+}
+
+func TestParseConfigWithClientScriptsWithoutScriptsPath(t *testing.T) {
+	if _, err = ParseConfig("../../test/data/config-bad-client-scripts.ini"); err == nil {
+		t.Errorf("Parsing a config with client scripts but no scripts_path should fail")
+		return
+	}
+	if err.Error() != "Client alice may only run some scripts but scripts_path isn't set" {
+		t.Errorf("Expected to fail for the missing scripts_path, got: %s", err.Error())
+	}
+}
+
+func TestParseConfigWithBadClientToken(t *testing.T) {
+	if _, err = ParseConfig("../../test/data/config-bad-client-token.ini"); err == nil {
+		t.Errorf("Parsing a config with a short client token should fail")
+		return
+	}
+	if err.Error() != "Token of client alice is shorter than 16 characters" {
+		t.Errorf("Expected to fail for a short token, got: %s", err.Error())
+	}
+}
+
+func TestParseConfigWithBadTLS(t *testing.T) {
+	if _, err = ParseConfig("../../test/data/config-bad-tls.ini"); err == nil {
+		t.Errorf("Parsing a config with a TLS certificate but no key should fail")
+		return
+	}
+	if err.Error() != "tls_cert_path and tls_key_path must be set together" {
+		t.Errorf("Expected to fail for the missing TLS key, got: %s", err.Error())
+	}
+}
+
 // Parse all the invalid config files before this point.  After we parse the
 // good config file, the rest of the tests assume having a good, populated
 // Config object.
@@ -183,3 +269,161 @@ func TestParseRemoteLockPath(t *testing.T) {
 			actual, expected)
 	}
 }
+
+func TestParseConfigRunAs(t *testing.T) {
+	expected := map[string]struct {
+		sudoCommand []string
+		runAsUsers  []string
+	}{
+		"server1": {[]string{"sudo", "-n", "-H"}, []string{"alice", "bob"}},
+		"server2": {[]string{"sudo", "-n"}, nil},
+		"server3": {[]string{"sudo", "-n"}, nil},
+	}
+
+	for _, host := range conf.Hosts {
+		e, ok := expected[host.Name]
+		if !ok {
+			t.Errorf("Unexpected host name: %s", host.Name)
+			continue
+		}
+		if fmt.Sprintf("%q", host.SudoCommand) != fmt.Sprintf("%q", e.sudoCommand) {
+			t.Errorf("Expected sudo command %q for host name \"%s\", got %q",
+				e.sudoCommand, host.Name, host.SudoCommand)
+		}
+		if fmt.Sprintf("%q", host.RunAsUsers) != fmt.Sprintf("%q", e.runAsUsers) {
+			t.Errorf("Expected run as users %q for host name \"%s\", got %q",
+				e.runAsUsers, host.Name, host.RunAsUsers)
+		}
+	}
+}
+
+func TestParseRemoteCache(t *testing.T) {
+	if conf.RemoteCachePath != "" || conf.RemoteCacheMaxSize != DEFAULT_REMOTE_CACHE_MAX_SIZE {
+		t.Errorf("Expected no cache path and the default cache size, got %q and %d",
+			conf.RemoteCachePath, conf.RemoteCacheMaxSize)
+	}
+
+	cacheConf, err := ParseConfig("../../test/data/geto-cache.ini")
+	if err != nil {
+		t.Fatalf("Parse of cache config should pass: %s", err.Error())
+	}
+	if cacheConf.RemoteCachePath != "/tmp/geto_cache" || cacheConf.RemoteCacheMaxSize != 65536 {
+		t.Errorf("Expected cache path /tmp/geto_cache and size 65536, got %q and %d",
+			cacheConf.RemoteCachePath, cacheConf.RemoteCacheMaxSize)
+	}
+
+	// Restore the good config for any tests that follow
+	if conf, err = ParseConfig("../../test/data/geto.ini"); err != nil {
+		t.Fatalf("Parse of good config should pass.")
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	if !conf.DeleteOnSuccess || conf.KeepFailedDays != DEFAULT_KEEP_FAILED_DAYS || conf.MaxWorkSize != 0 {
+		t.Errorf("Expected the default retention policy, got %t, %d and %d",
+			conf.DeleteOnSuccess, conf.KeepFailedDays, conf.MaxWorkSize)
+	}
+
+	gcConf, err := ParseConfig("../../test/data/geto-gc.ini")
+	if err != nil {
+		t.Fatalf("Parse of gc config should pass: %s", err.Error())
+	}
+	if gcConf.DeleteOnSuccess || gcConf.KeepFailedDays != 30 || gcConf.MaxWorkSize != 1 {
+		t.Errorf("Expected false, 30 and 1, got %t, %d and %d",
+			gcConf.DeleteOnSuccess, gcConf.KeepFailedDays, gcConf.MaxWorkSize)
+	}
+
+	// Restore the good config for any tests that follow
+	if conf, err = ParseConfig("../../test/data/geto.ini"); err != nil {
+		t.Fatalf("Parse of good config should pass.")
+	}
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	if conf.RPCListenAddr != DEFAULT_RPC_LISTEN_ADDR || conf.HTTPListenAddr != "" {
+		t.Errorf("Expected the default listen addresses, got %q and %q",
+			conf.RPCListenAddr, conf.HTTPListenAddr)
+	}
+	if conf.ShutdownTimeout != DEFAULT_SHUTDOWN_TIMEOUT {
+		t.Errorf("Expected the default shutdown timeout, got %d", conf.ShutdownTimeout)
+	}
+	if conf.TaskStorePath != DEFAULT_TASK_STORE_PATH {
+		t.Errorf("Expected the default task store path, got %q", conf.TaskStorePath)
+	}
+	if conf.MaxFinishedTasks != DEFAULT_MAX_FINISHED_TASKS || conf.FinishedTaskHours != DEFAULT_FINISHED_TASK_HOURS {
+		t.Errorf("Expected the default finished task retention, got %d and %d",
+			conf.MaxFinishedTasks, conf.FinishedTaskHours)
+	}
+
+	listenConf, err := ParseConfig("../../test/data/geto-listen.ini")
+	if err != nil {
+		t.Fatalf("Parse of listen config should pass: %s", err.Error())
+	}
+	if listenConf.RPCListenAddr != "unix:/var/run/geto.sock" || listenConf.HTTPListenAddr != "" {
+		t.Errorf("Expected unix:/var/run/geto.sock and \"\", got %q and %q",
+			listenConf.RPCListenAddr, listenConf.HTTPListenAddr)
+	}
+	if listenConf.ShutdownTimeout != 5 {
+		t.Errorf("Expected a shutdown timeout of 5, got %d", listenConf.ShutdownTimeout)
+	}
+	if listenConf.TaskStorePath != "" {
+		t.Errorf("Expected tasks to not be recorded, got %q", listenConf.TaskStorePath)
+	}
+	if listenConf.MaxFinishedTasks != 100 || listenConf.FinishedTaskHours != 0 {
+		t.Errorf("Expected 100 finished tasks without an age limit, got %d and %d",
+			listenConf.MaxFinishedTasks, listenConf.FinishedTaskHours)
+	}
+
+	// Restore the good config for any tests that follow
+	if conf, err = ParseConfig("../../test/data/geto.ini"); err != nil {
+		t.Fatalf("Parse of good config should pass.")
+	}
+}
+
+func TestParseClients(t *testing.T) {
+	if conf.Clients != nil || conf.TLSCertPath != "" {
+		t.Errorf("Expected no clients or TLS, got %#v and %q", conf.Clients, conf.TLSCertPath)
+	}
+
+	clientsConf, err := ParseConfig("../../test/data/geto-clients.ini")
+	if err != nil {
+		t.Fatalf("Parse of clients config should pass: %s", err.Error())
+	}
+	if clientsConf.TLSCertPath != "/etc/geto/server.crt" || clientsConf.TLSKeyPath != "/etc/geto/server.key" ||
+		clientsConf.TLSClientCAPath != "/etc/geto/clients-ca.crt" {
+		t.Errorf("Unexpected TLS paths: %q, %q and %q", clientsConf.TLSCertPath,
+			clientsConf.TLSKeyPath, clientsConf.TLSClientCAPath)
+	}
+	if clientsConf.ScriptsPath != "/etc/geto/scripts" {
+		t.Errorf("Unexpected scripts path: %q", clientsConf.ScriptsPath)
+	}
+	if len(clientsConf.Clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %#v", clientsConf.Clients)
+	}
+	alice, bob := clientsConf.Clients[0], clientsConf.Clients[1]
+	if alice.Name != "alice" || alice.Token != "0123456789abcdef0123" ||
+		!reflect.DeepEqual(alice.HostGroups, []string{"build"}) ||
+		!reflect.DeepEqual(alice.Scripts, []string{"build-*", "lint"}) {
+		t.Errorf("Unexpected client: %#v", alice)
+	}
+	if bob.Name != "bob" || bob.Token != "" || bob.HostGroups != nil || bob.Scripts != nil {
+		t.Errorf("Unexpected client: %#v", bob)
+	}
+
+	server1, server2 := clientsConf.Hosts[0], clientsConf.Hosts[1]
+	if !reflect.DeepEqual(server1.Groups, []string{"build", "test"}) {
+		t.Errorf("Unexpected host groups: %#v", server1.Groups)
+	}
+	if !alice.MayUseHost(server1) || alice.MayUseHost(server2) || !bob.MayUseHost(server2) {
+		t.Errorf("Unexpected host permissions")
+	}
+	if !alice.MayRunScript("build-all") || !alice.MayRunScript("lint") ||
+		alice.MayRunScript("deploy") || !bob.MayRunScript("deploy") {
+		t.Errorf("Unexpected script permissions")
+	}
+
+	// Restore the good config for any tests that follow
+	if conf, err = ParseConfig("../../test/data/geto.ini"); err != nil {
+		t.Fatalf("Parse of good config should pass.")
+	}
+}
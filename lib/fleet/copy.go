@@ -0,0 +1,243 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Copy a file to or from many hosts
+
+	results := fleet.Push(conn, hosts, "geto.conf", "/etc/geto.conf", fleet.Options{})
+	results = fleet.Pull(conn, hosts, "/var/log/syslog", "logs", fleet.Options{})
+
+Push skips the hosts that already have an identical file, and Pull the hosts
+whose file was already pulled.  Every copy is verified by comparing the
+SHA-256 of the file on the host with that of the local file; the hosts need
+sha256sum, shasum or openssl to compute it.  The remote path is passed to scp
+unquoted by the ssh Remote (see ssh.ScpTo), so it may only contain the
+characters that are safe in remote commands; the copy fails on every host
+otherwise.
+*/
+package fleet
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/shell"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The result of copying a file to or from a host
+type CopyResult struct {
+	Host string
+	// The path of the copied file: on the host for Push, locally for Pull
+	Path string
+	// Whether the file wasn't copied because it was identical already
+	Skipped bool
+	// The hex-encoded SHA-256 of the file
+	SHA256 string
+	// Why the copy failed, nil if it didn't
+	Err      error
+	Duration time.Duration
+}
+
+// The characters that a remote path may contain, the ones that are safe in
+// remote commands (as for task outputs)
+var validRemotePath *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_.,+=@%/-]+$`)
+
+// Return an error if a remote path can't be passed to scp as it is
+func validateRemotePath(remotePath string) error {
+	if !validRemotePath.MatchString(remotePath) {
+		return errors.New(fmt.Sprintf("Invalid remote path %q: it may only contain letters, digits and _.,+=@%%/-",
+			remotePath))
+	}
+	return nil
+}
+
+// Return the hex-encoded SHA-256 of a local file, "" if there's no such file
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return "", errors.New(fmt.Sprintf("%s: not a regular file", filePath))
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Return the command that prints the hex-encoded SHA-256 of a file on a host,
+// "none" if there's no such file and "other" if it isn't a regular file
+func getChecksumCommand(remotePath string) string {
+	return fmt.Sprintf(
+		"f=%s; if [ ! -e \"$f\" ]; then echo none; elif [ ! -f \"$f\" ]; then echo other; "+
+			"else (sha256sum \"$f\" || shasum -a 256 \"$f\" || openssl dgst -sha256 -r \"$f\") "+
+			"2>/dev/null | cut -d ' ' -f 1; fi",
+		shell.Quote(remotePath))
+}
+
+// Return the hex-encoded SHA-256 of a file on a host, "" if there's no such
+// file
+func hashRemoteFile(conn remote.Remote, h host.Host, remotePath string) (string, error) {
+	stdout, stderr, err := conn.Run(h, getChecksumCommand(remotePath), 0)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Failed to checksum %s on host %s: %s (%s)",
+			remotePath, h.Name, err.Error(), strings.TrimSpace(stderr)))
+	}
+	sum := strings.TrimSpace(stdout)
+	switch {
+	case sum == "none":
+		return "", nil
+	case sum == "other":
+		return "", errors.New(fmt.Sprintf("%s on host %s: not a regular file", remotePath, h.Name))
+	case len(sum) != sha256.Size*2:
+		return "", errors.New(fmt.Sprintf(
+			"Failed to checksum %s on host %s: it has no sha256sum, shasum or openssl", remotePath, h.Name))
+	}
+	return sum, nil
+}
+
+// Call f for each host as ForEachHost does, reporting a host as failed after
+// opts.Timeout seconds, and return the results in the order of hosts.  f
+// fills in the result's SHA256 and Skipped and returns why the copy failed.
+// A copy that times out still holds its host's slot until f returns, so that
+// no more than opts.Concurrency copies ever run at once and no file is
+// touched once the results are returned.
+func copyEach(hosts []host.Host, opts Options, getPath func(h host.Host) string,
+	f func(h host.Host, result *CopyResult) error) []CopyResult {
+	results := make([]CopyResult, len(hosts))
+	ForEachHost(hosts, opts.Concurrency, func(i int, h host.Host) {
+		start := time.Now()
+		done := make(chan CopyResult, 1)
+		go func() {
+			result := CopyResult{Host: h.Name, Path: getPath(h)}
+			result.Err = f(h, &result)
+			done <- result
+		}()
+		var timeout <-chan time.Time
+		if opts.Timeout > 0 {
+			timeout = time.After(time.Duration(opts.Timeout) * time.Second)
+		}
+		select {
+		case results[i] = <-done:
+			results[i].Duration = time.Since(start)
+		case <-timeout:
+			results[i] = CopyResult{Host: h.Name, Path: getPath(h), Duration: time.Since(start),
+				Err: errors.New(fmt.Sprintf("Timed out after %d seconds", opts.Timeout))}
+			<-done
+		}
+	})
+	return results
+}
+
+// Copy the local file at localPath to remotePath, the path of the file, on
+// each of the hosts, as described by opts, and return the results in the
+// order of hosts.  Hosts whose file is identical already are skipped.
+func Push(conn remote.Remote, hosts []host.Host, localPath string, remotePath string, opts Options) []CopyResult {
+	// Why the copy fails on every host, if it does
+	allErr := validateRemotePath(remotePath)
+	var sum string
+	if allErr == nil {
+		sum, allErr = hashFile(localPath)
+	}
+	if allErr == nil && sum == "" {
+		allErr = errors.New(fmt.Sprintf("%s: no such file", localPath))
+	}
+	return copyEach(hosts, opts, func(host.Host) string { return remotePath },
+		func(h host.Host, result *CopyResult) error {
+			if allErr != nil {
+				return allErr
+			}
+			result.SHA256 = sum
+			remoteSum, err := hashRemoteFile(conn, h, remotePath)
+			if err != nil {
+				return err
+			}
+			if remoteSum == sum {
+				result.Skipped = true
+				return nil
+			}
+			if err = conn.CopyTo(h, false, localPath, remotePath); err != nil {
+				return errors.New(fmt.Sprintf("Failed to copy %s to host %s: %s", localPath, h.Name, err.Error()))
+			}
+			if remoteSum, err = hashRemoteFile(conn, h, remotePath); err != nil {
+				return err
+			}
+			if remoteSum != sum {
+				return errors.New(fmt.Sprintf("Checksum mismatch after copying to host %s: expected %s, got %q",
+					h.Name, sum, remoteSum))
+			}
+			return nil
+		})
+}
+
+// Copy the file at remotePath on each of the hosts, as described by opts, to
+// <localDirPath>/<host name>/<file name> and return the results in the order
+// of hosts.  Hosts whose file was pulled already are skipped.
+func Pull(conn remote.Remote, hosts []host.Host, remotePath string, localDirPath string, opts Options) []CopyResult {
+	getLocalPath := func(h host.Host) string {
+		return filepath.Join(localDirPath, h.Name, path.Base(remotePath))
+	}
+	allErr := validateRemotePath(remotePath)
+	return copyEach(hosts, opts, getLocalPath, func(h host.Host, result *CopyResult) error {
+		if allErr != nil {
+			return allErr
+		}
+		remoteSum, err := hashRemoteFile(conn, h, remotePath)
+		if err != nil {
+			return err
+		}
+		if remoteSum == "" {
+			return errors.New(fmt.Sprintf("%s on host %s: no such file", remotePath, h.Name))
+		}
+		result.SHA256 = remoteSum
+		localPath := getLocalPath(h)
+		if sum, err := hashFile(localPath); err != nil {
+			return err
+		} else if sum == remoteSum {
+			result.Skipped = true
+			return nil
+		}
+		if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		if err = conn.CopyFrom(h, false, remotePath, localPath); err != nil {
+			return errors.New(fmt.Sprintf("Failed to copy %s from host %s: %s", remotePath, h.Name, err.Error()))
+		}
+		if sum, err := hashFile(localPath); err != nil {
+			return err
+		} else if sum != remoteSum {
+			// A partial or corrupt copy isn't left behind
+			os.Remove(localPath)
+			return errors.New(fmt.Sprintf("Checksum mismatch after copying from host %s: expected %s, got %q",
+				h.Name, remoteSum, sum))
+		}
+		return nil
+	})
+}
+
+// Return the results of the hosts that the copy failed on
+func FailedCopies(results []CopyResult) []CopyResult {
+	failed := []CopyResult{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
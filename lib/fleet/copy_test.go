@@ -0,0 +1,184 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package fleet
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Respond to the checksum command of remotePath on the named host ("" for any
+// host) with the checksum of content, or "none" if content is nil, for the
+// given number of calls (0 for all of them)
+func onChecksum(conn *fake.Remote, hostName string, remotePath string, content []byte, times int) {
+	stdout := "none\n"
+	if content != nil {
+		stdout = fmt.Sprintf("%x\n", sha256.Sum256(content))
+	}
+	pattern := "^" + regexp.QuoteMeta(getChecksumCommand(remotePath)) + "$"
+	response := fake.Response{Stdout: stdout, Times: times}
+	if hostName == "" {
+		conn.OnRun(pattern, response)
+	} else {
+		conn.OnRunOn(hostName, pattern, response)
+	}
+}
+
+func newTempDir(t *testing.T) (string, func()) {
+	dirPath, err := ioutil.TempDir("", "geto-fleet")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return dirPath, func() { os.RemoveAll(dirPath) }
+}
+
+func TestGetChecksumCommand(t *testing.T) {
+	dirPath, cleanUp := newTempDir(t)
+	defer cleanUp()
+	filePath := filepath.Join(dirPath, "a file")
+	if err := ioutil.WriteFile(filePath, []byte("content\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{filePath, fmt.Sprintf("%x\n", sha256.Sum256([]byte("content\n")))},
+		{filepath.Join(dirPath, "missing"), "none\n"},
+		{dirPath, "other\n"},
+	}
+	for i, test := range tests {
+		output, err := exec.Command("sh", "-c", getChecksumCommand(test.path)).Output()
+		if err != nil || string(output) != test.expected {
+			t.Errorf("Test %d: expected %q, got %q (%v)", i, test.expected, output, err)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	dirPath, cleanUp := newTempDir(t)
+	defer cleanUp()
+	localPath := filepath.Join(dirPath, "app.conf")
+	content := []byte("port=80\n")
+	if err := ioutil.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	const remotePath = "/etc/app.conf"
+	conn := fake.New()
+	hosts := []host.Host{{Name: "missing"}, {Name: "identical"}, {Name: "different"}, {Name: "corrupted"}}
+	conn.WriteFile(hosts[1], remotePath, content, 0644)
+	conn.WriteFile(hosts[2], remotePath, []byte("port=8080\n"), 0644)
+	// Each host's file before the copy, then after it
+	onChecksum(conn, "missing", remotePath, nil, 1)
+	onChecksum(conn, "different", remotePath, []byte("port=8080\n"), 1)
+	onChecksum(conn, "corrupted", remotePath, nil, 1)
+	onChecksum(conn, "corrupted", remotePath, []byte("corrupt"), 0)
+	onChecksum(conn, "", remotePath, content, 0)
+
+	results := Push(conn, hosts, localPath, remotePath, Options{Concurrency: 2})
+	for i, skipped := range []bool{false, true, false} {
+		if results[i].Err != nil || results[i].Skipped != skipped || results[i].Host != hosts[i].Name ||
+			results[i].Path != remotePath || results[i].SHA256 != fmt.Sprintf("%x", sha256.Sum256(content)) {
+			t.Errorf("Unexpected result: %#v", results[i])
+		}
+		if actual, err := conn.ReadFile(hosts[i], remotePath); err != nil || string(actual) != string(content) {
+			t.Errorf("Unexpected file on host %s: %q (%v)", hosts[i].Name, actual, err)
+		}
+	}
+	if failed := FailedCopies(results); len(failed) != 1 || failed[0].Host != "corrupted" {
+		t.Errorf("Expected the copy to the corrupted host to fail, got %#v", failed)
+	}
+	if calls := conn.CallsTo("CopyTo"); len(calls) != 3 {
+		t.Errorf("Expected 3 copies, got %d", len(calls))
+	}
+
+	results = Push(conn, hosts[:1], filepath.Join(dirPath, "missing"), remotePath, Options{})
+	if results[0].Err == nil {
+		t.Errorf("Expected a missing local file to fail")
+	}
+}
+
+func TestPull(t *testing.T) {
+	dirPath, cleanUp := newTempDir(t)
+	defer cleanUp()
+	const remotePath = "/var/log/app.log"
+	conn := fake.New()
+	hosts := []host.Host{{Name: "server1"}, {Name: "server2"}, {Name: "missing"}}
+	conn.WriteFile(hosts[0], remotePath, []byte("one\n"), 0644)
+	conn.WriteFile(hosts[1], remotePath, []byte("two\n"), 0644)
+	onChecksum(conn, "server1", remotePath, []byte("one\n"), 0)
+	onChecksum(conn, "server2", remotePath, []byte("two\n"), 0)
+	onChecksum(conn, "missing", remotePath, nil, 0)
+
+	for _, skipped := range []bool{false, true} {
+		results := Pull(conn, hosts, remotePath, dirPath, Options{})
+		for i, expected := range []string{"one\n", "two\n"} {
+			localPath := filepath.Join(dirPath, hosts[i].Name, "app.log")
+			if results[i].Err != nil || results[i].Skipped != skipped || results[i].Path != localPath {
+				t.Errorf("Unexpected result: %#v", results[i])
+			}
+			if actual, err := ioutil.ReadFile(localPath); err != nil || string(actual) != expected {
+				t.Errorf("Unexpected file from host %s: %q (%v)", hosts[i].Name, actual, err)
+			}
+		}
+		if failed := FailedCopies(results); len(failed) != 1 || failed[0].Host != "missing" {
+			t.Errorf("Expected the pull from the host without the file to fail, got %#v", failed)
+		}
+	}
+	if calls := conn.CallsTo("CopyFrom"); len(calls) != 2 {
+		t.Errorf("Expected 2 copies, got %d", len(calls))
+	}
+}
+
+func TestCopyTimeout(t *testing.T) {
+	dirPath, cleanUp := newTempDir(t)
+	defer cleanUp()
+	localPath := filepath.Join(dirPath, "app.conf")
+	if err := ioutil.WriteFile(localPath, []byte("port=80\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	const remotePath = "/etc/app.conf"
+	conn := fake.New()
+	conn.OnRun(`sha256sum`, fake.Response{Stdout: "none\n", Latency: 1100 * time.Millisecond})
+	results := Push(conn, []host.Host{{Name: "slow"}}, localPath, remotePath, Options{Timeout: 1})
+	if results[0].Err == nil || !strings.Contains(results[0].Err.Error(), "Timed out") {
+		t.Errorf("Expected the copy to time out, got %#v", results[0])
+	}
+	// The copy was still waited for
+	if calls := conn.CallsTo("CopyTo"); len(calls) != 1 {
+		t.Errorf("Expected the copy to be done before Push returned, got %d copies", len(calls))
+	}
+}
+
+func TestCopyInvalidRemotePath(t *testing.T) {
+	dirPath, cleanUp := newTempDir(t)
+	defer cleanUp()
+	localPath := filepath.Join(dirPath, "app.conf")
+	if err := ioutil.WriteFile(localPath, []byte("port=80\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	conn := fake.New()
+	hosts := []host.Host{{Name: "server1"}, {Name: "server2"}}
+	for _, remotePath := range []string{"/etc/app conf", "/etc/$(reboot)", "/etc/app.conf;true", ""} {
+		results := append(Push(conn, hosts, localPath, remotePath, Options{}),
+			Pull(conn, hosts, remotePath, dirPath, Options{})...)
+		if failed := FailedCopies(results); len(failed) != 4 {
+			t.Errorf("Expected copies of %q to fail on every host, got %#v", remotePath, results)
+		}
+	}
+	if calls := conn.Calls(); len(calls) != 0 {
+		t.Errorf("Expected nothing to be run on the hosts, got %#v", calls)
+	}
+}
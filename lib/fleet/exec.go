@@ -0,0 +1,95 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Run an ad-hoc command on many hosts
+
+	results := fleet.Exec(conn, hosts, "df -h", fleet.Options{Timeout: 30}, nil)
+	for _, failed := range fleet.Failed(results) {
+		fmt.Println(failed.Host, failed.Err)
+	}
+
+Unlike a task, the command runs in the foreground of its SSH session, in the
+login directory of the host's user, and leaves nothing behind on the host.
+With a timeout, the command runs in its own process group, which is killed
+when the timeout expires; the result then has the output written until then.
+*/
+package fleet
+
+import (
+	"errors"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"sync"
+	"time"
+)
+
+// The result of running a command on a host
+type ExecResult struct {
+	Host string
+	// The command's output, up to the timeout if it timed out
+	Stdout string
+	Stderr string
+	// The command's exit code, -1 if it didn't exit (e.g., the host
+	// couldn't be reached or the command timed out)
+	ExitCode int
+	// Why the command failed, nil if it exited with 0
+	Err      error
+	Duration time.Duration
+}
+
+// Return the exit code of a command that failed with err, -1 if it didn't
+// exit
+func getExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	// An SSH session's exit error
+	var exitStatus interface{ ExitStatus() int }
+	if errors.As(err, &exitStatus) {
+		return exitStatus.ExitStatus()
+	}
+	// A local command's exit error (e.g., exec.ExitError)
+	var exitCode interface{ ExitCode() int }
+	if errors.As(err, &exitCode) {
+		return exitCode.ExitCode()
+	}
+	return -1
+}
+
+// Run command on each of the hosts, as described by opts, and return the
+// results in the order of hosts.  onResult, if not nil, is called with each
+// host's result as soon as the host is done, one call at a time.
+func Exec(conn remote.Remote, hosts []host.Host, command string, opts Options, onResult func(ExecResult)) []ExecResult {
+	results := make([]ExecResult, len(hosts))
+	var lock sync.Mutex
+	ForEachHost(hosts, opts.Concurrency, func(i int, h host.Host) {
+		start := time.Now()
+		stdout, stderr, err := conn.Run(h, command, opts.Timeout)
+		results[i] = ExecResult{
+			Host:     h.Name,
+			Stdout:   stdout,
+			Stderr:   stderr,
+			ExitCode: getExitCode(err),
+			Err:      err,
+			Duration: time.Since(start)}
+		if onResult != nil {
+			lock.Lock()
+			defer lock.Unlock()
+			onResult(results[i])
+		}
+	})
+	return results
+}
+
+// Return the results of the hosts that the command failed on
+func Failed(results []ExecResult) []ExecResult {
+	failed := []ExecResult{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
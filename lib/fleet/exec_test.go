@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package fleet
+
+import (
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"github.com/bgmerrell/geto/lib/ssh/sshtest"
+	"testing"
+	"time"
+)
+
+// Start an in-process SSH server and return hosts that log in to it, named
+// after names, stopped by the returned function
+func startSSHServer(t *testing.T, names ...string) ([]host.Host, func()) {
+	if _, err := config.ParseConfig("../../test/data/geto-sshtest.ini"); err != nil {
+		t.Fatalf("Failed to parse test config: %s", err.Error())
+	}
+	s, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start SSH server: %s", err.Error())
+	}
+	hosts := []host.Host{}
+	for _, name := range names {
+		hosts = append(hosts, host.Host{Name: name, Addr: s.Addr,
+			Username: s.Username, Password: &s.Password, PortNum: s.Port})
+	}
+	return hosts, func() { s.Close() }
+}
+
+func TestExec(t *testing.T) {
+	hosts, stop := startSSHServer(t, "server1", "server2")
+	defer stop()
+	unreachable := hosts[0]
+	unreachable.Name = "unreachable"
+	// Nothing listens on port 1
+	unreachable.PortNum = 1
+	hosts = append(hosts, unreachable)
+
+	called := map[string]bool{}
+	results := Exec(ssh.New(), hosts, `echo "$0"; echo err >&2; exit 3`, Options{Concurrency: 2},
+		func(result ExecResult) { called[result.Host] = true })
+	if len(results) != 3 || len(called) != 3 {
+		t.Fatalf("Unexpected results: %#v (called for %v)", results, called)
+	}
+	for _, result := range results[:2] {
+		if result.Stdout == "" || result.Stderr != "err\n" || result.ExitCode != 3 || result.Err == nil {
+			t.Errorf("Unexpected result: %#v", result)
+		}
+	}
+	if results[2].Host != "unreachable" || results[2].ExitCode != -1 || results[2].Err == nil {
+		t.Errorf("Expected the unreachable host to fail, got %#v", results[2])
+	}
+	if failed := Failed(results); len(failed) != 3 {
+		t.Errorf("Expected every host to fail, got %#v", failed)
+	}
+
+	results = Exec(ssh.New(), hosts[:2], "true", Options{}, nil)
+	if failed := Failed(results); len(failed) != 0 || results[0].ExitCode != 0 {
+		t.Errorf("Expected the command to succeed, got %#v", results)
+	}
+
+	// A command that times out is killed, and its output so far kept
+	results = Exec(ssh.New(), hosts[:1], "echo started; sleep 30", Options{Timeout: 1}, nil)
+	if result := results[0]; result.Stdout != "started\n" || result.ExitCode != -1 ||
+		result.Err == nil || result.Err.Error() != "timeout" || result.Duration > 10*time.Second {
+		t.Errorf("Expected the command to time out, got %#v", result)
+	}
+}
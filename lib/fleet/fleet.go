@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Work on many hosts at once, outside of tasks.
+
+Exec runs an ad-hoc command on each of a set of hosts (e.g., the hosts of a
+group, see SelectHosts), a few hosts at a time, and returns each host's
+output and exit code.  Push and Pull copy a file to or from each of a set of
+hosts in the same way.
+*/
+package fleet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"sync"
+)
+
+// The default number of hosts that are worked on at once
+const DEFAULT_CONCURRENCY = 16
+
+// How the hosts are worked on
+type Options struct {
+	// The most hosts worked on at once, 0 for DEFAULT_CONCURRENCY
+	Concurrency int
+	// The number of seconds before giving up on a host, 0 for no limit
+	Timeout uint32
+}
+
+// Return the hosts that are named or in one of the groups, in the order of
+// hosts.  All of the hosts are returned if there are no names or groups.
+func SelectHosts(hosts []host.Host, names []string, groups []string) ([]host.Host, error) {
+	if len(names) == 0 && len(groups) == 0 {
+		return hosts, nil
+	}
+	selected := []host.Host{}
+	found := map[string]bool{}
+	for _, h := range hosts {
+		matched := false
+		for _, name := range names {
+			if h.Name == name {
+				matched = true
+				found[name] = true
+			}
+		}
+		for _, group := range groups {
+			for _, hostGroup := range h.Groups {
+				if hostGroup == group {
+					matched = true
+					found["group "+group] = true
+				}
+			}
+		}
+		if matched {
+			selected = append(selected, h)
+		}
+	}
+	for _, name := range names {
+		if !found[name] {
+			return nil, errors.New(fmt.Sprintf("Unknown host: %q", name))
+		}
+	}
+	for _, group := range groups {
+		if !found["group "+group] {
+			return nil, errors.New(fmt.Sprintf("No hosts in group %q", group))
+		}
+	}
+	return selected, nil
+}
+
+// Call f for each host, with the host's index, at most concurrency hosts at a
+// time (DEFAULT_CONCURRENCY if concurrency is 0), and wait for all of the
+// calls
+func ForEachHost(hosts []host.Host, concurrency int, f func(i int, h host.Host)) {
+	if concurrency <= 0 {
+		concurrency = DEFAULT_CONCURRENCY
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, h host.Host) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			f(i, h)
+		}(i, h)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package fleet
+
+import (
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testHosts = []host.Host{
+	{Name: "build1", Groups: []string{"build"}},
+	{Name: "build2", Groups: []string{"build", "test"}},
+	{Name: "test1", Groups: []string{"test"}},
+	{Name: "other"}}
+
+func getHostNames(hosts []host.Host) (names []string) {
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	return names
+}
+
+func TestSelectHosts(t *testing.T) {
+	tests := []struct {
+		names    []string
+		groups   []string
+		expected string
+	}{
+		{nil, nil, "[build1 build2 test1 other]"},
+		{[]string{"other"}, nil, "[other]"},
+		{nil, []string{"test"}, "[build2 test1]"},
+		{[]string{"build1", "other"}, []string{"build"}, "[build1 build2 other]"},
+	}
+	for i, test := range tests {
+		hosts, err := SelectHosts(testHosts, test.names, test.groups)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %s", i, err.Error())
+		} else if actual := fmt.Sprint(getHostNames(hosts)); actual != test.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, test.expected, actual)
+		}
+	}
+
+	if _, err := SelectHosts(testHosts, []string{"bogus"}, nil); err == nil || err.Error() != `Unknown host: "bogus"` {
+		t.Errorf("Expected an unknown host error, got %v", err)
+	}
+	if _, err := SelectHosts(testHosts, nil, []string{"deploy"}); err == nil || err.Error() != `No hosts in group "deploy"` {
+		t.Errorf("Expected an empty group error, got %v", err)
+	}
+}
+
+func TestForEachHostConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	done := make([]bool, len(testHosts))
+	ForEachHost(testHosts, 2, func(i int, h host.Host) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		done[i] = h.Name == testHosts[i].Name
+		lock.Unlock()
+	})
+	if maxRunning != 2 {
+		t.Errorf("Expected 2 hosts at a time, got %d", maxRunning)
+	}
+	for i := range done {
+		if !done[i] {
+			t.Errorf("Host %d wasn't worked on", i)
+		}
+	}
+}
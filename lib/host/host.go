@@ -21,4 +21,12 @@ type Host struct {
 	Password *string
 	// The port on which to connect to the host
 	PortNum uint16
+	// The command (as a list of words) used to run a task as another user,
+	// e.g., []string{"sudo", "-n"}.  The user is passed with "-u".
+	SudoCommand []string
+	// The users that tasks may run as on the host, see Task.RunAs
+	RunAsUsers []string
+	// The groups that the host is in, which limit the clients of the geto
+	// server that may use it (see config.Client)
+	Groups []string
 }
@@ -36,3 +36,16 @@ func (r dummyRemote) CopyFrom(host host.Host,
 	localPath string) (err error) {
 	return nil
 }
+
+func (r dummyRemote) CopyArchiveTo(host host.Host,
+	localPath string,
+	remoteDirPath string) (err error) {
+	return nil
+}
+
+func (r dummyRemote) CopyArchiveFrom(host host.Host,
+	remoteDirPath string,
+	relPaths []string,
+	localDirPath string) (err error) {
+	return nil
+}
@@ -73,3 +73,19 @@ func TestCopyFrom(t *testing.T) {
 		}
 	}
 }
+
+func TestCopyArchiveTo(t *testing.T) {
+	for _, host := range conf.Hosts {
+		if err := r.CopyArchiveTo(host, "", ""); err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+}
+
+func TestCopyArchiveFrom(t *testing.T) {
+	for _, host := range conf.Hosts {
+		if err := r.CopyArchiveFrom(host, "", []string{}, ""); err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+}
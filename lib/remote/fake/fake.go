@@ -0,0 +1,449 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Provide a scriptable fake remote for unit testing purposes.
+
+A fake Remote records every call made to it.  Run returns the canned response
+of the first registered pattern that matches the command (or empty output and
+a nil error if none does), and the copy methods work against a simulated
+filesystem per host.  Any call can be made to fail by its number.
+
+A Remote made with NewLocal treats the local machine as every host instead, for
+tests that run real scripts: commands that no pattern matches are run with the
+local sh, and files are copied on the local filesystem.
+
+	r := fake.New()
+	r.OnRun(`^mkdir `, fake.Response{Stderr: "denied", Err: errors.New("exit 1")})
+	r.OnRunOn("server2", `^uname`, fake.Response{Stdout: "Darwin\n"})
+	r.FailNth("CopyTo", 2, errors.New("connection reset"))
+	r.OnRun(`^sha256sum `, fake.Response{Stdout: "none\n", Times: 1})
+*/
+package fake
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/archive"
+	"github.com/bgmerrell/geto/lib/host"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A call made to a Remote
+type Call struct {
+	// The name of the method, e.g., "Run"
+	Method string
+	Host   host.Host
+	// The command, for Run
+	Command string
+	// The paths, for the copy methods
+	LocalPath  string
+	RemotePath string
+	RelPaths   []string
+	Recursive  bool
+}
+
+// The canned result of a Run call
+type Response struct {
+	Stdout string
+	Stderr string
+	Err    error
+	// How long the call takes
+	Latency time.Duration
+	// How many matching calls get the response, 0 for all of them.  Once
+	// they're used up, the next matching pattern responds.
+	Times int
+}
+
+type matcher struct {
+	// The name of the host whose commands are matched, "" for any host
+	hostName string
+	pattern  *regexp.Regexp
+	response Response
+	// The number of calls that got the response
+	used int
+}
+
+type failure struct {
+	method string
+	n      int
+	err    error
+}
+
+type file struct {
+	content []byte
+	mode    os.FileMode
+}
+
+// Remote implements the remote.Remote interface
+type Remote struct {
+	lock     sync.Mutex
+	calls    []Call
+	counts   map[string]int
+	matchers []matcher
+	failures []failure
+	// Host name to remote path to file
+	files map[string]map[string]file
+	// Host name to remote directory paths
+	dirs map[string]map[string]bool
+	// Whether the local machine is every host, rather than the simulated
+	// filesystem
+	local bool
+}
+
+func New() *Remote {
+	return &Remote{
+		counts: map[string]int{},
+		files:  map[string]map[string]file{},
+		dirs:   map[string]map[string]bool{}}
+}
+
+// Return a Remote that runs the commands that no pattern matches with the
+// local sh, and copies files on the local filesystem
+func NewLocal() *Remote {
+	r := New()
+	r.local = true
+	return r
+}
+
+// Respond to the Run commands that match the regular expression pattern.
+// Patterns are tried in the order they were registered.
+func (r *Remote) OnRun(pattern string, response Response) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.matchers = append(r.matchers, matcher{"", regexp.MustCompile(pattern), response, 0})
+}
+
+// Respond to the Run commands on the named host that match the regular
+// expression pattern, as OnRun does for every host
+func (r *Remote) OnRunOn(hostName string, pattern string, response Response) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.matchers = append(r.matchers, matcher{hostName, regexp.MustCompile(pattern), response, 0})
+}
+
+// Fail the nth call (counting from 1) of the named method with err
+func (r *Remote) FailNth(method string, n int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = append(r.failures, failure{method, n, err})
+}
+
+// Return the calls made so far, in order
+func (r *Remote) Calls() []Call {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Call{}, r.calls...)
+}
+
+// Return the calls of the named method made so far, in order
+func (r *Remote) CallsTo(method string) (calls []Call) {
+	for _, call := range r.Calls() {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Create a file, and its parent directories, on a host.  Like the other
+// methods of the simulated filesystem, it isn't used by a local Remote.
+func (r *Remote) WriteFile(h host.Host, remotePath string, content []byte, mode os.FileMode) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.writeFile(h.Name, remotePath, content, mode)
+}
+
+// Return the content of a file on a host.  The error satisfies os.IsNotExist
+// if there is no such file.
+func (r *Remote) ReadFile(h host.Host, remotePath string) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f, ok := r.files[h.Name][path.Clean(remotePath)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: remotePath, Err: os.ErrNotExist}
+	}
+	return append([]byte{}, f.content...), nil
+}
+
+// Create a directory, and its parents, on a host
+func (r *Remote) Mkdir(h host.Host, remotePath string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.mkdir(h.Name, remotePath)
+}
+
+// Return the paths of the files on a host, sorted
+func (r *Remote) Paths(h host.Host) (paths []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for p := range r.files[h.Name] {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Record a call and return the error it should fail with, if any
+func (r *Remote) record(call Call) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = append(r.calls, call)
+	r.counts[call.Method]++
+	for _, f := range r.failures {
+		if f.method == call.Method && f.n == r.counts[call.Method] {
+			return f.err
+		}
+	}
+	return nil
+}
+
+func (r *Remote) writeFile(hostName string, remotePath string, content []byte, mode os.FileMode) {
+	remotePath = path.Clean(remotePath)
+	r.mkdir(hostName, path.Dir(remotePath))
+	if r.files[hostName] == nil {
+		r.files[hostName] = map[string]file{}
+	}
+	r.files[hostName][remotePath] = file{append([]byte{}, content...), mode}
+}
+
+func (r *Remote) mkdir(hostName string, remotePath string) {
+	if r.dirs[hostName] == nil {
+		r.dirs[hostName] = map[string]bool{}
+	}
+	for p := path.Clean(remotePath); p != "/" && p != "."; p = path.Dir(p) {
+		r.dirs[hostName][p] = true
+	}
+}
+
+func (r *Remote) isDir(hostName string, remotePath string) bool {
+	return r.dirs[hostName][path.Clean(remotePath)]
+}
+
+func (r *Remote) TestConnection(h host.Host) (err error) {
+	return r.record(Call{Method: "TestConnection", Host: h})
+}
+
+func (r *Remote) Run(h host.Host,
+	command string,
+	timeout uint32) (stdout string, stderr string, err error) {
+	if err = r.record(Call{Method: "Run", Host: h, Command: command}); err != nil {
+		return "", err.Error(), err
+	}
+	var response Response
+	matched := false
+	r.lock.Lock()
+	for i := range r.matchers {
+		m := &r.matchers[i]
+		if (m.hostName == "" || m.hostName == h.Name) && m.pattern.MatchString(command) &&
+			(m.response.Times == 0 || m.used < m.response.Times) {
+			m.used++
+			response = m.response
+			matched = true
+			break
+		}
+	}
+	r.lock.Unlock()
+	if !matched && r.local {
+		var stdoutBuf, stderrBuf bytes.Buffer
+		err = runLocally(command, nil, &stdoutBuf, &stderrBuf)
+		return stdoutBuf.String(), stderrBuf.String(), err
+	}
+	time.Sleep(response.Latency)
+	return response.Stdout, response.Stderr, response.Err
+}
+
+// Run a command with the local sh
+func runLocally(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// Copy a local file, or a directory if recursive is set, with the local cp
+func copyLocally(recursive bool, fromPath string, toPath string) error {
+	args := []string{fromPath, toPath}
+	if recursive {
+		args = append([]string{"-r"}, args...)
+	}
+	output, err := exec.Command("cp", args...).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s (%s)", err.Error(), strings.TrimSpace(string(output))))
+	}
+	return nil
+}
+
+// Copy localPath to remotePath on the host (into it, if it's a directory)
+func (r *Remote) CopyTo(h host.Host,
+	recursive bool,
+	localPath string,
+	remotePath string) (err error) {
+	err = r.record(Call{Method: "CopyTo", Host: h,
+		LocalPath: localPath, RemotePath: remotePath, Recursive: recursive})
+	if err != nil {
+		return err
+	}
+	if r.local {
+		return copyLocally(recursive, localPath, remotePath)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isDir(h.Name, remotePath) {
+		remotePath = path.Join(remotePath, filepath.Base(localPath))
+	}
+	return r.copyIn(h.Name, recursive, localPath, remotePath)
+}
+
+// Copy remotePath on the host to localPath (into it, if it's a directory)
+func (r *Remote) CopyFrom(h host.Host,
+	recursive bool,
+	remotePath string,
+	localPath string) (err error) {
+	err = r.record(Call{Method: "CopyFrom", Host: h,
+		LocalPath: localPath, RemotePath: remotePath, Recursive: recursive})
+	if err != nil {
+		return err
+	}
+	if r.local {
+		return copyLocally(recursive, remotePath, localPath)
+	}
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.copyOut(h.Name, recursive, remotePath, localPath)
+}
+
+func (r *Remote) CopyArchiveTo(h host.Host,
+	localPath string,
+	remoteDirPath string) (err error) {
+	err = r.record(Call{Method: "CopyArchiveTo", Host: h,
+		LocalPath: localPath, RemotePath: remoteDirPath, Recursive: true})
+	if err != nil {
+		return err
+	}
+	if r.local {
+		return archive.Upload(localPath, remoteDirPath,
+			func(command string, stdin io.Reader) error {
+				return runLocally(command, stdin, nil, nil)
+			})
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.mkdir(h.Name, remoteDirPath)
+	return r.copyIn(h.Name, true, localPath,
+		path.Join(remoteDirPath, filepath.Base(localPath)))
+}
+
+func (r *Remote) CopyArchiveFrom(h host.Host,
+	remoteDirPath string,
+	relPaths []string,
+	localDirPath string) (err error) {
+	err = r.record(Call{Method: "CopyArchiveFrom", Host: h,
+		LocalPath: localDirPath, RemotePath: remoteDirPath,
+		RelPaths: append([]string{}, relPaths...), Recursive: true})
+	if err != nil {
+		return err
+	}
+	if r.local {
+		return archive.Download(remoteDirPath, relPaths, localDirPath,
+			func(command string, stdout io.Writer) error {
+				return runLocally(command, nil, stdout, nil)
+			})
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, relPath := range relPaths {
+		err = r.copyOut(h.Name, true, path.Join(remoteDirPath, relPath),
+			filepath.Join(localDirPath, filepath.FromSlash(relPath)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy a local file or directory to exactly remotePath
+func (r *Remote) copyIn(hostName string, recursive bool, localPath string, remotePath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !recursive {
+		return errors.New(fmt.Sprintf("%s: not a regular file", localPath))
+	}
+	return filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(remotePath, filepath.ToSlash(relPath))
+		if info.IsDir() {
+			r.mkdir(hostName, dest)
+			return nil
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		r.writeFile(hostName, dest, content, info.Mode().Perm())
+		return nil
+	})
+}
+
+// Copy a remote file or directory to exactly localPath, creating localPath's
+// parent directories
+func (r *Remote) copyOut(hostName string, recursive bool, remotePath string, localPath string) error {
+	remotePath = path.Clean(remotePath)
+	if f, ok := r.files[hostName][remotePath]; ok {
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(localPath, f.content, f.mode)
+	}
+	if !r.isDir(hostName, remotePath) {
+		return &os.PathError{Op: "open", Path: remotePath, Err: os.ErrNotExist}
+	}
+	if !recursive {
+		return errors.New(fmt.Sprintf("%s: not a regular file", remotePath))
+	}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+	prefix := remotePath + "/"
+	for p := range r.dirs[hostName] {
+		if strings.HasPrefix(p, prefix) {
+			dest := filepath.Join(localPath, filepath.FromSlash(p[len(prefix):]))
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		}
+	}
+	for p, f := range r.files[hostName] {
+		if strings.HasPrefix(p, prefix) {
+			dest := filepath.Join(localPath, filepath.FromSlash(p[len(prefix):]))
+			if err := ioutil.WriteFile(dest, f.content, f.mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package fake
+
+import (
+	"errors"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testHost = host.Host{Name: "server1", Addr: "10.0.0.10", Username: "athos"}
+
+// A Remote must be usable wherever a remote.Remote is
+var _ remote.Remote = New()
+
+func TestRunRecordsCalls(t *testing.T) {
+	r := New()
+	r.TestConnection(testHost)
+	r.Run(testHost, "echo hi", 0)
+	calls := r.Calls()
+	if len(calls) != 2 || calls[0].Method != "TestConnection" ||
+		calls[1].Method != "Run" || calls[1].Command != "echo hi" ||
+		calls[1].Host.Name != testHost.Name {
+		t.Errorf("Unexpected calls: %#v", calls)
+	}
+	if len(r.CallsTo("Run")) != 1 {
+		t.Errorf("Expected one Run call, got %#v", r.CallsTo("Run"))
+	}
+}
+
+func TestOnRun(t *testing.T) {
+	r := New()
+	r.OnRunOn("other", `^echo `, Response{Stdout: "other\n"})
+	r.OnRun(`^mkdir `, Response{Stderr: "denied", Err: errors.New("exit 1")})
+	r.OnRun(`^echo `, Response{Stdout: "first\n"})
+	r.OnRun(`^echo hi$`, Response{Stdout: "second\n"})
+	r.OnRun(`^sleep`, Response{Latency: 50 * time.Millisecond})
+
+	if stdout, _, err := r.Run(testHost, "echo hi", 0); err != nil || stdout != "first\n" {
+		t.Errorf("Expected the first matching response, got %q and %v", stdout, err)
+	}
+	if stdout, _, _ := r.Run(host.Host{Name: "other"}, "echo hi", 0); stdout != "other\n" {
+		t.Errorf("Expected the other host's response, got %q", stdout)
+	}
+	if _, stderr, err := r.Run(testHost, "mkdir /tmp/x", 0); err == nil || stderr != "denied" {
+		t.Errorf("Expected the canned failure, got %q and %v", stderr, err)
+	}
+	if stdout, stderr, err := r.Run(testHost, "true", 0); stdout != "" || stderr != "" || err != nil {
+		t.Errorf("Expected an empty response, got %q, %q and %v", stdout, stderr, err)
+	}
+	start := time.Now()
+	r.Run(testHost, "sleep 1", 0)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected the response to take 50ms, it took %s", time.Since(start))
+	}
+}
+
+func TestOnRunTimes(t *testing.T) {
+	r := New()
+	r.OnRun(`^sha256sum `, Response{Stdout: "none\n", Times: 2})
+	r.OnRun(`^sha256sum `, Response{Stdout: "abc\n"})
+	for i, expected := range []string{"none\n", "none\n", "abc\n", "abc\n"} {
+		if stdout, _, _ := r.Run(testHost, "sha256sum f", 0); stdout != expected {
+			t.Errorf("Expected call %d to return %q, got %q", i+1, expected, stdout)
+		}
+	}
+}
+
+func TestFailNth(t *testing.T) {
+	r := New()
+	injected := errors.New("connection reset")
+	r.FailNth("Run", 2, injected)
+	for i, expected := range []error{nil, injected, nil} {
+		if _, _, err := r.Run(testHost, "true", 0); err != expected {
+			t.Errorf("Expected call %d to return %v, got %v", i+1, expected, err)
+		}
+	}
+	if len(r.CallsTo("Run")) != 3 {
+		t.Errorf("Expected the failed call to be recorded too")
+	}
+}
+
+func TestCopyToAndFrom(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "geto-fake")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+	taskDirPath := filepath.Join(dirPath, "task")
+	if err = os.MkdirAll(filepath.Join(taskDirPath, "DEPS"), 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = ioutil.WriteFile(filepath.Join(taskDirPath, "script"), []byte("true\n"), 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	r := New()
+	r.Mkdir(testHost, "/tmp/geto")
+	if err = r.CopyTo(testHost, false, taskDirPath, "/tmp/geto"); err == nil {
+		t.Errorf("Expected a non-recursive copy of a directory to fail")
+	}
+	if err = r.CopyTo(testHost, true, taskDirPath, "/tmp/geto"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err = r.CopyArchiveTo(testHost, filepath.Join(taskDirPath, "script"), "/tmp/other"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	paths := r.Paths(testHost)
+	if len(paths) != 2 || paths[0] != "/tmp/geto/task/script" || paths[1] != "/tmp/other/script" {
+		t.Errorf("Unexpected remote files: %#v", paths)
+	}
+
+	r.WriteFile(testHost, "/tmp/geto/task/stdout", []byte("out\n"), 0644)
+	if content, err := r.ReadFile(testHost, "/tmp/geto/task/stdout"); err != nil || string(content) != "out\n" {
+		t.Errorf("Unexpected content: %q (%v)", content, err)
+	}
+	if _, err = r.ReadFile(testHost, "/tmp/geto/task/stderr"); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file, got %v", err)
+	}
+
+	outPath := filepath.Join(dirPath, "out")
+	if err = r.CopyFrom(testHost, true, "/tmp/geto/task", outPath); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for _, name := range []string{"script", "stdout", "DEPS"} {
+		if _, err = os.Stat(filepath.Join(outPath, name)); err != nil {
+			t.Errorf("Expected %s to be copied: %s", name, err.Error())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(outPath, "script")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected the script to keep its mode: %v", info)
+	}
+
+	resultsPath := filepath.Join(dirPath, "results")
+	err = r.CopyArchiveFrom(testHost, "/tmp/geto/task", []string{"stdout"}, resultsPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(resultsPath, "stdout")); err != nil || string(content) != "out\n" {
+		t.Errorf("Unexpected content: %q (%v)", content, err)
+	}
+	err = r.CopyArchiveFrom(testHost, "/tmp/geto/task", []string{"missing"}, resultsPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected copying a missing file to fail, got %v", err)
+	}
+	if calls := r.CallsTo("CopyArchiveFrom"); len(calls) != 2 || calls[1].RelPaths[0] != "missing" {
+		t.Errorf("Unexpected calls: %#v", calls)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "geto-fake")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+	r := NewLocal()
+	r.OnRun(`^uname$`, Response{Stdout: "Darwin\n"})
+	if stdout, _, _ := r.Run(testHost, "uname", 0); stdout != "Darwin\n" {
+		t.Errorf("Expected the canned response, got %q", stdout)
+	}
+	stdout, stderr, err := r.Run(testHost, "cd "+dirPath+" && echo hi > a && cat a && echo err >&2", 0)
+	if err != nil || stdout != "hi\n" || stderr != "err\n" {
+		t.Errorf("Expected the command to run locally, got %q and %q (%v)", stdout, stderr, err)
+	}
+	if _, _, err = r.Run(testHost, "exit 3", 0); err == nil {
+		t.Errorf("Expected a failed command to return an error")
+	}
+
+	if err = r.CopyTo(testHost, false, filepath.Join(dirPath, "a"), filepath.Join(dirPath, "b")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err = r.CopyArchiveTo(testHost, filepath.Join(dirPath, "b"), filepath.Join(dirPath, "sub")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	outPath := filepath.Join(dirPath, "out")
+	err = r.CopyArchiveFrom(testHost, filepath.Join(dirPath, "sub"), []string{"b"}, outPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err = r.CopyFrom(testHost, true, outPath, filepath.Join(dirPath, "back")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dirPath, "back", "b")); err != nil || string(content) != "hi\n" {
+		t.Errorf("Unexpected content: %q (%v)", content, err)
+	}
+	if len(r.Paths(testHost)) != 0 || len(r.Calls()) != 7 {
+		t.Errorf("Expected only local copies and 7 recorded calls, got %#v", r.Calls())
+	}
+}
@@ -17,7 +17,8 @@ type Remote interface {
 	//
 	// The returned error is nil if the command runs, has no problems
 	// copying stdin, stdout, and stderr, and exits with a zero exit
-	// status.
+	// status.  A command that times out is killed, and the output that
+	// it wrote until then is returned with the error.
 	Run(host host.Host,
 		command string,
 		timeout uint32) (stdout string, stderr string, err error)
@@ -41,4 +42,26 @@ type Remote interface {
 		recursive bool,
 		remotePath string,
 		localPath string) (err error)
+
+	// CopyArchiveTo copies localPath, recursively, into the remoteDirPath
+	// directory on host as a single compressed archive stream.
+	//
+	// The host must have tar and gzip.
+	//
+	// An error is returned if the copy fails.
+	CopyArchiveTo(host host.Host,
+		localPath string,
+		remoteDirPath string) (err error)
+
+	// CopyArchiveFrom copies relPaths, relative to remoteDirPath on host,
+	// into the localDirPath directory as a single compressed archive
+	// stream.
+	//
+	// The host must have tar and gzip.
+	//
+	// An error is returned if the copy fails.
+	CopyArchiveFrom(host host.Host,
+		remoteDirPath string,
+		relPaths []string,
+		localDirPath string) (err error)
 }
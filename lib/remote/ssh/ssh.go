@@ -1,10 +1,14 @@
 package ssh
 
 import (
+	"errors"
+	"github.com/bgmerrell/geto/lib/archive"
 	"github.com/bgmerrell/geto/lib/config"
 	"github.com/bgmerrell/geto/lib/host"
 	"github.com/bgmerrell/geto/lib/remote"
 	"github.com/bgmerrell/geto/lib/ssh"
+	"io"
+	"strings"
 )
 
 // remote implements the Remote interface
@@ -42,9 +46,12 @@ func (r sshRemote) CopyTo(host host.Host,
 	recursive bool,
 	localPath string,
 	remotePath string) (err error) {
+	conf := config.GetParsedConfig()
 	return ssh.ScpTo(
 		host.Addr,
 		host.Username,
+		host.Password,
+		conf.PrivKeyPath,
 		host.PortNum,
 		recursive,
 		localPath,
@@ -55,11 +62,55 @@ func (r sshRemote) CopyFrom(host host.Host,
 	recursive bool,
 	remotePath string,
 	localPath string) (err error) {
+	conf := config.GetParsedConfig()
 	return ssh.ScpFrom(
 		host.Addr,
 		host.Username,
+		host.Password,
+		conf.PrivKeyPath,
 		host.PortNum,
 		recursive,
 		remotePath,
 		localPath)
 }
+
+// Run a command on the host with the given stdin and stdout
+func (r sshRemote) runWithIO(host host.Host,
+	command string,
+	stdin io.Reader,
+	stdout io.Writer) (err error) {
+	conf := config.GetParsedConfig()
+	stderr, err := ssh.RunWithIO(
+		host.Addr,
+		host.Username,
+		host.Password,
+		conf.PrivKeyPath,
+		host.PortNum,
+		command,
+		stdin,
+		stdout)
+	if err != nil {
+		return errors.New("Archive transfer with " + host.Addr + " failed: " +
+			err.Error() + " (" + strings.TrimSpace(stderr) + ")")
+	}
+	return nil
+}
+
+func (r sshRemote) CopyArchiveTo(host host.Host,
+	localPath string,
+	remoteDirPath string) (err error) {
+	return archive.Upload(localPath, remoteDirPath,
+		func(command string, stdin io.Reader) error {
+			return r.runWithIO(host, command, stdin, nil)
+		})
+}
+
+func (r sshRemote) CopyArchiveFrom(host host.Host,
+	remoteDirPath string,
+	relPaths []string,
+	localDirPath string) (err error) {
+	return archive.Download(remoteDirPath, relPaths, localDirPath,
+		func(command string, stdout io.Writer) error {
+			return r.runWithIO(host, command, nil, stdout)
+		})
+}
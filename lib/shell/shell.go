@@ -0,0 +1,46 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Build command lines that are safe to run with a POSIX shell on a target host.
+
+Every value that is interpolated into a remote command line (paths, names,
+arguments) should go through Quote or Command so that spaces, quotes and
+other shell metacharacters are taken literally instead of being interpreted
+by the shell on the target host.
+*/
+package shell
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Strings made up of only these characters don't need quoting
+var safeWord *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_./:=@%+,-]+$`)
+
+// Quote s so that the shell treats it as a single literal word
+func Quote(s string) string {
+	if safeWord.MatchString(s) {
+		return s
+	}
+	// Nothing is special inside single quotes except the single quote
+	// itself, which is written as '\'' (end quote, escaped quote, start
+	// quote).
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Quote each of words and join them with spaces
+func Join(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = Quote(w)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Build a command line that runs name with args, quoting each of them
+func Command(name string, args ...string) string {
+	return Join(append([]string{name}, args...))
+}
@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var hostileStrings []string = []string{
+	"",
+	"with space",
+	"single'quote",
+	"double\"quote",
+	"$(touch pwned)",
+	"`touch pwned`",
+	"; touch pwned",
+	"&& touch pwned",
+	"| touch pwned",
+	"> pwned",
+	"$HOME",
+	"*",
+	"back\\slash",
+	"new\nline",
+	"'; touch pwned; echo '",
+	"-rf",
+}
+
+func TestQuoteSafeWord(t *testing.T) {
+	const word = "/tmp/geto/1234-abcd_script.sh"
+	if Quote(word) != word {
+		t.Errorf("Expected %q to be left unquoted, got %q", word, Quote(word))
+	}
+}
+
+// Run each quoted string through a real shell and make sure it comes out
+// the other side unchanged (and that nothing was executed)
+func TestQuoteHostileStrings(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "geto-shell-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+
+	for _, s := range hostileStrings {
+		cmd := exec.Command("sh", "-c", Command("printf", "%s", s))
+		cmd.Dir = dirPath
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("Failed to run quoted %q: %s", s, err.Error())
+		} else if string(out) != s {
+			t.Errorf("Expected %q, got %q", s, string(out))
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(dirPath, "pwned")); err == nil {
+		t.Errorf("A quoted string was executed by the shell")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	expected := `mkdir -p '/tmp/with space' '$(x)'`
+	actual := Command("mkdir", "-p", "/tmp/with space", "$(x)")
+	if actual != expected {
+		t.Errorf("Expected %q, got %q", expected, actual)
+	}
+}
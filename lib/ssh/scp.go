@@ -0,0 +1,306 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Copy files to and from remote hosts with the scp protocol.  The remote host's
+scp is run over an SSH session (with -t to receive files, or -f to send them)
+and the local end of the protocol is spoken here, so copies authenticate the
+same way as Run: with the master's key or the host's password.
+*/
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/shell"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Read the remote scp's reply to a protocol message
+func readScpReply(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	if b != 1 && b != 2 {
+		msg = string(b) + msg
+	}
+	return errors.New(strings.TrimSpace(msg))
+}
+
+// Write a protocol message and wait for the remote scp's reply
+func sendScpMessage(w io.Writer, r *bufio.Reader, format string, a ...interface{}) error {
+	if _, err := fmt.Fprintf(w, format, a...); err != nil {
+		return err
+	}
+	return readScpReply(r)
+}
+
+// Send a local file, or a directory if recursive is set, to the remote scp
+func sendScp(w io.Writer, r *bufio.Reader, localPath string, recursive bool) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if !recursive {
+			return errors.New(fmt.Sprintf("%s is a directory", localPath))
+		}
+		err = sendScpMessage(w, r, "D%04o 0 %s\n", info.Mode().Perm(), info.Name())
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = sendScp(w, r, filepath.Join(localPath, name), true); err != nil {
+				return err
+			}
+		}
+		return sendScpMessage(w, r, "E\n")
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New(fmt.Sprintf("%s is not a regular file", localPath))
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = sendScpMessage(w, r, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), info.Name())
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(w, f, info.Size()); err != nil {
+		return err
+	}
+	return sendScpMessage(w, r, "\x00")
+}
+
+// Parse the "<mode> <size> <name>" that follows a C or D message
+func parseScpHeader(header string) (mode os.FileMode, size int64, name string, err error) {
+	fields := strings.SplitN(strings.TrimSuffix(header, "\n"), " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", errors.New(fmt.Sprintf("Malformed scp message: %q", header))
+	}
+	m, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.New(fmt.Sprintf("Malformed scp mode: %q", fields[0]))
+	}
+	size, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errors.New(fmt.Sprintf("Malformed scp size: %q", fields[1]))
+	}
+	name = fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", errors.New(fmt.Sprintf("Invalid scp file name: %q", name))
+	}
+	return os.FileMode(m).Perm(), size, name, nil
+}
+
+// Receive the files and directories that the remote scp sends, putting the
+// first one at localPath, or inside it if it's an existing directory
+func receiveScp(w io.Writer, r *bufio.Reader, localPath string) error {
+	// The local directories being received into, innermost last
+	var dirs []string
+	reply := func() error {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+
+	if err := reply(); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" && len(dirs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch line[0] {
+		case 1, 2:
+			return errors.New(strings.TrimSpace(line[1:]))
+		case 'T':
+			// Times are only sent with -p, which isn't used
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("Unexpected end of directory from scp")
+			}
+			dirs = dirs[:len(dirs)-1]
+		case 'C', 'D':
+			mode, size, name, err := parseScpHeader(line[1:])
+			if err != nil {
+				return err
+			}
+			path := localPath
+			if len(dirs) > 0 {
+				path = filepath.Join(dirs[len(dirs)-1], name)
+			} else if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+				path = filepath.Join(localPath, name)
+			}
+			if line[0] == 'D' {
+				if err = os.Mkdir(path, mode); err != nil && !os.IsExist(err) {
+					return err
+				}
+				dirs = append(dirs, path)
+				break
+			}
+			if err = reply(); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(f, r, size)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			if err = readScpReply(r); err != nil {
+				return err
+			}
+		default:
+			return errors.New(fmt.Sprintf("Unexpected scp message: %q", line))
+		}
+		if err = reply(); err != nil {
+			return err
+		}
+	}
+}
+
+// Run the remote end of an scp copy and speak the local end with transfer
+func runScp(
+	addr string,
+	username string,
+	password *string,
+	privKeyPath string,
+	portNum uint16,
+	command string,
+	transfer func(w io.Writer, r *bufio.Reader) error) (err error) {
+
+	session, err := getSession(addr, username, password, privKeyPath, portNum)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr_buf bytes.Buffer
+	session.Stderr = &stderr_buf
+	if err = session.Start(command); err != nil {
+		return err
+	}
+	r := bufio.NewReader(stdout)
+	err = transfer(stdin, r)
+	// Let the remote scp see the end of its input and exit, discarding
+	// anything it still sends after a failure so that it isn't blocked
+	stdin.Close()
+	io.Copy(ioutil.Discard, r)
+	if waitErr := session.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil && stderr_buf.Len() > 0 {
+		err = errors.New(err.Error() + " (" + strings.TrimSpace(stderr_buf.String()) + ")")
+	}
+	return err
+}
+
+// Build the remote scp command for the given mode (-t or -f)
+func scpCommand(mode string, recursive bool, remotePath string) string {
+	command := "scp " + mode
+	if recursive {
+		command += " -r"
+	}
+	return command + " -- " + shell.Quote(remotePath)
+}
+
+// Secure copy (scp) from localhost to addr
+// The addr parameter is the address (IP, hostname, etc) of the remote host.
+// The username parameter is the username to use to SSH to the remote host.
+// The password parameter is the password to use to SSH to the remote host.
+// The privKeyPath parameter is the path to the private key of the master.
+// The portNum is the SSH port number of the remote host.
+// The recursive parameter indicates whether to copy directories.
+func ScpTo(
+	addr string,
+	username string,
+	password *string,
+	privKeyPath string,
+	portNum uint16,
+	recursive bool,
+	localPath string,
+	remotePath string) (err error) {
+
+	err = runScp(addr, username, password, privKeyPath, portNum,
+		scpCommand("-t", recursive, remotePath),
+		func(w io.Writer, r *bufio.Reader) error {
+			if err := readScpReply(r); err != nil {
+				return err
+			}
+			return sendScp(w, r, localPath, recursive)
+		})
+	if err != nil {
+		return errors.New("scp to " + addr + " failed: " + err.Error())
+	}
+	return nil
+}
+
+// Secure copy (scp) from addr to localhost
+// The addr parameter is the address (IP, hostname, etc) of the remote host.
+// The username parameter is the username to use to SSH to the remote host.
+// The password parameter is the password to use to SSH to the remote host.
+// The privKeyPath parameter is the path to the private key of the master.
+// The portNum is the SSH port number of the remote host.
+// The recursive parameter indicates whether to copy directories.
+func ScpFrom(
+	addr string,
+	username string,
+	password *string,
+	privKeyPath string,
+	portNum uint16,
+	recursive bool,
+	remotePath string,
+	localPath string) (err error) {
+
+	err = runScp(addr, username, password, privKeyPath, portNum,
+		scpCommand("-f", recursive, remotePath),
+		func(w io.Writer, r *bufio.Reader) error {
+			return receiveScp(w, r, localPath)
+		})
+	if err != nil {
+		return errors.New("scp from " + addr + " failed: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package ssh
+
+import (
+	"github.com/bgmerrell/geto/lib/ssh/sshtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Check that path is a file with the given contents and permissions
+func checkFile(t *testing.T, path string, contents string, perm os.FileMode) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("Expected %s to exist: %s", path, err.Error())
+		return
+	}
+	buf, _ := ioutil.ReadFile(path)
+	if string(buf) != contents || info.Mode().Perm() != perm {
+		t.Errorf("Expected %s to hold %q with mode %o, got %q with mode %o",
+			path, contents, perm, string(buf), info.Mode().Perm())
+	}
+}
+
+// Copy a file and a directory to the server and back with the given auth
+func testScp(t *testing.T, s *sshtest.Server, password *string, privKeyPath string) {
+	local := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(local, "dir", "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create a directory: %s", err.Error())
+	}
+	files := map[string]os.FileMode{
+		"file":      0644,
+		"dir/a":     0755,
+		"dir/sub/b": 0600,
+		"dir/empty": 0644,
+	}
+	for name, perm := range files {
+		contents := ""
+		if !strings.HasSuffix(name, "empty") {
+			contents = "contents of " + name + "\n"
+		}
+		if err := ioutil.WriteFile(filepath.Join(local, name), []byte(contents), perm); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err.Error())
+		}
+		os.Chmod(filepath.Join(local, name), perm)
+	}
+
+	err := ScpTo(s.Addr, s.Username, password, privKeyPath, s.Port, false,
+		filepath.Join(local, "file"), filepath.Join(s.Dir, "copied file"))
+	if err != nil {
+		t.Fatalf("Unexpected error copying a file: %s", err.Error())
+	}
+	checkFile(t, filepath.Join(s.Dir, "copied file"), "contents of file\n", 0644)
+	err = ScpTo(s.Addr, s.Username, password, privKeyPath, s.Port, true,
+		filepath.Join(local, "dir"), filepath.Join(s.Dir, "copied dir"))
+	if err != nil {
+		t.Fatalf("Unexpected error copying a directory: %s", err.Error())
+	}
+
+	back := t.TempDir()
+	err = ScpFrom(s.Addr, s.Username, password, privKeyPath, s.Port, false,
+		filepath.Join(s.Dir, "copied file"), filepath.Join(back, "file"))
+	if err != nil {
+		t.Fatalf("Unexpected error copying a file back: %s", err.Error())
+	}
+	// Into an existing directory, the copy keeps its name
+	err = ScpFrom(s.Addr, s.Username, password, privKeyPath, s.Port, true,
+		filepath.Join(s.Dir, "copied dir"), back)
+	if err != nil {
+		t.Fatalf("Unexpected error copying a directory back: %s", err.Error())
+	}
+	os.Rename(filepath.Join(back, "copied dir"), filepath.Join(back, "dir"))
+	for name, perm := range files {
+		contents := ""
+		if !strings.HasSuffix(name, "empty") {
+			contents = "contents of " + name + "\n"
+		}
+		checkFile(t, filepath.Join(back, name), contents, perm)
+	}
+}
+
+func TestScpWithPassword(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	testScp(t, s, &s.Password, "")
+}
+
+func TestScpWithKey(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	testScp(t, s, nil, s.PrivKeyPath)
+}
+
+func TestScpErrors(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	local := t.TempDir()
+
+	err := ScpFrom(s.Addr, s.Username, &s.Password, "", s.Port, false,
+		filepath.Join(s.Dir, "missing"), local)
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected copying a missing file to fail, got %v", err)
+	}
+	err = ScpTo(s.Addr, s.Username, &s.Password, "", s.Port, false,
+		local, filepath.Join(s.Dir, "dir"))
+	if err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Errorf("Expected copying a directory without recursive to fail, got %v", err)
+	}
+	err = ScpTo(s.Addr, s.Username, &s.Password, "", s.Port, false,
+		filepath.Join(local, "missing"), filepath.Join(s.Dir, "file"))
+	if err == nil {
+		t.Errorf("Expected copying a missing local file to fail")
+	}
+	wrong := "wrong"
+	err = ScpTo(s.Addr, s.Username, &wrong, "", s.Port, true, local, s.Dir)
+	if err == nil {
+		t.Errorf("Expected a wrong password to fail")
+	}
+}
+
+func TestParseScpHeader(t *testing.T) {
+	mode, size, name, err := parseScpHeader("0644 12 a file\n")
+	if err != nil || mode != 0644 || size != 12 || name != "a file" {
+		t.Errorf("Unexpected header: %o %d %q (%v)", mode, size, name, err)
+	}
+	for _, header := range []string{
+		"0644 12\n", "0x644 12 f\n", "0644 -1 f\n",
+		"0644 1 ..\n", "0644 1 .\n", "0644 1 a/b\n", "0644 1 \n",
+	} {
+		if _, _, _, err = parseScpHeader(header); err == nil {
+			t.Errorf("Expected %q to be rejected", header)
+		}
+	}
+}
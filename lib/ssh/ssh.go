@@ -3,116 +3,98 @@
  * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
 
 /*
-All of the calls to the external SSH library
-(code.google.com/p/go.crypto/ssh) will go through this package.  This gives us
-the opportunity to adjust the interface for our needs.  More importantly, it
-will allow us to more easily swap out the backend if all of our external SSH
-calls are in the same place.
+All of the calls to the external SSH library (golang.org/x/crypto/ssh) will go
+through this package.  This gives us the opportunity to adjust the interface
+for our needs.  More importantly, it will allow us to more easily swap out the
+backend if all of our external SSH calls are in the same place.
 */
 package ssh
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/ssh"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"github.com/bgmerrell/geto/lib/shell"
+	"golang.org/x/crypto/ssh"
 	"io"
 	"io/ioutil"
 	"log"
-	"os/exec"
 	"strconv"
 	"time"
 )
 
 const DEFAULT_SSH_PORT = 22
 
-// keychain implements the ssh.ClientKeyring interface
-type keychain struct {
-	keys []ssh.Signer
-}
-
-func (k *keychain) Key(i int) (ssh.PublicKey, error) {
-	if i < 0 || i >= len(k.keys) {
-		return nil, nil
-	}
-
-	return k.keys[i].PublicKey(), nil
-}
-
-func (k *keychain) Sign(i int, rand io.Reader, data []byte) (sig []byte, err error) {
-	return k.keys[i].Sign(rand, data)
-}
-
-func (k *keychain) add(key ssh.Signer) {
-	k.keys = append(k.keys, key)
-}
-
-func (k *keychain) loadPEM(file string) error {
+// Load a private key from a PEM file
+func loadPEM(file string) (ssh.Signer, error) {
 	buf, err := ioutil.ReadFile(file)
 	if err != nil {
-		return err
-	}
-	key, err := ssh.ParsePrivateKey(buf)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	k.add(key)
-	return nil
+	return ssh.ParsePrivateKey(buf)
 }
 
-// clientPassword implements the ssh.ClientPassword interface
-type clientPassword string
+// A session along with the client connection that it belongs to
+type clientSession struct {
+	*ssh.Session
+	client *ssh.Client
+}
 
-func (p clientPassword) Password(user string) (string, error) {
-	return string(p), nil
+// Close the session and its client connection
+func (s *clientSession) Close() error {
+	s.Session.Close()
+	return s.client.Close()
 }
 
-// Establish a code.google.com/p/go.crypto/ssh Session.
+// Establish a golang.org/x/crypto/ssh Session.
 // The caller is responsible for closing the session.
 func getSession(
 	addr string,
 	username string,
 	password *string,
 	privKeyPath string,
-	portNum uint16) (session *ssh.Session, err error) {
+	portNum uint16) (session *clientSession, err error) {
 
-	var authorizers []ssh.ClientAuth = []ssh.ClientAuth{}
+	var authMethods []ssh.AuthMethod
 	if privKeyPath != "" {
-		var clientKeychain *keychain = new(keychain)
-		if err := clientKeychain.loadPEM(privKeyPath); err != nil {
-			return session, err
+		key, err := loadPEM(privKeyPath)
+		if err != nil {
+			return nil, err
 		}
-		authorizers = append(
-			authorizers, ssh.ClientAuthKeyring(clientKeychain))
+		authMethods = append(authMethods, ssh.PublicKeys(key))
 	}
 
 	if password != nil {
-		authorizers = append(
-			authorizers, ssh.ClientAuthPassword(clientPassword(*password)))
+		authMethods = append(authMethods, ssh.Password(*password))
 	}
 
-	if len(authorizers) == 0 {
-		return session, errors.New("No authorization methods provided")
+	if len(authMethods) == 0 {
+		return nil, errors.New("No authorization methods provided")
 	}
 
 	/* Try to authenticate with a public SSH key first, try a password if that fails */
 	config := &ssh.ClientConfig{
 		User: username,
-		Auth: authorizers,
+		Auth: authMethods,
+		// TODO: Verify host keys.  Like the original client library,
+		// geto doesn't check them yet.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 	client, err := ssh.Dial(
 		"tcp",
 		addr+":"+strconv.FormatUint(uint64(portNum), 10),
 		config)
 	if err != nil {
-		return session, err
+		return nil, err
 	}
 
-	session, err = client.NewSession()
+	sshSession, err := client.NewSession()
 	if err != nil {
-		return session, err
+		client.Close()
+		return nil, err
 	}
-	return session, err
+	return &clientSession{sshSession, client}, nil
 }
 
 func TestConnection(
@@ -122,7 +104,7 @@ func TestConnection(
 	privKeyPath string,
 	portNum uint16) (err error) {
 
-	var session *ssh.Session
+	var session *clientSession
 
 	session, err = getSession(addr, username, password, privKeyPath, portNum)
 	if err != nil {
@@ -136,25 +118,63 @@ func TestConnection(
 	return nil
 }
 
-// Connect to the remote host and attempt to kill -9 the process that timed out
+// The number of seconds to wait for the output of a command that timed out
+// once it's been killed
+const TIMEOUT_OUTPUT_WAIT = 5
+
+// The directory, on the remote host, of the files that record the processes
+// of the commands that have a timeout
+const REMOTE_PID_DIR = "/tmp"
+
+// Return a new path for the file that records the process of a command with
+// a timeout (see getKillableCommand)
+func getRemotePIDPath() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/geto-run.%x", REMOTE_PID_DIR, b), nil
+}
+
+// Return the command that runs command in its own process group, if the
+// remote host has setsid or perl, and records what to kill after a timeout
+// (the negated process group, or else the command's PID) in the file at
+// pidPath.  The file is removed once the command exits.
+func getKillableCommand(command string, pidPath string) string {
+	quoted := shell.Quote(command)
+	return fmt.Sprintf(
+		"p=%s; "+
+			"if command -v setsid >/dev/null 2>&1; then setsid sh -c %[2]s & echo -$! > \"$p\"; "+
+			"elif command -v perl >/dev/null 2>&1; then %[3]s sh -c %[2]s & echo -$! > \"$p\"; "+
+			"else sh -c %[2]s & echo $! > \"$p\"; fi; "+
+			"wait $!; rc=$?; rm -f \"$p\"; exit $rc",
+		shell.Quote(pidPath), quoted,
+		shell.Command("perl", "-e", "setpgrp(0, 0); exec @ARGV or die $!"))
+}
+
+// Connect to the remote host and kill -9 the command that timed out, by the
+// process group (or PID) recorded in the file at pidPath
 // The addr parameter is the address (IP, hostname, etc) of the remote host.
 // The username parameter is the username to use to SSH to the remote host.
 // The password parameter is the password to use to SSH to the remote host.
 // The privKeyPath parameter is the path to the private key of the master.
 // The portNum parameter is the SSH port number of the remote host.
-// The command parameter is the command that timed out on the remote host.
+// The pidPath parameter is the path of the record of the command that timed
+// out (see getKillableCommand).
 func handleTimeout(
 	addr string,
 	username string,
 	password *string,
 	privKeyPath string,
 	portNum uint16,
-	expiredCmd string) (stdout string, stderr string, err error) {
+	pidPath string) (stdout string, stderr string, err error) {
 
 	// TODO: perhaps be a bit more diplomatic in the future by trying
 	// -TERM (instead of -9) first?
-	// The negation of the PID is important, see kill(1)
-	killCmd := fmt.Sprintf("kill -9 -$(pgrep -f \"%s\")", expiredCmd)
+	// The record holds the negated process group, see kill(1)
+	killCmd := fmt.Sprintf(
+		"p=%s; if [ -f \"$p\" ]; then kill -9 $(cat \"$p\"); rm -f \"$p\"; fi",
+		shell.Quote(pidPath))
 
 	session, err := getSession(addr, username, password, privKeyPath, portNum)
 	if err != nil {
@@ -174,7 +194,8 @@ func handleTimeout(
 // The portNum parameter is the SSH port number of the remote host.
 // The command parameter is the command to run on the remote host.
 // The timeout parameter is the number of seconds before abandoning the command.
-// A timeout of 0 means no timeout.
+// A timeout of 0 means no timeout.  A command that times out is killed, along
+// with its process group, and its output so far is returned with the error.
 func Run(
 	addr string,
 	username string,
@@ -184,7 +205,7 @@ func Run(
 	command string,
 	timeout uint32) (stdout string, stderr string, err error) {
 
-	var session *ssh.Session
+	var session *clientSession
 
 	session, err = getSession(addr, username, password, privKeyPath, portNum)
 	if err != nil {
@@ -198,110 +219,74 @@ func Run(
 	session.Stderr = &stderr_buf
 
 	if timeout == 0 {
-		if err = session.Run(command); err != nil {
+		err = session.Run(command)
+	} else {
+		// The command is run so that it can be killed after a timeout
+		var pidPath string
+		if pidPath, err = getRemotePIDPath(); err != nil {
 			return "", "", err
 		}
-	} else {
-		c := make(chan error)
-		var e error
+		// Buffered so that the goroutine can finish after a timeout
+		c := make(chan error, 1)
 		go func() {
-			c <- session.Run(command)
+			c <- session.Run(getKillableCommand(command, pidPath))
 		}()
 		select {
-		case e = <-c:
-			if e == nil {
-				return "", "", err
-			}
+		case err = <-c:
 		case <-time.After(time.Duration(timeout) * time.Second):
-			err = errors.New("timeout")
-			defer handleTimeout(
+			handleTimeout(
 				addr,
 				username,
 				password,
 				privKeyPath,
 				portNum,
-				command)
+				pidPath)
+			// Once the command is killed, its session ends with
+			// the output written so far.  A session that doesn't
+			// end is closed, which ends its output.
+			select {
+			case <-c:
+			case <-time.After(TIMEOUT_OUTPUT_WAIT * time.Second):
+				session.Close()
+				<-c
+			}
+			return stdout_buf.String(), stderr_buf.String(), errors.New("timeout")
 		}
 	}
 
 	return stdout_buf.String(), stderr_buf.String(), err
 }
 
-// Secure copy (scp) from localhost to addr
-// Run a separate scp process (for now) to secure copy files between hosts.
+// Run a command on the remote host with the given stdin and stdout, for
+// streaming data to or from the command.
 // The addr parameter is the address (IP, hostname, etc) of the remote host.
+// The username parameter is the username to use to SSH to the remote host.
+// The password parameter is the password to use to SSH to the remote host.
 // The privKeyPath parameter is the path to the private key of the master.
-// The portNum is the SSH port number of the remote host.
-// The incoming parameter indicates which direction to perform the copy.
-// The recursive parameter indicates whether to use the -r scp option.
-// Password authentication not supported for this function.
-// XXX: This function should probably go away in favor of a single Scp function when Issue #1 is fixed.
-func ScpTo(
+// The portNum parameter is the SSH port number of the remote host.
+// The command parameter is the command to run on the remote host.
+// The stdin and stdout parameters are the command's stdin and stdout; either
+// may be nil.
+func RunWithIO(
 	addr string,
 	username string,
+	password *string,
+	privKeyPath string,
 	portNum uint16,
-	recursive bool,
-	localPath string,
-	remotePath string) (err error) {
-
-	/* Unfortunately, there doesn't appear to be an SFTP or SCP library, so
-	we'll just have to run a separate scp process.  This means no password
-	authentication for when calling this method. */
-	var stdout bytes.Buffer
-	var args []string = []string{}
-	var cmd *exec.Cmd
-	if recursive {
-		args = append(args, "-r")
-	}
-	args = append(args, fmt.Sprintf("-P"))
-	args = append(args, strconv.FormatUint(uint64(portNum), 10))
-	args = append(args, localPath)
-	args = append(args, fmt.Sprintf("%s@%s:%s", username, addr, remotePath))
-	cmd = exec.Command("scp", args...)
-	cmd.Stderr = &stdout
-	err = cmd.Run()
-	if err != nil {
-		return errors.New("scp to " + addr + " failed: " + err.Error())
-	}
-	return nil
-
-}
+	command string,
+	stdin io.Reader,
+	stdout io.Writer) (stderr string, err error) {
 
-// Secure copy (scp) from addr to localhost
-// Run a separate scp process (for now) to secure copy files between hosts.
-// The addr parameter is the address (IP, hostname, etc) of the remote host.
-// The privKeyPath parameter is the path to the private key of the master.
-// The portNum is the SSH port number of the remote host.
-// The incoming parameter indicates which direction to perform the copy.
-// The recursive parameter indicates whether to use the -r scp option.
-// Password authentication not supported for this function.
-// XXX: This function should probably go away in favor of a single Scp function when Issue #1 is fixed.
-func ScpFrom(
-	addr string,
-	username string,
-	portNum uint16,
-	recursive bool,
-	remotePath string,
-	localPath string) (err error) {
-
-	/* Unfortunately, there doesn't appear to be an SFTP or SCP library, so
-	we'll just have to run a separate scp process.  This means no password
-	authentication for when calling this method. */
-	var stdout bytes.Buffer
-	var args []string = []string{}
-	var cmd *exec.Cmd
-	if recursive {
-		args = append(args, "-r")
-	}
-	args = append(args, fmt.Sprintf("-P"))
-	args = append(args, strconv.FormatUint(uint64(portNum), 10))
-	args = append(args, fmt.Sprintf("%s@%s:%s", username, addr, remotePath))
-	args = append(args, localPath)
-	cmd = exec.Command("scp", args...)
-	cmd.Stderr = &stdout
-	err = cmd.Run()
+	session, err := getSession(addr, username, password, privKeyPath, portNum)
 	if err != nil {
-		return errors.New("scp to " + addr + "failed: " + err.Error())
+		return "", err
 	}
-	return nil
+	defer session.Close()
+
+	var stderr_buf bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = &stderr_buf
+	err = session.Run(command)
+	return stderr_buf.String(), err
 }
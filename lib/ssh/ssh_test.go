@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package ssh
+
+import (
+	"bytes"
+	"github.com/bgmerrell/geto/lib/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start an in-process SSH server, stopped by the returned function
+func startServer(t *testing.T) (*sshtest.Server, func()) {
+	s, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start SSH server: %s", err.Error())
+	}
+	return s, func() { s.Close() }
+}
+
+func TestRunWithPassword(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	stdout, stderr, err := Run(s.Addr, s.Username, &s.Password, "", s.Port,
+		"pwd; echo err >&2", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if strings.TrimSpace(stdout) != s.Dir || stderr != "err\n" {
+		t.Errorf("Unexpected output: %q and %q", stdout, stderr)
+	}
+}
+
+func TestRunWithKey(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	stdout, _, err := Run(s.Addr, s.Username, nil, s.PrivKeyPath, s.Port, "echo hi", 0)
+	if err != nil || stdout != "hi\n" {
+		t.Errorf("Unexpected output: %q (%v)", stdout, err)
+	}
+}
+
+func TestRunWithBadCredentials(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	wrong := "wrong"
+	if _, _, err := Run(s.Addr, s.Username, &wrong, "", s.Port, "true", 0); err == nil {
+		t.Errorf("Expected a wrong password to fail")
+	}
+	if _, _, err := Run(s.Addr, "nobody", &s.Password, "", s.Port, "true", 0); err == nil {
+		t.Errorf("Expected a wrong user to fail")
+	}
+	_, _, err := Run(s.Addr, s.Username, nil, "", s.Port, "true", 0)
+	if err == nil || err.Error() != "No authorization methods provided" {
+		t.Errorf("Expected no authorization methods to fail, got %v", err)
+	}
+}
+
+func TestRunExitStatus(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	stdout, stderr, err := Run(s.Addr, s.Username, &s.Password, "", s.Port,
+		"echo out; echo err >&2; exit 3", 0)
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok || exitErr.ExitStatus() != 3 {
+		t.Fatalf("Expected exit status 3, got %v", err)
+	}
+	if stdout != "out\n" || stderr != "err\n" {
+		t.Errorf("Expected the output of a failed command, got %q and %q", stdout, stderr)
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	stdout, _, err := Run(s.Addr, s.Username, &s.Password, "", s.Port, "echo hi", 5)
+	if err != nil || stdout != "hi\n" {
+		t.Errorf("Unexpected output: %q (%v)", stdout, err)
+	}
+}
+
+func TestRunWithIO(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	var stdout bytes.Buffer
+	stderr, err := RunWithIO(s.Addr, s.Username, &s.Password, "", s.Port,
+		"tr a-z A-Z", strings.NewReader("geto\n"), &stdout)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s (%s)", err.Error(), stderr)
+	}
+	if stdout.String() != "GETO\n" {
+		t.Errorf("Expected GETO, got %q", stdout.String())
+	}
+}
+
+func TestTestConnection(t *testing.T) {
+	s, stop := startServer(t)
+	if err := TestConnection(s.Addr, s.Username, &s.Password, "", s.Port); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	stop()
+	if err := TestConnection(s.Addr, s.Username, &s.Password, "", s.Port); err == nil {
+		t.Errorf("Expected connecting to a stopped server to fail")
+	}
+}
+
+func TestRunWithTimeoutKillsProcessGroup(t *testing.T) {
+	s, stop := startServer(t)
+	defer stop()
+	// A process of the same command that isn't the one timing out
+	command := "(sleep 2; touch done) & wait"
+	other := exec.Command("sh", "-c", command)
+	other.Dir = t.TempDir()
+	if err := other.Start(); err != nil {
+		t.Fatalf("Failed to start a process: %s", err.Error())
+	}
+
+	start := time.Now()
+	_, _, err := Run(s.Addr, s.Username, &s.Password, "", s.Port, command, 1)
+	if err == nil || err.Error() != "timeout" || time.Since(start) > 2*time.Second {
+		t.Fatalf("Expected a timeout after 1 second, got %v after %s", err, time.Since(start))
+	}
+	if err = other.Wait(); err != nil {
+		t.Errorf("Expected the other process to be left alone, got %s", err.Error())
+	}
+	// The timed out command's children were killed with it
+	if _, err = os.Stat(filepath.Join(s.Dir, "done")); !os.IsNotExist(err) {
+		t.Errorf("Expected the command's children to be killed, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(other.Dir, "done")); err != nil {
+		t.Errorf("Expected the other process to finish: %s", err.Error())
+	}
+	if paths, _ := filepath.Glob(REMOTE_PID_DIR + "/geto-run.*"); len(paths) != 0 {
+		t.Errorf("Expected the process records to be removed, got %v", paths)
+	}
+}
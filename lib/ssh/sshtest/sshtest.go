@@ -0,0 +1,259 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Provide an in-process SSH server for tests, so that the SSH client and the
+task runner can be tested without any external machines.
+
+The server listens on localhost and runs each exec request with the local sh
+in the server's directory, as the user running the tests.  Files are
+transferred by running commands (e.g., tar or "scp -t"), the same as with a
+real host.  Shells, ptys and subsystems (e.g., sftp) aren't supported.
+
+	s, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	stdout, stderr, err := ssh.Run(s.Addr, s.Username, &s.Password, "", s.Port, "echo hi", 0)
+*/
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// The user that the server accepts
+const USERNAME = "geto"
+
+// An in-process SSH server
+type Server struct {
+	// The address and port that the server listens on
+	Addr string
+	Port uint16
+	// The user and password that the server accepts
+	Username string
+	Password string
+	// The path of a private key (in PEM) that the server accepts
+	PrivKeyPath string
+	// The directory that commands are run in, removed by Close
+	Dir string
+
+	config    *ssh.ServerConfig
+	listener  net.Listener
+	lock      sync.Mutex
+	conns     map[net.Conn]bool
+	waitGroup sync.WaitGroup
+}
+
+// Start a server on a random localhost port with a new password, client key
+// and directory
+func NewServer() (*Server, error) {
+	dirPath, err := ioutil.TempDir("", "geto-sshtest")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Addr: "127.0.0.1", Username: USERNAME, Dir: dirPath,
+		conns: map[net.Conn]bool{}}
+	if err = s.start(); err != nil {
+		os.RemoveAll(dirPath)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) start() error {
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return err
+	}
+	s.Password = fmt.Sprintf("%x", password)
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return err
+	}
+	clientPublicKey, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	authorizedKey, err := ssh.NewPublicKey(clientPublicKey)
+	if err != nil {
+		return err
+	}
+	if s.PrivKeyPath, err = writePrivateKey(s.Dir, clientKey); err != nil {
+		return err
+	}
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == s.Username &&
+				subtle.ConstantTimeCompare(password, []byte(s.Password)) == 1 {
+				return nil, nil
+			}
+			return nil, errors.New("Wrong user or password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == s.Username &&
+				subtle.ConstantTimeCompare(key.Marshal(), authorizedKey.Marshal()) == 1 {
+				return nil, nil
+			}
+			return nil, errors.New("Unknown user or key")
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+
+	if s.listener, err = net.Listen("tcp", s.Addr+":0"); err != nil {
+		return err
+	}
+	s.Port = uint16(s.listener.Addr().(*net.TCPAddr).Port)
+	s.waitGroup.Add(1)
+	go s.serve()
+	return nil
+}
+
+// Write a private key where only its owner can read it and return its path
+func writePrivateKey(dirPath string, key ed25519.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dirPath, "id_ed25519")
+	content := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return path, ioutil.WriteFile(path, content, 0600)
+}
+
+// Stop the server, close its connections and remove its directory
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.waitGroup.Wait()
+	os.RemoveAll(s.Dir)
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.waitGroup.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		s.waitGroup.Add(1)
+		go func() {
+			defer s.waitGroup.Done()
+			s.handleConn(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+	var sessions sync.WaitGroup
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			s.handleSession(channel, channelRequests)
+		}()
+	}
+	sessions.Wait()
+}
+
+// Serve a session's requests until it runs a command
+func (s *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		switch request.Type {
+		case "env":
+			// The command gets the server's environment
+			request.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			status := struct{ Status uint32 }{s.run(payload.Command, channel)}
+			channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+			return
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+// Run a command with the channel as its stdin, stdout and stderr and return
+// its exit status
+func (s *Server) run(command string, channel ssh.Channel) uint32 {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = s.Dir
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 255
+	}
+	if err = cmd.Start(); err != nil {
+		fmt.Fprintln(channel.Stderr(), err.Error())
+		return 127
+	}
+	// The command might not read all of its stdin, so its copying isn't
+	// waited for.
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	if err = cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+			return uint32(exitErr.ExitCode())
+		}
+		return 255
+	}
+	return 0
+}
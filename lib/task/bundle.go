@@ -0,0 +1,160 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Provide the script bundle structure and functions.
+*/
+package task
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The mode given to bundle files that don't specify one
+const DEFAULT_BUNDLE_FILE_MODE = 0644
+
+// A file that is part of a script bundle
+type BundleFile struct {
+	// The contents of the file
+	Content []byte
+	// The permission bits of the file.  Executable bits are preserved
+	// when the bundle is packaged into the task directory.  A zero value
+	// means DEFAULT_BUNDLE_FILE_MODE.
+	Mode os.FileMode
+}
+
+// A script bundle is a set of files (e.g., a main script and the helper
+// modules it uses) along with an entrypoint, which is the file that actually
+// gets run on the target host.
+type Bundle struct {
+	// The files that make up the bundle, keyed by slash-separated path
+	// relative to the root of the bundle
+	files map[string]BundleFile
+	// The path (relative to the root of the bundle) of the file to run
+	entrypoint string
+}
+
+// Create a bundle from an in-memory map of relative file paths to files.
+// The entrypoint must be one of the keys in files.
+func NewBundle(files map[string]BundleFile, entrypoint string) (Bundle, error) {
+	b := Bundle{map[string]BundleFile{}, ""}
+	for p, f := range files {
+		cleaned, err := cleanBundlePath(p)
+		if err != nil {
+			return b, err
+		}
+		if _, ok := b.files[cleaned]; ok {
+			return b, errors.New(fmt.Sprintf(
+				"Duplicate bundle file path: %s", p))
+		}
+		b.files[cleaned] = f
+	}
+
+	cleaned, err := cleanBundlePath(entrypoint)
+	if err != nil {
+		return b, err
+	}
+	if _, ok := b.files[cleaned]; !ok {
+		return b, errors.New(fmt.Sprintf(
+			"Bundle entrypoint not found: %s", entrypoint))
+	}
+	b.entrypoint = cleaned
+	return b, nil
+}
+
+// Create a bundle from the contents of a local directory.  Every regular
+// file under dirPath becomes part of the bundle (with its permission bits)
+// and entrypoint is the path of the file to run, relative to dirPath.
+// Symbolic links to files are followed, but a symbolic link to a directory is
+// an error, since its files wouldn't be in the bundle.
+func NewBundleFromDir(dirPath string, entrypoint string) (Bundle, error) {
+	files := map[string]BundleFile{}
+	err := filepath.Walk(dirPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Follow symbolic links so that the bundle contains the
+		// linked-to contents.  Walk doesn't descend into linked
+		// directories, so they're refused rather than left out.
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(p); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return errors.New(fmt.Sprintf(
+					"Symbolic link to a directory in bundle: %s", p))
+			}
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return errors.New(fmt.Sprintf(
+				"Unsupported file type in bundle: %s", p))
+		}
+		rel, err := filepath.Rel(dirPath, p)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = BundleFile{content, info.Mode().Perm()}
+		return nil
+	})
+	if err != nil {
+		return Bundle{}, errors.New(fmt.Sprintf(
+			"Failed to read bundle directory: %s", err.Error()))
+	}
+	return NewBundle(files, entrypoint)
+}
+
+// Return the entrypoint path (slash-separated, relative to the bundle root)
+func (b *Bundle) Entrypoint() string {
+	return b.entrypoint
+}
+
+// Write the bundle's files beneath dirPath, preserving permission bits.
+// The entrypoint is always made executable by its owner.
+func (b *Bundle) write(dirPath string) error {
+	for p, f := range b.files {
+		filePath := filepath.Join(dirPath, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		mode := f.Mode.Perm()
+		if mode == 0 {
+			mode = DEFAULT_BUNDLE_FILE_MODE
+		}
+		if p == b.entrypoint {
+			mode |= 0100
+		}
+		if err := ioutil.WriteFile(filePath, f.Content, mode); err != nil {
+			return err
+		}
+		// WriteFile is subject to the umask (and doesn't touch the
+		// mode of an existing file), so set the mode explicitly.
+		if err := os.Chmod(filePath, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clean a bundle file path, making sure that it stays inside the bundle
+func cleanBundlePath(p string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(p))
+	if p == "" || cleaned == "." || path.IsAbs(cleaned) ||
+		cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.New(fmt.Sprintf("Invalid bundle file path: %q", p))
+	}
+	return cleaned, nil
+}
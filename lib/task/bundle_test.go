@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getTestBundleFiles() map[string]BundleFile {
+	return map[string]BundleFile{
+		"main.sh":        BundleFile{[]byte("#!/bin/bash\n. lib/helper.sh\n"), 0755},
+		"lib/helper.sh":  BundleFile{[]byte("greet() { echo hi; }\n"), 0644},
+		"bin/tool":       BundleFile{[]byte("#!/bin/sh\ntrue\n"), 0750},
+		"data/input.txt": BundleFile{[]byte("input\n"), 0},
+	}
+}
+
+func TestNewBundle(t *testing.T) {
+	b, err := NewBundle(getTestBundleFiles(), "./main.sh")
+	if err != nil {
+		t.Fatalf("Failed to create bundle: %s", err.Error())
+	}
+	if b.Entrypoint() != "main.sh" {
+		t.Errorf("Expected entrypoint \"main.sh\", got \"%s\"", b.Entrypoint())
+	}
+}
+
+func TestNewBundleWithMissingEntrypoint(t *testing.T) {
+	if _, err := NewBundle(getTestBundleFiles(), "missing.sh"); err == nil {
+		t.Errorf("Creating a bundle with a missing entrypoint should fail")
+	}
+}
+
+func TestNewBundleWithInvalidPaths(t *testing.T) {
+	for _, p := range []string{"../escape.sh", "/etc/passwd", "a/../../b", ""} {
+		files := getTestBundleFiles()
+		files[p] = BundleFile{[]byte("true\n"), 0755}
+		if _, err := NewBundle(files, "main.sh"); err == nil {
+			t.Errorf("Creating a bundle with file path %q should fail", p)
+		}
+	}
+}
+
+func TestNewBundleFromDir(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "geto-bundle-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+	if err = (&Bundle{getTestBundleFiles(), "main.sh"}).write(dirPath); err != nil {
+		t.Fatalf("Failed to write bundle: %s", err.Error())
+	}
+
+	b, err := NewBundleFromDir(dirPath, "main.sh")
+	if err != nil {
+		t.Fatalf("Failed to create bundle from directory: %s", err.Error())
+	}
+	expected := getTestBundleFiles()
+	if len(b.files) != len(expected) {
+		t.Fatalf("Expected %d bundle files, got %d", len(expected), len(b.files))
+	}
+	f, ok := b.files["bin/tool"]
+	if !ok {
+		t.Fatalf("Missing bundle file \"bin/tool\"")
+	}
+	if f.Mode != 0750 {
+		t.Errorf("Expected mode %o for \"bin/tool\", got %o", 0750, f.Mode)
+	}
+	if string(f.Content) != string(expected["bin/tool"].Content) {
+		t.Errorf("Unexpected contents for \"bin/tool\": %q", f.Content)
+	}
+}
+
+func TestNewBundleFromDirWithLinks(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "geto-bundle-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+	if err = (&Bundle{getTestBundleFiles(), "main.sh"}).write(dirPath); err != nil {
+		t.Fatalf("Failed to write bundle: %s", err.Error())
+	}
+
+	// A linked file is bundled with the linked-to contents
+	if err = os.Symlink("helper.sh", filepath.Join(dirPath, "lib", "alias.sh")); err != nil {
+		t.Fatalf("Failed to create link: %s", err.Error())
+	}
+	b, err := NewBundleFromDir(dirPath, "main.sh")
+	if err != nil {
+		t.Fatalf("Failed to create bundle from directory: %s", err.Error())
+	}
+	if f, ok := b.files["lib/alias.sh"]; !ok || string(f.Content) != "greet() { echo hi; }\n" {
+		t.Errorf("Expected the linked file to be bundled, got %q", f.Content)
+	}
+
+	// A linked directory is refused, naming the link
+	linkPath := filepath.Join(dirPath, "linked-lib")
+	if err = os.Symlink("lib", linkPath); err != nil {
+		t.Fatalf("Failed to create link: %s", err.Error())
+	}
+	if _, err = NewBundleFromDir(dirPath, "main.sh"); err == nil ||
+		!strings.Contains(err.Error(), linkPath) {
+		t.Errorf("Expected an error naming %s, got %v", linkPath, err)
+	}
+}
+
+func TestTaskCreateDirWithBundle(t *testing.T) {
+	b, err := NewBundle(getTestBundleFiles(), "main.sh")
+	if err != nil {
+		t.Fatalf("Failed to create bundle: %s", err.Error())
+	}
+	task, err := New([]string{}, NewScriptFromBundle(TEST_NAME, b, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	taskDirPath, err := task.CreateDir()
+	if err != nil {
+		t.Fatalf("Failed to create directory from Task: " + err.Error())
+	}
+	defer os.RemoveAll(taskDirPath)
+
+	expectedModes := map[string]os.FileMode{
+		"main.sh":        0755,
+		"lib/helper.sh":  0644,
+		"bin/tool":       0750,
+		"data/input.txt": DEFAULT_BUNDLE_FILE_MODE,
+	}
+	for p, expected := range expectedModes {
+		info, err := os.Stat(filepath.Join(
+			taskDirPath, task.getScriptFileName(), filepath.FromSlash(p)))
+		if err != nil {
+			t.Errorf("Missing bundle file %s: %s", p, err.Error())
+			continue
+		}
+		if info.Mode().Perm() != expected {
+			t.Errorf("Expected mode %o for %s, got %o",
+				expected, p, info.Mode().Perm())
+		}
+	}
+
+	expectedPath := filepath.Join(
+		task.getRemoteDirPath(), task.getScriptFileName(), "main.sh")
+	if task.getRemoteScriptPath() != expectedPath {
+		t.Errorf("Expected remote script path %s, got %s",
+			expectedPath, task.getRemoteScriptPath())
+	}
+}
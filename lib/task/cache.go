@@ -0,0 +1,247 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Cache task dependencies on the target hosts by content.
+
+When the config sets remote_cache_path, the files of a task's DepFiles are
+not copied with the task directory.  Instead, each file is stored once per
+host as a blob named by its SHA-256 in the "blobs" subdirectory of the cache,
+only the blobs that the host doesn't have are uploaded, and the task's DEPS
+directory is populated with hard links to the blobs.  Where a blob can't be
+hard linked (e.g., the cache is on another file system than the remote work
+directory), it's copied on the host instead; a symbolic link would leave
+nothing to keep the blob from being evicted while the task uses it.  Blobs
+are read-only since they are shared by every task that links to them.
+
+The modification time of a blob is updated whenever a task uses it, and the
+least recently used blobs are evicted once the cache is over the config's
+remote_cache_max_size.  Blobs that are hard linked from a task directory are
+never evicted.  All of this is done while holding the remote runner lock.
+
+Tasks that share a blob share its inode, so a task that runs as the user
+owning the cache could make a blob writable and change it for every later
+task; such a task could as well write to the cache directory itself.  Tasks
+are thus trusted with the cache, unless they run as another user (see
+Task.RunAs), who can't change the mode of the blobs.
+*/
+package task
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/shell"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A file of a task's dependencies
+type depFile struct {
+	// The path of the file relative to the DEPS directory
+	relPath string
+	// The local path of the file
+	localPath string
+	// The name of the file's blob in the cache
+	blob string
+}
+
+// A local file's hash, valid as long as the file's size and modification
+// time don't change
+type hashCacheEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// Hashing a large dependency takes a while, so hashes are remembered for the
+// life of the process.
+var hashCache map[string]hashCacheEntry = map[string]hashCacheEntry{}
+var hashCacheLock sync.Mutex
+
+// Return the hex-encoded SHA-256 of a local file, from the hash cache if
+// the file hasn't changed
+func hashFile(path string, info os.FileInfo) (string, error) {
+	hashCacheLock.Lock()
+	entry, ok := hashCache[path]
+	hashCacheLock.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+
+	hashCacheLock.Lock()
+	hashCache[path] = hashCacheEntry{info.Size(), info.ModTime(), sum}
+	hashCacheLock.Unlock()
+	return sum, nil
+}
+
+// Return the blob name of a file.  Executable files get their own blobs since
+// the links to a blob share its mode.
+func getBlobName(sum string, mode os.FileMode) string {
+	if mode&0111 != 0 {
+		return sum + ".x"
+	}
+	return sum
+}
+
+// Return the files and directories of the task's dependencies, laid out the
+// same as they would be by CreateDir
+func (t *Task) getDepFiles() (files []depFile, dirs []string, err error) {
+	for _, depFilePath := range t.DepFiles {
+		base := filepath.Base(depFilePath)
+		err = filepath.Walk(depFilePath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(depFilePath, path)
+			if err != nil {
+				return err
+			}
+			relPath := filepath.ToSlash(filepath.Join(base, rel))
+			if info.Mode()&os.ModeSymlink != 0 {
+				// Follow links to files, like cp does
+				if info, err = os.Stat(path); err != nil {
+					return err
+				}
+			}
+			if info.IsDir() {
+				dirs = append(dirs, relPath)
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			sum, err := hashFile(path, info)
+			if err != nil {
+				return err
+			}
+			files = append(files, depFile{relPath, path, getBlobName(sum, info.Mode())})
+			return nil
+		})
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf(
+				"Failed to read file dependencies: %s", err.Error()))
+		}
+	}
+	return files, dirs, nil
+}
+
+// Return the blobs, of those given, that the host's cache doesn't have
+func getMissingBlobs(conn remote.Remote, host host.Host, blobs []string) (missing []string, err error) {
+	c := config.GetParsedConfig()
+	cacheDirPath := shell.Quote(c.RemoteCachePath)
+	// Blob names are hex digits (and ".x"), so they don't need quoting.
+	stdout, stderr, err := conn.Run(
+		host,
+		fmt.Sprintf(
+			"mkdir -p %[1]s/blobs %[1]s/tmp && cd %[1]s/blobs && "+
+				"for b in %[2]s; do [ -f \"$b\" ] || echo \"$b\"; done",
+			cacheDirPath, strings.Join(blobs, " ")),
+		0)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Failed to check the dependency cache: %s (%s)",
+			err.Error(), strings.TrimSpace(stderr)))
+	}
+	return strings.Fields(stdout), nil
+}
+
+// Return a shell command that evicts the least recently used blobs until the
+// cache is under its maximum size.  Blobs with more than one link are in use
+// by a task directory and are kept.
+func getCacheEviction() string {
+	c := config.GetParsedConfig()
+	return fmt.Sprintf(
+		"cd %s/blobs && set -- $(du -sk .) && total=$1 && "+
+			"for b in $(ls -tr); do "+
+			"[ $total -le %d ] && break; "+
+			"set -- $(ls -ln \"$b\"); [ $2 -gt 1 ] && continue; "+
+			"rm -f \"$b\" && total=$((total - ($5 + 1023) / 1024)); "+
+			"done; true",
+		shell.Quote(c.RemoteCachePath),
+		c.RemoteCacheMaxSize/1024)
+}
+
+// Upload the task's dependencies to the host's cache and populate the task's
+// remote DEPS directory from the cache.  The remote runner lock must be held.
+func populateDepsFromCache(conn remote.Remote, task Task, host host.Host) error {
+	c := config.GetParsedConfig()
+	files, dirs, err := task.getDepFiles()
+	if err != nil || (len(files) == 0 && len(dirs) == 0) {
+		return err
+	}
+
+	var blobs []string
+	localPaths := map[string]string{}
+	for _, f := range files {
+		if _, ok := localPaths[f.blob]; !ok {
+			blobs = append(blobs, f.blob)
+			localPaths[f.blob] = f.localPath
+		}
+	}
+	missing, err := getMissingBlobs(conn, host, blobs)
+	if err != nil {
+		return err
+	}
+
+	// Upload to a temporary name and then move into place so that a
+	// partially uploaded blob is never used.
+	commands := []string{"set -e"}
+	for _, blob := range missing {
+		tmpPath := filepath.Join(c.RemoteCachePath, "tmp", blob+"."+task.Id)
+		if err = conn.CopyTo(host, false, localPaths[blob], tmpPath); err != nil {
+			return newRunError(PhaseUpload, ErrTransfer, errors.New(fmt.Sprintf(
+				"Failed to upload %s to the dependency cache: %s",
+				localPaths[blob], err.Error())))
+		}
+		mode := "0444"
+		if strings.HasSuffix(blob, ".x") {
+			mode = "0555"
+		}
+		commands = append(commands,
+			shell.Command("chmod", mode, tmpPath),
+			shell.Command("mv", "-f", tmpPath, filepath.Join(c.RemoteCachePath, "blobs", blob)))
+	}
+
+	depsDirPath := filepath.Join(task.getRemoteDirPath(), "DEPS")
+	commands = append(commands, shell.Command("cd", depsDirPath))
+	for _, dir := range dirs {
+		commands = append(commands, shell.Command("mkdir", "-p", dir))
+	}
+	for _, f := range files {
+		blobPath := filepath.Join(c.RemoteCachePath, "blobs", f.blob)
+		commands = append(commands,
+			fmt.Sprintf("%s 2>/dev/null || %s",
+				shell.Command("ln", blobPath, f.relPath),
+				shell.Command("cp", blobPath, f.relPath)),
+			shell.Command("touch", "-c", blobPath))
+	}
+	commands = append(commands, getCacheEviction())
+
+	_, stderr, err := conn.Run(host, strings.Join(commands, "\n"), 0)
+	if err != nil {
+		return errors.New(fmt.Sprintf(
+			"Failed to populate DEPS from the dependency cache: %s (%s)",
+			err.Error(), strings.TrimSpace(stderr)))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use the config at path, starting with an empty dependency cache if it has
+// one.  The returned function restores the test config.
+func useConfig(t *testing.T, path string) func() {
+	c, err := config.ParseConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %s", path, err.Error())
+	}
+	if c.RemoteCachePath != "" {
+		os.RemoveAll(c.RemoteCachePath)
+	}
+	return func() {
+		if c.RemoteCachePath != "" {
+			os.RemoveAll(c.RemoteCachePath)
+		}
+		if _, err := config.ParseConfig("../../test/data/geto.ini"); err != nil {
+			t.Fatalf("Failed to parse test config: %s", err.Error())
+		}
+	}
+}
+
+// Create a dependency directory with the given files (relative path to
+// content); files whose name starts with "x" are executable
+func createDepDir(t *testing.T, files map[string]string) string {
+	dirPath, err := ioutil.TempDir("", "geto-deps")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for relPath, content := range files {
+		path := filepath.Join(dirPath, relPath)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		mode := os.FileMode(0644)
+		if strings.HasPrefix(filepath.Base(relPath), "x") {
+			mode = 0755
+		}
+		if err = ioutil.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	return dirPath
+}
+
+// Run a task with the given dependencies and return its output and the
+// number of files copied to the host
+func runCachedDepsTask(t *testing.T, depFiles []string, commands []string) (Task, RunOutput, int) {
+	task, err := New(depFiles, NewScriptWithCommands("test-cache", commands, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	resetCapabilitiesCache()
+	conn := fake.NewLocal()
+	ch := make(chan RunOutput)
+	go RunOnHost(conn, task, config.GetParsedConfig().Hosts[0], ch)
+	output := <-ch
+	return task, output, len(conn.CallsTo("CopyTo")) + len(conn.CallsTo("CopyArchiveTo"))
+}
+
+func getBlobPath(content string, executable bool) string {
+	blob := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	if executable {
+		blob += ".x"
+	}
+	return filepath.Join(config.GetParsedConfig().RemoteCachePath, "blobs", blob)
+}
+
+func TestRunWithDepsFromCache(t *testing.T) {
+	defer useConfig(t, "../../test/data/geto-cache.ini")()
+	depDirPath := createDepDir(t, map[string]string{
+		"a": "apple\n", "sub/b": "banana\n", "sub/a": "apple\n", "xrun": "#!/bin/sh\n"})
+	defer os.RemoveAll(depDirPath)
+	dep := filepath.Base(depDirPath)
+	commands := []string{
+		fmt.Sprintf("cat DEPS/%s/a DEPS/%s/sub/b DEPS/%s/sub/a", dep, dep, dep),
+		fmt.Sprintf("[ -x DEPS/%s/xrun ] && echo executable", dep)}
+
+	task, output, nCopies := runCachedDepsTask(t, []string{depDirPath}, commands)
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+	if output.Stdout != "apple\nbanana\napple\nexecutable\n" {
+		t.Errorf("Unexpected stdout: %q", output.Stdout)
+	}
+	// The task and wrapper directories, and one upload per blob
+	if nCopies != 5 {
+		t.Errorf("Expected 5 copies to the host, got %d", nCopies)
+	}
+	for _, path := range []string{getBlobPath("apple\n", false), getBlobPath("#!/bin/sh\n", true)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected blob %s in the cache", path)
+		}
+	}
+	localDepPath := filepath.Join(config.GetParsedConfig().LocalWorkPath, task.Id, "DEPS", dep)
+	if _, err := os.Stat(localDepPath); err == nil {
+		t.Errorf("Expected the dependencies not to be copied into %s", localDepPath)
+	}
+
+	// The blobs are already on the host this time around
+	_, output, nCopies = runCachedDepsTask(t, []string{depDirPath}, commands)
+	if output.Err != nil || nCopies != 2 {
+		t.Errorf("Expected 2 copies to the host, got %d (%v)", nCopies, output.Err)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	defer useConfig(t, "../../test/data/geto-cache.ini")()
+	// The cache is limited to 64 KiB
+	old := strings.Repeat("o", 40<<10)
+	recent := strings.Repeat("r", 40<<10)
+	oldDirPath := createDepDir(t, map[string]string{"old": old})
+	defer os.RemoveAll(oldDirPath)
+	recentDirPath := createDepDir(t, map[string]string{"recent": recent})
+	defer os.RemoveAll(recentDirPath)
+
+	task, output, _ := runCachedDepsTask(t, []string{oldDirPath}, []string{"true"})
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+	// The old blob is in use until its task directory is removed
+	os.RemoveAll(task.getRemoteDirPath())
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(getBlobPath(old, false), past, past)
+
+	_, output, _ = runCachedDepsTask(t, []string{recentDirPath}, []string{"true"})
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+	if _, err := os.Stat(getBlobPath(old, false)); err == nil {
+		t.Errorf("Expected the least recently used blob to be evicted")
+	}
+	if _, err := os.Stat(getBlobPath(recent, false)); err != nil {
+		t.Errorf("Expected the blob in use to be kept")
+	}
+}
@@ -0,0 +1,159 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Probe target hosts for the optional tools that tasks can make use of.
+
+Only a POSIX shell is required on a target host; anything else is detected
+per host by running a probe command, and the wrapper script is generated
+according to what was found.  Probe results are cached for the life of the
+process.
+*/
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The capabilities of a target host
+type Capabilities struct {
+	// A timeout command that supports --kill-after (e.g., GNU coreutils)
+	Timeout bool
+	// A setsid command, used to run a task in its own process group
+	Setsid bool
+	// Perl, used to run a task in its own process group when there's no
+	// setsid command
+	Perl bool
+	// A systemd-run command that can create scopes for the user, used to
+	// apply cgroup resource limits
+	SystemdRun bool
+	// The docker and podman container runtimes, used to run tasks in a
+	// container (see Task.Container)
+	Docker bool
+	Podman bool
+	// tar and gzip, used to copy task directories as a single archive
+	// stream instead of file by file
+	Tar bool
+}
+
+// The probe command prints the name of each capability that the host has,
+// one per line.
+var capabilityProbes = []struct {
+	name  string
+	probe string
+	set   func(c *Capabilities)
+}{
+	{"timeout", "timeout --kill-after=1 1 true",
+		func(c *Capabilities) { c.Timeout = true }},
+	{"setsid", "command -v setsid",
+		func(c *Capabilities) { c.Setsid = true }},
+	{"perl", "command -v perl",
+		func(c *Capabilities) { c.Perl = true }},
+	{"systemd-run", "systemd-run --user --scope --quiet true",
+		func(c *Capabilities) { c.SystemdRun = true }},
+	{"docker", "command -v docker",
+		func(c *Capabilities) { c.Docker = true }},
+	{"podman", "command -v podman",
+		func(c *Capabilities) { c.Podman = true }},
+	{"tar", "{ command -v tar && command -v gzip; }",
+		func(c *Capabilities) { c.Tar = true }},
+}
+
+var capabilitiesCache map[string]Capabilities = map[string]Capabilities{}
+var capabilitiesCacheLock sync.Mutex
+
+// Probe a host for its capabilities
+func ProbeCapabilities(conn remote.Remote, host host.Host) (caps Capabilities, err error) {
+	probes := make([]string, len(capabilityProbes))
+	for i, p := range capabilityProbes {
+		probes[i] = fmt.Sprintf("if %s >/dev/null 2>&1; then echo %s; fi",
+			p.probe, p.name)
+	}
+	stdout, stderr, err := conn.Run(host, strings.Join(probes, "; "), 0)
+	if err != nil {
+		return caps, errors.New(fmt.Sprintf(
+			"Failed to probe capabilities of host %s: %s (%s)",
+			host.Name, err.Error(), strings.TrimSpace(stderr)))
+	}
+	return parseCapabilities(stdout), nil
+}
+
+// Parse the output of the probe command
+func parseCapabilities(output string) (caps Capabilities) {
+	for _, line := range strings.Split(output, "\n") {
+		for _, p := range capabilityProbes {
+			if strings.TrimSpace(line) == p.name {
+				p.set(&caps)
+			}
+		}
+	}
+	return caps
+}
+
+// Return the names of the capabilities, as printed by the probe command
+func (c Capabilities) Names() (names []string) {
+	for _, p := range capabilityProbes {
+		with := c
+		p.set(&with)
+		if with == c {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// Return the capabilities of a host, probing the host if it hasn't been
+// probed already
+func getCapabilities(conn remote.Remote, host host.Host) (caps Capabilities, err error) {
+	capabilitiesCacheLock.Lock()
+	caps, ok := capabilitiesCache[host.Name]
+	capabilitiesCacheLock.Unlock()
+	if ok {
+		return caps, nil
+	}
+
+	if caps, err = ProbeCapabilities(conn, host); err != nil {
+		return caps, err
+	}
+
+	capabilitiesCacheLock.Lock()
+	capabilitiesCache[host.Name] = caps
+	capabilitiesCacheLock.Unlock()
+	return caps, nil
+}
+
+// What's known of a target host
+type HostFacts struct {
+	// The operating system, its release and the machine (uname -srm)
+	System string
+	// The number of online processors
+	CPUs int
+	Capabilities
+}
+
+// Probe a host for its facts
+func GetHostFacts(conn remote.Remote, host host.Host) (facts HostFacts, err error) {
+	stdout, stderr, err := conn.Run(host,
+		"uname -srm; getconf _NPROCESSORS_ONLN 2>/dev/null || echo 0", 0)
+	if err != nil {
+		return facts, errors.New(fmt.Sprintf(
+			"Failed to get facts of host %s: %s (%s)",
+			host.Name, err.Error(), strings.TrimSpace(stderr)))
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	facts.System = strings.TrimSpace(lines[0])
+	if len(lines) > 1 {
+		facts.CPUs, _ = strconv.Atoi(strings.TrimSpace(lines[1]))
+	}
+	if facts.Capabilities, err = ProbeCapabilities(conn, host); err != nil {
+		return facts, err
+	}
+	return facts, nil
+}
@@ -0,0 +1,142 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Capabilities of the different kinds of hosts that tasks should run on
+var testCapabilities = map[string]Capabilities{
+	"coreutils":  Capabilities{Timeout: true, Setsid: true, Perl: true},
+	"busybox":    Capabilities{Setsid: true},
+	"bsd":        Capabilities{Perl: true},
+	"shell-only": Capabilities{},
+}
+
+// Return script commands that sleep for a long time.  With a process group,
+// the sleep is run as a child of the script to check that the task's
+// children are killed too.
+func getLongSleepCommands(caps Capabilities) []string {
+	if caps.Timeout || caps.Setsid || caps.Perl {
+		return []string{"sleep 30 &", "wait"}
+	}
+	return []string{"exec sleep 30"}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	expected := Capabilities{Timeout: true, Perl: true}
+	actual := parseCapabilities("timeout\nperl\nbogus\n")
+	if actual != expected {
+		t.Errorf("Expected %#v, got %#v", expected, actual)
+	}
+	if names := actual.Names(); !reflect.DeepEqual(names, []string{"timeout", "perl"}) {
+		t.Errorf("Unexpected capability names: %v", names)
+	}
+	if actual = parseCapabilities(""); actual != (Capabilities{}) {
+		t.Errorf("Expected no capabilities, got %#v", actual)
+	}
+}
+
+func TestGetCapabilitiesIsCached(t *testing.T) {
+	h := config.GetParsedConfig().Hosts[0]
+	capabilitiesCacheLock.Lock()
+	capabilitiesCache[h.Name] = testCapabilities["bsd"]
+	capabilitiesCacheLock.Unlock()
+	defer func() {
+		capabilitiesCacheLock.Lock()
+		delete(capabilitiesCache, h.Name)
+		capabilitiesCacheLock.Unlock()
+	}()
+
+	caps, err := getCapabilities(fake.NewLocal(), h)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if caps != testCapabilities["bsd"] {
+		t.Errorf("Expected cached capabilities %#v, got %#v",
+			testCapabilities["bsd"], caps)
+	}
+}
+
+func TestTimeoutWithCapabilities(t *testing.T) {
+	for kind, caps := range testCapabilities {
+		task, err := New([]string{},
+			NewScriptWithCommands("test-timeout", getLongSleepCommands(caps), nil), 1)
+		if err != nil {
+			t.Fatalf("Failed to create new Task: " + err.Error())
+		}
+		start := time.Now()
+		task = startLocalTaskWithCapabilities(t, task, caps)
+		status := waitForLocalTask(t, task)
+		if status.State != StateExited || status.ExitCode != TIMED_OUT_EXIT_CODE || !status.TimedOut {
+			t.Errorf("%s: expected state %s with exit code %d, got %#v",
+				kind, StateExited, TIMED_OUT_EXIT_CODE, status)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: timing out took %.1f seconds", kind, elapsed.Seconds())
+		}
+
+		// A script that exits with timeout's exit code didn't time out
+		task, err = New([]string{},
+			NewScriptWithCommands("test-timeout", []string{"exit 124"}, nil), 10)
+		if err != nil {
+			t.Fatalf("Failed to create new Task: " + err.Error())
+		}
+		task = startLocalTaskWithCapabilities(t, task, caps)
+		if status = waitForLocalTask(t, task); status.ExitCode != TIMED_OUT_EXIT_CODE || status.TimedOut {
+			t.Errorf("%s: expected exit code %d without a timeout, got %#v",
+				kind, TIMED_OUT_EXIT_CODE, status)
+		}
+	}
+}
+
+func TestNoTimeoutWithCapabilities(t *testing.T) {
+	for kind, caps := range testCapabilities {
+		task, err := New([]string{},
+			NewScriptWithCommands("test-no-timeout", []string{"exit 7"}, nil), 0)
+		if err != nil {
+			t.Fatalf("Failed to create new Task: " + err.Error())
+		}
+		task = startLocalTaskWithCapabilities(t, task, caps)
+		status := waitForLocalTask(t, task)
+		if status.State != StateExited || status.ExitCode != 7 {
+			t.Errorf("%s: expected state %s with exit code 7, got %s with exit code %d",
+				kind, StateExited, status.State, status.ExitCode)
+		}
+	}
+}
+
+func TestKillWithCapabilities(t *testing.T) {
+	for kind, caps := range testCapabilities {
+		task, err := New([]string{},
+			NewScriptWithCommands("test-kill", getLongSleepCommands(caps), nil), 0)
+		if err != nil {
+			t.Fatalf("Failed to create new Task: " + err.Error())
+		}
+		task = startLocalTaskWithCapabilities(t, task, caps)
+		if err = Kill(fake.NewLocal(), task, config.GetParsedConfig().Hosts[0]); err != nil {
+			t.Errorf("%s: %s", kind, err.Error())
+		}
+		if status := waitForLocalTask(t, task); status.State != StateExited {
+			t.Errorf("%s: expected state %s after kill, got %s",
+				kind, StateExited, status.State)
+		}
+	}
+}
+
+func TestGetHostFacts(t *testing.T) {
+	facts, err := GetHostFacts(fake.NewLocal(), config.GetParsedConfig().Hosts[0])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if facts.System == "" || facts.CPUs < 1 {
+		t.Errorf("Unexpected facts: %#v", facts)
+	}
+}
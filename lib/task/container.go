@@ -0,0 +1,106 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Run a task's script inside a container on the target host.
+
+The task directory is bind-mounted into the container at the same path and
+is the container's working directory, so the script and the DEPS directory
+are found the same way as outside of a container.
+
+The script runs as the user that starts the container (the task's RunAs
+user, if any), so that the files it writes in the task directory can be
+cleaned up without root: with --user for docker, and with --userns=keep-id
+for rootless podman, whose root already is the user.  The container is named
+after the task so that it can be removed when the task times out or is
+killed, since signals can't always be passed on to it by the runtime's
+client.
+*/
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/shell"
+	"path"
+)
+
+// The container runtimes that geto knows how to find on a host
+const (
+	RUNTIME_DOCKER = "docker"
+	RUNTIME_PODMAN = "podman"
+)
+
+// A container that a task's script runs in
+type Container struct {
+	// The image to run the script in.  The image must have the script's
+	// interpreter and, if the task has resource limits, a POSIX sh.
+	Image string
+	// The container runtime command (a docker compatible CLI), "" to use
+	// docker or podman, whichever the host has
+	Runtime string
+}
+
+// Return the container runtime command to use on a host with the given
+// capabilities
+func (c *Container) getRuntime(caps Capabilities) (string, error) {
+	switch {
+	case c.Runtime != "":
+		return c.Runtime, nil
+	case caps.Docker:
+		return RUNTIME_DOCKER, nil
+	case caps.Podman:
+		return RUNTIME_PODMAN, nil
+	}
+	return "", errors.New("No container runtime (docker or podman) found")
+}
+
+// Return the name of the task's container
+func (t *Task) getContainerName() string {
+	return "geto-" + t.Id
+}
+
+// Return the shell command that starts the runtime, $0, with "run", the
+// option that makes the container run as the user starting it, and the rest
+// of the arguments, "$@".  The user is only known once the command runs on
+// the host (e.g., through sudo for Task.RunAs).
+func getContainerRunCommand(runtime string) string {
+	if path.Base(runtime) == RUNTIME_PODMAN {
+		// Rootful podman runs the container as root, the user
+		return `exec "$0" run $([ "$(id -u)" = 0 ] || echo --userns=keep-id) "$@"`
+	}
+	return `exec "$0" run --user "$(id -u):$(id -g)" "$@"`
+}
+
+// Return the command (as a list of words) that runs command in the task's
+// container with the given runtime
+func (t *Task) wrapContainer(command []string, runtime string) []string {
+	dirPath := t.getRemoteDirPath()
+	args := []string{"sh", "-c", getContainerRunCommand(runtime), runtime, "--rm",
+		"--name", t.getContainerName(),
+		"-v", dirPath + ":" + dirPath,
+		"-w", dirPath}
+	// The runtime applies the cgroup limits
+	if t.Limits.MemoryMax > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%d", t.Limits.MemoryMax))
+	}
+	if t.Limits.CPUQuota > 0 {
+		args = append(args, "--cpus",
+			fmt.Sprintf("%.2f", float64(t.Limits.CPUQuota)/100))
+	}
+	args = append(args, t.Container.Image)
+	return append(args, command...)
+}
+
+// Return a shell command that removes the task's container, if it is still
+// around, with the given runtime
+func (t *Task) getContainerCleanup(runtime string, host host.Host) string {
+	command := []string{runtime, "rm", "-f", t.getContainerName()}
+	if t.RunAs != "" {
+		// The container belongs to the task's user
+		command = append(t.getSudoCommand(host), command...)
+	}
+	return shell.Join(command) + " >/dev/null 2>&1"
+}
@@ -0,0 +1,177 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A stand-in for the docker CLI that runs the command on the host, with the
+// image in the CONTAINER_IMAGE environment variable.  Each call is logged to
+// the "log" file next to it.
+const FAKE_DOCKER = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir"/log
+case $1 in
+run)
+	shift
+	while [ $# -gt 0 ]; do
+		case $1 in
+		--rm|--userns=*) shift ;;
+		--name) name=$2; shift 2 ;;
+		-v|--memory|--cpus|--user) shift 2 ;;
+		-w) cd "$2" || exit 125; shift 2 ;;
+		*) break ;;
+		esac
+	done
+	CONTAINER_IMAGE=$1
+	export CONTAINER_IMAGE
+	shift
+	echo $$ > "$dir/$name.pid"
+	exec "$@"
+	;;
+rm)
+	pid=$(cat "$dir/$3.pid" 2>/dev/null) && kill -9 "$pid" 2>/dev/null
+	exit 0
+	;;
+esac
+exit 1
+`
+
+// Put a fake docker command first on the PATH.  The returned function
+// restores the PATH.
+func installFakeDocker(t *testing.T) (dirPath string, restore func()) {
+	dirPath, err := ioutil.TempDir("", "geto-docker")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(dirPath, "docker"), []byte(FAKE_DOCKER), 0755)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dirPath+":"+path)
+	resetCapabilitiesCache()
+	return dirPath, func() {
+		os.Setenv("PATH", path)
+		resetCapabilitiesCache()
+		os.RemoveAll(dirPath)
+	}
+}
+
+// Return the calls made to the fake docker command
+func readFakeDockerLog(t *testing.T, dirPath string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dirPath, "log"))
+	if err != nil {
+		t.Fatalf("Failed to read the fake docker log: %s", err.Error())
+	}
+	return string(content)
+}
+
+func TestGetContainerRuntime(t *testing.T) {
+	var tests = []struct {
+		runtime string
+		caps    Capabilities
+		result  string
+	}{
+		{"", Capabilities{Docker: true, Podman: true}, RUNTIME_DOCKER},
+		{"", Capabilities{Podman: true}, RUNTIME_PODMAN},
+		{"nerdctl", Capabilities{Docker: true}, "nerdctl"},
+	}
+	for _, test := range tests {
+		c := Container{Image: "alpine", Runtime: test.runtime}
+		runtime, err := c.getRuntime(test.caps)
+		if err != nil || runtime != test.result {
+			t.Errorf("Expected runtime %q for %#v, got %q (%v)",
+				test.result, test.caps, runtime, err)
+		}
+	}
+	c := Container{Image: "alpine"}
+	if _, err := c.getRuntime(Capabilities{Timeout: true}); err == nil {
+		t.Errorf("Expected an error without a container runtime")
+	}
+}
+
+func TestWrapContainer(t *testing.T) {
+	task := Task{Id: "test-task", Container: &Container{Image: "alpine"},
+		Limits: Limits{MemoryMax: 1 << 20, CPUQuota: 150}}
+	dirPath := task.getRemoteDirPath()
+	expected := []string{
+		"sh", "-c", `exec "$0" run $([ "$(id -u)" = 0 ] || echo --userns=keep-id) "$@"`,
+		"podman", "--rm", "--name", "geto-test-task",
+		"-v", dirPath + ":" + dirPath, "-w", dirPath,
+		"--memory", "1048576", "--cpus", "1.50",
+		"alpine", "sh", "script"}
+	actual := task.wrapContainer([]string{"sh", "script"}, RUNTIME_PODMAN)
+	if fmt.Sprintf("%#v", actual) != fmt.Sprintf("%#v", expected) {
+		t.Errorf("Unexpected command:\n"+
+			"Actual: %#v\n"+
+			"Expected: %#v",
+			actual, expected)
+	}
+
+	actual = task.wrapContainer([]string{"sh", "script"}, "/usr/bin/docker")
+	if actual[2] != `exec "$0" run --user "$(id -u):$(id -g)" "$@"` {
+		t.Errorf("Unexpected command: %#v", actual)
+	}
+}
+
+func TestRunInContainer(t *testing.T) {
+	dockerDirPath, restore := installFakeDocker(t)
+	defer restore()
+	depFilePath := filepath.Join(dockerDirPath, "dep")
+	if err := ioutil.WriteFile(depFilePath, []byte("dep\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	task, err := New([]string{depFilePath}, NewScriptWithCommands("test-container",
+		[]string{"echo \"$CONTAINER_IMAGE\"", "cat DEPS/dep"}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Container = &Container{Image: "alpine"}
+	output := runLocalTaskOnHost(t, task, config.GetParsedConfig().Hosts[0])
+	if output.Err != nil || output.ExitCode != 0 {
+		t.Fatalf("Unexpected output: %#v", output)
+	}
+	if output.Stdout != "alpine\ndep\n" {
+		t.Errorf("Expected the script to run in the container, got %q", output.Stdout)
+	}
+	log := readFakeDockerLog(t, dockerDirPath)
+	if !strings.Contains(log, "rm -f "+task.getContainerName()) {
+		t.Errorf("Expected the container to be removed, got calls:\n%s", log)
+	}
+	if user := fmt.Sprintf("run --user %d:%d ", os.Getuid(), os.Getgid()); !strings.Contains(log, user) {
+		t.Errorf("Expected the container to run as the user, got calls:\n%s", log)
+	}
+}
+
+func TestKillContainer(t *testing.T) {
+	dockerDirPath, restore := installFakeDocker(t)
+	defer restore()
+	task, err := New([]string{}, NewScriptWithCommands("test-container",
+		[]string{"sleep 30 &", "wait"}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Container = &Container{Image: "alpine"}
+	task = startLocalTask(t, task)
+	if err = Kill(fake.NewLocal(), task, config.GetParsedConfig().Hosts[0]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if status := waitForLocalTask(t, task); status.State != StateExited || !status.Killed {
+		t.Errorf("Expected state %s after kill, got %#v", StateExited, status)
+	}
+	log := readFakeDockerLog(t, dockerDirPath)
+	if !strings.Contains(log, "rm -f "+task.getContainerName()) {
+		t.Errorf("Expected the container to be removed, got calls:\n%s", log)
+	}
+}
@@ -0,0 +1,95 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Provide the errors reported by the runner.
+
+An error in RunOutput.Err is a *RunError, which names the phase of the run
+that failed.  Failures that callers may want to handle (e.g., by trying
+another host) also match one of the Err* values with errors.Is.
+*/
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+)
+
+var (
+	// The host's remote runner lock is held by another runner
+	ErrLockBusy = errors.New("Remote lock is busy")
+	// maxConcurrent scripts of the same name are already running on the
+	// host
+	ErrMaxConcurrent = errors.New("Max concurrent scripts already running")
+	// Copying files to or from the host failed
+	ErrTransfer = errors.New("Failed to transfer files")
+	// The task hit its Timeout
+	ErrTimeout = errors.New("Task timed out")
+	// The host can't be communicated with
+	ErrHostUnreachable = errors.New("Host is unreachable")
+)
+
+// A phase of running a task on a host
+type Phase string
+
+const (
+	// Validating the task and creating its local directory
+	PhasePrepare Phase = "prepare"
+	// Acquiring the host's remote runner lock
+	PhaseLock Phase = "lock"
+	// Checking the number of running scripts against maxConcurrent
+	PhaseSchedule Phase = "schedule"
+	// Copying the task directory and dependencies to the host
+	PhaseUpload Phase = "upload"
+	// Starting the task on the host
+	PhaseStart Phase = "start"
+	// Waiting for the task to exit
+	PhaseWait Phase = "wait"
+	// Collecting the task's stdout, stderr and output files
+	PhaseCollect Phase = "collect"
+)
+
+// An error from running a task on a host
+type RunError struct {
+	// The phase that failed
+	Phase Phase
+	// One of the Err* values, or nil if the failure isn't of a known kind
+	Kind error
+	// The underlying error
+	Err error
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Phase, e.Err.Error())
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// Report whether target is the kind of the error
+func (e *RunError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// Return a RunError for a failure in phase.  An err that already is a
+// RunError (from a helper that knows better) is returned as is.
+func newRunError(phase Phase, kind error, err error) *RunError {
+	if runErr, ok := err.(*RunError); ok {
+		return runErr
+	}
+	return &RunError{Phase: phase, Kind: kind, Err: err}
+}
+
+// Return a RunError for a failed command or copy on a host.  The kind is
+// ErrHostUnreachable if the host can't be communicated with at all.
+func newRemoteError(conn remote.Remote, host host.Host, phase Phase, kind error, err error) *RunError {
+	runErr := newRunError(phase, kind, err)
+	if conn.TestConnection(host) != nil {
+		runErr.Kind = ErrHostUnreachable
+	}
+	return runErr
+}
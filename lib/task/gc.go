@@ -0,0 +1,284 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Clean up task directories on the target hosts and locally.
+
+Wrapper task directories are deleted as soon as the wrapper has run.  Once
+the results of a task have been collected, COLLECTED_FILE is created in the
+task's remote directory and, if the task succeeded and the config's
+delete_on_success is set (the default), the remote directory is deleted and
+the local task directory is trimmed down to the task's stdout, stderr and
+results.
+
+Everything else is left to CollectGarbage, which applies the retention policy
+from the config:
+  - A remote task directory is never deleted while its task is running.
+  - A successful task's collected remote directory is deleted if
+    delete_on_success is set.
+  - Any other task directory of a task that isn't running (locally, of a
+    finished task) is deleted once it is more than keep_failed_days whole
+    days old, as find's -mtime +<keep_failed_days> tests it: with 0, a
+    directory is kept for a day.
+  - The oldest directories of collected (or, locally, finished) tasks are
+    deleted until each work directory is under max_work_size.
+
+A local task directory is finished once the task's stdout has been collected
+into it or FINISHED_FILE has been created in it, when the runner gave up on
+the task.
+
+Remote directories are swept while holding the host's remote runner lock, so
+tasks that are being started are left alone.
+*/
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/shell"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Created in a remote task directory once the task's results have been
+// collected
+const COLLECTED_FILE = "collected"
+
+// Created in a local task directory once the runner is done with the task,
+// whether or not its result was collected
+const FINISHED_FILE = "finished"
+
+// Mark the local directory of a task, if there is one, as finished
+func markLocalDirFinished(id string) {
+	path := filepath.Join(config.GetParsedConfig().LocalWorkPath, id)
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, FINISHED_FILE), nil, 0644); err != nil {
+		log.Printf("Failed to mark %s as finished: %s", path, err.Error())
+	}
+}
+
+// Report whether a directory last modified at modTime is more than days whole
+// days old, as find's -mtime +<days> tests it
+func isOlderThanDays(modTime time.Time, days uint64) bool {
+	return uint64(time.Since(modTime)/(24*time.Hour)) > days
+}
+
+// Delete a wrapper task's local and remote directories
+func removeWrapperDirs(conn remote.Remote, wrapperTask Task, host host.Host, wrapperTaskDirPath string) {
+	if err := os.RemoveAll(wrapperTaskDirPath); err != nil {
+		log.Printf("Failed to remove %s: %s", wrapperTaskDirPath, err.Error())
+	}
+	_, stderr, err := conn.Run(
+		host, shell.Command("rm", "-rf", wrapperTask.getRemoteDirPath()), 0)
+	if err != nil {
+		log.Printf("Failed to remove wrapper directory of %s on host %s: %s (%s)",
+			wrapperTask.Id, host.Name, err.Error(), strings.TrimSpace(stderr))
+	}
+}
+
+// Clean up after the results of a task have been collected (see the package
+// documentation)
+func cleanUpAfterResult(conn remote.Remote, task Task, host host.Host, output RunOutput, taskDirPath string) {
+	c := config.GetParsedConfig()
+	if _, err := os.Stat(filepath.Join(taskDirPath, "stdout")); err != nil {
+		// The task's results weren't collected (it may even still be
+		// running), so leave it to CollectGarbage.
+		return
+	}
+	remoteDirPath := task.getRemoteDirPath()
+	command := shell.Command("touch", filepath.Join(remoteDirPath, COLLECTED_FILE))
+	succeeded := output.Err == nil && output.ExitCode == 0
+	if succeeded && c.DeleteOnSuccess {
+		command = shell.Command("rm", "-rf", remoteDirPath)
+		if task.RunAs != "" && task.Isolated {
+			// The private directories belong to the task's user
+			command = shell.Join(task.wrapRunAs([]string{"rm", "-rf",
+				filepath.Join(remoteDirPath, PRIVATE_DIR)}, host)) +
+				"; " + command
+		}
+	}
+	if _, stderr, err := conn.Run(host, command, 0); err != nil {
+		log.Printf("Failed to clean up task %s on host %s: %s (%s)",
+			task.Id, host.Name, err.Error(), strings.TrimSpace(stderr))
+	}
+
+	if succeeded && c.DeleteOnSuccess {
+		// Only keep what the task produced
+		for _, name := range []string{task.getScriptFileName(), "DEPS"} {
+			if err := os.RemoveAll(filepath.Join(taskDirPath, name)); err != nil {
+				log.Printf("Failed to clean up %s: %s", taskDirPath, err.Error())
+			}
+		}
+	}
+}
+
+// Return the shell command that sweeps the remote work directory, printing
+// the path of each directory that it deletes
+func getRemoteSweep() string {
+	c := config.GetParsedConfig()
+	deleteOnSuccess := "false"
+	if c.DeleteOnSuccess {
+		deleteOnSuccess = "true"
+	}
+	isRunning := fmt.Sprintf("[ \"$(cat \"$d\"%s 2>/dev/null)\" = %s ]",
+		STATE_FILE, StateRunning)
+	remove := "rm -rf \"$d\" && echo \"$d\""
+	commands := []string{
+		fmt.Sprintf("for d in %s/*/; do", shell.Quote(c.RemoteWorkPath)),
+		"[ -d \"$d\" ] || continue",
+		getStaleRecordCleanup(),
+		isRunning + " && continue",
+		fmt.Sprintf("if %s && [ -f \"$d\"%s ] && [ \"$(cat \"$d\"%s 2>/dev/null)\" = 0 ]; then %s; continue; fi",
+			deleteOnSuccess, COLLECTED_FILE, EXIT_CODE_FILE, remove),
+		fmt.Sprintf("if [ -n \"$(find \"$d\" -prune -mtime +%d)\" ]; then %s; fi",
+			c.KeepFailedDays, remove),
+		"done"}
+	if c.MaxWorkSize > 0 {
+		// Task directory names don't need quoting, and the work path
+		// is validated, so the ls output can be split into words.
+		commands = append(commands,
+			fmt.Sprintf("set -- $(du -sk %s) && total=$1", shell.Quote(c.RemoteWorkPath)),
+			fmt.Sprintf("for d in $(ls -dtr %s/*/ 2>/dev/null); do", shell.Quote(c.RemoteWorkPath)),
+			fmt.Sprintf("[ $total -le %d ] && break", c.MaxWorkSize/1024),
+			fmt.Sprintf("[ -f \"$d\"%s ] || continue", COLLECTED_FILE),
+			isRunning+" && continue",
+			"set -- $(du -sk \"$d\")",
+			remove+" && total=$((total - $1))",
+			"done")
+	}
+	return strings.Join(append(commands, "true"), "\n")
+}
+
+// Sweep a host's remote work directory and return the deleted directories
+func collectRemoteGarbage(conn remote.Remote, host host.Host) (removed []string, err error) {
+	owner, err := genTaskId()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = acquireRemoteRunnerLock(conn, host, owner); err != nil {
+		return nil, err
+	}
+	defer removeRemoteRunnerLock(conn, host, owner)
+	stdout, stderr, err := conn.Run(host, getRemoteSweep(), 0)
+	for _, line := range strings.Split(stdout, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			removed = append(removed, host.Name+":"+filepath.Clean(line))
+		}
+	}
+	if err != nil {
+		return removed, errors.New(fmt.Sprintf(
+			"Failed to sweep host %s: %s (%s)",
+			host.Name, err.Error(), strings.TrimSpace(stderr)))
+	}
+	return removed, nil
+}
+
+// Sweep the local work directory and return the deleted directories
+func collectLocalGarbage() (removed []string, err error) {
+	c := config.GetParsedConfig()
+	infos, err := ioutil.ReadDir(c.LocalWorkPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Failed to read local work directory: %s", err.Error()))
+	}
+
+	type localDir struct {
+		path     string
+		modTime  time.Time
+		size     int64
+		finished bool
+	}
+	var dirs []localDir
+	var total int64
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		path := filepath.Join(c.LocalWorkPath, info.Name())
+		finished := false
+		for _, name := range []string{"stdout", FINISHED_FILE} {
+			if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+				finished = true
+			}
+		}
+		if finished && isOlderThanDays(info.ModTime(), c.KeepFailedDays) {
+			if err = os.RemoveAll(path); err != nil {
+				return removed, err
+			}
+			removed = append(removed, path)
+			continue
+		}
+		dir := localDir{path, info.ModTime(), getDirSize(path), finished}
+		total += dir.size
+		dirs = append(dirs, dir)
+	}
+
+	if c.MaxWorkSize == 0 {
+		return removed, nil
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].modTime.Before(dirs[j].modTime) })
+	for _, dir := range dirs {
+		if total <= int64(c.MaxWorkSize) {
+			break
+		}
+		if !dir.finished {
+			continue
+		}
+		if err = os.RemoveAll(dir.path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir.path)
+		total -= dir.size
+	}
+	return removed, nil
+}
+
+// Return the total size of the files in a local directory
+func getDirSize(path string) (size int64) {
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Delete the task directories on all of the hosts and locally according to
+// the retention policy in the config, skipping tasks that are still running.
+// The deleted directories are returned (remote ones prefixed by the host's
+// name and a colon).  Sweeping continues with the other hosts if a host
+// fails; the returned error then names the hosts that failed.
+func CollectGarbage(conn remote.Remote) (removed []string, err error) {
+	c := config.GetParsedConfig()
+	var failures []string
+	for _, host := range c.Hosts {
+		hostRemoved, err := collectRemoteGarbage(conn, host)
+		removed = append(removed, hostRemoved...)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	localRemoved, err := collectLocalGarbage()
+	removed = append(removed, localRemoved...)
+	if err != nil {
+		failures = append(failures, "Failed to sweep local work directory: "+err.Error())
+	}
+	if len(failures) > 0 {
+		return removed, errors.New(strings.Join(failures, "; "))
+	}
+	return removed, nil
+}
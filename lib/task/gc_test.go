@@ -0,0 +1,156 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Create a task directory named id in dirPath with the given files (name to
+// content), last modified daysOld days ago
+func createGarbageDir(t *testing.T, dirPath string, id string, files map[string]string, daysOld int) string {
+	path := filepath.Join(dirPath, id)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(path, name), []byte(content), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	modTime := time.Now().Add(-time.Duration(daysOld) * 24 * time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return path
+}
+
+// Check which of the paths CollectGarbage deleted
+func checkRemoved(t *testing.T, paths map[string]bool) {
+	removed, err := CollectGarbage(fake.NewLocal())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for path, expected := range paths {
+		_, statErr := os.Stat(path)
+		if expected != os.IsNotExist(statErr) {
+			t.Errorf("Expected %s to be removed: %t", path, expected)
+		}
+		listed := false
+		for _, r := range removed {
+			listed = listed || r == path || r == "server1:"+path
+		}
+		if listed != expected {
+			t.Errorf("Expected %s to be listed as removed: %t (%#v)", path, expected, removed)
+		}
+	}
+}
+
+func TestCleanUpAfterSuccess(t *testing.T) {
+	task, output := runOutputsTask(t, []string{"out/*.txt"}, 0)
+	if output.Err != nil || output.ExitCode != 0 {
+		t.Fatalf("Unexpected output: %#v", output)
+	}
+	if _, err := os.Stat(task.getRemoteDirPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the remote task directory to be removed")
+	}
+	taskDirPath := filepath.Join(config.GetParsedConfig().LocalWorkPath, task.Id)
+	for name, kept := range map[string]bool{
+		"stdout": true, "stderr": true, RESULTS_DIR: true,
+		task.getScriptFileName(): false, "DEPS": false} {
+		if _, err := os.Stat(filepath.Join(taskDirPath, name)); (err == nil) != kept {
+			t.Errorf("Expected %s to be kept in the local task directory: %t", name, kept)
+		}
+	}
+}
+
+func TestKeepFailedTask(t *testing.T) {
+	output := runLocalTask(t, []string{"echo failed", "exit 3"}, Limits{}, 0)
+	if output.ExitCode != 3 {
+		t.Fatalf("Unexpected output: %#v", output)
+	}
+	infos, err := ioutil.ReadDir(config.GetParsedConfig().RemoteWorkPath)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// The most recently modified directory is the task's (the wrapper's
+	// is gone)
+	var newest os.FileInfo
+	for _, info := range infos {
+		if newest == nil || info.ModTime().After(newest.ModTime()) {
+			newest = info
+		}
+	}
+	remoteDirPath := filepath.Join(config.GetParsedConfig().RemoteWorkPath, newest.Name())
+	for _, name := range []string{COLLECTED_FILE, "stdout"} {
+		if _, err := os.Stat(filepath.Join(remoteDirPath, name)); err != nil {
+			t.Errorf("Expected %s in the failed task's directory: %s", name, err.Error())
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	c := config.GetParsedConfig()
+	running := map[string]string{
+		STATE_FILE: string(StateRunning), PID_FILE: fmt.Sprintf("%d", os.Getpid())}
+	failed := map[string]string{
+		STATE_FILE: string(StateExited), EXIT_CODE_FILE: "1", COLLECTED_FILE: ""}
+	succeeded := map[string]string{
+		STATE_FILE: string(StateExited), EXIT_CODE_FILE: "0", COLLECTED_FILE: ""}
+	finished := map[string]string{"stdout": "out\n"}
+	abandoned := map[string]string{FINISHED_FILE: ""}
+	// Both sides keep directories that are keep_failed_days (7) whole
+	// days old, and delete them once they're a day older
+	checkRemoved(t, map[string]bool{
+		createGarbageDir(t, c.RemoteWorkPath, "gc-running", running, 30):         false,
+		createGarbageDir(t, c.RemoteWorkPath, "gc-old", failed, 30):              true,
+		createGarbageDir(t, c.RemoteWorkPath, "gc-failed", failed, 1):            false,
+		createGarbageDir(t, c.RemoteWorkPath, "gc-succeeded", succeeded, 1):      true,
+		createGarbageDir(t, c.RemoteWorkPath, "gc-kept", failed, 7):              false,
+		createGarbageDir(t, c.RemoteWorkPath, "gc-expired", failed, 8):           true,
+		createGarbageDir(t, c.LocalWorkPath, "gc-old-local", finished, 30):       true,
+		createGarbageDir(t, c.LocalWorkPath, "gc-local", finished, 1):            false,
+		createGarbageDir(t, c.LocalWorkPath, "gc-kept-local", finished, 7):       false,
+		createGarbageDir(t, c.LocalWorkPath, "gc-expired-local", finished, 8):    true,
+		createGarbageDir(t, c.LocalWorkPath, "gc-abandoned-local", abandoned, 8): true,
+		createGarbageDir(t, c.LocalWorkPath, "gc-running-local", nil, 30):        false,
+	})
+	for _, id := range []string{"gc-running", "gc-failed", "gc-kept"} {
+		os.RemoveAll(filepath.Join(c.RemoteWorkPath, id))
+	}
+	for _, id := range []string{"gc-local", "gc-kept-local", "gc-running-local"} {
+		os.RemoveAll(filepath.Join(c.LocalWorkPath, id))
+	}
+}
+
+func TestCollectGarbageBySize(t *testing.T) {
+	// Keep everything but a single byte of work
+	defer useConfig(t, "../../test/data/geto-gc.ini")()
+	c := config.GetParsedConfig()
+	running := map[string]string{
+		STATE_FILE: string(StateRunning), PID_FILE: fmt.Sprintf("%d", os.Getpid()),
+		COLLECTED_FILE: ""}
+	failed := map[string]string{
+		STATE_FILE: string(StateExited), EXIT_CODE_FILE: "1", COLLECTED_FILE: ""}
+	uncollected := map[string]string{STATE_FILE: string(StateExited), EXIT_CODE_FILE: "1"}
+	checkRemoved(t, map[string]bool{
+		createGarbageDir(t, c.RemoteWorkPath, "gc-running", running, 1):                      false,
+		createGarbageDir(t, c.RemoteWorkPath, "gc-failed", failed, 1):                        true,
+		createGarbageDir(t, c.RemoteWorkPath, "gc-uncollected", uncollected, 1):              false,
+		createGarbageDir(t, c.LocalWorkPath, "gc-local", map[string]string{"stdout": ""}, 1): true,
+		createGarbageDir(t, c.LocalWorkPath, "gc-unfinished", map[string]string{}, 1):        false,
+	})
+	for _, id := range []string{"gc-running", "gc-uncollected"} {
+		os.RemoveAll(filepath.Join(c.RemoteWorkPath, id))
+	}
+	os.RemoveAll(filepath.Join(c.LocalWorkPath, "gc-unfinished"))
+}
@@ -0,0 +1,176 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Query the history of tasks and report on it.
+
+A HistoryQuery selects tasks, e.g., the ones that failed on a host over a
+time range, from a Manager (Manager.History) or straight from a Store
+(QueryStore).  GetHistoryReport sums the selected tasks up: how many ended in
+each state, the success rate and the median and 95th percentile durations,
+overall and per script name and host.
+*/
+package task
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Which tasks a history query selects; zero fields select any task
+type HistoryQuery struct {
+	State      TaskState
+	Host       string
+	ScriptName string
+	Owner      string
+	// The tasks submitted at or after Since and before Until
+	Since time.Time
+	Until time.Time
+	// The tasks whose script exited with the code, nil for any task
+	ExitCode *int
+}
+
+// Report whether a task's script ran until it exited (even if the task
+// failed afterwards, e.g., by hitting a limit or failing to collect its
+// output files), so that its exit code is meaningful
+func scriptExited(output *RunOutput) bool {
+	if output == nil {
+		return false
+	}
+	if output.Err == nil || output.LimitHit != LimitNone {
+		return true
+	}
+	var runErr *RunError
+	return errors.As(output.Err, &runErr) && runErr.Phase == PhaseCollect
+}
+
+// Report whether the query selects a task
+func (q HistoryQuery) Matches(info TaskInfo) bool {
+	switch {
+	case q.State != "" && info.State != q.State,
+		q.Host != "" && info.Host != q.Host,
+		q.ScriptName != "" && info.ScriptName != q.ScriptName,
+		q.Owner != "" && info.Owner != q.Owner,
+		!q.Since.IsZero() && info.Submitted.Before(q.Since),
+		!q.Until.IsZero() && !info.Submitted.Before(q.Until):
+		return false
+	case q.ExitCode != nil:
+		return scriptExited(info.Output) && info.Output.ExitCode == *q.ExitCode
+	}
+	return true
+}
+
+// Return the tasks that the query selects, in the order they were submitted
+func (m *Manager) History(q HistoryQuery) []TaskInfo {
+	infos := []TaskInfo{}
+	for _, info := range m.List() {
+		if q.Matches(info) {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Return the tasks recorded in store that the query selects, in the order
+// they were submitted
+func QueryStore(store Store, q HistoryQuery) ([]TaskInfo, error) {
+	records, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	infos := []TaskInfo{}
+	for _, record := range records {
+		if q.Matches(record.Info) {
+			infos = append(infos, record.Info)
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].Submitted.Before(infos[j].Submitted) })
+	return infos, nil
+}
+
+// A summary of a set of tasks
+type HistoryStats struct {
+	Tasks     int
+	Succeeded int
+	Failed    int
+	Cancelled int
+	// The share of the succeeded and failed tasks that succeeded, 0 if
+	// there are none
+	SuccessRate float64
+	// The median and 95th percentile durations of the tasks that were
+	// started on a host and are done
+	P50Duration time.Duration
+	P95Duration time.Duration
+}
+
+// A summary of a set of tasks, overall and per script name and host
+type HistoryReport struct {
+	Total        HistoryStats
+	ByScriptName map[string]HistoryStats
+	// Tasks that were never placed on a host aren't counted per host
+	ByHost map[string]HistoryStats
+}
+
+// Return the pth percentile of sorted durations, by the nearest-rank method
+func getPercentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(durations))))
+	if rank < 1 {
+		rank = 1
+	}
+	return durations[rank-1]
+}
+
+// Return the summary of a set of tasks
+func GetHistoryStats(infos []TaskInfo) HistoryStats {
+	stats := HistoryStats{Tasks: len(infos)}
+	var durations []time.Duration
+	for _, info := range infos {
+		switch info.State {
+		case TaskSucceeded:
+			stats.Succeeded++
+		case TaskFailed:
+			stats.Failed++
+		case TaskCancelled:
+			stats.Cancelled++
+		}
+		if info.State.Terminal() && !info.Started.IsZero() {
+			durations = append(durations, info.Finished.Sub(info.Started))
+		}
+	}
+	if stats.Succeeded+stats.Failed > 0 {
+		stats.SuccessRate = float64(stats.Succeeded) / float64(stats.Succeeded+stats.Failed)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	stats.P50Duration = getPercentile(durations, 50)
+	stats.P95Duration = getPercentile(durations, 95)
+	return stats
+}
+
+// Return the summary of a set of tasks, overall and per script name and host
+func GetHistoryReport(infos []TaskInfo) HistoryReport {
+	byScriptName := map[string][]TaskInfo{}
+	byHost := map[string][]TaskInfo{}
+	for _, info := range infos {
+		byScriptName[info.ScriptName] = append(byScriptName[info.ScriptName], info)
+		if info.Host != "" {
+			byHost[info.Host] = append(byHost[info.Host], info)
+		}
+	}
+	report := HistoryReport{
+		Total:        GetHistoryStats(infos),
+		ByScriptName: map[string]HistoryStats{},
+		ByHost:       map[string]HistoryStats{}}
+	for name, group := range byScriptName {
+		report.ByScriptName[name] = GetHistoryStats(group)
+	}
+	for name, group := range byHost {
+		report.ByHost[name] = GetHistoryStats(group)
+	}
+	return report
+}
@@ -0,0 +1,113 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Return the info of a done task that ran for the given number of seconds
+func newHistoryInfo(id string, scriptName string, host string, state TaskState, submitted time.Time, seconds int, output *RunOutput) TaskInfo {
+	started := submitted.Add(time.Second)
+	return TaskInfo{Id: id, ScriptName: scriptName, Host: host, State: state,
+		Submitted: submitted, Started: started,
+		Finished: started.Add(time.Duration(seconds) * time.Second), Output: output}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	night := time.Date(2020, 3, 1, 2, 0, 0, 0, time.UTC)
+	infos := []TaskInfo{
+		newHistoryInfo("a", "build", "server1", TaskSucceeded, night, 10, &RunOutput{}),
+		newHistoryInfo("b", "build", "server2", TaskFailed, night.Add(time.Hour), 20, &RunOutput{ExitCode: 2}),
+		newHistoryInfo("c", "test", "server2", TaskFailed, night.Add(12*time.Hour), 30, &RunOutput{ExitCode: 2}),
+		// Failed before the script ran, so its exit code means nothing
+		{Id: "d", ScriptName: "test", State: TaskFailed, Submitted: night,
+			Output: &RunOutput{Err: newRunError(PhaseSchedule, nil, errors.New("No host"))}},
+	}
+	two, zero := 2, 0
+	for _, test := range []struct {
+		query    HistoryQuery
+		expected string
+	}{
+		{HistoryQuery{}, "abcd"},
+		{HistoryQuery{State: TaskFailed, Host: "server2"}, "bc"},
+		{HistoryQuery{State: TaskFailed, Host: "server2",
+			Since: night.Add(-time.Hour), Until: night.Add(6 * time.Hour)}, "b"},
+		{HistoryQuery{ScriptName: "test"}, "cd"},
+		{HistoryQuery{ExitCode: &two}, "bc"},
+		{HistoryQuery{ExitCode: &zero}, "a"},
+		{HistoryQuery{Since: night.Add(time.Hour)}, "bc"},
+	} {
+		var got string
+		for _, info := range infos {
+			if test.query.Matches(info) {
+				got += info.Id
+			}
+		}
+		if got != test.expected {
+			t.Errorf("Expected %#v to select %q, got %q", test.query, test.expected, got)
+		}
+	}
+}
+
+func TestHistoryReport(t *testing.T) {
+	now := time.Now()
+	var infos []TaskInfo
+	// 20 tasks of 1 to 20 seconds, every fourth of which failed
+	for i := 1; i <= 20; i++ {
+		state := TaskSucceeded
+		if i%4 == 0 {
+			state = TaskFailed
+		}
+		infos = append(infos, newHistoryInfo("t", "build", "server1", state, now, i, &RunOutput{}))
+	}
+	infos = append(infos, TaskInfo{ScriptName: "test", State: TaskCancelled, Submitted: now})
+
+	report := GetHistoryReport(infos)
+	total := report.Total
+	if total.Tasks != 21 || total.Succeeded != 15 || total.Failed != 5 || total.Cancelled != 1 {
+		t.Errorf("Unexpected counts: %#v", total)
+	}
+	if total.SuccessRate != 0.75 {
+		t.Errorf("Expected a success rate of 0.75, got %f", total.SuccessRate)
+	}
+	if total.P50Duration != 10*time.Second || total.P95Duration != 19*time.Second {
+		t.Errorf("Expected p50 and p95 of 10s and 19s, got %v and %v", total.P50Duration, total.P95Duration)
+	}
+	if build := report.ByScriptName["build"]; build.Tasks != 20 || build.P95Duration != 19*time.Second {
+		t.Errorf("Unexpected build stats: %#v", build)
+	}
+	if test := report.ByScriptName["test"]; test.Tasks != 1 || test.SuccessRate != 0 || test.P50Duration != 0 {
+		t.Errorf("Unexpected test stats: %#v", test)
+	}
+	// The cancelled task was never placed on a host
+	if len(report.ByHost) != 1 || report.ByHost["server1"].Tasks != 20 {
+		t.Errorf("Unexpected host stats: %#v", report.ByHost)
+	}
+}
+
+func TestQueryStore(t *testing.T) {
+	store, remove := newTestFileStore(t)
+	defer remove()
+	now := time.Now()
+	for i, id := range []string{"c", "a", "b"} {
+		// Submitted in the order a, b, c
+		submitted := now.Add(time.Duration(map[string]int{"a": 0, "b": 1, "c": 2}[id]) * time.Minute)
+		state := TaskFailed
+		if i == 0 {
+			state = TaskSucceeded
+		}
+		info := newHistoryInfo(id, "build", "server1", state, submitted, 1, &RunOutput{})
+		if err := store.Put(TaskRecord{Info: info}); err != nil {
+			t.Fatalf("Failed to put record: %s", err.Error())
+		}
+	}
+	infos, err := QueryStore(store, HistoryQuery{State: TaskFailed})
+	if err != nil || len(infos) != 2 || infos[0].Id != "a" || infos[1].Id != "b" {
+		t.Errorf("Expected a and b, got %#v (%v)", infos, err)
+	}
+}
@@ -0,0 +1,51 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Provide the interpreter structure and functions.
+*/
+package task
+
+import (
+	"strings"
+)
+
+// An interpreter that runs a script on a target host
+type Interpreter struct {
+	// The interpreter command followed by any arguments.  The script path
+	// is appended when the script is run.
+	command []string
+}
+
+// Commonly used interpreters.  Interpreters are looked up in the PATH of
+// the target host.
+var (
+	BashInterpreter    = NewInterpreter("bash")
+	ShInterpreter      = NewInterpreter("sh")
+	Python3Interpreter = NewInterpreter("python3")
+	PerlInterpreter    = NewInterpreter("perl")
+)
+
+// Create an interpreter from an arbitrary command and its arguments
+func NewInterpreter(name string, args ...string) Interpreter {
+	return Interpreter{append([]string{name}, args...)}
+}
+
+// Return the interpreter command followed by any arguments
+func (i Interpreter) Command() []string {
+	return append([]string{}, i.command...)
+}
+
+// Parse an interpreter from a script's first line.  ok is false if the
+// line is not a shebang interpreter directive.
+func parseShebang(line string) (i Interpreter, ok bool) {
+	if !strings.HasPrefix(line, "#!") {
+		return i, false
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return i, false
+	}
+	return Interpreter{fields}, true
+}
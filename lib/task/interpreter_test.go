@@ -0,0 +1,73 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"strings"
+	"testing"
+)
+
+func TestGetInterpreterFromShebang(t *testing.T) {
+	expected := map[string][]string{
+		"#!/bin/bash":            []string{"/bin/bash"},
+		"#!/usr/bin/env python3": []string{"/usr/bin/env", "python3"},
+		"#! /usr/bin/perl -w":    []string{"/usr/bin/perl", "-w"},
+		"echo no shebang":        ShInterpreter.Command(),
+	}
+	for line, command := range expected {
+		s := NewScriptWithCommands(TEST_NAME, []string{line, "true"}, nil)
+		actual := s.GetInterpreter().Command()
+		if fmt.Sprintf("%#v", actual) != fmt.Sprintf("%#v", command) {
+			t.Errorf("Unexpected interpreter for %q:\n"+
+				"Actual: %#v\n"+
+				"Expected: %#v",
+				line, actual, command)
+		}
+	}
+}
+
+func TestGetInterpreterFromBundleEntrypoint(t *testing.T) {
+	b, err := NewBundle(map[string]BundleFile{
+		"main.py":   BundleFile{[]byte("#!/usr/bin/env python3\nimport helper\n"), 0755},
+		"helper.py": BundleFile{[]byte("#!/bin/bash\n"), 0644},
+	}, "main.py")
+	if err != nil {
+		t.Fatalf("Failed to create bundle: %s", err.Error())
+	}
+	s := NewScriptFromBundle(TEST_NAME, b, nil)
+	actual := strings.Join(s.GetInterpreter().Command(), " ")
+	if actual != "/usr/bin/env python3" {
+		t.Errorf("Expected interpreter \"/usr/bin/env python3\", got \"%s\"", actual)
+	}
+}
+
+func TestSetInterpreter(t *testing.T) {
+	s := NewScriptWithCommands(TEST_NAME, []string{"#!/bin/bash", "true"}, nil)
+	s.SetInterpreter(PerlInterpreter)
+	actual := strings.Join(s.GetInterpreter().Command(), " ")
+	if actual != "perl" {
+		t.Errorf("Expected interpreter \"perl\", got \"%s\"", actual)
+	}
+}
+
+func TestWrapperUsesInterpreter(t *testing.T) {
+	s := NewScriptWithCommands(TEST_NAME, []string{"print('hi')"}, nil)
+	s.SetInterpreter(Python3Interpreter)
+	inner, err := New([]string{}, s, 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	wrapper, err := getWrapperTask(inner, config.GetParsedConfig().Hosts[0], Capabilities{Timeout: true})
+	if err != nil {
+		t.Fatalf("Failed to create wrapper Task: " + err.Error())
+	}
+	expected := "python3 " + inner.getRemoteScriptPath()
+	if !strings.Contains(strings.Join(wrapper.Script.commands, "\n"), expected) {
+		t.Errorf("Wrapper script does not run %q:\n%s",
+			expected, strings.Join(wrapper.Script.commands, "\n"))
+	}
+}
@@ -0,0 +1,118 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Run tasks as another user and with private working directories.
+
+A task with RunAs set runs its script through the host's sudo command.  The
+task directory stays owned by the user that geto logs in as, so geto can
+still record the task's state and collect its output; the script's stdout
+and stderr are opened by geto's user before sudo is run and are only
+readable by geto's user.  The task directory can be traversed, but not
+listed, by other users so that the script's user can read the script and the
+DEPS.
+
+An Isolated task gets a private HOME and TMPDIR in the PRIVATE_DIR
+subdirectory of the task directory, created by the user that runs the script.
+*/
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/shell"
+	"path/filepath"
+)
+
+// The subdirectory of a task directory that holds the private HOME and
+// TMPDIR of an isolated task
+const PRIVATE_DIR = "private"
+
+// Return an error if the task can't run as its RunAs user on the host
+func validateRunAs(task Task, host host.Host) error {
+	if task.RunAs == "" {
+		return nil
+	}
+	for _, user := range host.RunAsUsers {
+		if user == task.RunAs {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf(
+		"Task %s can't run as %q on host %s: not in run_as_users",
+		task.Id, task.RunAs, host.Name))
+}
+
+// Return the sudo command that runs a command as the task's RunAs user
+func (t *Task) getSudoCommand(host host.Host) []string {
+	return append(
+		append([]string{}, host.SudoCommand...), "-u", t.RunAs, "--")
+}
+
+// Return the command used to signal the task's processes
+func (t *Task) getKillCommand(host host.Host) string {
+	if t.RunAs == "" {
+		return "kill"
+	}
+	return shell.Join(append(t.getSudoCommand(host), "kill"))
+}
+
+// Return the wrapper commands that set the permissions of the task directory
+// (the current directory) before the task is started
+func (t *Task) getIsolationSetup() []string {
+	var commands []string
+	if t.RunAs != "" || t.Isolated {
+		// The task's output and records are only for geto's user
+		commands = append(commands, "umask 077")
+	}
+	if t.RunAs != "" {
+		commands = append(commands, "chmod -R a+rX .", "chmod 0711 .")
+	} else if t.Isolated {
+		commands = append(commands, "chmod 0700 .")
+	}
+	if t.Isolated {
+		mode := "0700"
+		if t.RunAs != "" {
+			// Like /tmp, but not listable: the script's user creates
+			// its private directories in here.
+			mode = "1733"
+		}
+		commands = append(commands,
+			shell.Command("mkdir", "-m", mode, PRIVATE_DIR))
+	}
+	return commands
+}
+
+// Return the command (as a list of words) that runs command as the task's
+// user and with its private directories
+func (t *Task) wrapIsolation(command []string, host host.Host) []string {
+	return t.wrapRunAs(t.wrapPrivateDirs(command), host)
+}
+
+// Return the command (as a list of words) that runs command with the task's
+// private directories
+func (t *Task) wrapPrivateDirs(command []string) []string {
+	if t.Isolated {
+		// The private directories are created by the user that runs
+		// the script so that no one else can read them.
+		command = append(
+			[]string{"sh", "-c",
+				"mkdir -m 0700 \"$0\"/home \"$0\"/tmp && " +
+					"export HOME=\"$0\"/home TMPDIR=\"$0\"/tmp && " +
+					"exec \"$@\"",
+				filepath.Join(t.getRemoteDirPath(), PRIVATE_DIR)},
+			command...)
+	}
+	return command
+}
+
+// Return the command (as a list of words) that runs command as the task's
+// RunAs user
+func (t *Task) wrapRunAs(command []string, host host.Host) []string {
+	if t.RunAs != "" {
+		command = append(t.getSudoCommand(host), command...)
+	}
+	return command
+}
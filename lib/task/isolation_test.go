@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A stand-in for sudo that checks its arguments and passes the user to the
+// command in the RUN_AS_USER environment variable
+const FAKE_SUDO = `#!/bin/sh
+[ "$1" = -u ] && [ "$3" = -- ] || exit 99
+RUN_AS_USER=$2
+export RUN_AS_USER
+shift 3
+exec "$@"
+`
+
+// Return the first configured host, set up to run tasks as "nobody" with a
+// fake sudo command
+func getRunAsHost(t *testing.T) host.Host {
+	dirPath, err := ioutil.TempDir("", "geto-sudo")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sudoPath := filepath.Join(dirPath, "sudo")
+	if err = ioutil.WriteFile(sudoPath, []byte(FAKE_SUDO), 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	h := config.GetParsedConfig().Hosts[0]
+	h.SudoCommand = []string{sudoPath}
+	h.RunAsUsers = []string{"nobody"}
+	return h
+}
+
+// Run a task on the local machine, as the given host, with RunOnHost
+func runLocalTaskOnHost(t *testing.T, task Task, h host.Host) RunOutput {
+	resetCapabilitiesCache()
+	ch := make(chan RunOutput)
+	go RunOnHost(fake.NewLocal(), task, h, ch)
+	return <-ch
+}
+
+func checkMode(t *testing.T, path string, expected os.FileMode) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	mode := info.Mode() & (os.ModePerm | os.ModeSticky)
+	if mode != expected {
+		t.Errorf("Expected mode %v for %s, got %v", expected, path, mode)
+	}
+}
+
+func TestValidateRunAs(t *testing.T) {
+	h := host.Host{Name: "test-host", RunAsUsers: []string{"alice", "bob"}}
+	for _, user := range []string{"", "alice", "bob"} {
+		if err := validateRunAs(Task{Id: "test-task", RunAs: user}, h); err != nil {
+			t.Errorf("Expected run as %q to be allowed: %s", user, err.Error())
+		}
+	}
+	for _, user := range []string{"root", "alic", "alice "} {
+		if err := validateRunAs(Task{Id: "test-task", RunAs: user}, h); err == nil {
+			t.Errorf("Expected run as %q to be rejected", user)
+		}
+	}
+}
+
+func TestWrapIsolation(t *testing.T) {
+	h := host.Host{SudoCommand: []string{"sudo", "-n"}}
+	task := Task{Id: "test-task", RunAs: "alice", Isolated: true}
+	expected := []string{
+		"sudo", "-n", "-u", "alice", "--",
+		"sh", "-c",
+		"mkdir -m 0700 \"$0\"/home \"$0\"/tmp && " +
+			"export HOME=\"$0\"/home TMPDIR=\"$0\"/tmp && exec \"$@\"",
+		filepath.Join(task.getRemoteDirPath(), PRIVATE_DIR),
+		"bash", "script"}
+	actual := task.wrapIsolation([]string{"bash", "script"}, h)
+	if fmt.Sprintf("%#v", actual) != fmt.Sprintf("%#v", expected) {
+		t.Errorf("Unexpected command:\n"+
+			"Actual: %#v\n"+
+			"Expected: %#v",
+			actual, expected)
+	}
+	if len(h.SudoCommand) != 2 {
+		t.Errorf("The host's sudo command was modified: %#v", h.SudoCommand)
+	}
+
+	task = Task{Id: "test-task"}
+	actual = task.wrapIsolation([]string{"bash", "script"}, h)
+	if fmt.Sprintf("%#v", actual) != fmt.Sprintf("%#v", []string{"bash", "script"}) {
+		t.Errorf("Expected the command to be unchanged, got %#v", actual)
+	}
+}
+
+func TestRunIsolatedTask(t *testing.T) {
+	// The task directory is inspected after the task succeeds
+	defer useConfig(t, "../../test/data/geto-keep.ini")()
+	task, err := New([]string{}, NewScriptWithCommands("test-isolated",
+		[]string{"echo \"$HOME\"", "echo \"$TMPDIR\"", "touch \"$HOME\"/file"}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Isolated = true
+	output := runLocalTaskOnHost(t, task, config.GetParsedConfig().Hosts[0])
+	if output.Err != nil || output.ExitCode != 0 {
+		t.Fatalf("Unexpected output: %#v", output)
+	}
+	privateDirPath := filepath.Join(task.getRemoteDirPath(), PRIVATE_DIR)
+	expected := fmt.Sprintf("%s/home\n%s/tmp\n", privateDirPath, privateDirPath)
+	if output.Stdout != expected {
+		t.Errorf("Expected stdout %q, got %q", expected, output.Stdout)
+	}
+	checkMode(t, task.getRemoteDirPath(), 0700)
+	checkMode(t, filepath.Join(privateDirPath, "home"), 0700)
+	checkMode(t, filepath.Join(privateDirPath, "home", "file"), 0600)
+	checkMode(t, filepath.Join(task.getRemoteDirPath(), "stdout"), 0600)
+}
+
+func TestRunTaskAsUser(t *testing.T) {
+	// The task directory is inspected after the task succeeds
+	defer useConfig(t, "../../test/data/geto-keep.ini")()
+	h := getRunAsHost(t)
+	defer os.RemoveAll(filepath.Dir(h.SudoCommand[0]))
+	task, err := New([]string{}, NewScriptWithCommands("test-run-as",
+		[]string{"echo \"$RUN_AS_USER\""}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.RunAs = "nobody"
+	task.Isolated = true
+	output := runLocalTaskOnHost(t, task, h)
+	if output.Err != nil || output.ExitCode != 0 {
+		t.Fatalf("Unexpected output: %#v", output)
+	}
+	if output.Stdout != "nobody\n" {
+		t.Errorf("Expected the script to run as nobody, got %q", output.Stdout)
+	}
+	checkMode(t, task.getRemoteDirPath(), 0711)
+	checkMode(t, filepath.Join(task.getRemoteDirPath(), PRIVATE_DIR), os.ModeSticky|0733)
+	checkMode(t, filepath.Join(task.getRemoteDirPath(), "stdout"), 0600)
+}
+
+func TestRunTaskAsUnlistedUser(t *testing.T) {
+	h := getRunAsHost(t)
+	defer os.RemoveAll(filepath.Dir(h.SudoCommand[0]))
+	task, err := New([]string{}, NewScriptWithCommands("test-run-as",
+		[]string{"true"}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.RunAs = "root"
+	if output := runLocalTaskOnHost(t, task, h); output.Err == nil {
+		t.Errorf("Expected running as a user not in run_as_users to fail")
+	}
+}
@@ -0,0 +1,126 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Provide the resource limits structure and functions.
+*/
+package task
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Resource limits for a task on a target host.  A zero value means no limit.
+type Limits struct {
+	// The maximum CPU time, in seconds
+	CPUTime uint32
+	// The maximum address space (virtual memory), in kilobytes
+	AddressSpace uint64
+	// The maximum number of open files
+	OpenFiles uint32
+	// The niceness adjustment (see nice(1))
+	Niceness int
+	// The maximum memory, in bytes, of the task's cgroup.  This is only
+	// applied on hosts where systemd-run is available.
+	MemoryMax uint64
+	// The maximum CPU usage of the task's cgroup, as a percentage of one
+	// CPU.  This is only applied on hosts where systemd-run is available.
+	CPUQuota uint32
+}
+
+// A resource limit that a task hit
+type Limit string
+
+const (
+	// No limit was hit
+	LimitNone Limit = ""
+	// The task's Timeout
+	LimitTimeout Limit = "timeout"
+	// Limits.CPUTime
+	LimitCPUTime Limit = "cpu_time"
+	// Limits.MemoryMax
+	LimitMemory Limit = "memory"
+)
+
+// Exit codes of a script killed by SIGXCPU and SIGKILL (128 + the signal
+// number, as reported by the shell)
+const (
+	SIGXCPU_EXIT_CODE = 128 + 24
+	SIGKILL_EXIT_CODE = 128 + 9
+)
+
+// Return true if the limits need cgroup support on the host
+func (l Limits) needCgroup() bool {
+	return l.MemoryMax > 0 || l.CPUQuota > 0
+}
+
+// Return the command (as a list of words) that runs command with the
+// limits applied on a host with the given capabilities
+func (l Limits) wrapCommand(command []string, caps Capabilities) []string {
+	if l.Niceness != 0 {
+		command = append(
+			[]string{"nice", "-n", fmt.Sprintf("%d", l.Niceness)},
+			command...)
+	}
+
+	var ulimits []string
+	if l.CPUTime > 0 {
+		// The soft limit sends SIGXCPU (so that hitting the limit can
+		// be told apart from being killed); the hard limit, a little
+		// later, sends SIGKILL in case SIGXCPU is caught.  The soft
+		// limit is set first since it can't be above the hard limit.
+		ulimits = append(ulimits,
+			fmt.Sprintf("ulimit -S -t %d", l.CPUTime),
+			fmt.Sprintf("ulimit -H -t %d", l.CPUTime+KILL_AFTER))
+	}
+	if l.AddressSpace > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -v %d", l.AddressSpace))
+	}
+	if l.OpenFiles > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -n %d", l.OpenFiles))
+	}
+	if len(ulimits) > 0 {
+		// Apply the ulimits in a shell that then replaces itself with
+		// the command, so that only the task is limited.
+		command = append(
+			[]string{"sh", "-c",
+				strings.Join(ulimits, " && ") + " && exec \"$@\"", "sh"},
+			command...)
+	}
+
+	if l.needCgroup() && caps.SystemdRun {
+		args := []string{"systemd-run", "--user", "--scope", "--quiet"}
+		if l.MemoryMax > 0 {
+			args = append(args, "-p", fmt.Sprintf("MemoryMax=%d", l.MemoryMax))
+		}
+		if l.CPUQuota > 0 {
+			args = append(args, "-p", fmt.Sprintf("CPUQuota=%d%%", l.CPUQuota))
+		}
+		command = append(append(args, "--"), command...)
+	}
+	return command
+}
+
+// Return the limit that a task hit, given its exit status
+func getLimitHit(task Task, status Status) Limit {
+	if status.State != StateExited || status.Killed {
+		return LimitNone
+	}
+	switch {
+	case task.Timeout > 0 && status.TimedOut:
+		return LimitTimeout
+	case task.Limits.CPUTime > 0 && (status.ExitCode == SIGXCPU_EXIT_CODE ||
+		status.ExitCode == SIGKILL_EXIT_CODE):
+		// A SIGKILL could also be from the memory cgroup, but the
+		// CPU time limit is far more likely to be the cause if there
+		// is one.
+		return LimitCPUTime
+	case task.Limits.MemoryMax > 0 && status.ExitCode == SIGKILL_EXIT_CODE:
+		// The OOM killer is the only other source of SIGKILL that
+		// geto knows of.
+		return LimitMemory
+	}
+	return LimitNone
+}
@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"strings"
+	"testing"
+)
+
+// Forget any probed capabilities so that the local machine gets probed
+func resetCapabilitiesCache() {
+	capabilitiesCacheLock.Lock()
+	capabilitiesCache = map[string]Capabilities{}
+	capabilitiesCacheLock.Unlock()
+}
+
+// Run a task on the local machine with RunOnHost
+func runLocalTask(t *testing.T, commands []string, limits Limits, timeout uint32) RunOutput {
+	resetCapabilitiesCache()
+	task, err := New([]string{}, NewScriptWithCommands("test-limits", commands, nil), timeout)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Limits = limits
+	ch := make(chan RunOutput)
+	go RunOnHost(fake.NewLocal(), task, config.GetParsedConfig().Hosts[0], ch)
+	return <-ch
+}
+
+func TestWrapCommandWithLimits(t *testing.T) {
+	limits := Limits{CPUTime: 5, OpenFiles: 64, Niceness: 10, MemoryMax: 1 << 20, CPUQuota: 50}
+	expected := []string{
+		"systemd-run", "--user", "--scope", "--quiet",
+		"-p", "MemoryMax=1048576", "-p", "CPUQuota=50%", "--",
+		"sh", "-c", "ulimit -S -t 5 && ulimit -H -t 15 && ulimit -n 64 && exec \"$@\"", "sh",
+		"nice", "-n", "10",
+		"bash", "script"}
+	actual := limits.wrapCommand([]string{"bash", "script"}, Capabilities{SystemdRun: true})
+	if fmt.Sprintf("%#v", actual) != fmt.Sprintf("%#v", expected) {
+		t.Errorf("Unexpected command:\n"+
+			"Actual: %#v\n"+
+			"Expected: %#v",
+			actual, expected)
+	}
+
+	// Without systemd-run, the cgroup limits can't be applied
+	actual = limits.wrapCommand([]string{"bash", "script"}, Capabilities{})
+	if actual[0] != "sh" {
+		t.Errorf("Expected the command to start with sh, got %#v", actual)
+	}
+
+	actual = Limits{}.wrapCommand([]string{"bash", "script"}, Capabilities{SystemdRun: true})
+	if strings.Join(actual, " ") != "bash script" {
+		t.Errorf("Expected the command to be unchanged, got %#v", actual)
+	}
+}
+
+func TestGetLimitHit(t *testing.T) {
+	var tests = []struct {
+		timeout uint32
+		limits  Limits
+		status  Status
+		limit   Limit
+	}{
+		{0, Limits{}, Status{StateExited, 0, false, false}, LimitNone},
+		{10, Limits{}, Status{StateExited, TIMED_OUT_EXIT_CODE, false, true}, LimitTimeout},
+		// The script's own exit code isn't mistaken for a timeout
+		{10, Limits{}, Status{StateExited, TIMED_OUT_EXIT_CODE, false, false}, LimitNone},
+		{0, Limits{}, Status{StateExited, TIMED_OUT_EXIT_CODE, false, false}, LimitNone},
+		{0, Limits{CPUTime: 1}, Status{StateExited, SIGXCPU_EXIT_CODE, false, false}, LimitCPUTime},
+		// A timeout killed with SIGKILL isn't mistaken for the CPU time limit
+		{10, Limits{CPUTime: 1}, Status{StateExited, TIMED_OUT_EXIT_CODE, false, true}, LimitTimeout},
+		{0, Limits{MemoryMax: 1024}, Status{StateExited, SIGKILL_EXIT_CODE, false, false}, LimitMemory},
+		{0, Limits{MemoryMax: 1024}, Status{StateExited, SIGKILL_EXIT_CODE, true, false}, LimitNone},
+		{0, Limits{MemoryMax: 1024}, Status{StateLost, 0, false, false}, LimitNone},
+	}
+	for _, test := range tests {
+		task := Task{Id: "test-task", Script: NewScript(TEST_NAME, nil),
+			Timeout: test.timeout, Limits: test.limits}
+		if limit := getLimitHit(task, test.status); limit != test.limit {
+			t.Errorf("Expected limit %q for %#v and %#v, got %q",
+				test.limit, test.limits, test.status, limit)
+		}
+	}
+}
+
+func TestRunOnHostCollectsOutput(t *testing.T) {
+	output := runLocalTask(t, []string{"echo out", "echo err >&2", "exit 5"}, Limits{}, 0)
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+	if output.Stdout != "out\n" || output.Stderr != "err\n" || output.ExitCode != 5 {
+		t.Errorf("Unexpected output: %#v", output)
+	}
+}
+
+func TestRunOnHostWithCPUTimeLimit(t *testing.T) {
+	output := runLocalTask(t, []string{"while :; do :; done"}, Limits{CPUTime: 1}, 0)
+	if output.LimitHit != LimitCPUTime || output.Err == nil {
+		t.Errorf("Expected the %s limit to be hit, got %#v", LimitCPUTime, output)
+	}
+}
+
+func TestRunOnHostWithTimeout(t *testing.T) {
+	output := runLocalTask(t, []string{"exec sleep 30"}, Limits{}, 1)
+	if output.LimitHit != LimitTimeout || !errors.Is(output.Err, ErrTimeout) {
+		t.Errorf("Expected the %s limit to be hit, got %#v", LimitTimeout, output)
+	}
+}
+
+func TestRunOnHostWithOpenFilesAndNiceness(t *testing.T) {
+	output := runLocalTask(t, []string{"ulimit -n", "nice"}, Limits{OpenFiles: 17, Niceness: 3}, 0)
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+	if output.Stdout != "17\n3\n" {
+		t.Errorf("Expected the open files limit and niceness, got %q", output.Stdout)
+	}
+}
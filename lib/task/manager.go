@@ -0,0 +1,738 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Keep track of submitted tasks.
+
+A Manager runs each submitted task in the background on a host chosen by the
+submission's Strategy and remembers the task's progress and output, so that
+tasks can be looked up, waited for and cancelled by ID (e.g., by the geto
+server on behalf of its clients).  A Manager with a Store (see store.go)
+records its tasks as they progress.
+
+Finished tasks, with their output, are only kept in memory up to a number
+and an age (see SetRetention).  A task that's dropped is still served from
+the Store, if there is one, and is otherwise forgotten.
+*/
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The state of a task submitted to a Manager
+type TaskState string
+
+const (
+	// The task hasn't been started on a host yet
+	TaskPending TaskState = "pending"
+	// The task has been started on a host
+	TaskRunning TaskState = "running"
+	// The task's script exited with 0 and its results were collected
+	TaskSucceeded TaskState = "succeeded"
+	// The task couldn't be run, its script exited with another code, or
+	// its results couldn't be collected
+	TaskFailed TaskState = "failed"
+	// The task was cancelled
+	TaskCancelled TaskState = "cancelled"
+)
+
+// Report whether a task in the state is done
+func (s TaskState) Terminal() bool {
+	return s == TaskSucceeded || s == TaskFailed || s == TaskCancelled
+}
+
+// How a Manager chooses the host to run a task on
+type Strategy string
+
+const (
+	// The host named in the submission
+	StrategyHost Strategy = "host"
+	// A random host (see RunOnRandomHost)
+	StrategyRandom Strategy = "random"
+	// The host running the fewest scripts of the same name (see
+	// RunOnHostBalancedByScriptName)
+	StrategyBalanced Strategy = "balanced"
+)
+
+var (
+	// The Manager doesn't know of the task
+	ErrNoSuchTask = errors.New("No such task")
+	// The task can't be cancelled because it's done
+	ErrTaskDone = errors.New("Task is already done")
+	// The Manager is shutting down and doesn't take new tasks
+	ErrShuttingDown = errors.New("Shutting down")
+)
+
+// What a Manager knows about a task
+type TaskInfo struct {
+	Id         string
+	ScriptName string
+	// The name of the host the task runs on, "" until it's chosen
+	Host  string
+	State TaskState
+	// When the task was submitted, started on its host and done (zero
+	// until then)
+	Submitted time.Time
+	Started   time.Time
+	Finished  time.Time
+	// The task's output, nil until the task is done
+	Output *RunOutput
+	// Who submitted the task (see SubmitOptions)
+	Owner string
+}
+
+// How a task is submitted to a Manager
+type SubmitOptions struct {
+	Strategy Strategy
+	// The name of the host to run the task on, for StrategyHost
+	Host string
+	// The hosts that may be chosen, nil for all of the configured hosts
+	Hosts []host.Host
+	// Who submits the task (e.g., a client of the geto server), "" if
+	// unknown
+	Owner string
+}
+
+type managedTask struct {
+	task            Task
+	info            TaskInfo
+	cancelRequested bool
+	// Closed when the task is done
+	done chan struct{}
+	// The latest chunks of the task's output, while it runs
+	backlog     []OutputChunk
+	backlogSize int
+	subscribers map[chan OutputChunk]struct{}
+}
+
+// The most bytes of a running task's latest output that are kept for new
+// subscribers (see Manager.Subscribe)
+const MAX_OUTPUT_BACKLOG = 1 << 20
+
+// The number of chunks that a subscriber can fall behind by before it's
+// dropped
+const SUBSCRIBER_BUFFER = 256
+
+// Runs submitted tasks and keeps track of them
+type Manager struct {
+	conn  remote.Remote
+	lock  sync.Mutex
+	tasks map[string]*managedTask
+	// Task IDs in the order they were submitted
+	ids          []string
+	shuttingDown bool
+	// Where tasks are recorded, nil if they aren't
+	store Store
+	// The most finished tasks kept in memory and how long each is kept
+	// for, 0 for no limit
+	maxFinished uint64
+	maxAge      time.Duration
+	// Whether any finished task was dropped from memory
+	dropped bool
+}
+
+func NewManager(conn remote.Remote) *Manager {
+	return &Manager{conn: conn, tasks: map[string]*managedTask{},
+		maxFinished: config.DEFAULT_MAX_FINISHED_TASKS,
+		maxAge:      config.DEFAULT_FINISHED_TASK_HOURS * time.Hour}
+}
+
+// Return a Manager that records its tasks in store.  Call Reconcile to pick
+// up the tasks that store already has.
+func NewManagerWithStore(conn remote.Remote, store Store) *Manager {
+	m := NewManager(conn)
+	m.store = store
+	return m
+}
+
+// Keep at most maxFinished finished tasks in memory, each for at most maxAge
+// after it's done (0 for no limit).  The tasks submitted first are dropped
+// first.
+func (m *Manager) SetRetention(maxFinished uint64, maxAge time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.maxFinished = maxFinished
+	m.maxAge = maxAge
+	m.dropFinished()
+}
+
+// Drop the finished tasks beyond the Manager's retention limits from memory,
+// with the Manager locked
+func (m *Manager) dropFinished() {
+	finished := uint64(0)
+	for _, id := range m.ids {
+		if m.tasks[id].info.State.Terminal() {
+			finished++
+		}
+	}
+	now := time.Now()
+	kept := m.ids[:0]
+	for _, id := range m.ids {
+		info := m.tasks[id].info
+		if info.State.Terminal() && ((m.maxFinished > 0 && finished > m.maxFinished) ||
+			(m.maxAge > 0 && now.Sub(info.Finished) > m.maxAge)) {
+			delete(m.tasks, id)
+			finished--
+			m.dropped = true
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.ids = kept
+}
+
+// Return the host of hosts with the given name
+func getHostByName(hosts []host.Host, name string) (host.Host, error) {
+	for _, h := range hosts {
+		if h.Name == name {
+			return h, nil
+		}
+	}
+	return host.Host{}, errors.New(fmt.Sprintf("Unknown host: %q", name))
+}
+
+// Start running a task in the background on a host chosen as opts say and
+// return what's known of it
+func (m *Manager) Submit(task Task, opts SubmitOptions) (TaskInfo, error) {
+	if opts.Hosts == nil {
+		opts.Hosts = config.GetParsedConfig().Hosts
+	}
+	switch opts.Strategy {
+	case StrategyHost:
+		if _, err := getHostByName(opts.Hosts, opts.Host); err != nil {
+			return TaskInfo{}, err
+		}
+	case StrategyRandom, StrategyBalanced:
+		if len(opts.Hosts) == 0 {
+			return TaskInfo{}, errors.New("No hosts to run the task on")
+		}
+	default:
+		return TaskInfo{}, errors.New(fmt.Sprintf("Unknown strategy: %q", opts.Strategy))
+	}
+	if err := validateScriptName(task.Script.name); err != nil {
+		return TaskInfo{}, err
+	}
+
+	m.lock.Lock()
+	if m.shuttingDown {
+		m.lock.Unlock()
+		return TaskInfo{}, ErrShuttingDown
+	}
+	if _, ok := m.tasks[task.Id]; ok {
+		m.lock.Unlock()
+		return TaskInfo{}, errors.New(fmt.Sprintf("Task %s was already submitted", task.Id))
+	}
+	mt := &managedTask{
+		task: task,
+		info: TaskInfo{Id: task.Id, ScriptName: task.Script.name,
+			State: TaskPending, Submitted: time.Now(), Owner: opts.Owner},
+		done:        make(chan struct{}),
+		subscribers: map[chan OutputChunk]struct{}{}}
+	m.streamOutput(mt)
+	m.tasks[task.Id] = mt
+	m.ids = append(m.ids, task.Id)
+	m.dropFinished()
+	info := mt.info
+	record := m.getRecord(mt)
+	m.lock.Unlock()
+
+	m.put(record)
+	go m.run(mt, opts)
+	return info, nil
+}
+
+// Pass a task's output on to its subscribers as well as to its own OnOutput
+func (m *Manager) streamOutput(mt *managedTask) {
+	onOutput := mt.task.OnOutput
+	mt.task.OnOutput = func(chunk OutputChunk) {
+		if onOutput != nil {
+			onOutput(chunk)
+		}
+		m.publish(mt, chunk)
+	}
+}
+
+// Return the record of a task, with the Manager locked
+func (m *Manager) getRecord(mt *managedTask) TaskRecord {
+	return TaskRecord{Info: mt.info, Task: getTaskDefinition(mt.task)}
+}
+
+// Record a task in the store, if any.  A task whose record can't be written
+// still runs; it just can't be picked up by Reconcile.
+func (m *Manager) put(record TaskRecord) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.Put(record); err != nil {
+		log.Print("Failed to record task: ", err.Error())
+	}
+}
+
+// Choose a host for a task and run the task on it
+func (m *Manager) run(mt *managedTask, opts SubmitOptions) {
+	var h host.Host
+	var err error
+	switch opts.Strategy {
+	case StrategyHost:
+		h, err = getHostByName(opts.Hosts, opts.Host)
+	case StrategyRandom:
+		h, err = getRandomHost(opts.Hosts)
+	case StrategyBalanced:
+		h, err = getBalancedHost(m.conn, mt.task, opts.Hosts)
+	}
+	if err != nil {
+		m.finish(mt, RunOutput{Err: newRunError(PhaseSchedule, nil, err)})
+		return
+	}
+
+	m.lock.Lock()
+	if mt.cancelRequested {
+		m.lock.Unlock()
+		m.finish(mt, RunOutput{})
+		return
+	}
+	mt.info.Host = h.Name
+	mt.info.State = TaskRunning
+	mt.info.Started = time.Now()
+	record := m.getRecord(mt)
+	m.lock.Unlock()
+	m.put(record)
+
+	ch := make(chan RunOutput)
+	go RunOnHost(m.conn, mt.task, h, ch)
+	m.finish(mt, <-ch)
+}
+
+// Record the output of a task that is done
+func (m *Manager) finish(mt *managedTask, output RunOutput) {
+	m.lock.Lock()
+	switch {
+	case mt.cancelRequested:
+		mt.info.State = TaskCancelled
+	case output.Err == nil && output.ExitCode == 0:
+		mt.info.State = TaskSucceeded
+	default:
+		mt.info.State = TaskFailed
+	}
+	mt.info.Finished = time.Now()
+	mt.info.Output = &output
+	for ch := range mt.subscribers {
+		close(ch)
+	}
+	mt.subscribers = nil
+	mt.backlog = nil
+	record := m.getRecord(mt)
+	m.lock.Unlock()
+	// The task is only done, and only dropped from memory, once it's
+	// recorded as such
+	m.put(record)
+	m.lock.Lock()
+	m.dropFinished()
+	m.lock.Unlock()
+	close(mt.done)
+}
+
+// Pass a chunk of a task's output on to its subscribers
+func (m *Manager) publish(mt *managedTask, chunk OutputChunk) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mt.backlog = append(mt.backlog, chunk)
+	mt.backlogSize += len(chunk.Data)
+	for mt.backlogSize > MAX_OUTPUT_BACKLOG && len(mt.backlog) > 1 {
+		mt.backlogSize -= len(mt.backlog[0].Data)
+		mt.backlog = mt.backlog[1:]
+	}
+	for ch := range mt.subscribers {
+		select {
+		case ch <- chunk:
+		default:
+			// The subscriber can't keep up
+			close(ch)
+			delete(mt.subscribers, ch)
+		}
+	}
+}
+
+// Split a stream of a task's output into chunks of up to TAIL_CHUNK_SIZE
+// bytes
+func splitOutput(id string, stream string, content string) (chunks []OutputChunk) {
+	for offset := 0; offset < len(content); offset += TAIL_CHUNK_SIZE {
+		end := offset + TAIL_CHUNK_SIZE
+		if end > len(content) {
+			end = len(content)
+		}
+		chunks = append(chunks, OutputChunk{TaskId: id, Stream: stream,
+			Offset: int64(offset), Data: []byte(content[offset:end])})
+	}
+	return chunks
+}
+
+// Subscribe to a task's output.  The returned channel gets the chunks of the
+// task's latest output (the whole output if the task is done) and then the
+// chunks of its output as it runs, and is closed once the task is done.  A
+// subscriber that falls too far behind has its channel closed early; the
+// chunks' offsets tell whether any output was missed.  The returned function
+// unsubscribes.
+func (m *Manager) Subscribe(id string) (<-chan OutputChunk, func(), error) {
+	mt, err := m.getManagedTask(id)
+	if err == ErrNoSuchTask {
+		var info TaskInfo
+		if info, err = m.getStoredTask(id); err != nil {
+			return nil, nil, err
+		}
+		return getOutputChannel(info), func() {}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if mt.info.State.Terminal() {
+		return getOutputChannel(mt.info), func() {}, nil
+	}
+	ch := make(chan OutputChunk, len(mt.backlog)+SUBSCRIBER_BUFFER)
+	for _, chunk := range mt.backlog {
+		ch <- chunk
+	}
+	mt.subscribers[ch] = struct{}{}
+	return ch, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if _, ok := mt.subscribers[ch]; ok {
+			close(ch)
+			delete(mt.subscribers, ch)
+		}
+	}, nil
+}
+
+// Return a closed channel of the chunks of a finished task's output
+func getOutputChannel(info TaskInfo) <-chan OutputChunk {
+	var chunks []OutputChunk
+	if info.Output != nil {
+		chunks = splitOutput(info.Id, STDOUT, info.Output.Stdout)
+		chunks = append(chunks, splitOutput(info.Id, STDERR, info.Output.Stderr)...)
+	}
+	ch := make(chan OutputChunk, len(chunks))
+	for _, chunk := range chunks {
+		ch <- chunk
+	}
+	close(ch)
+	return ch
+}
+
+// Return what the store knows of a task that isn't in memory, e.g., a
+// finished task that was dropped, ErrNoSuchTask if there's no store
+func (m *Manager) getStoredTask(id string) (TaskInfo, error) {
+	if m.store == nil {
+		return TaskInfo{}, ErrNoSuchTask
+	}
+	record, err := m.store.Get(id)
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	return record.Info, nil
+}
+
+func (m *Manager) getManagedTask(id string) (*managedTask, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mt, ok := m.tasks[id]
+	if !ok {
+		return nil, ErrNoSuchTask
+	}
+	return mt, nil
+}
+
+// Return what's known of a task
+func (m *Manager) Get(id string) (TaskInfo, error) {
+	mt, err := m.getManagedTask(id)
+	if err == ErrNoSuchTask {
+		return m.getStoredTask(id)
+	}
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return mt.info, nil
+}
+
+// Wait up to timeout (forever if 0) for a task to be done and return what's
+// known of it.  The task's state tells whether it's done.
+func (m *Manager) Wait(id string, timeout time.Duration) (TaskInfo, error) {
+	mt, err := m.getManagedTask(id)
+	if err == ErrNoSuchTask {
+		// A task that was dropped from memory is done
+		return m.getStoredTask(id)
+	}
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	if timeout == 0 {
+		<-mt.done
+	} else {
+		select {
+		case <-mt.done:
+		case <-time.After(timeout):
+		}
+	}
+	// The task may have been dropped from memory as soon as it was done
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return mt.info, nil
+}
+
+// Cancel a task.  A pending task is never started; a running task is killed
+// on its host, which can take a moment (e.g., if it's still being copied to
+// the host), so the task is only in the cancelled state once it's done.
+func (m *Manager) Cancel(id string) (TaskInfo, error) {
+	mt, err := m.getManagedTask(id)
+	if err == ErrNoSuchTask {
+		if _, err = m.getStoredTask(id); err == nil {
+			err = ErrTaskDone
+		}
+		return TaskInfo{}, err
+	}
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	m.lock.Lock()
+	if mt.info.State.Terminal() {
+		m.lock.Unlock()
+		return TaskInfo{}, ErrTaskDone
+	}
+	alreadyRequested := mt.cancelRequested
+	mt.cancelRequested = true
+	info := mt.info
+	m.lock.Unlock()
+
+	if info.State == TaskRunning && !alreadyRequested {
+		go m.kill(mt, info.Host)
+	}
+	return info, nil
+}
+
+// Kill a running task, retrying until it's killed or done (it might not
+// have been started on the host yet)
+func (m *Manager) kill(mt *managedTask, hostName string) {
+	h, err := getHostByName(config.GetParsedConfig().Hosts, hostName)
+	if err != nil {
+		log.Printf("Failed to cancel task %s: %s", mt.task.Id, err.Error())
+		return
+	}
+	for {
+		if err = Kill(m.conn, mt.task, h); err == nil {
+			return
+		}
+		select {
+		case <-mt.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Return what's known of every task, in the order they were submitted.  The
+// tasks that were dropped from memory are listed from the store, if any.
+func (m *Manager) List() []TaskInfo {
+	m.lock.Lock()
+	infos := make([]TaskInfo, len(m.ids))
+	for i, id := range m.ids {
+		infos[i] = m.tasks[id].info
+	}
+	listStore := m.store != nil && m.dropped
+	m.lock.Unlock()
+	if !listStore {
+		return infos
+	}
+
+	records, err := m.store.List()
+	if err != nil {
+		log.Print("Failed to list the recorded tasks: ", err.Error())
+		return infos
+	}
+	listed := map[string]bool{}
+	for _, info := range infos {
+		listed[info.Id] = true
+	}
+	for _, record := range records {
+		if !listed[record.Info.Id] {
+			infos = append(infos, record.Info)
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Submitted.Before(infos[j].Submitted)
+	})
+	return infos
+}
+
+// Stop taking new tasks, cancel the pending ones and wait for the running
+// ones to be done, until ctx is done.  The tasks still running then are left
+// running on their hosts (their results can be found in their remote
+// directories, which are logged) and returned, and any remote runner lock
+// that they hold is released.
+func (m *Manager) Shutdown(ctx context.Context) []TaskInfo {
+	m.lock.Lock()
+	m.shuttingDown = true
+	var unfinished []*managedTask
+	for _, id := range m.ids {
+		mt := m.tasks[id]
+		if mt.info.State.Terminal() {
+			continue
+		}
+		if mt.info.State == TaskPending {
+			mt.cancelRequested = true
+		}
+		unfinished = append(unfinished, mt)
+	}
+	m.lock.Unlock()
+
+	for _, mt := range unfinished {
+		select {
+		case <-mt.done:
+		case <-ctx.Done():
+		}
+	}
+	var left []TaskInfo
+	m.lock.Lock()
+	for _, mt := range unfinished {
+		if !mt.info.State.Terminal() {
+			left = append(left, mt.info)
+			log.Printf("Task %s left running on host %s in %s (local directory %s)", mt.info.Id,
+				mt.info.Host, mt.task.getRemoteDirPath(),
+				filepath.Join(config.GetParsedConfig().LocalWorkPath, mt.info.Id))
+		}
+	}
+	m.lock.Unlock()
+	if len(left) == 0 {
+		return nil
+	}
+	if m.store == nil {
+		log.Printf("WARNING: there's no task store, so the %d task(s) left running won't be picked up "+
+			"when the server starts again; their results must be collected from their hosts", len(left))
+	}
+
+	// A task that's still being scheduled or started may hold the lock
+	// of any host
+	var wg sync.WaitGroup
+	for _, h := range config.GetParsedConfig().Hosts {
+		for _, info := range left {
+			wg.Add(1)
+			go func(h host.Host, owner string) {
+				defer wg.Done()
+				removeRemoteRunnerLock(m.conn, h, owner)
+			}(h, info.Id)
+		}
+	}
+	wg.Wait()
+	return left
+}
+
+// Load the tasks recorded in the Manager's store.  The tasks that aren't done
+// are picked up (see store.go) in the background.
+func (m *Manager) Reconcile() error {
+	if m.store == nil {
+		return nil
+	}
+	records, err := m.store.List()
+	if err != nil {
+		return err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Info.Submitted.Before(records[j].Info.Submitted)
+	})
+
+	var unfinished []*managedTask
+	m.lock.Lock()
+	for _, record := range records {
+		if _, ok := m.tasks[record.Info.Id]; ok {
+			continue
+		}
+		mt := &managedTask{
+			task:        record.GetTask(),
+			info:        record.Info,
+			done:        make(chan struct{}),
+			subscribers: map[chan OutputChunk]struct{}{}}
+		if mt.info.State.Terminal() {
+			close(mt.done)
+		} else {
+			m.streamOutput(mt)
+			unfinished = append(unfinished, mt)
+		}
+		m.tasks[mt.info.Id] = mt
+		m.ids = append(m.ids, mt.info.Id)
+	}
+	m.dropFinished()
+	m.lock.Unlock()
+
+	for _, mt := range unfinished {
+		log.Printf("Picking up task %s (%s)", mt.info.Id, mt.info.State)
+		go m.resume(mt)
+	}
+	return nil
+}
+
+// Pick up a task that wasn't done when it was last recorded: collect the
+// result of a task that was started on its host and fail any other
+func (m *Manager) resume(mt *managedTask) {
+	m.lock.Lock()
+	info := mt.info
+	m.lock.Unlock()
+	defer markLocalDirFinished(info.Id)
+	if info.State == TaskPending || info.Host == "" {
+		m.finish(mt, RunOutput{Err: newRunError(PhaseSchedule, nil, errors.New(
+			"Task was interrupted before it was started"))})
+		return
+	}
+	h, err := getHostByName(config.GetParsedConfig().Hosts, info.Host)
+	if err != nil {
+		m.finish(mt, RunOutput{Err: newRunError(PhaseWait, nil, err)})
+		return
+	}
+	status, err := GetStatus(m.conn, mt.task, h)
+	if err != nil {
+		m.finish(mt, RunOutput{Err: newRemoteError(m.conn, h, PhaseWait, nil, err)})
+		return
+	}
+	switch status.State {
+	case StateUnknown:
+		// The task may have been interrupted while holding the host's
+		// lock
+		removeRemoteRunnerLock(m.conn, h, info.Id)
+		m.finish(mt, RunOutput{Err: newRunError(PhaseStart, nil, errors.New(fmt.Sprintf(
+			"Task %s was interrupted before it was started on host %s", info.Id, h.Name)))})
+		return
+	case StateLost:
+		m.finish(mt, RunOutput{Err: newRunError(PhaseWait, nil, errors.New(fmt.Sprintf(
+			"Task %s was lost on host %s", info.Id, h.Name)))})
+		return
+	}
+
+	caps, err := getCapabilities(m.conn, h)
+	if err != nil {
+		m.finish(mt, RunOutput{Err: newRemoteError(m.conn, h, PhaseCollect, nil, err)})
+		return
+	}
+	taskDirPath := filepath.Join(config.GetParsedConfig().LocalWorkPath, info.Id)
+	if err = os.MkdirAll(taskDirPath, 0755); err != nil {
+		m.finish(mt, RunOutput{Err: newRunError(PhaseCollect, nil, errors.New(fmt.Sprintf(
+			"Failed to create task directory: %s", err.Error())))})
+		return
+	}
+	output := getResult(m.conn, mt.task, h, caps, taskDirPath)
+	cleanUpAfterResult(m.conn, mt.task, h, output, taskDirPath)
+	m.finish(mt, output)
+}
@@ -0,0 +1,312 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"errors"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Create a new task with the given script commands
+func newManagedTask(t *testing.T, commands []string) Task {
+	task, err := New([]string{}, NewScriptWithCommands("test-manager", commands, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	return task
+}
+
+func TestManagerSubmitAndWait(t *testing.T) {
+	resetCapabilitiesCache()
+	m := NewManager(fake.NewLocal())
+	succeeding := newManagedTask(t, []string{"echo done"})
+	failing := newManagedTask(t, []string{"exit 4"})
+	for _, task := range []Task{succeeding, failing} {
+		info, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1", Owner: "alice"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if info.Id != task.Id || info.State != TaskPending ||
+			info.ScriptName != "test-manager" || info.Owner != "alice" {
+			t.Errorf("Unexpected info: %#v", info)
+		}
+	}
+
+	info, err := m.Wait(succeeding.Id, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if info.State != TaskSucceeded || info.Host != "server1" ||
+		info.Output == nil || info.Output.Stdout != "done\n" {
+		t.Errorf("Unexpected info: %#v", info)
+	}
+	if info.Started.Before(info.Submitted) || info.Finished.Before(info.Started) {
+		t.Errorf("Unexpected times: %#v", info)
+	}
+	if info, _ = m.Wait(failing.Id, 0); info.State != TaskFailed || info.Output.ExitCode != 4 {
+		t.Errorf("Unexpected info: %#v", info)
+	}
+
+	infos := m.List()
+	if len(infos) != 2 || infos[0].Id != succeeding.Id || infos[1].Id != failing.Id {
+		t.Errorf("Unexpected tasks: %#v", infos)
+	}
+	if _, err = m.Cancel(succeeding.Id); err != ErrTaskDone {
+		t.Errorf("Expected %v, got %v", ErrTaskDone, err)
+	}
+}
+
+func TestManagerErrors(t *testing.T) {
+	m := NewManager(fake.NewLocal())
+	if _, err := m.Get("no-such-task"); err != ErrNoSuchTask {
+		t.Errorf("Expected %v, got %v", ErrNoSuchTask, err)
+	}
+	if _, err := m.Wait("no-such-task", time.Second); err != ErrNoSuchTask {
+		t.Errorf("Expected %v, got %v", ErrNoSuchTask, err)
+	}
+	task := newManagedTask(t, []string{"true"})
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "no-such-host"}); err == nil {
+		t.Errorf("Expected submitting to an unknown host to fail")
+	}
+	if _, err := m.Submit(task, SubmitOptions{Strategy: Strategy("fastest")}); err == nil {
+		t.Errorf("Expected submitting with an unknown strategy to fail")
+	}
+	hosts := config.GetParsedConfig().Hosts[1:]
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1", Hosts: hosts}); err == nil {
+		t.Errorf("Expected submitting to a host that may not be chosen to fail")
+	}
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyRandom, Hosts: []host.Host{}}); err == nil {
+		t.Errorf("Expected submitting without hosts to fail")
+	}
+	if len(m.List()) != 0 {
+		t.Errorf("Expected the failed submissions not to be recorded")
+	}
+}
+
+func TestManagerCancel(t *testing.T) {
+	resetCapabilitiesCache()
+	m := NewManager(fake.NewLocal())
+	task := newManagedTask(t, []string{"sleep 30"})
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyRandom}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, err := m.Cancel(task.Id); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	info, err := m.Wait(task.Id, 20*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if info.State != TaskCancelled {
+		t.Errorf("Expected the task to be cancelled, got %#v", info)
+	}
+
+	// Cancel a task once it's running on its host
+	task = newManagedTask(t, []string{"sleep 30"})
+	if _, err = m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for info, _ = m.Get(task.Id); info.State == TaskPending; info, _ = m.Get(task.Id) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err = m.Cancel(task.Id); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if info, _ = m.Wait(task.Id, 20*time.Second); info.State != TaskCancelled {
+		t.Errorf("Expected the running task to be cancelled, got %#v", info)
+	}
+	if info.Output == nil || info.Output.ExitCode != SIGKILL_EXIT_CODE {
+		t.Errorf("Expected the running task to be killed, got %#v", info.Output)
+	}
+}
+
+func TestManagerWaitTimeout(t *testing.T) {
+	resetCapabilitiesCache()
+	m := NewManager(fake.NewLocal())
+	task := newManagedTask(t, []string{"sleep 3"})
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	info, err := m.Wait(task.Id, 100*time.Millisecond)
+	if err != nil || info.State.Terminal() {
+		t.Errorf("Expected the task to still be going, got %#v (%v)", info, err)
+	}
+	if info, _ = m.Wait(task.Id, 0); info.State != TaskSucceeded {
+		t.Errorf("Expected the task to succeed, got %#v", info)
+	}
+}
+
+func TestManagerSubscribe(t *testing.T) {
+	resetCapabilitiesCache()
+	m := NewManager(fake.NewLocal())
+	task := newManagedTask(t, []string{"echo one", "sleep 2", "echo two"})
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	ch, unsubscribe, err := m.Subscribe(task.Id)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer unsubscribe()
+	var chunks []OutputChunk
+	for chunk := range ch {
+		chunks = append(chunks, chunk)
+	}
+	if stdout, _ := joinChunks(t, chunks, STDOUT); stdout != "one\ntwo\n" {
+		t.Errorf("Unexpected streamed stdout: %q", stdout)
+	}
+	if info, _ := m.Get(task.Id); !info.State.Terminal() {
+		t.Errorf("Expected the channel to be closed once the task is done")
+	}
+
+	// A done task's whole output
+	if ch, _, err = m.Subscribe(task.Id); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	chunks = nil
+	for chunk := range ch {
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) != 1 || string(chunks[0].Data) != "one\ntwo\n" {
+		t.Errorf("Unexpected output of a done task: %#v", chunks)
+	}
+	if _, _, err = m.Subscribe("no-such-task"); err != ErrNoSuchTask {
+		t.Errorf("Expected %v, got %v", ErrNoSuchTask, err)
+	}
+}
+
+func TestManagerReconcile(t *testing.T) {
+	resetCapabilitiesCache()
+	store, remove := newTestFileStore(t)
+	defer remove()
+	m := NewManagerWithStore(fake.NewLocal(), store)
+	task := newManagedTask(t, []string{"echo partial", "exit 5"})
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	m.Wait(task.Id, 0)
+	record, err := store.Get(task.Id)
+	if err != nil || record.Info.State != TaskFailed || record.Info.Output.ExitCode != 5 {
+		t.Fatalf("Unexpected record: %#v (%v)", record, err)
+	}
+
+	// Records as a crashed process would have left them: the task above
+	// as still running and its result not collected, a task that was
+	// never started and one that was interrupted while being started
+	record.Info.State = TaskRunning
+	record.Info.Finished = time.Time{}
+	record.Info.Output = nil
+	os.RemoveAll(filepath.Join(config.GetParsedConfig().LocalWorkPath, task.Id))
+	now := time.Now()
+	for _, r := range []TaskRecord{record,
+		{Info: TaskInfo{Id: "pending-task", ScriptName: "test-manager", State: TaskPending, Submitted: now}},
+		{Info: TaskInfo{Id: "starting-task", ScriptName: "test-manager", State: TaskRunning,
+			Host: "server1", Submitted: now.Add(time.Second)}},
+	} {
+		if err = store.Put(r); err != nil {
+			t.Fatalf("Failed to put record: %s", err.Error())
+		}
+	}
+
+	m = NewManagerWithStore(fake.NewLocal(), store)
+	if err = m.Reconcile(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	infos := m.List()
+	if len(infos) != 3 || infos[0].Id != task.Id || infos[2].Id != "starting-task" {
+		t.Errorf("Expected the tasks in submission order, got %#v", infos)
+	}
+	info, _ := m.Wait(task.Id, 20*time.Second)
+	if info.State != TaskFailed || info.Output.ExitCode != 5 || info.Output.Stdout != "partial\n" {
+		t.Errorf("Expected the result to be collected again, got %#v", info)
+	}
+	for id, phase := range map[string]Phase{"pending-task": PhaseSchedule, "starting-task": PhaseStart} {
+		info, _ = m.Wait(id, 20*time.Second)
+		var runErr *RunError
+		if info.State != TaskFailed || !errors.As(info.Output.Err, &runErr) || runErr.Phase != phase {
+			t.Errorf("Expected %s to fail in the %s phase, got %#v", id, phase, info)
+		}
+	}
+	if record, _ = store.Get(task.Id); record.Info.State != TaskFailed {
+		t.Errorf("Expected the collected result to be recorded, got %#v", record.Info)
+	}
+}
+
+func TestManagerRetention(t *testing.T) {
+	resetCapabilitiesCache()
+	store, remove := newTestFileStore(t)
+	defer remove()
+	for _, withStore := range []bool{false, true} {
+		m := NewManager(fake.NewLocal())
+		if withStore {
+			m = NewManagerWithStore(fake.NewLocal(), store)
+		}
+		m.SetRetention(1, 0)
+		var ids []string
+		for _, commands := range [][]string{{"echo first"}, {"echo second"}} {
+			task := newManagedTask(t, commands)
+			if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1"}); err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			if info, _ := m.Wait(task.Id, 0); info.State != TaskSucceeded {
+				t.Errorf("Unexpected info: %#v", info)
+			}
+			ids = append(ids, task.Id)
+		}
+		if _, ok := m.tasks[ids[0]]; ok || len(m.tasks) != 1 {
+			t.Errorf("Expected only the latest finished task to be kept in memory, got %d", len(m.tasks))
+		}
+
+		info, err := m.Get(ids[0])
+		if !withStore {
+			if err != ErrNoSuchTask {
+				t.Errorf("Expected %v without a store, got %v", ErrNoSuchTask, err)
+			}
+			if infos := m.List(); len(infos) != 1 || infos[0].Id != ids[1] {
+				t.Errorf("Unexpected tasks: %#v", infos)
+			}
+			continue
+		}
+		if err != nil || info.State != TaskSucceeded || info.Output.Stdout != "first\n" {
+			t.Errorf("Expected the dropped task from the store, got %#v (%v)", info, err)
+		}
+		if info, err = m.Wait(ids[0], time.Second); err != nil || info.State != TaskSucceeded {
+			t.Errorf("Expected the dropped task to be done, got %#v (%v)", info, err)
+		}
+		if _, err = m.Cancel(ids[0]); err != ErrTaskDone {
+			t.Errorf("Expected %v, got %v", ErrTaskDone, err)
+		}
+		ch, unsubscribe, err := m.Subscribe(ids[0])
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		unsubscribe()
+		if chunk := <-ch; string(chunk.Data) != "first\n" {
+			t.Errorf("Expected the dropped task's output, got %q", chunk.Data)
+		}
+		if infos := m.List(); len(infos) != 2 || infos[0].Id != ids[0] || infos[1].Id != ids[1] {
+			t.Errorf("Expected both tasks in submission order, got %#v", infos)
+		}
+	}
+
+	// Finished tasks older than the age limit are dropped too
+	m := NewManager(fake.NewLocal())
+	task := newManagedTask(t, []string{"true"})
+	if _, err := m.Submit(task, SubmitOptions{Strategy: StrategyHost, Host: "server1"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	m.Wait(task.Id, 0)
+	time.Sleep(10 * time.Millisecond)
+	m.SetRetention(0, time.Millisecond)
+	if _, err := m.Get(task.Id); err != ErrNoSuchTask {
+		t.Errorf("Expected the old task to be dropped, got %v", err)
+	}
+}
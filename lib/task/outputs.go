@@ -0,0 +1,241 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Collect the output files of tasks.
+
+A task declares its output files as globs relative to its remote task
+directory (see Task.Outputs).  After the task's script exits, the globs are
+expanded by the shell on the target host and the matching regular files are
+copied into the "results" subdirectory of the local task directory.  A
+manifest of the collected files is returned in the RunOutput.
+
+Symbolic links are never followed: a matching file that is a link, or that is
+in a linked directory outside of the task directory, is left out.  Otherwise a
+task (e.g., one run as another user) could have geto copy any file that its
+SSH user can read into the results.
+*/
+package task
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/shell"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The subdirectory of the local task directory that output files are
+// collected into
+const RESULTS_DIR = "results"
+
+// The maximum total size of a task's output files when the task doesn't set
+// MaxOutputSize (100 MiB)
+const DEFAULT_MAX_OUTPUT_SIZE = 100 << 20
+
+// An output file collected from a task
+type OutputFile struct {
+	// The path of the file relative to the task directory (and to the
+	// local results directory)
+	Path string
+	// The size of the file in bytes
+	Size int64
+	// The hex-encoded SHA-256 of the file
+	SHA256 string
+}
+
+// Output globs are expanded by the shell on the target host, so they may only
+// contain glob characters and characters that the shell doesn't treat
+// specially.
+var validOutputGlob *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_.*?\[\]/-]+$`)
+
+// Output files are copied with their paths, so they are limited to the
+// characters that are safe in remote commands.
+var validOutputPath *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_.,+=@%/-]+$`)
+
+// Return an error if the path (or glob) isn't relative to the task directory
+func validateRelPath(path string) error {
+	if filepath.IsAbs(path) {
+		return errors.New(fmt.Sprintf("Output %q is absolute", path))
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return errors.New(fmt.Sprintf(
+				"Output %q is outside of the task directory", path))
+		}
+	}
+	return nil
+}
+
+// Return an error if any of the task's output globs is invalid
+func validateOutputs(task Task) error {
+	for _, glob := range task.Outputs {
+		if !validOutputGlob.MatchString(glob) {
+			return errors.New(fmt.Sprintf(
+				"Invalid output glob %q: must be letters, digits, "+
+					"'_', '.', '-', '/' and the glob characters "+
+					"'*', '?', '[' and ']'",
+				glob))
+		}
+		if err := validateRelPath(glob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the maximum total size of the task's output files
+func (t *Task) getMaxOutputSize() int64 {
+	if t.MaxOutputSize == 0 {
+		return DEFAULT_MAX_OUTPUT_SIZE
+	}
+	return int64(t.MaxOutputSize)
+}
+
+// List the regular files on the host that match the task's output globs,
+// with their sizes.  Files that are links or whose real directory is outside
+// of the task directory are listed with a size of -1.
+func listOutputFiles(conn remote.Remote, task Task, host host.Host) (files []OutputFile, err error) {
+	// The globs are validated, so they are left unquoted for the shell to
+	// expand.  A glob that matches nothing is left as is, and is then
+	// skipped since it isn't a file.
+	stdout, stderr, err := conn.Run(
+		host,
+		fmt.Sprintf(
+			"cd %s && t=$(pwd -P) && for f in %s; do if [ -f \"$f\" ]; then "+
+				"if [ -h \"$f\" ]; then n=-; else d=$(cd -P \"$(dirname \"$f\")\" && pwd -P)/; "+
+				"case \"$d\" in \"$t\"/*) n=$(wc -c < \"$f\");; *) n=-;; esac; fi; "+
+				"printf '%%s %%s\\n' \"$n\" \"$f\"; fi; done",
+			shell.Quote(task.getRemoteDirPath()),
+			strings.Join(task.Outputs, " ")),
+		0)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Failed to list output files of task %s: %s (%s)",
+			task.Id, err.Error(), strings.TrimSpace(stderr)))
+	}
+	return parseOutputFiles(stdout)
+}
+
+// Parse the output file listing, lines of "<size> <path>", where the size of a
+// file that mustn't be collected is "-" (and is returned as -1).  Files
+// matched by more than one glob are only listed once.
+func parseOutputFiles(output string) (files []OutputFile, err error) {
+	seen := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf(
+				"Unexpected output file listing: %q", line))
+		}
+		size := int64(-1)
+		if fields[0] != "-" {
+			size, err = strconv.ParseInt(fields[0], 10, 64)
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(
+				"Failed to parse output file size: %s", err.Error()))
+		}
+		path := filepath.Clean(fields[1])
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, OutputFile{Path: path, Size: size})
+		}
+	}
+	return files, nil
+}
+
+// Return the hex-encoded SHA-256 of a local file
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Collect the task's output files into the results directory of the local
+// task directory and return their manifest.  Files are collected in the
+// order they are listed until the task's MaxOutputSize is reached; an error
+// is returned (along with the manifest of the files that were collected) if
+// any matching file was left out.
+func collectOutputs(conn remote.Remote, task Task, host host.Host, caps Capabilities, taskDirPath string) (manifest []OutputFile, err error) {
+	if len(task.Outputs) == 0 {
+		return nil, nil
+	}
+	files, err := listOutputFiles(conn, task, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	var selected []OutputFile
+	var relPaths, leftOut []string
+	for _, file := range files {
+		if file.Size < 0 {
+			leftOut = append(leftOut, fmt.Sprintf("%s (symbolic link)", file.Path))
+			continue
+		}
+		if !validOutputPath.MatchString(file.Path) || validateRelPath(file.Path) != nil {
+			leftOut = append(leftOut, fmt.Sprintf("%q (unsafe name)", file.Path))
+			continue
+		}
+		if total+file.Size > task.getMaxOutputSize() {
+			leftOut = append(leftOut, fmt.Sprintf("%s (size limit)", file.Path))
+			continue
+		}
+		total += file.Size
+		selected = append(selected, file)
+		relPaths = append(relPaths, file.Path)
+	}
+
+	resultsDirPath := filepath.Join(taskDirPath, RESULTS_DIR)
+	if len(selected) > 0 {
+		err = copyFilesFrom(conn, host, caps, task.getRemoteDirPath(), relPaths, resultsDirPath)
+		if err != nil {
+			return nil, newRunError(PhaseCollect, ErrTransfer, errors.New(fmt.Sprintf(
+				"Failed to copy output files of task %s: %s",
+				task.Id, err.Error())))
+		}
+	}
+
+	for _, file := range selected {
+		// Describe the file as it was received
+		localPath := filepath.Join(resultsDirPath, filepath.FromSlash(file.Path))
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return manifest, errors.New(fmt.Sprintf(
+				"Failed to read output file %s: %s", file.Path, err.Error()))
+		}
+		file.Size = info.Size()
+		if file.SHA256, err = sha256File(localPath); err != nil {
+			return manifest, errors.New(fmt.Sprintf(
+				"Failed to read output file %s: %s", file.Path, err.Error()))
+		}
+		manifest = append(manifest, file)
+	}
+
+	if len(leftOut) > 0 {
+		return manifest, errors.New(fmt.Sprintf(
+			"Output files of task %s were not collected: %s",
+			task.Id, strings.Join(leftOut, ", ")))
+	}
+	return manifest, nil
+}
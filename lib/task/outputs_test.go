@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Script commands that create some output files
+var outputCommands = []string{
+	"mkdir -p out/sub",
+	"printf a > out/a.txt",
+	"printf bb > out/sub/b.txt",
+	"printf c > out/c.log",
+}
+
+// Run a task that creates output files on the local machine
+func runOutputsTask(t *testing.T, outputs []string, maxOutputSize uint64) (Task, RunOutput) {
+	task, err := New([]string{}, NewScriptWithCommands("test-outputs", outputCommands, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Outputs = outputs
+	task.MaxOutputSize = maxOutputSize
+	return task, runLocalTaskOnHost(t, task, config.GetParsedConfig().Hosts[0])
+}
+
+func TestValidateOutputs(t *testing.T) {
+	for _, glob := range []string{"out/*.txt", "report.html", "out/[ab]?.bin", "a/b-c_d"} {
+		if err := validateOutputs(Task{Outputs: []string{glob}}); err != nil {
+			t.Errorf("Expected %q to be valid: %s", glob, err.Error())
+		}
+	}
+	for _, glob := range []string{
+		"", "/etc/passwd", "../other/*", "out/../../x", "$(reboot)",
+		"a b", "a;b", "`id`", "out/{a,b}"} {
+		if err := validateOutputs(Task{Outputs: []string{glob}}); err == nil {
+			t.Errorf("Expected %q to be invalid", glob)
+		}
+	}
+}
+
+func TestParseOutputFiles(t *testing.T) {
+	files, err := parseOutputFiles("      12 out/a.txt\n3 ./out/b\n12 out/a.txt\n- out/link\n")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := []OutputFile{{Path: "out/a.txt", Size: 12}, {Path: "out/b", Size: 3}, {Path: "out/link", Size: -1}}
+	if fmt.Sprintf("%#v", files) != fmt.Sprintf("%#v", expected) {
+		t.Errorf("Expected %#v, got %#v", expected, files)
+	}
+	if _, err = parseOutputFiles("garbage\n"); err == nil {
+		t.Errorf("Expected a bad listing to fail")
+	}
+}
+
+func TestCollectOutputs(t *testing.T) {
+	task, output := runOutputsTask(t,
+		[]string{"out/*.txt", "out/*/*.txt", "out/a.txt", "missing*"}, 0)
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+	expected := []OutputFile{
+		{Path: "out/a.txt", Size: 1, SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("a")))},
+		{Path: "out/sub/b.txt", Size: 2, SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("bb")))},
+	}
+	if fmt.Sprintf("%#v", output.Outputs) != fmt.Sprintf("%#v", expected) {
+		t.Errorf("Expected manifest %#v, got %#v", expected, output.Outputs)
+	}
+	resultsDirPath := filepath.Join(config.GetParsedConfig().LocalWorkPath, task.Id, RESULTS_DIR)
+	content, err := ioutil.ReadFile(filepath.Join(resultsDirPath, "out", "sub", "b.txt"))
+	if err != nil || string(content) != "bb" {
+		t.Errorf("Expected the output file to be collected, got %q (%v)", content, err)
+	}
+}
+
+func TestCollectOutputsSkipsLinks(t *testing.T) {
+	secretDirPath, err := ioutil.TempDir("", "geto-secret")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(secretDirPath)
+	if err = ioutil.WriteFile(filepath.Join(secretDirPath, "id_rsa"), []byte("key"), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	task, err := New([]string{}, NewScriptWithCommands("test-outputs", []string{
+		"mkdir -p out",
+		"printf a > out/a.txt",
+		"ln -s " + filepath.Join(secretDirPath, "id_rsa") + " out/key",
+		"ln -s a.txt out/alias",
+		"ln -s " + secretDirPath + " out/ssh",
+	}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Outputs = []string{"out/*", "out/ssh/*"}
+	output := runLocalTaskOnHost(t, task, config.GetParsedConfig().Hosts[0])
+	if output.Err == nil {
+		t.Errorf("Expected an error for the linked output files")
+	} else {
+		for _, path := range []string{"out/key", "out/alias", "out/ssh/id_rsa"} {
+			if !strings.Contains(output.Err.Error(), path) {
+				t.Errorf("Expected %s to be reported, got %s", path, output.Err.Error())
+			}
+		}
+	}
+	if len(output.Outputs) != 1 || output.Outputs[0].Path != "out/a.txt" {
+		t.Errorf("Expected only out/a.txt to be collected, got %#v", output.Outputs)
+	}
+	resultsDirPath := filepath.Join(config.GetParsedConfig().LocalWorkPath, task.Id, RESULTS_DIR)
+	for _, path := range []string{"out/key", "out/ssh/id_rsa"} {
+		if _, err = os.Lstat(filepath.Join(resultsDirPath, path)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to be copied (%v)", path, err)
+		}
+	}
+}
+
+func TestCollectOutputsSizeLimit(t *testing.T) {
+	_, output := runOutputsTask(t, []string{"out/sub/b.txt", "out/a.txt", "out/c.log"}, 3)
+	if output.Err == nil {
+		t.Errorf("Expected an error for output files over the size limit")
+	}
+	// b.txt and a.txt fit in the limit, c.log doesn't
+	if len(output.Outputs) != 2 || output.Outputs[1].Path != "out/a.txt" {
+		t.Errorf("Unexpected manifest: %#v", output.Outputs)
+	}
+}
+
+func TestCollectOutputsWithoutTar(t *testing.T) {
+	// Pretend that the host doesn't have tar, so files are copied one by
+	// one
+	caps, err := ProbeCapabilities(fake.NewLocal(), config.GetParsedConfig().Hosts[0])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	caps.Tar = false
+	task, err := New([]string{}, NewScriptWithCommands("test-outputs", outputCommands, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Outputs = []string{"out/*/*.txt"}
+	h := config.GetParsedConfig().Hosts[0]
+	capabilitiesCacheLock.Lock()
+	capabilitiesCache[h.Name] = caps
+	capabilitiesCacheLock.Unlock()
+	defer resetCapabilitiesCache()
+
+	ch := make(chan RunOutput)
+	go RunOnHost(fake.NewLocal(), task, h, ch)
+	output := <-ch
+	if output.Err != nil || len(output.Outputs) != 1 || output.Outputs[0].Path != "out/sub/b.txt" {
+		t.Errorf("Unexpected output: %#v", output)
+	}
+}
@@ -13,8 +13,11 @@ import (
 	"github.com/bgmerrell/geto/lib/config"
 	"github.com/bgmerrell/geto/lib/host"
 	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/shell"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -26,9 +29,16 @@ func init() {
 }
 
 type RunOutput struct {
+	// The stdout and stderr of the task's script
 	Stdout string
 	Stderr string
 	Err    error
+	// The exit code of the task's script
+	ExitCode int
+	// The resource limit, if any, that the task hit
+	LimitHit Limit
+	// The output files collected into the local results directory
+	Outputs []OutputFile
 }
 
 type NRunningScriptsOutput struct {
@@ -36,41 +46,65 @@ type NRunningScriptsOutput struct {
 	err error
 }
 
-// Acquire a remote lock by creating a remote directory that acts as a lock.
+// The file in the remote lock directory that names the lock's owner
+const LOCK_OWNER_FILE = "owner"
+
+// Acquire a remote lock by creating a remote directory that acts as a lock,
+// recording owner in it so that only the owner releases it.  The returned
+// error is a *RunError, of kind ErrLockBusy if the lock is held by someone
+// else.
 // IMPORTANT: This assumes mkdir is atomic on the target filesystem
-func acquireRemoteRunnerLock(conn remote.Remote, host host.Host) (stderr string, err error) {
+func acquireRemoteRunnerLock(conn remote.Remote, host host.Host, owner string) (stderr string, err error) {
 	const RETRIES = 10
 	const SLEEP_INTERVAL = 0.1
 	c := config.GetParsedConfig()
+	lockOwnerPath := filepath.Join(c.RemoteLockPath, LOCK_OWNER_FILE)
+	// If mkdir fails for any other reason than the lock being held, it
+	// is run again to fail with its error.
+	command := fmt.Sprintf(
+		"if mkdir %[1]s 2>/dev/null; then echo %[2]s > %[3]s; "+
+			"elif [ -d %[1]s ]; then echo busy; else mkdir %[1]s; fi",
+		shell.Quote(c.RemoteLockPath),
+		shell.Quote(owner),
+		shell.Quote(lockOwnerPath))
 	for i := 0; i < RETRIES; i++ {
-		_, stderr, err = conn.Run(
-			host,
-			fmt.Sprintf("mkdir %s", c.RemoteLockPath),
-			0)
-		if err == nil {
-			break
+		if i > 0 {
+			time.Sleep(SLEEP_INTERVAL * 1000 * time.Millisecond)
+		}
+		var stdout string
+		stdout, stderr, err = conn.Run(host, command, 0)
+		if err != nil {
+			return stderr, newRemoteError(conn, host, PhaseLock, nil, errors.New(
+				"Failed to acquire remote lock: "+err.Error()))
+		}
+		if strings.TrimSpace(stdout) != "busy" {
+			return stderr, nil
 		}
 	}
-	if err != nil {
-		err = errors.New("Failed to acquire remote lock: " + err.Error())
-	}
-
-	return stderr, err
+	return stderr, newRunError(PhaseLock, ErrLockBusy, errors.New(fmt.Sprintf(
+		"Remote lock %s on host %s is busy", c.RemoteLockPath, host.Name)))
 }
 
-// Remove the remote runner lock from the master side.  This is only to be
-// used when an error is encountered that prevents the task script from being
-// executed on the target and the lock has already been acquired.
-func removeRemoteRunnerLock(conn remote.Remote, host host.Host) {
+// Remove the remote runner lock from the master side if owner holds it.  This
+// is only to be used when an error is encountered that prevents the task
+// script from being executed on the target (the wrapper script releases the
+// lock otherwise) or when the lock was acquired for something other than
+// starting a task.
+func removeRemoteRunnerLock(conn remote.Remote, host host.Host, owner string) {
 	const RETRIES = 20
 	const SLEEP_INTERVAL = 0.1
 	c := config.GetParsedConfig()
+	command := fmt.Sprintf(
+		"if [ \"$(cat %s 2>/dev/null)\" = %s ]; then rm -r %s; fi",
+		shell.Quote(filepath.Join(c.RemoteLockPath, LOCK_OWNER_FILE)),
+		shell.Quote(owner),
+		shell.Quote(c.RemoteLockPath))
 	var err error
 	for i := 0; i < RETRIES; i++ {
-		_, _, err = conn.Run(
-			host,
-			fmt.Sprintf("rm -r %s", c.RemoteLockPath),
-			0)
+		if i > 0 {
+			time.Sleep(SLEEP_INTERVAL * 1000 * time.Millisecond)
+		}
+		_, _, err = conn.Run(host, command, 0)
 		if err == nil {
 			log.Printf("Remote lock removed")
 			break
@@ -81,6 +115,52 @@ func removeRemoteRunnerLock(conn remote.Remote, host host.Host) {
 	}
 }
 
+// The state of a host's remote runner lock
+type LockStatus struct {
+	Held bool
+	// The owner recorded in the lock (e.g., the ID of the task being
+	// started), "" if the lock isn't held or has no owner
+	Owner string
+	// When the lock was acquired, zero if it isn't held
+	Since time.Time
+}
+
+// Return the state of a host's remote runner lock
+func GetRemoteRunnerLock(conn remote.Remote, host host.Host) (status LockStatus, err error) {
+	c := config.GetParsedConfig()
+	stdout, stderr, err := conn.Run(host, fmt.Sprintf(
+		"if [ -d %[1]s ]; then stat -c %%Y %[1]s 2>/dev/null || stat -f %%m %[1]s; "+
+			"cat %[2]s 2>/dev/null; fi",
+		shell.Quote(c.RemoteLockPath),
+		shell.Quote(filepath.Join(c.RemoteLockPath, LOCK_OWNER_FILE))), 0)
+	if err != nil {
+		return status, errors.New(fmt.Sprintf(
+			"Failed to get remote lock of host %s: %s (%s)",
+			host.Name, err.Error(), strings.TrimSpace(stderr)))
+	}
+	lines := strings.SplitN(strings.TrimSpace(stdout), "\n", 2)
+	if lines[0] == "" {
+		return status, nil
+	}
+	status.Held = true
+	mtime, err := strconv.ParseInt(strings.TrimSpace(lines[0]), 10, 64)
+	if err != nil {
+		return status, errors.New(fmt.Sprintf(
+			"Failed to parse remote lock time of host %s: %q", host.Name, lines[0]))
+	}
+	status.Since = time.Unix(mtime, 0)
+	if len(lines) > 1 {
+		status.Owner = strings.TrimSpace(lines[1])
+	}
+	return status, nil
+}
+
+// Release a host's remote runner lock if owner still holds it, e.g., when the
+// lock was left behind by a geto process that was killed
+func ReleaseRemoteRunnerLock(conn remote.Remote, host host.Host, owner string) {
+	removeRemoteRunnerLock(conn, host, owner)
+}
+
 func createRemoteWorkPathDir(conn remote.Remote, host host.Host) (stderr string, err error) {
 	// Create the remote work path on the target host in case it hasn't
 	// been corrected yet.
@@ -89,7 +169,7 @@ func createRemoteWorkPathDir(conn remote.Remote, host host.Host) (stderr string,
 	c := config.GetParsedConfig()
 	_, stderr, err = conn.Run(
 		host,
-		fmt.Sprintf("mkdir -p %s", c.RemoteWorkPath),
+		shell.Command("mkdir", "-p", c.RemoteWorkPath),
 		0)
 	if err != nil {
 		err = errors.New(fmt.Sprintf(
@@ -99,169 +179,442 @@ func createRemoteWorkPathDir(conn remote.Remote, host host.Host) (stderr string,
 	return stderr, err
 }
 
-func getWrapperTask(innerTask Task) (wrapperTask Task, err error) {
+// Copy a local directory into a directory on the host, as a single archive
+// stream if the host has tar
+func copyDirTo(conn remote.Remote, host host.Host, caps Capabilities, localPath string, remoteDirPath string) error {
+	if caps.Tar {
+		return conn.CopyArchiveTo(host, localPath, remoteDirPath)
+	}
+	return conn.CopyTo(host, true, localPath, remoteDirPath)
+}
+
+// Copy files, relative to a directory on the host, into a local directory
+// with the same relative paths.  The files are copied as a single archive
+// stream if the host has tar, and one by one otherwise.
+func copyFilesFrom(conn remote.Remote, host host.Host, caps Capabilities, remoteDirPath string, relPaths []string, localDirPath string) error {
+	if caps.Tar {
+		return conn.CopyArchiveFrom(host, remoteDirPath, relPaths, localDirPath)
+	}
+	for _, relPath := range relPaths {
+		localPath := filepath.Join(localDirPath, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		err := conn.CopyFrom(
+			host, false, filepath.Join(remoteDirPath, relPath), localPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The number of seconds to wait after sending SIGTERM to a task that has
+// timed out before sending SIGKILL
+const KILL_AFTER = 10
+
+// The exit code recorded for a task that timed out, the same as timeout(1).
+// Whether a task timed out is told by TIMED_OUT_FILE, since its script may
+// exit with this code too.
+const TIMED_OUT_EXIT_CODE = 124
+
+// The exit code of timeout(1) when it had to kill the command with SIGKILL
+const TIMEOUT_KILLED_EXIT_CODE = 128 + 9
+
+// Return the wrapper task that starts innerTask on a host with the given
+// capabilities.  The wrapper sets up the task directory (see isolation.go),
+// records the task's state (see state.go), starts a supervising process for
+// the task in the background and releases the remote lock.
+func getWrapperTask(innerTask Task, host host.Host, caps Capabilities) (wrapperTask Task, err error) {
 	remoteInnerTaskDirPath := innerTask.getRemoteDirPath()
-	stdoutPath := filepath.Join(remoteInnerTaskDirPath, "stdout")
-	stderrPath := filepath.Join(remoteInnerTaskDirPath, "stderr")
 	c := config.GetParsedConfig()
-	var timeoutString string
-	if innerTask.Timeout > 0 {
-		timeoutString = fmt.Sprintf("%ss", innerTask.Timeout)
-	} else {
-		timeoutString = "3650d" // effectively no timeout
-	}
-	wrapperScript := NewScriptWithCommands(
-		"wrapper",
-		[]string{
-			"#!/bin/bash",
-			// It would be nice to not have the "timeout"
-			// dependency.
-			fmt.Sprintf("timeout --kill-after=10 %s %s 1>%s 2>%s &",
-				timeoutString,
-				innerTask.getRemoteScriptPath(),
-				stdoutPath,
-				stderrPath),
-			fmt.Sprintf("rm -r %s", c.RemoteLockPath)},
-		nil)
-	return New([]string{}, wrapperScript, 0)
+	commands := []string{
+		"#!/bin/sh",
+		// Run from the task directory so that the DEPS directory can
+		// be referenced relatively.
+		shell.Command("cd", remoteInnerTaskDirPath)}
+	commands = append(commands, innerTask.getIsolationSetup()...)
+	commands = append(commands,
+		// Record the task's state before the lock is released so
+		// that anyone counting running scripts sees this task.
+		fmt.Sprintf("echo %s > %s", shell.Quote(innerTask.Script.name), NAME_FILE),
+		fmt.Sprintf("echo %s > %s", StateRunning, STATE_FILE),
+		"(")
+	supervisorCommands, err := getSupervisorCommands(innerTask, host, caps)
+	if err != nil {
+		return Task{}, err
+	}
+	commands = append(commands, supervisorCommands...)
+	commands = append(commands,
+		") >/dev/null 2>&1 </dev/null &",
+		fmt.Sprintf("echo $! > %s", PID_FILE),
+		shell.Command("rm", "-r", c.RemoteLockPath))
+	return New([]string{}, NewScriptWithCommands("wrapper", commands, nil), 0)
 }
 
-func getRemoteNRunningScripts(conn remote.Remote, task Task, host host.Host, ch chan<- NRunningScriptsOutput) {
-	c := config.GetParsedConfig()
-	// ^ is used to avoid matching the wrapper timeout process
-	var pgrepPattern = fmt.Sprintf(
-		"^/bin/bash %s/.*_%s", c.RemoteWorkPath, task.Script.name)
-	stdout, _, err := conn.Run(
-		host,
-		// pgrep -c returns 1 if the count is zero (which
-		// seems silly); we append the "; true" to work around
-		// this.
-		fmt.Sprintf("pgrep -c -f \"%s\"; true", pgrepPattern),
-		0)
-	n, err := strconv.ParseUint(strings.TrimSpace(stdout), 10, 32)
-	ch <- NRunningScriptsOutput{uint32(n), err}
+// Return the command (as a list of words) that runs the task's script on a
+// host with the given capabilities
+func getScriptCommand(innerTask Task, host host.Host, caps Capabilities) ([]string, error) {
+	command := append(
+		innerTask.Script.GetInterpreter().Command(),
+		innerTask.getRemoteScriptPath())
+	if innerTask.Container == nil {
+		return innerTask.Limits.wrapCommand(
+			innerTask.wrapIsolation(command, host), caps), nil
+	}
+	runtime, err := innerTask.Container.getRuntime(caps)
+	if err != nil {
+		return nil, err
+	}
+	// The limits are applied inside of the container, except for the
+	// cgroup limits, which are applied by the runtime.
+	command = innerTask.wrapPrivateDirs(
+		innerTask.Limits.wrapCommand(command, Capabilities{}))
+	return innerTask.wrapRunAs(
+		innerTask.wrapContainer(command, runtime), host), nil
 }
 
-// Run a task on a target host
+// Return the commands of the process that supervises a task: it runs the
+// task's script in its own process group, enforces the task's timeout and
+// records the script's exit code.
+func getSupervisorCommands(innerTask Task, host host.Host, caps Capabilities) ([]string, error) {
+	remoteInnerTaskDirPath := innerTask.getRemoteDirPath()
+	command, err := getScriptCommand(innerTask, host, caps)
+	if err != nil {
+		return nil, err
+	}
+	scriptCommand := fmt.Sprintf("%s 1>%s 2>%s </dev/null",
+		shell.Join(command),
+		shell.Quote(filepath.Join(remoteInnerTaskDirPath, "stdout")),
+		shell.Quote(filepath.Join(remoteInnerTaskDirPath, "stderr")))
+	var recordExit []string
+	if innerTask.Container != nil {
+		// The runtime's client might have been killed without
+		// stopping the container.
+		runtime, _ := innerTask.Container.getRuntime(caps)
+		recordExit = append(recordExit,
+			innerTask.getContainerCleanup(runtime, host))
+	}
+	recordExit = append(recordExit,
+		fmt.Sprintf("echo $rc > %s", EXIT_CODE_FILE),
+		fmt.Sprintf("echo %s > %s", StateExited, STATE_FILE))
+
+	if caps.Timeout {
+		// timeout puts itself (and thus the script) in its own process
+		// group.  A duration of 0 disables the timeout.
+		commands := []string{
+			"s=$(date +%s)",
+			fmt.Sprintf("timeout --kill-after=%d %d %s &",
+				KILL_AFTER, innerTask.Timeout, scriptCommand),
+			fmt.Sprintf("echo $! > %s", PGID_FILE),
+			"wait $!",
+			"rc=$?"}
+		if innerTask.Timeout > 0 {
+			// timeout's exit codes could also be the script's own,
+			// so the script only timed out if it ran for as long
+			commands = append(commands,
+				fmt.Sprintf("if { [ $rc -eq %d ] || [ $rc -eq %d ]; } && [ $(($(date +%%s) - s)) -ge %d ]; then",
+					TIMED_OUT_EXIT_CODE, TIMEOUT_KILLED_EXIT_CODE, innerTask.Timeout),
+				fmt.Sprintf(": > %s", TIMED_OUT_FILE),
+				fmt.Sprintf("rc=%d", TIMED_OUT_EXIT_CODE),
+				"fi")
+		}
+		return append(commands, recordExit...), nil
+	}
+
+	// Without a timeout command, start the script in its own process
+	// group if possible, and enforce the timeout from a watchdog loop.
+	var launcher, group string
+	if caps.Setsid {
+		launcher = "setsid "
+		group = "-$c"
+	} else if caps.Perl {
+		launcher = shell.Command(
+			"perl", "-e", "setpgrp(0, 0); exec @ARGV or die $!") + " "
+		group = "-$c"
+	} else {
+		// Only the script itself (not its children) can be killed
+		group = "$c"
+	}
+	commands := []string{
+		fmt.Sprintf("%s%s &", launcher, scriptCommand),
+		"c=$!",
+		fmt.Sprintf("echo $c > %s", PGID_FILE)}
+	if innerTask.Timeout > 0 {
+		// The watchdog checks the exit code record rather than the
+		// script's process, which might belong to another user (see
+		// Task.RunAs).
+		kill := innerTask.getKillCommand(host)
+		commands = append(commands,
+			"(",
+			"i=0",
+			fmt.Sprintf("while [ ! -f %s ]; do", EXIT_CODE_FILE),
+			fmt.Sprintf("if [ $i -ge %d ]; then", innerTask.Timeout),
+			fmt.Sprintf(": > %s", TIMED_OUT_FILE),
+			fmt.Sprintf("%s -TERM %s", kill, group),
+			"j=0",
+			fmt.Sprintf("while [ ! -f %s ] && [ $j -lt %d ]; do sleep 1; j=$((j+1)); done",
+				EXIT_CODE_FILE, KILL_AFTER),
+			fmt.Sprintf("%s -KILL %s", kill, group),
+			"break",
+			"fi",
+			"sleep 1",
+			"i=$((i+1))",
+			"done",
+			") &")
+	}
+	commands = append(commands,
+		"wait $c",
+		"rc=$?",
+		fmt.Sprintf("if [ -f %s ]; then rc=%d; fi", TIMED_OUT_FILE, TIMED_OUT_EXIT_CODE))
+	return append(commands, recordExit...), nil
+}
+
+// Run a task on a target host.  Exactly one RunOutput is sent on resultChan,
+// and the host's remote runner lock is released whatever happens.
 func RunOnHost(conn remote.Remote, task Task, host host.Host, resultChan chan<- RunOutput) {
 	log.Printf("Running task %s on host %s (%s)...", task.Id, host.Name, host.Addr)
+	output := runOnHost(conn, task, host)
+	markLocalDirFinished(task.Id)
+	if output.Err != nil {
+		log.Printf("Task %s failed on host %s: %s", task.Id, host.Name, output.Err.Error())
+	}
+	resultChan <- output
+}
 
-	// TODO: Better handle removeRemoteRunnerLock failures!  It might be
-	// a problem that we just log a message when such a failure occurs,
-	// since it means the user will have to go in and delete the lock
-	// manually.  In generally, this code could probably benefit from more
-	// specific types of errors.
-
+// Run a task on a target host and return its output
+func runOnHost(conn remote.Remote, task Task, host host.Host) RunOutput {
 	c := config.GetParsedConfig()
+	if err := validateRunAs(task, host); err != nil {
+		return RunOutput{Err: newRunError(PhasePrepare, nil, err)}
+	}
+	if err := validateOutputs(task); err != nil {
+		return RunOutput{Err: newRunError(PhasePrepare, nil, err)}
+	}
+
 	taskDirPath, err := task.CreateDir()
 	if err != nil {
-		resultChan <- RunOutput{"", "", err}
-		return
+		return RunOutput{Err: newRunError(PhasePrepare, nil, err)}
 	}
 
-	// Acquire the remote lock; if we fail after this, we need to make
-	// sure the remote lock is removed.
-	if stderr, err := acquireRemoteRunnerLock(conn, host); err != nil {
-		resultChan <- RunOutput{"", stderr, err}
-		return
-	} else {
-		log.Printf("%s acquired remote lock", task.Id)
+	if stderr, err := acquireRemoteRunnerLock(conn, host, task.Id); err != nil {
+		return RunOutput{Stderr: stderr, Err: err}
 	}
+	log.Printf("%s acquired remote lock", task.Id)
+	// Until the wrapper script has started, the lock is ours to release.
+	locked := true
+	defer func() {
+		if locked {
+			removeRemoteRunnerLock(conn, host, task.Id)
+		}
+	}()
 
 	if task.Script.maxConcurrent != nil {
 		ch := make(chan NRunningScriptsOutput)
 		go getRemoteNRunningScripts(conn, task, host, ch)
 		nRunningScriptsOutput := <-ch
 		if nRunningScriptsOutput.err != nil {
-			removeRemoteRunnerLock(conn, host)
-			resultChan <- RunOutput{"", "", errors.New("Failed to parse pgrep output: " + err.Error())}
+			return RunOutput{Err: newRemoteError(conn, host, PhaseSchedule, nil, errors.New(
+				"Failed to count running scripts: "+nRunningScriptsOutput.err.Error()))}
 		}
 		if nRunningScriptsOutput.n >= *task.Script.maxConcurrent {
-			removeRemoteRunnerLock(conn, host)
-			resultChan <- RunOutput{"", "", errors.New(fmt.Sprintf(
+			return RunOutput{Err: newRunError(PhaseSchedule, ErrMaxConcurrent, errors.New(fmt.Sprintf(
 				"Max concurrent (%d) \"%s\" scripts already running",
-				nRunningScriptsOutput.n, task.Script.name))}
-			return
+				nRunningScriptsOutput.n, task.Script.name)))}
 		}
 	}
 
 	stderr, err := createRemoteWorkPathDir(conn, host)
 	if err != nil {
-		resultChan <- RunOutput{"", stderr, err}
-		removeRemoteRunnerLock(conn, host)
-		return
+		return RunOutput{Stderr: stderr, Err: newRemoteError(conn, host, PhaseUpload, nil, err)}
+	}
+
+	caps, err := getCapabilities(conn, host)
+	if err != nil {
+		return RunOutput{Err: newRemoteError(conn, host, PhaseUpload, nil, err)}
+	}
+
+	if err = copyDirTo(conn, host, caps, taskDirPath, c.RemoteWorkPath); err != nil {
+		return RunOutput{Err: newRemoteError(conn, host, PhaseUpload, ErrTransfer, errors.New(fmt.Sprintf(
+			"Failed to copy task directory of %s: %s", task.Id, err.Error())))}
 	}
 
-	conn.CopyTo(host, true, taskDirPath, c.RemoteWorkPath)
+	if c.RemoteCachePath != "" {
+		if err = populateDepsFromCache(conn, task, host); err != nil {
+			return RunOutput{Err: newRemoteError(conn, host, PhaseUpload, nil, err)}
+		}
+	}
+
+	if task.Limits.needCgroup() && !caps.SystemdRun {
+		log.Printf("Host %s doesn't have systemd-run, not applying "+
+			"cgroup limits to task %s", host.Name, task.Id)
+	}
 
-	wrapperTask, err := getWrapperTask(task)
+	wrapperTask, err := getWrapperTask(task, host, caps)
 	if err != nil {
-		removeRemoteRunnerLock(conn, host)
-		resultChan <- RunOutput{"", stderr, err}
-		return
+		return RunOutput{Err: newRunError(PhaseStart, nil, err)}
 	}
 
 	log.Printf("Wrapper task: %s", wrapperTask.Id)
 	wrapperTaskDirPath, err := wrapperTask.CreateDir()
 	if err != nil {
-		removeRemoteRunnerLock(conn, host)
-		resultChan <- RunOutput{"", "", err}
-		return
+		return RunOutput{Err: newRunError(PhaseStart, nil, err)}
+	}
+	err = copyDirTo(conn, host, caps, wrapperTaskDirPath, c.RemoteWorkPath)
+	if err != nil {
+		removeWrapperDirs(conn, wrapperTask, host, wrapperTaskDirPath)
+		return RunOutput{Err: newRemoteError(conn, host, PhaseUpload, ErrTransfer, errors.New(fmt.Sprintf(
+			"Failed to copy wrapper of %s: %s", task.Id, err.Error())))}
 	}
-
-	conn.CopyTo(host, true, wrapperTaskDirPath, c.RemoteWorkPath)
 
 	stdout, stderr, err := conn.Run(
-		host, wrapperTask.getRemoteScriptPath(), wrapperTask.Timeout)
-	resultChan <- RunOutput{stdout, stderr, err}
+		host, shell.Quote(wrapperTask.getRemoteScriptPath()), wrapperTask.Timeout)
+	removeWrapperDirs(conn, wrapperTask, host, wrapperTaskDirPath)
+	if err != nil {
+		// The wrapper may not have got as far as releasing the lock
+		return RunOutput{Stdout: stdout, Stderr: stderr,
+			Err: newRemoteError(conn, host, PhaseStart, nil, err)}
+	}
+	locked = false
+
+	output := getResult(conn, task, host, caps, taskDirPath)
+	cleanUpAfterResult(conn, task, host, output, taskDirPath)
+	return output
+}
+
+// Wait for a started task to finish and collect its result.  The task's
+// stdout, stderr and output files are copied back into the local task
+// directory.
+func getResult(conn remote.Remote, task Task, host host.Host, caps Capabilities, taskDirPath string) (output RunOutput) {
+	var tailer *outputTailer
+	if task.OnOutput != nil {
+		tailer = startTailing(conn, task, host)
+	}
+	status, err := waitForTask(conn, task, host)
+	if tailer != nil {
+		tailer.stopTailing()
+	}
+	if err != nil {
+		return RunOutput{Err: newRemoteError(conn, host, PhaseWait, nil, err)}
+	}
+	if status.State != StateExited {
+		return RunOutput{Err: newRunError(PhaseWait, nil, errors.New(fmt.Sprintf(
+			"Task %s did not exit on host %s, its state is %s",
+			task.Id, host.Name, status.State)))}
+	}
+	output.ExitCode = status.ExitCode
+	output.LimitHit = getLimitHit(task, status)
+
+	err = copyFilesFrom(conn, host, caps,
+		task.getRemoteDirPath(), []string{"stdout", "stderr"}, taskDirPath)
+	if err != nil {
+		output.Err = newRemoteError(conn, host, PhaseCollect, ErrTransfer, errors.New(fmt.Sprintf(
+			"Failed to copy stdout and stderr of task %s: %s", task.Id, err.Error())))
+		return output
+	}
+	for name, dest := range map[string]*string{"stdout": &output.Stdout, "stderr": &output.Stderr} {
+		content, err := ioutil.ReadFile(filepath.Join(taskDirPath, name))
+		if err != nil {
+			output.Err = newRunError(PhaseCollect, nil, errors.New(fmt.Sprintf(
+				"Failed to read %s of task %s: %s", name, task.Id, err.Error())))
+			return output
+		}
+		*dest = string(content)
+	}
+	if tailer != nil {
+		tailer.flush(output)
+	}
+
+	if output.Outputs, err = collectOutputs(conn, task, host, caps, taskDirPath); err != nil {
+		output.Err = newRunError(PhaseCollect, nil, err)
+		return output
+	}
+
+	if output.LimitHit != LimitNone {
+		var kind error
+		if output.LimitHit == LimitTimeout {
+			kind = ErrTimeout
+		}
+		output.Err = newRunError(PhaseWait, kind, errors.New(fmt.Sprintf(
+			"Task %s hit its %s limit", task.Id, output.LimitHit)))
+	}
+	return output
 }
 
 func RunOnHostBalancedByScriptName(conn remote.Remote, task Task, ch chan<- RunOutput) {
-	c := config.GetParsedConfig()
-	hostToChan := map[host.Host](chan NRunningScriptsOutput){}
-	var bestHost host.Host
+	bestHost, err := getBalancedHost(conn, task, config.GetParsedConfig().Hosts)
+	if err != nil {
+		ch <- RunOutput{Err: err}
+		return
+	}
+	RunOnHost(conn, task, bestHost, ch)
+}
+
+// Return the host, of hosts, running the fewest scripts with the same name as
+// the task's script.  Hosts whose lock can't be acquired (e.g., because it's
+// busy) or whose scripts can't be counted are skipped; an error is only
+// returned if none of the hosts can be used.
+func getBalancedHost(conn remote.Remote, task Task, hosts []host.Host) (bestHost host.Host, err error) {
+	hostToChan := map[string](chan NRunningScriptsOutput){}
 	var minScriptsRunning uint32
 	var failure error = nil
-	for _, host := range c.Hosts {
-		log.Printf("candidate: %s\n", host.Name)
-	}
-	for _, host := range c.Hosts {
-		hostToChan[host] = make(chan NRunningScriptsOutput)
+	for _, host := range hosts {
+		hostToChan[host.Name] = make(chan NRunningScriptsOutput)
 		host := host // new instance for go routine
+		hostCh := hostToChan[host.Name]
 		go func() {
-			if _, err := acquireRemoteRunnerLock(conn, host); err != nil {
-				log.Printf("%s acquired remote lock", task.Id)
+			if _, err := acquireRemoteRunnerLock(conn, host, task.Id); err != nil {
+				// A lock that wasn't acquired is left alone, since
+				// it has another owner
+				hostCh <- NRunningScriptsOutput{0, err}
+				return
 			}
-			go getRemoteNRunningScripts(conn, task, host, hostToChan[host])
+			log.Printf("%s acquired remote lock", task.Id)
+			countCh := make(chan NRunningScriptsOutput)
+			go getRemoteNRunningScripts(conn, task, host, countCh)
+			nRunningScriptsOutput := <-countCh
+			// The lock is only held while the scripts are counted
+			removeRemoteRunnerLock(conn, host, task.Id)
+			hostCh <- nRunningScriptsOutput
 		}()
 	}
-	for host, _ := range hostToChan {
-		nRunningScriptsOutput := <-hostToChan[host]
+	for _, host := range hosts {
+		nRunningScriptsOutput := <-hostToChan[host.Name]
 		if nRunningScriptsOutput.err != nil {
+			log.Printf("Skipping host %s: %s", host.Name, nRunningScriptsOutput.err.Error())
 			failure = nRunningScriptsOutput.err
+			continue
 		}
 		log.Printf("%d scripts running on %s\n", nRunningScriptsOutput.n, host.Name)
 		if nRunningScriptsOutput.n < minScriptsRunning || bestHost.Name == "" {
 			bestHost = host
 			minScriptsRunning = nRunningScriptsOutput.n
 		}
-		// TODO: parallelize lock removals
-		removeRemoteRunnerLock(conn, host)
 	}
 
-	if failure != nil {
-		ch <- RunOutput{"", "", errors.New("Failed : " + failure.Error())}
-	} else {
-		log.Printf("Selected host \"%s\" for load balancing", bestHost.Name)
-		RunOnHost(conn, task, bestHost, ch)
+	if bestHost.Name == "" {
+		if failure == nil {
+			failure = errors.New("No hosts to run the task on")
+		}
+		return host.Host{}, newRunError(PhaseSchedule, nil, failure)
 	}
+	log.Printf("Selected host \"%s\" for load balancing", bestHost.Name)
+	return bestHost, nil
 }
 
 func RunOnRandomHost(conn remote.Remote, task Task, ch chan<- RunOutput) {
-	RunOnHost(conn, task, getRandomHost(), ch)
+	randomHost, err := getRandomHost(config.GetParsedConfig().Hosts)
+	if err != nil {
+		ch <- RunOutput{Err: err}
+		return
+	}
+	RunOnHost(conn, task, randomHost, ch)
 }
 
-func getRandomHost() host.Host {
-	c := config.GetParsedConfig()
-	return c.Hosts[rand.Intn(len(c.Hosts))]
+// Return a random host of hosts, or an error if there are none
+func getRandomHost(hosts []host.Host) (host.Host, error) {
+	if len(hosts) == 0 {
+		return host.Host{}, newRunError(PhaseSchedule, nil, errors.New("No hosts to run the task on"))
+	}
+	return hosts[rand.Intn(len(hosts))], nil
 }
@@ -5,11 +5,22 @@
 package task
 
 import (
+	"errors"
 	"fmt"
 	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
 	"github.com/bgmerrell/geto/lib/remote/dummy"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"github.com/bgmerrell/geto/lib/ssh/sshtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -20,7 +31,7 @@ func init() {
 
 func TestRunOnRandomHost(t *testing.T) {
 	dummyConn := dummy.New()
-	task := Task{"test-task", []string{}, NewScript("test-script", nil), 0}
+	task := Task{Id: "test-task", DepFiles: []string{}, Script: NewScript("test-script", nil)}
 	ch := make(chan RunOutput)
 	go RunOnRandomHost(dummyConn, task, ch)
 	_ = <-ch
@@ -31,7 +42,11 @@ func TestGetRandomHost(t *testing.T) {
 	c := config.GetParsedConfig()
 	const TRIES = 100
 	for i := 0; i < TRIES; i++ {
-		m[getRandomHost().Name] = struct{}{}
+		h, err := getRandomHost(c.Hosts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		m[h.Name] = struct{}{}
 	}
 	/* statistically, this should be true  */
 	if len(m) != len(c.Hosts) {
@@ -55,12 +70,257 @@ func TestGetRandomHost(t *testing.T) {
 			actual,
 			expected)
 	}
+
+	var runErr *RunError
+	if _, err := getRandomHost(nil); !errors.As(err, &runErr) || runErr.Phase != PhaseSchedule {
+		t.Errorf("Expected an error in the %s phase without hosts, got %v", PhaseSchedule, err)
+	}
 }
 
 func TestRunOnHostBalancedByScript(t *testing.T) {
 	dummyConn := dummy.New()
-	task := Task{"test-task", []string{}, NewScript("test-script", nil), 0}
+	task := Task{Id: "test-task", DepFiles: []string{}, Script: NewScript("test-script", nil)}
 	ch := make(chan RunOutput)
 	go RunOnHostBalancedByScriptName(dummyConn, task, ch)
 	<-ch
 }
+
+func TestGetBalancedHostSkipsUnusableHosts(t *testing.T) {
+	injected := errors.New("connection reset")
+	conn := fake.New()
+	conn.OnRunOn("busy", `^if mkdir `, fake.Response{Stdout: "busy\n"})
+	conn.OnRunOn("failing", `^if mkdir `, fake.Response{Err: injected})
+	conn.OnRunOn("loaded", `n=0; for d in`, fake.Response{Stdout: "3\n"})
+	conn.OnRunOn("idle", `n=0; for d in`, fake.Response{Stdout: "1\n"})
+	task := Task{Id: "test-task", DepFiles: []string{}, Script: NewScript("test-script", nil)}
+	hosts := []host.Host{{Name: "busy"}, {Name: "loaded"}, {Name: "failing"}, {Name: "idle"}}
+
+	h, err := getBalancedHost(conn, task, hosts)
+	if err != nil || h.Name != "idle" {
+		t.Errorf("Expected the idle host, got %q (%v)", h.Name, err)
+	}
+	// Only the locks that were acquired are released
+	released := map[string]int{}
+	for _, call := range conn.CallsTo("Run") {
+		if strings.Contains(call.Command, RELEASE_LOCK) {
+			released[call.Host.Name]++
+		}
+	}
+	if len(released) != 2 || released["loaded"] != 1 || released["idle"] != 1 {
+		t.Errorf("Expected the locks of loaded and idle to be released once, got %v", released)
+	}
+
+	if _, err = getBalancedHost(conn, task, hosts[:1]); !errors.Is(err, ErrLockBusy) {
+		t.Errorf("Expected %v when no host can be used, got %v", ErrLockBusy, err)
+	}
+	if _, err = getBalancedHost(conn, task, []host.Host{{Name: "busy"}, {Name: "failing"}}); err == nil ||
+		!strings.Contains(err.Error(), injected.Error()) {
+		t.Errorf("Expected the last failure when no host can be used, got %v", err)
+	}
+}
+
+func TestRunOnHostWithBusyLock(t *testing.T) {
+	lockPath := config.GetParsedConfig().RemoteLockPath
+	if err := os.Mkdir(lockPath, 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(lockPath)
+	ownerPath := filepath.Join(lockPath, LOCK_OWNER_FILE)
+	if err := ioutil.WriteFile(ownerPath, []byte("someone-else\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	output := runTestTask(t, fake.NewLocal(), nil)
+	if !errors.Is(output.Err, ErrLockBusy) {
+		t.Errorf("Expected %v, got %v", ErrLockBusy, output.Err)
+	}
+	if content, err := ioutil.ReadFile(ownerPath); err != nil || string(content) != "someone-else\n" {
+		t.Errorf("Expected the other owner's lock to be left alone")
+	}
+}
+
+// Run a task with RunOnHost, failing if more than one result is sent
+func runTestTask(t *testing.T, conn remote.Remote, maxConcurrent *uint32) RunOutput {
+	resetCapabilitiesCache()
+	task, err := New([]string{}, NewScriptWithCommands(
+		"test-fake", []string{"echo out"}, maxConcurrent), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	ch := make(chan RunOutput, 2)
+	RunOnHost(conn, task, config.GetParsedConfig().Hosts[0], ch)
+	if len(ch) != 1 {
+		t.Fatalf("Expected exactly one result, got %d", len(ch))
+	}
+	return <-ch
+}
+
+// Return the number of Run calls whose command contains s
+func countRuns(conn *fake.Remote, s string) (n int) {
+	for _, call := range conn.CallsTo("Run") {
+		if strings.Contains(call.Command, s) {
+			n++
+		}
+	}
+	return n
+}
+
+// The command that releases the lock (see removeRemoteRunnerLock)
+const RELEASE_LOCK = "; then rm -r "
+
+func TestRunOnHostRetriesBusyLock(t *testing.T) {
+	conn := fake.New()
+	conn.OnRun(`^if mkdir `, fake.Response{Stdout: "busy\n"})
+	output := runTestTask(t, conn, nil)
+	if !errors.Is(output.Err, ErrLockBusy) {
+		t.Errorf("Expected %v, got %v", ErrLockBusy, output.Err)
+	}
+	if n := countRuns(conn, "if mkdir "); n != 10 {
+		t.Errorf("Expected 10 attempts to acquire the lock, got %d", n)
+	}
+	if n := countRuns(conn, RELEASE_LOCK); n != 0 {
+		t.Errorf("Expected a lock that wasn't acquired to be left alone")
+	}
+}
+
+func TestRunOnHostReleasesLockOnFailure(t *testing.T) {
+	zero := uint32(0)
+	injected := errors.New("connection reset")
+	// The number of times that geto releases the lock: once if it fails
+	// while holding it, never if the lock wasn't acquired or the wrapper
+	// released it
+	var tests = []struct {
+		setUp         func(conn *fake.Remote)
+		maxConcurrent *uint32
+		phase         Phase
+		kind          error
+		releases      int
+	}{
+		// The host can't be reached to acquire the lock
+		{func(conn *fake.Remote) {
+			conn.FailNth("Run", 1, injected)
+			conn.FailNth("TestConnection", 1, injected)
+		}, nil, PhaseLock, ErrHostUnreachable, 0},
+		// Counting the running scripts fails
+		{func(conn *fake.Remote) {
+			conn.OnRun(`n=0; for d in`, fake.Response{Err: injected})
+		}, &zero, PhaseSchedule, nil, 1},
+		// Creating the remote work directory fails
+		{func(conn *fake.Remote) {
+			conn.OnRun(`^mkdir -p `, fake.Response{Err: injected})
+		}, nil, PhaseUpload, nil, 1},
+		// Copying the task directory fails
+		{func(conn *fake.Remote) {
+			conn.FailNth("CopyTo", 1, injected)
+		}, nil, PhaseUpload, ErrTransfer, 1},
+		// Copying the wrapper fails
+		{func(conn *fake.Remote) {
+			conn.FailNth("CopyTo", 2, injected)
+		}, nil, PhaseUpload, ErrTransfer, 1},
+		// Running the wrapper fails
+		{func(conn *fake.Remote) {
+			conn.OnRun(`_wrapper'?$`, fake.Response{Err: injected})
+		}, nil, PhaseStart, nil, 1},
+		// The host goes away after the lock is acquired
+		{func(conn *fake.Remote) {
+			conn.FailNth("CopyTo", 1, injected)
+			conn.FailNth("TestConnection", 1, injected)
+		}, nil, PhaseUpload, ErrHostUnreachable, 1},
+		// Copying the output back fails once the task has exited
+		{func(conn *fake.Remote) {
+			conn.OnRun(`; while \[`, fake.Response{Stdout: "exited 0\n"})
+			conn.FailNth("CopyFrom", 1, injected)
+		}, nil, PhaseCollect, ErrTransfer, 0},
+	}
+	for i, test := range tests {
+		conn := fake.New()
+		test.setUp(conn)
+		output := runTestTask(t, conn, test.maxConcurrent)
+		var runErr *RunError
+		if !errors.As(output.Err, &runErr) {
+			t.Errorf("Test %d: expected a RunError, got %#v", i, output.Err)
+			continue
+		}
+		if runErr.Phase != test.phase || runErr.Kind != test.kind {
+			t.Errorf("Test %d: expected phase %s and kind %v, got %s and %v",
+				i, test.phase, test.kind, runErr.Phase, runErr.Kind)
+		}
+		if !strings.Contains(output.Err.Error(), injected.Error()) {
+			t.Errorf("Test %d: expected %v to report the injected error", i, output.Err)
+		}
+		if n := countRuns(conn, RELEASE_LOCK); n != test.releases {
+			t.Errorf("Test %d: expected the lock to be released %d times, got %d", i, test.releases, n)
+		}
+	}
+}
+
+func TestRunOnHostWithMaxConcurrent(t *testing.T) {
+	zero := uint32(0)
+	conn := fake.New()
+	conn.OnRun(`n=0; for d in`, fake.Response{Stdout: "0\n"})
+	output := runTestTask(t, conn, &zero)
+	var runErr *RunError
+	if !errors.As(output.Err, &runErr) || runErr.Phase != PhaseSchedule || !errors.Is(output.Err, ErrMaxConcurrent) {
+		t.Errorf("Expected %v in the %s phase, got %#v", ErrMaxConcurrent, PhaseSchedule, output.Err)
+	}
+	if n := countRuns(conn, RELEASE_LOCK); n != 1 {
+		t.Errorf("Expected the lock to be released once, got %d", n)
+	}
+}
+
+func TestRunOnHostOverSSH(t *testing.T) {
+	defer useConfig(t, "../../test/data/geto-sshtest.ini")()
+	s, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start SSH server: %s", err.Error())
+	}
+	defer s.Close()
+	h := host.Host{Name: "sshtest", Addr: s.Addr, Username: s.Username,
+		Password: &s.Password, PortNum: s.Port}
+
+	resetCapabilitiesCache()
+	task, err := New([]string{}, NewScriptWithCommands("test-ssh",
+		[]string{"mkdir -p out", "echo result > out/a.txt", "echo out", "exit 2"}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	task.Outputs = []string{"out/*.txt"}
+	ch := make(chan RunOutput)
+	go RunOnHost(ssh.New(), task, h, ch)
+	output := <-ch
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+	if output.Stdout != "out\n" || output.ExitCode != 2 {
+		t.Errorf("Unexpected output: %#v", output)
+	}
+	if len(output.Outputs) != 1 || output.Outputs[0].Path != "out/a.txt" {
+		t.Errorf("Unexpected output files: %#v", output.Outputs)
+	}
+	if _, err = os.Stat(config.GetParsedConfig().RemoteLockPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the remote lock to be released")
+	}
+}
+
+func TestGetAndReleaseRemoteRunnerLock(t *testing.T) {
+	h := config.GetParsedConfig().Hosts[0]
+	conn := fake.NewLocal()
+	if status, err := GetRemoteRunnerLock(conn, h); err != nil || status.Held {
+		t.Fatalf("Expected the lock to be free, got %#v (%v)", status, err)
+	}
+	if _, err := acquireRemoteRunnerLock(conn, h, "test-owner"); err != nil {
+		t.Fatalf("Failed to acquire lock: %s", err.Error())
+	}
+	status, err := GetRemoteRunnerLock(conn, h)
+	if err != nil || !status.Held || status.Owner != "test-owner" || time.Since(status.Since) > time.Minute {
+		t.Errorf("Unexpected lock status: %#v (%v)", status, err)
+	}
+	// Only the owner's lock is released
+	ReleaseRemoteRunnerLock(conn, h, "someone-else")
+	if status, _ = GetRemoteRunnerLock(conn, h); !status.Held {
+		t.Errorf("Expected another owner's lock to be kept")
+	}
+	ReleaseRemoteRunnerLock(conn, h, "test-owner")
+	if status, _ = GetRemoteRunnerLock(conn, h); status.Held {
+		t.Errorf("Expected the lock to be released, got %#v", status)
+	}
+}
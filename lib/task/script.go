@@ -9,7 +9,10 @@ package task
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 )
 
 // A script that runs on a target host
@@ -22,19 +25,31 @@ type Script struct {
 	// The number of scripts of the same name that will run on a target host
 	// concurrently.  A nil value means there is no limit.
 	maxConcurrent *uint32
+	// A bundle of files to run instead of the commands.  A nil value
+	// means the script is made up of the commands.
+	bundle *Bundle
+	// The interpreter used to run the script.  A nil value means the
+	// interpreter is taken from the script's shebang line.
+	interpreter *Interpreter
 }
 
 func NewScript(name string, maxConcurrent *uint32) Script {
-	return Script{name, []string{}, maxConcurrent}
+	return Script{name: name, commands: []string{}, maxConcurrent: maxConcurrent}
 }
 
 func NewScriptWithCommands(name string, commands []string, maxConcurrent *uint32) Script {
-	return Script{name, commands, maxConcurrent}
+	return Script{name: name, commands: commands, maxConcurrent: maxConcurrent}
+}
+
+// Takes a name and a bundle and returns a Script object that runs the
+// bundle's entrypoint
+func NewScriptFromBundle(name string, bundle Bundle, maxConcurrent *uint32) Script {
+	return Script{name: name, commands: []string{}, maxConcurrent: maxConcurrent, bundle: &bundle}
 }
 
 // Takes a name and a path to a shell script and returns a Script object
 func NewScriptFromPath(name string, path string, maxConcurrent *uint32) (Script, error) {
-	var s Script = Script{name, []string{}, maxConcurrent}
+	var s Script = NewScript(name, maxConcurrent)
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -53,3 +68,48 @@ func NewScriptFromPath(name string, path string, maxConcurrent *uint32) (Script,
 	}
 	return s, err
 }
+
+// Set the interpreter used to run the script on the target host
+func (s *Script) SetInterpreter(interpreter Interpreter) {
+	s.interpreter = &interpreter
+}
+
+// Return the interpreter used to run the script on the target host.
+// If no interpreter has been set, the interpreter is taken from the script's
+// shebang line (the entrypoint's for a bundle); ShInterpreter is used if
+// there is no shebang line.
+func (s *Script) GetInterpreter() Interpreter {
+	if s.interpreter != nil {
+		return *s.interpreter
+	}
+	var firstLine string
+	if s.bundle != nil {
+		content := string(s.bundle.files[s.bundle.entrypoint].Content)
+		firstLine = strings.SplitN(content, "\n", 2)[0]
+	} else if len(s.commands) > 0 {
+		firstLine = s.commands[0]
+	}
+	if i, ok := parseShebang(firstLine); ok {
+		return i
+	}
+	return ShInterpreter
+}
+
+// Write the script's commands, one per line, to an executable file at path
+func (s *Script) writeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return errors.New(fmt.Sprintf(
+			"Failed to create script file: %s", err.Error()))
+	}
+	defer f.Close()
+
+	for _, c := range s.commands {
+		_, err := f.Write([]byte(c + "\n"))
+		if err != nil {
+			return errors.New(fmt.Sprintf(
+				"Failed to write script file: %s", err.Error()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Track the state of tasks on the target hosts.
+
+The wrapper script records the state of each task in files in the task's
+remote directory (see the *_FILE constants).  Counting running scripts,
+getting the status of a task and killing a task all work from those records
+instead of from pattern matching against process command lines.
+*/
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/shell"
+	"strconv"
+	"strings"
+)
+
+// The names of the record files in a remote task directory
+const (
+	// The name of the task's script
+	NAME_FILE = "name"
+	// The state of the task (one of the State values)
+	STATE_FILE = "state"
+	// The PID of the process supervising the task
+	PID_FILE = "pid"
+	// The process group of the task's processes or, if the host can't
+	// start a new process group, the PID of the task's script
+	PGID_FILE = "pgid"
+	// The exit code of the task's script
+	EXIT_CODE_FILE = "exitcode"
+	// Created if the task timed out
+	TIMED_OUT_FILE = "timedout"
+	// Created if the task was killed with Kill
+	KILLED_FILE = "killed"
+)
+
+// The state of a task on a target host
+type State string
+
+const (
+	// There is no record of the task having been started
+	StateUnknown State = "unknown"
+	// The task is running
+	StateRunning State = "running"
+	// The task's script has exited
+	StateExited State = "exited"
+	// The task was recorded as running, but its process is gone (e.g., the
+	// host was rebooted)
+	StateLost State = "lost"
+)
+
+// The status of a task on a target host
+type Status struct {
+	State State
+	// The exit code of the task's script, only valid for StateExited
+	ExitCode int
+	// Whether the task was killed with Kill
+	Killed bool
+	// Whether the task was killed because it timed out
+	TimedOut bool
+}
+
+// Return a shell snippet that marks the task recorded in the directory $d
+// as lost if it is recorded as running but its supervising process is gone.
+// $d must end with a slash.
+func getStaleRecordCleanup() string {
+	return fmt.Sprintf(
+		"if [ \"$(cat \"$d\"%[1]s 2>/dev/null)\" = %[2]s ] && "+
+			"! kill -0 \"$(cat \"$d\"%[3]s 2>/dev/null)\" 2>/dev/null; "+
+			"then echo %[4]s > \"$d\"%[1]s; fi",
+		STATE_FILE, StateRunning, PID_FILE, StateLost)
+}
+
+func getRemoteNRunningScripts(conn remote.Remote, task Task, host host.Host, ch chan<- NRunningScriptsOutput) {
+	c := config.GetParsedConfig()
+	// Count the task directories whose records say that a script of the
+	// same name is running, after cleaning up any stale records.
+	stdout, _, err := conn.Run(
+		host,
+		fmt.Sprintf(
+			"n=0; for d in %s/*/; do "+
+				"[ \"$(cat \"$d\"%s 2>/dev/null)\" = %s ] || continue; "+
+				"%s; "+
+				"[ \"$(cat \"$d\"%s 2>/dev/null)\" = %s ] && n=$((n+1)); "+
+				"done; echo $n",
+			shell.Quote(c.RemoteWorkPath),
+			NAME_FILE,
+			shell.Quote(task.Script.name),
+			getStaleRecordCleanup(),
+			STATE_FILE,
+			StateRunning),
+		0)
+	if err != nil {
+		ch <- NRunningScriptsOutput{0, err}
+		return
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(stdout), 10, 32)
+	ch <- NRunningScriptsOutput{uint32(n), err}
+}
+
+// Return a shell snippet that prints the status records of the task
+// recorded in the directory $d (after cleaning up stale records), e.g.,
+// "exited 124 timedout".  $d must end with a slash.
+func getStatusReport() string {
+	return fmt.Sprintf(
+		"%s; echo $(cat \"$d\"%s \"$d\"%s 2>/dev/null) "+
+			"$([ -f \"$d\"%[4]s ] && echo %[4]s) $([ -f \"$d\"%[5]s ] && echo %[5]s)",
+		getStaleRecordCleanup(),
+		STATE_FILE,
+		EXIT_CODE_FILE,
+		TIMED_OUT_FILE,
+		KILLED_FILE)
+}
+
+// Get the status of a task on a target host from its records
+func GetStatus(conn remote.Remote, task Task, host host.Host) (status Status, err error) {
+	stdout, stderr, err := conn.Run(
+		host,
+		fmt.Sprintf("d=%s/; %s",
+			shell.Quote(task.getRemoteDirPath()),
+			getStatusReport()),
+		0)
+	if err != nil {
+		return Status{State: StateUnknown}, errors.New(fmt.Sprintf(
+			"Failed to get status of task %s: %s (%s)",
+			task.Id, err.Error(), strings.TrimSpace(stderr)))
+	}
+	return parseStatus(stdout)
+}
+
+// Wait for a task on a target host to stop running and return its status
+func waitForTask(conn remote.Remote, task Task, host host.Host) (status Status, err error) {
+	// Poll on the host rather than from here so that only a single
+	// session is needed.
+	stdout, stderr, err := conn.Run(
+		host,
+		fmt.Sprintf(
+			"d=%s/; while [ \"$(cat \"$d\"%s 2>/dev/null)\" = %s ] && "+
+				"kill -0 \"$(cat \"$d\"%s 2>/dev/null)\" 2>/dev/null; "+
+				"do sleep 1; done; %s",
+			shell.Quote(task.getRemoteDirPath()),
+			STATE_FILE,
+			StateRunning,
+			PID_FILE,
+			getStatusReport()),
+		0)
+	if err != nil {
+		return Status{State: StateUnknown}, errors.New(fmt.Sprintf(
+			"Failed to wait for task %s: %s (%s)",
+			task.Id, err.Error(), strings.TrimSpace(stderr)))
+	}
+	return parseStatus(stdout)
+}
+
+// Parse the status records, e.g., "exited 124 timedout"
+func parseStatus(output string) (status Status, err error) {
+	fields := strings.Fields(output)
+	status.State = StateUnknown
+	for len(fields) > 0 {
+		if last := fields[len(fields)-1]; last == KILLED_FILE {
+			status.Killed = true
+		} else if last == TIMED_OUT_FILE {
+			status.TimedOut = true
+		} else {
+			break
+		}
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) == 0 {
+		return status, nil
+	}
+	switch State(fields[0]) {
+	case StateRunning, StateLost:
+		status.State = State(fields[0])
+	case StateExited:
+		if len(fields) < 2 {
+			return status, errors.New("Missing exit code record")
+		}
+		if status.ExitCode, err = strconv.Atoi(fields[1]); err != nil {
+			return status, errors.New(
+				"Failed to parse exit code record: " + err.Error())
+		}
+		status.State = StateExited
+	default:
+		return status, errors.New(fmt.Sprintf(
+			"Unexpected state record: %s", fields[0]))
+	}
+	return status, nil
+}
+
+// Kill a task's processes on a target host.  The task's whole process group
+// is killed, falling back to the supervising process if the process group
+// hasn't been recorded yet.  The process group is killed as the task's RunAs
+// user, if any.  A task's container is removed.
+func Kill(conn remote.Remote, task Task, host host.Host) (err error) {
+	var containerCleanup string
+	if task.Container != nil {
+		caps, err := getCapabilities(conn, host)
+		if err != nil {
+			return err
+		}
+		runtime, err := task.Container.getRuntime(caps)
+		if err != nil {
+			return err
+		}
+		containerCleanup = task.getContainerCleanup(runtime, host) + "; "
+	}
+	// The negation of the PID is important, see kill(1)
+	_, stderr, err := conn.Run(
+		host,
+		fmt.Sprintf(
+			"d=%[1]s/; : > \"$d\"%[2]s; %[6]s"+
+				"g=$(cat \"$d\"%[3]s 2>/dev/null); p=$(cat \"$d\"%[4]s 2>/dev/null); "+
+				"if [ -n \"$g\" ]; then %[5]s -9 -\"$g\" 2>/dev/null || %[5]s -9 \"$g\"; "+
+				"elif [ -n \"$p\" ]; then kill -9 \"$p\"; "+
+				"else echo 'No process records' >&2; exit 1; fi",
+			shell.Quote(task.getRemoteDirPath()), KILLED_FILE, PGID_FILE, PID_FILE,
+			task.getKillCommand(host), containerCleanup),
+		0)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to kill task %s: %s (%s)",
+			task.Id, err.Error(), strings.TrimSpace(stderr)))
+	}
+	return nil
+}
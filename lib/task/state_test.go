@@ -0,0 +1,191 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Start a task on the local machine the same way RunOnHost starts a task on
+// a target host
+func startLocalTask(t *testing.T, task Task) Task {
+	caps, err := ProbeCapabilities(fake.NewLocal(), config.GetParsedConfig().Hosts[0])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return startLocalTaskWithCapabilities(t, task, caps)
+}
+
+// Start a task on the local machine as if it had the given capabilities
+func startLocalTaskWithCapabilities(t *testing.T, task Task, caps Capabilities) Task {
+	conn := fake.NewLocal()
+	h := config.GetParsedConfig().Hosts[0]
+	if _, err := createRemoteWorkPathDir(conn, h); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := acquireRemoteRunnerLock(conn, h, task.Id); err != nil {
+		t.Fatalf(err.Error())
+	}
+	wrapperTask, err := getWrapperTask(task, h, caps)
+	if err != nil {
+		t.Fatalf("Failed to create wrapper Task: " + err.Error())
+	}
+	for _, tk := range []Task{task, wrapperTask} {
+		dirPath, err := tk.CreateDir()
+		if err != nil {
+			t.Fatalf("Failed to create directory from Task: " + err.Error())
+		}
+		if err = conn.CopyTo(h, true, dirPath, config.GetParsedConfig().RemoteWorkPath); err != nil {
+			t.Fatalf("Failed to copy task directory: " + err.Error())
+		}
+	}
+	if _, stderr, err := conn.Run(h, wrapperTask.getRemoteScriptPath(), 0); err != nil {
+		t.Fatalf("Failed to run wrapper: %s (%s)", err.Error(), stderr)
+	}
+	return task
+}
+
+// Create a task and start it on the local machine
+func startNewLocalTask(t *testing.T, name string, commands []string) Task {
+	task, err := New([]string{}, NewScriptWithCommands(name, commands, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	return startLocalTask(t, task)
+}
+
+// Wait for a task to leave the running state
+func waitForLocalTask(t *testing.T, task Task) Status {
+	h := config.GetParsedConfig().Hosts[0]
+	for i := 0; i < 100; i++ {
+		status, err := GetStatus(fake.NewLocal(), task, h)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if status.State != StateRunning {
+			return status
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Task %s is still running", task.Id)
+	return Status{}
+}
+
+func countLocalRunningScripts(t *testing.T, task Task) uint32 {
+	ch := make(chan NRunningScriptsOutput)
+	go getRemoteNRunningScripts(fake.NewLocal(), task, config.GetParsedConfig().Hosts[0], ch)
+	output := <-ch
+	if output.err != nil {
+		t.Fatalf("Failed to count running scripts: %s", output.err.Error())
+	}
+	return output.n
+}
+
+func TestStatusRecordsExitCode(t *testing.T) {
+	task := startNewLocalTask(t, "test-exit", []string{"#!/bin/sh", "exit 3"})
+	status := waitForLocalTask(t, task)
+	if status.State != StateExited || status.ExitCode != 3 {
+		t.Errorf("Expected state %s with exit code 3, got %s with exit code %d",
+			StateExited, status.State, status.ExitCode)
+	}
+}
+
+func TestCountAndKillRunningScripts(t *testing.T) {
+	name, err := genTaskId()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	commands := []string{"#!/bin/sh", "sleep 30"}
+	t1 := startNewLocalTask(t, name, commands)
+	t2 := startNewLocalTask(t, name, commands)
+	// A script whose name starts with the same name must not be counted
+	t3 := startNewLocalTask(t, name+"_other", commands)
+
+	if n := countLocalRunningScripts(t, t1); n != 2 {
+		t.Errorf("Expected 2 running \"%s\" scripts, got %d", name, n)
+	}
+
+	for _, task := range []Task{t1, t2, t3} {
+		if err := Kill(fake.NewLocal(), task, config.GetParsedConfig().Hosts[0]); err != nil {
+			t.Errorf(err.Error())
+		}
+		if status := waitForLocalTask(t, task); status.State != StateExited {
+			t.Errorf("Expected state %s after kill, got %s", StateExited, status.State)
+		}
+	}
+
+	if n := countLocalRunningScripts(t, t1); n != 0 {
+		t.Errorf("Expected 0 running \"%s\" scripts after kill, got %d", name, n)
+	}
+}
+
+func TestStaleRecordCleanup(t *testing.T) {
+	name, err := genTaskId()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	task, err := New([]string{}, NewScript(name, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	dirPath := task.getRemoteDirPath()
+	if err = os.MkdirAll(dirPath, 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+	// Records of a running script whose process no longer exists
+	records := map[string]string{
+		NAME_FILE:  name,
+		STATE_FILE: string(StateRunning),
+		PID_FILE:   "999999999",
+	}
+	for fileName, content := range records {
+		if err = ioutil.WriteFile(filepath.Join(dirPath, fileName), []byte(content+"\n"), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	if n := countLocalRunningScripts(t, task); n != 0 {
+		t.Errorf("Expected 0 running \"%s\" scripts, got %d", name, n)
+	}
+	status, err := GetStatus(fake.NewLocal(), task, config.GetParsedConfig().Hosts[0])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if status.State != StateLost {
+		t.Errorf("Expected state %s, got %s", StateLost, status.State)
+	}
+}
+
+func TestWrapperWithHostileInterpreterArgs(t *testing.T) {
+	const hostileArg = "it's a $(touch pwned); `touch pwned` \"test\""
+	task, err := New([]string{}, NewScriptWithCommands("test-hostile", []string{}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	// printf prints the argument and then the script path
+	task.Script.SetInterpreter(NewInterpreter("printf", "%s|", hostileArg))
+	task = startLocalTask(t, task)
+	if status := waitForLocalTask(t, task); status.State != StateExited || status.ExitCode != 0 {
+		t.Fatalf("Unexpected status: %#v", status)
+	}
+	stdout, err := ioutil.ReadFile(filepath.Join(task.getRemoteDirPath(), "stdout"))
+	if err != nil {
+		t.Fatalf("Failed to read stdout: %s", err.Error())
+	}
+	expected := hostileArg + "|" + task.getRemoteScriptPath() + "|"
+	if string(stdout) != expected {
+		t.Errorf("Expected stdout %q, got %q", expected, string(stdout))
+	}
+	if _, err = os.Stat(filepath.Join(task.getRemoteDirPath(), "pwned")); err == nil {
+		t.Errorf("The interpreter argument was executed by the shell")
+	}
+}
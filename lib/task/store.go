@@ -0,0 +1,282 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Record the tasks of a Manager so that they outlive the process running it.
+
+A Manager with a Store records each task when it's submitted, when it's
+started on its host and when it's done: the task's definition, its host, the
+times of its state transitions and its result.  Manager.Reconcile loads the
+records of an earlier process (e.g., a geto server that crashed or was
+restarted) and picks up the tasks that weren't done: a task that was started
+on its host has its result collected once it exits, as if it had been running
+all along, and any other is failed.
+
+FileStore, which keeps each record in a JSON file, is the default Store.
+*/
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What a Store records of a task
+type TaskRecord struct {
+	Info TaskInfo
+	Task TaskDefinition
+}
+
+// What's needed of a task to collect its result if it's picked up by
+// Manager.Reconcile
+type TaskDefinition struct {
+	DepFiles      []string
+	Timeout       uint32
+	Limits        Limits
+	RunAs         string
+	Isolated      bool
+	Container     *Container
+	Outputs       []string
+	MaxOutputSize uint64
+	// The script's commands, nil for a script bundle
+	Commands      []string
+	MaxConcurrent *uint32
+}
+
+// Records tasks
+type Store interface {
+	// Record a task, replacing any earlier record of it
+	Put(record TaskRecord) error
+	// Return the record of a task, ErrNoSuchTask if there isn't one
+	Get(id string) (TaskRecord, error)
+	// Return the record of every task, in no particular order.  Records
+	// that can't be read are logged and skipped, so that one corrupt
+	// record doesn't hide the others.
+	List() ([]TaskRecord, error)
+}
+
+func getTaskDefinition(task Task) TaskDefinition {
+	definition := TaskDefinition{
+		DepFiles:      task.DepFiles,
+		Timeout:       task.Timeout,
+		Limits:        task.Limits,
+		RunAs:         task.RunAs,
+		Isolated:      task.Isolated,
+		Container:     task.Container,
+		Outputs:       task.Outputs,
+		MaxOutputSize: task.MaxOutputSize,
+		MaxConcurrent: task.Script.maxConcurrent}
+	if task.Script.bundle == nil {
+		definition.Commands = task.Script.commands
+	}
+	return definition
+}
+
+// Return the task with the ID and script name that the definition describes
+func (d TaskDefinition) getTask(id string, scriptName string) Task {
+	return Task{
+		Id:            id,
+		DepFiles:      d.DepFiles,
+		Script:        NewScriptWithCommands(scriptName, d.Commands, d.MaxConcurrent),
+		Timeout:       d.Timeout,
+		Limits:        d.Limits,
+		RunAs:         d.RunAs,
+		Isolated:      d.Isolated,
+		Container:     d.Container,
+		Outputs:       d.Outputs,
+		MaxOutputSize: d.MaxOutputSize}
+}
+
+// Return the task that a record describes, enough of it to look the task up
+// or kill it on its host (see GetStatus and Kill)
+func (r TaskRecord) GetTask() Task {
+	return r.Task.getTask(r.Info.Id, r.Info.ScriptName)
+}
+
+// A Store that keeps each task's record in a JSON file, named after the
+// task's ID, in a directory
+type FileStore struct {
+	dirPath string
+}
+
+// Return a FileStore that keeps its records in dirPath, which is created if
+// it doesn't exist
+func NewFileStore(dirPath string) (*FileStore, error) {
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Failed to create task store directory: %s", err.Error()))
+	}
+	return &FileStore{dirPath}, nil
+}
+
+// Return an error if records can't be written to the store's directory,
+// e.g., because it belongs to another user
+func (s *FileStore) CheckWritable() error {
+	f, err := ioutil.TempFile(s.dirPath, ".write-test")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// The suffix of the files of a FileStore's records
+const RECORD_FILE_SUFFIX = ".json"
+
+// A TaskRecord as it's written to a file: errors can't be decoded from JSON,
+// so the error of the task's output is kept apart
+type fileRecord struct {
+	TaskRecord
+	Error *fileError
+}
+
+// The *RunError of a task's output
+type fileError struct {
+	Phase Phase
+	// The message of the RunError's Kind, "" if it has none
+	Kind    string
+	Message string
+}
+
+// The kinds of RunError that are kept by name
+var runErrorKinds = []error{
+	ErrLockBusy, ErrMaxConcurrent, ErrTransfer, ErrTimeout, ErrHostUnreachable}
+
+func getFileRecord(record TaskRecord) fileRecord {
+	fr := fileRecord{TaskRecord: record}
+	if record.Info.Output == nil || record.Info.Output.Err == nil {
+		return fr
+	}
+	output := *record.Info.Output
+	fr.Error = &fileError{Message: output.Err.Error()}
+	if runErr, ok := output.Err.(*RunError); ok {
+		fr.Error.Phase = runErr.Phase
+		fr.Error.Message = runErr.Err.Error()
+		if runErr.Kind != nil {
+			fr.Error.Kind = runErr.Kind.Error()
+		}
+	}
+	output.Err = nil
+	fr.Info.Output = &output
+	return fr
+}
+
+func (fr fileRecord) getTaskRecord() TaskRecord {
+	record := fr.TaskRecord
+	if fr.Error == nil || record.Info.Output == nil {
+		return record
+	}
+	if fr.Error.Phase == "" {
+		record.Info.Output.Err = errors.New(fr.Error.Message)
+		return record
+	}
+	runErr := &RunError{Phase: fr.Error.Phase, Err: errors.New(fr.Error.Message)}
+	for _, kind := range runErrorKinds {
+		if kind.Error() == fr.Error.Kind {
+			runErr.Kind = kind
+		}
+	}
+	record.Info.Output.Err = runErr
+	return record
+}
+
+// Return the path of a task's record file
+func (s *FileStore) getRecordPath(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return "", errors.New(fmt.Sprintf("Invalid task ID: %q", id))
+	}
+	return filepath.Join(s.dirPath, id+RECORD_FILE_SUFFIX), nil
+}
+
+// Write a task's record, replacing its record file atomically so that a
+// crash never leaves a partial record
+func (s *FileStore) Put(record TaskRecord) error {
+	path, err := s.getRecordPath(record.Info.Id)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(getFileRecord(record))
+	if err != nil {
+		return errors.New(fmt.Sprintf(
+			"Failed to encode record of task %s: %s", record.Info.Id, err.Error()))
+	}
+	f, err := ioutil.TempFile(s.dirPath, "."+record.Info.Id)
+	if err != nil {
+		return errors.New(fmt.Sprintf(
+			"Failed to write record of task %s: %s", record.Info.Id, err.Error()))
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.New(fmt.Sprintf(
+			"Failed to write record of task %s: %s", record.Info.Id, err.Error()))
+	}
+	return nil
+}
+
+func (s *FileStore) readRecord(path string) (TaskRecord, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TaskRecord{}, err
+	}
+	var fr fileRecord
+	if err = json.Unmarshal(content, &fr); err != nil {
+		return TaskRecord{}, errors.New(fmt.Sprintf(
+			"Failed to decode task record %s: %s", path, err.Error()))
+	}
+	return fr.getTaskRecord(), nil
+}
+
+func (s *FileStore) Get(id string) (TaskRecord, error) {
+	path, err := s.getRecordPath(id)
+	if err != nil {
+		return TaskRecord{}, err
+	}
+	record, err := s.readRecord(path)
+	if os.IsNotExist(err) {
+		return TaskRecord{}, ErrNoSuchTask
+	}
+	return record, err
+}
+
+func (s *FileStore) List() ([]TaskRecord, error) {
+	infos, err := ioutil.ReadDir(s.dirPath)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Failed to read task store directory: %s", err.Error()))
+	}
+	records := []TaskRecord{}
+	for _, info := range infos {
+		// Temporary files of records being written start with "."
+		if !strings.HasSuffix(info.Name(), RECORD_FILE_SUFFIX) || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		record, err := s.readRecord(filepath.Join(s.dirPath, info.Name()))
+		if err == nil && record.Info.Id+RECORD_FILE_SUFFIX != info.Name() {
+			err = errors.New(fmt.Sprintf("Task record %s is of task %q",
+				filepath.Join(s.dirPath, info.Name()), record.Info.Id))
+		}
+		if err != nil {
+			log.Printf("Skipping task record: %s", err.Error())
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
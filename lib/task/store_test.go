@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Return a FileStore in a new temporary directory.  The returned function
+// removes the directory.
+func newTestFileStore(t *testing.T) (*FileStore, func()) {
+	dirPath, err := ioutil.TempDir("", "geto-store")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	store, err := NewFileStore(dirPath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err.Error())
+	}
+	return store, func() { os.RemoveAll(dirPath) }
+}
+
+func TestFileStore(t *testing.T) {
+	store, remove := newTestFileStore(t)
+	defer remove()
+
+	maxConcurrent := uint32(2)
+	task, err := New([]string{"data.txt"},
+		NewScriptWithCommands("test-store", []string{"cat DEPS/data.txt"}, &maxConcurrent), 30)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: %s", err.Error())
+	}
+	task.Outputs = []string{"out/*"}
+	now := time.Now().Round(0)
+	record := TaskRecord{
+		Info: TaskInfo{Id: task.Id, ScriptName: "test-store", Host: "server1",
+			State: TaskFailed, Submitted: now, Started: now, Finished: now,
+			Output: &RunOutput{Stdout: "out", ExitCode: 1, Err: newRunError(
+				PhaseLock, ErrLockBusy, errors.New("Remote lock is busy"))}},
+		Task: getTaskDefinition(task)}
+	if err = store.Put(record); err != nil {
+		t.Fatalf("Failed to put record: %s", err.Error())
+	}
+	// Replacing a record
+	record.Info.Owner = "alice"
+	if err = store.Put(record); err != nil {
+		t.Fatalf("Failed to put record: %s", err.Error())
+	}
+
+	got, err := store.Get(task.Id)
+	if err != nil {
+		t.Fatalf("Failed to get record: %s", err.Error())
+	}
+	if got.Info.Owner != "alice" || !got.Info.Finished.Equal(now) || got.Info.Output.Stdout != "out" {
+		t.Errorf("Unexpected record: %#v", got.Info)
+	}
+	if !errors.Is(got.Info.Output.Err, ErrLockBusy) ||
+		got.Info.Output.Err.Error() != record.Info.Output.Err.Error() {
+		t.Errorf("Unexpected error: %v", got.Info.Output.Err)
+	}
+	restored := got.Task.getTask(got.Info.Id, got.Info.ScriptName)
+	if restored.Timeout != 30 || *restored.Script.maxConcurrent != 2 ||
+		restored.Script.commands[0] != "cat DEPS/data.txt" || restored.Outputs[0] != "out/*" {
+		t.Errorf("Unexpected task: %#v", restored)
+	}
+
+	records, err := store.List()
+	if err != nil || len(records) != 1 {
+		t.Errorf("Expected one record, got %#v (%v)", records, err)
+	}
+	if _, err = store.Get("no-such-task"); err != ErrNoSuchTask {
+		t.Errorf("Expected %v, got %v", ErrNoSuchTask, err)
+	}
+	if err = store.Put(TaskRecord{Info: TaskInfo{Id: "../escape"}}); err == nil {
+		t.Errorf("Expected an invalid task ID to be refused")
+	}
+
+	// Corrupt records are skipped
+	for name, content := range map[string]string{
+		"truncated.json": `{"Info": {"Id": "trunc`,
+		"renamed.json":   `{"Info": {"Id": "other"}}`} {
+		if err = ioutil.WriteFile(filepath.Join(store.dirPath, name), []byte(content), 0600); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if records, err = store.List(); err != nil || len(records) != 1 || records[0].Info.Id != task.Id {
+		t.Errorf("Expected the corrupt records to be skipped, got %#v (%v)", records, err)
+	}
+}
+
+func TestFileStoreCheckWritable(t *testing.T) {
+	store, remove := newTestFileStore(t)
+	defer remove()
+	if err := store.CheckWritable(); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if infos, _ := ioutil.ReadDir(store.dirPath); len(infos) != 0 {
+		t.Errorf("Expected the check to leave nothing behind, got %d files", len(infos))
+	}
+	remove()
+	if err := store.CheckWritable(); err == nil {
+		t.Errorf("Expected a store without a directory not to be writable")
+	}
+}
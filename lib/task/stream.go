@@ -0,0 +1,126 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Stream the output of running tasks.
+
+If a task has an OnOutput function, the runner tails the task's stdout and
+stderr files on the host while the task's script runs and passes each new
+chunk of either to OnOutput.  Tailing is best effort (e.g., a task that runs
+as another user may not let geto read its output until it exits), but the
+chunks always add up to the task's whole stdout and stderr: whatever hasn't
+been passed on by the time the script exits is passed on once the output has
+been collected, before the task's RunOutput is sent.
+*/
+package task
+
+import (
+	"fmt"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/shell"
+	"path"
+	"sync"
+	"time"
+)
+
+// The streams of a task's output
+const (
+	STDOUT = "stdout"
+	STDERR = "stderr"
+)
+
+// A chunk of a task's stdout or stderr
+type OutputChunk struct {
+	TaskId string
+	// STDOUT or STDERR
+	Stream string
+	// The offset of Data in the stream
+	Offset int64
+	Data   []byte
+}
+
+// The number of seconds between polls of a running task's output
+const TAIL_INTERVAL = 1
+
+// The most bytes of each stream read by a poll
+const TAIL_CHUNK_SIZE = 64 << 10
+
+// Tails the stdout and stderr of a running task
+type outputTailer struct {
+	conn remote.Remote
+	task Task
+	host host.Host
+	// The number of bytes of each stream passed on so far
+	offsets map[string]int64
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// Start tailing the output of a task that has an OnOutput function
+func startTailing(conn remote.Remote, task Task, host host.Host) *outputTailer {
+	t := &outputTailer{
+		conn:    conn,
+		task:    task,
+		host:    host,
+		offsets: map[string]int64{STDOUT: 0, STDERR: 0},
+		stop:    make(chan struct{})}
+	t.done.Add(1)
+	go func() {
+		defer t.done.Done()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(TAIL_INTERVAL * time.Second):
+			}
+			for _, stream := range []string{STDOUT, STDERR} {
+				t.poll(stream)
+			}
+		}
+	}()
+	return t
+}
+
+// Pass on the new output of a stream, if any
+func (t *outputTailer) poll(stream string) {
+	stdout, _, err := t.conn.Run(t.host, fmt.Sprintf(
+		"tail -c +%d %s 2>/dev/null | head -c %d",
+		t.offsets[stream]+1,
+		shell.Quote(path.Join(t.task.getRemoteDirPath(), stream)),
+		TAIL_CHUNK_SIZE), 0)
+	if err != nil || stdout == "" {
+		return
+	}
+	t.publish(stream, []byte(stdout))
+}
+
+func (t *outputTailer) publish(stream string, data []byte) {
+	t.task.OnOutput(OutputChunk{
+		TaskId: t.task.Id,
+		Stream: stream,
+		Offset: t.offsets[stream],
+		Data:   data})
+	t.offsets[stream] += int64(len(data))
+}
+
+// Stop tailing, waiting for a poll in progress
+func (t *outputTailer) stopTailing() {
+	close(t.stop)
+	t.done.Wait()
+}
+
+// Pass on the rest of the task's collected output
+func (t *outputTailer) flush(output RunOutput) {
+	for _, s := range []struct {
+		stream  string
+		content string
+	}{{STDOUT, output.Stdout}, {STDERR, output.Stderr}} {
+		// The collected output can only be shorter than what was
+		// tailed if the script truncated it
+		if int64(len(s.content)) > t.offsets[s.stream] {
+			t.publish(s.stream, []byte(s.content[t.offsets[s.stream]:]))
+		}
+	}
+}
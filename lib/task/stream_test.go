@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package task
+
+import (
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/fake"
+	"sync"
+	"testing"
+)
+
+// Concatenate the chunks of a stream, checking that they're contiguous
+func joinChunks(t *testing.T, chunks []OutputChunk, stream string) (joined string, n int) {
+	for _, chunk := range chunks {
+		if chunk.Stream != stream {
+			continue
+		}
+		if chunk.Offset != int64(len(joined)) {
+			t.Errorf("Expected a %s chunk at offset %d, got %d", stream, len(joined), chunk.Offset)
+		}
+		joined += string(chunk.Data)
+		n++
+	}
+	return joined, n
+}
+
+func TestRunStreamsOutput(t *testing.T) {
+	resetCapabilitiesCache()
+	task, err := New([]string{}, NewScriptWithCommands("test-stream", []string{
+		"echo first", "sleep 3", "echo second", "echo oops >&2"}, nil), 0)
+	if err != nil {
+		t.Fatalf("Failed to create new Task: " + err.Error())
+	}
+	var lock sync.Mutex
+	var chunks []OutputChunk
+	task.OnOutput = func(chunk OutputChunk) {
+		lock.Lock()
+		defer lock.Unlock()
+		if chunk.TaskId != task.Id {
+			t.Errorf("Unexpected task ID: %s", chunk.TaskId)
+		}
+		chunks = append(chunks, chunk)
+	}
+	ch := make(chan RunOutput)
+	go RunOnHost(fake.NewLocal(), task, config.GetParsedConfig().Hosts[0], ch)
+	output := <-ch
+	if output.Err != nil {
+		t.Fatalf("Unexpected error: %s", output.Err.Error())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	stdout, n := joinChunks(t, chunks, STDOUT)
+	if stdout != output.Stdout || stdout != "first\nsecond\n" {
+		t.Errorf("Expected the stdout chunks to add up to %q, got %q", output.Stdout, stdout)
+	}
+	// "first" is tailed while the script sleeps
+	if n < 2 {
+		t.Errorf("Expected stdout to be streamed while the script ran, got %d chunks", n)
+	}
+	if stderr, _ := joinChunks(t, chunks, STDERR); stderr != "oops\n" {
+		t.Errorf("Expected the stderr chunks to add up to \"oops\\n\", got %q", stderr)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 )
 
 // A task that runs on a target host
@@ -27,11 +28,51 @@ type Task struct {
 	// The number of seconds before giving up on a task after it has been
 	// started
 	Timeout uint32
+	// Resource limits applied to the task's script
+	Limits Limits
+	// The user to run the task's script as (with the host's sudo command),
+	// "" for the user that geto logs in as.  The user must be in the
+	// host's RunAsUsers.
+	RunAs string
+	// Run the task's script with a private HOME and TMPDIR inside the task
+	// directory, and keep the task directory private to the user that
+	// runs the script
+	Isolated bool
+	// The container to run the task's script in, nil to run the script
+	// directly on the host
+	Container *Container
+	// Globs, relative to the task directory, of the files to collect from
+	// the host after the task's script exits
+	Outputs []string
+	// The maximum total size, in bytes, of the collected output files, 0
+	// for DEFAULT_MAX_OUTPUT_SIZE
+	MaxOutputSize uint64
+	// Called with each chunk of the script's stdout and stderr while the
+	// task runs (see stream.go), nil to not stream the output
+	OnOutput func(chunk OutputChunk)
 }
 
 func New(depFiles []string, script Script, timeout uint32) (Task, error) {
+	if err := validateScriptName(script.name); err != nil {
+		return Task{}, err
+	}
 	taskId, err := genTaskId()
-	return Task{taskId, depFiles, script, timeout}, err
+	return Task{Id: taskId, DepFiles: depFiles, Script: script, Timeout: timeout}, err
+}
+
+// Script names are used in file names and remote commands, so they are
+// limited to characters that are safe in both.
+var validScriptName *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// Return an error if name isn't a valid script name
+func validateScriptName(name string) error {
+	if !validScriptName.MatchString(name) {
+		return errors.New(fmt.Sprintf(
+			"Invalid script name %q: must be 1-128 letters, digits, "+
+				"'_', '.' or '-' and must not start with '.' or '-'",
+			name))
+	}
+	return nil
 }
 
 // Generate a new task ID
@@ -58,20 +99,34 @@ func genTaskId() (string, error) {
 	return uuid, nil
 }
 
-// Return the script filename
-// The script filename is the task ID combined with the script name.
+// Return the path of the task directory on the target host
 func (t *Task) getRemoteDirPath() (path string) {
 	c := config.GetParsedConfig()
 	return filepath.Join(c.RemoteWorkPath, t.Id)
 }
 
 // Return the script filename
-// The script filename is the task ID combined with the script name.
+// The script filename is the task ID combined with the script name.  For a
+// script bundle, this is the name of the directory holding the bundle.
+func (t *Task) getScriptFileName() string {
+	return fmt.Sprintf("%s_%s", t.Id, t.Script.name)
+}
+
+// Return the path, relative to the task directory, of the file to run
+func (t *Task) getScriptRelPath() string {
+	if t.Script.bundle != nil {
+		return filepath.Join(
+			t.getScriptFileName(),
+			filepath.FromSlash(t.Script.bundle.entrypoint))
+	}
+	return t.getScriptFileName()
+}
+
+// Return the path of the file to run on the target host
 func (t *Task) getRemoteScriptPath() (path string) {
 	// If this changes, we may need to update any pattern matchting we do
 	// to do pattern-based matching on remote processes.
-	return filepath.Join(
-		t.getRemoteDirPath(), fmt.Sprintf("%s_%s", t.Id, t.Script.name))
+	return filepath.Join(t.getRemoteDirPath(), t.getScriptRelPath())
 }
 
 // Creates a directory from a task object.
@@ -80,33 +135,33 @@ func (t *Task) getRemoteScriptPath() (path string) {
 // The path to the created file is returned
 // If there is a problem a non-nil error is returned
 func (t *Task) CreateDir() (path string, err error) {
+	if err = validateScriptName(t.Script.name); err != nil {
+		return "", err
+	}
 	c := config.GetParsedConfig()
 	taskDirPath := filepath.Join(c.LocalWorkPath, t.Id)
 	taskDepsDirPath := filepath.Join(taskDirPath, "DEPS")
 	// The directory name is the task ID; we also create a special
 	// dependency subdirectory where any file dependencies will live.
-	os.MkdirAll(taskDepsDirPath, 0755)
-	if err != nil {
+	if err = os.MkdirAll(taskDepsDirPath, 0755); err != nil {
 		return "", errors.New(fmt.Sprintf(
 			"Failed to create task directory: %s", err.Error()))
 	}
 
-	scriptFilePath := filepath.Join(
-		taskDirPath,
-		fmt.Sprintf("%s_%s", t.Id, t.Script.name))
-	f, err := os.OpenFile(scriptFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
-	defer f.Close()
-	if err != nil {
-		return "", errors.New(fmt.Sprintf(
-			"Failed to create script file: %s", err.Error()))
-	}
-
-	for _, c := range t.Script.commands {
-		_, err := f.Write([]byte(c + "\n"))
-		if err != nil {
+	scriptFilePath := filepath.Join(taskDirPath, t.getScriptFileName())
+	if t.Script.bundle != nil {
+		if err = t.Script.bundle.write(scriptFilePath); err != nil {
 			return "", errors.New(fmt.Sprintf(
-				"Failed to write script file: %s", err.Error()))
+				"Failed to write script bundle: %s", err.Error()))
 		}
+	} else if err = t.Script.writeFile(scriptFilePath); err != nil {
+		return "", err
+	}
+
+	if c.RemoteCachePath != "" {
+		// The file dependencies are put in place on the target host
+		// from the dependency cache (see cache.go).
+		return taskDirPath, nil
 	}
 
 	// Now copy over the file dependencies to this task directory
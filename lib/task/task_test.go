@@ -107,3 +107,17 @@ func TestTaskCreateDir(t *testing.T) {
 		t.Errorf("Missing %s", expectedPath)
 	}
 }
+
+func TestNewTaskWithHostileScriptName(t *testing.T) {
+	for _, name := range []string{
+		"", "with space", "semi;colon", "$(reboot)", "`id`", "quote'", "../escape",
+		"-rf", ".hidden", "new\nline", "slash/name"} {
+		if _, err := New([]string{}, NewScript(name, nil), 0); err == nil {
+			t.Errorf("Creating a task with script name %q should fail", name)
+		}
+		task := Task{Id: "test-task", DepFiles: []string{}, Script: NewScript(name, nil)}
+		if _, err := task.CreateDir(); err == nil {
+			t.Errorf("Creating a directory for script name %q should fail", name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Authenticate and authorize the clients of the server
+
+If the config has clients (see config.Client), every RPC connection and HTTP
+request must be authenticated as one of them, either with a TLS client
+certificate whose common name is the client's name (if tls_client_ca_path is
+set) or with the client's token: over JSON RPC by calling
+GetoRPC.Authenticate first, over HTTP with an "Authorization: Bearer <token>"
+header.  A client only sees the hosts that it may use and the tasks that it
+submitted.
+
+Without clients in the config, anyone who can connect to the server may use
+it.
+*/
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/task"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	// The connection or request isn't authenticated as any client
+	ErrUnauthenticated = errors.New("Not authenticated")
+	// The client may not do what it asked to
+	ErrForbidden = errors.New("Permission denied")
+)
+
+// The client of an RPC connection or HTTP request
+type session struct {
+	lock   sync.Mutex
+	client *config.Client
+}
+
+// Return a GetoRPC for a connection or request by client, nil if the client
+// isn't known (yet)
+func (g *GetoRPC) newSession(client *config.Client) *GetoRPC {
+	return &GetoRPC{g.conn, g.manager, &session{client: client}}
+}
+
+// Return the client of g, nil if the client isn't restricted in any way
+func (g *GetoRPC) getClient() (*config.Client, error) {
+	if g.session == nil || config.GetParsedConfig().Clients == nil {
+		return nil, nil
+	}
+	g.session.lock.Lock()
+	defer g.session.lock.Unlock()
+	if g.session.client == nil {
+		return nil, ErrUnauthenticated
+	}
+	return g.session.client, nil
+}
+
+// Return the configured client with the token, nil if there isn't one
+func getClientByToken(token string) *config.Client {
+	var found *config.Client
+	clients := config.GetParsedConfig().Clients
+	for i := range clients {
+		// Every token is compared so that the time taken doesn't tell
+		// which one matched
+		if clients[i].Token != "" &&
+			subtle.ConstantTimeCompare([]byte(clients[i].Token), []byte(token)) == 1 {
+			found = &clients[i]
+		}
+	}
+	return found
+}
+
+// Return the configured client of a verified TLS client certificate, nil if
+// there isn't one
+func getClientByCert(state tls.ConnectionState) *config.Client {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	name := state.PeerCertificates[0].Subject.CommonName
+	clients := config.GetParsedConfig().Clients
+	for i := range clients {
+		if clients[i].Name == name {
+			return &clients[i]
+		}
+	}
+	return nil
+}
+
+// Authenticate the connection with a client's token
+// The incoming parameter is the token
+// The name of the client is returned via the "clientName" parameter
+func (g *GetoRPC) Authenticate(token *string, clientName *string) error {
+	if g.session == nil || config.GetParsedConfig().Clients == nil {
+		return errors.New("Authentication isn't enabled")
+	}
+	client := getClientByToken(*token)
+	if client == nil {
+		return ErrUnauthenticated
+	}
+	g.session.lock.Lock()
+	g.session.client = client
+	g.session.lock.Unlock()
+	*clientName = client.Name
+	return nil
+}
+
+// Return the configured hosts that client may use
+func getPermittedHosts(client *config.Client) []host.Host {
+	hosts := config.GetParsedConfig().Hosts
+	if client == nil {
+		return hosts
+	}
+	permitted := []host.Host{}
+	for _, h := range hosts {
+		if client.MayUseHost(h) {
+			permitted = append(permitted, h)
+		}
+	}
+	return permitted
+}
+
+// Report whether client may see the task
+func mayAccessTask(client *config.Client, info task.TaskInfo) bool {
+	return client == nil || info.Owner == client.Name
+}
+
+// Return what's known of a task that client may see
+func (g *GetoRPC) getTask(client *config.Client, id string) (task.TaskInfo, error) {
+	info, err := g.manager.Get(id)
+	if err != nil {
+		return task.TaskInfo{}, err
+	}
+	if !mayAccessTask(client, info) {
+		// Other clients' tasks don't exist as far as client knows
+		return task.TaskInfo{}, task.ErrNoSuchTask
+	}
+	return info, nil
+}
+
+// Return the TLS config of the server's listeners, nil if they don't use TLS
+func GetTLSConfig() (*tls.Config, error) {
+	conf := config.GetParsedConfig()
+	if conf.TLSCertPath == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TLSCertPath, conf.TLSKeyPath)
+	if err != nil {
+		return nil, errors.New("Failed to load TLS certificate: " + err.Error())
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12}
+	if conf.TLSClientCAPath != "" {
+		pem, err := ioutil.ReadFile(conf.TLSClientCAPath)
+		if err != nil {
+			return nil, errors.New("Failed to read TLS client CA: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates in TLS client CA " + conf.TLSClientCAPath)
+		}
+		tlsConfig.ClientCAs = pool
+		// Clients with tokens don't need certificates
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
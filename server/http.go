@@ -0,0 +1,492 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Serve the HTTP API
+
+The HTTP API exposes the GetoRPC task and host methods as JSON resources:
+
+	GET    /healthz                     "ok" if the server is up
+	GET    /hosts                       ListHosts
+	GET    /hosts/test                  TestHostConnection (?host= for one host)
+	GET    /tasks                       ListTasks (?state=&host=&script_name=)
+	POST   /tasks                       SubmitTask
+	GET    /tasks/{id}                  GetTaskStatus (WaitTask with ?wait=<seconds>)
+	DELETE /tasks/{id}                  CancelTask
+	GET    /tasks/{id}/output           The task's output as Server-Sent Events
+	GET    /tasks/{id}/outputs/{path}   Download a collected output file
+	GET    /history                     QueryHistory (?state=&host=&script_name=&since=&until=&exit_code=)
+
+The since and until times of /history are in RFC 3339 format.
+
+A task is submitted either as a JSON SubmitTaskArgs or as a multipart form
+whose "task" field is the JSON SubmitTaskArgs and whose "deps" files are the
+task's dependency files (available to the script as DEPS/<file name>).
+Dependency files are uploaded or sent in Deps; DepFiles must be empty.
+
+Requests other than /healthz are authenticated as described in auth.go.
+Errors are replied as {"error": "<message>"} with a 4xx or 5xx status.
+*/
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/task"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The size of a multipart form that is kept in memory, the rest of the
+// uploaded files are buffered in temporary files
+const MAX_FORM_MEMORY = 32 << 20
+
+type httpHandler struct {
+	rpc *GetoRPC
+}
+
+// Return the handler of the HTTP API, backed by rpc.  Each request is
+// authenticated by its TLS client certificate or its bearer token (see
+// auth.go); /healthz doesn't need to be.
+func NewHTTPHandler(rpc *GetoRPC) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			httpHandler{rpc}.healthz(w, r)
+			return
+		}
+		client, err := authenticateRequest(r)
+		if err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		h := httpHandler{rpc.newSession(client)}
+		switch {
+		case r.URL.Path == "/hosts":
+			h.hosts(w, r)
+		case r.URL.Path == "/hosts/test":
+			h.testHosts(w, r)
+		case r.URL.Path == "/tasks":
+			h.tasks(w, r)
+		case strings.HasPrefix(r.URL.Path, "/tasks/"):
+			h.task(w, r)
+		case r.URL.Path == "/history":
+			h.history(w, r)
+		default:
+			writeError(w, http.StatusNotFound, errors.New("Not found"))
+		}
+	})
+}
+
+// Return the client that a request is from, nil if it doesn't say
+func authenticateRequest(r *http.Request) (*config.Client, error) {
+	if r.TLS != nil {
+		if client := getClientByCert(*r.TLS); client != nil {
+			return client, nil
+		}
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, ErrUnauthenticated
+	}
+	client := getClientByToken(strings.TrimPrefix(authorization, "Bearer "))
+	if client == nil {
+		return nil, ErrUnauthenticated
+	}
+	return client, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print("Failed to write HTTP reply: ", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Reply with the error of a GetoRPC method
+func writeRPCError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, err)
+	case errors.Is(err, ErrForbidden):
+		writeError(w, http.StatusForbidden, err)
+	case errors.Is(err, task.ErrNoSuchTask):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, task.ErrTaskDone):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, task.ErrShuttingDown):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+}
+
+func (h httpHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+func (h httpHandler) hosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	var hosts []HostReply
+	if err := h.rpc.ListHosts(&NoArgs{}, &hosts); err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, hosts)
+}
+
+// /hosts/test
+func (h httpHandler) testHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	hostName := r.URL.Query().Get("host")
+	var results []HostConnectionReply
+	if err := h.rpc.TestHostConnection(&hostName, &results); err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// /tasks
+func (h httpHandler) tasks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		args := ListTasksArgs{
+			State:      query.Get("state"),
+			Host:       query.Get("host"),
+			ScriptName: query.Get("script_name")}
+		var tasks []TaskReply
+		if err := h.rpc.ListTasks(&args, &tasks); err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tasks)
+	case http.MethodPost:
+		h.submitTask(w, r)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// Return the HistoryArgs of a /history query
+func getHistoryArgs(query url.Values) (HistoryArgs, error) {
+	args := HistoryArgs{
+		State:      query.Get("state"),
+		Host:       query.Get("host"),
+		ScriptName: query.Get("script_name")}
+	for _, param := range []struct {
+		name  string
+		value **time.Time
+	}{{"since", &args.Since}, {"until", &args.Until}} {
+		if s := query.Get(param.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return args, errors.New(fmt.Sprintf("Invalid %s: %q", param.name, s))
+			}
+			*param.value = &t
+		}
+	}
+	if s := query.Get("exit_code"); s != "" {
+		exitCode, err := strconv.Atoi(s)
+		if err != nil {
+			return args, errors.New(fmt.Sprintf("Invalid exit_code: %q", s))
+		}
+		args.ExitCode = &exitCode
+	}
+	return args, nil
+}
+
+// /history
+func (h httpHandler) history(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	args, err := getHistoryArgs(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var reply HistoryReply
+	if err = h.rpc.QueryHistory(&args, &reply); err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+func (h httpHandler) submitTask(w http.ResponseWriter, r *http.Request) {
+	var args SubmitTaskArgs
+	var depDirPath string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		var err error
+		if depDirPath, err = parseTaskForm(r, &args); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("Invalid task: "+err.Error()))
+		return
+	} else if len(args.DepFiles) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New(
+			"Invalid task: dependency files must be uploaded"))
+		return
+	}
+
+	var reply TaskReply
+	if err := h.rpc.submitTask(&args, &reply); err != nil {
+		os.RemoveAll(depDirPath)
+		writeRPCError(w, err)
+		return
+	}
+	if depDirPath != "" {
+		go h.rpc.removeWhenDone(reply.Id, depDirPath)
+	}
+	w.Header().Set("Location", "/tasks/"+reply.Id)
+	writeJSON(w, http.StatusCreated, reply)
+}
+
+// Parse a multipart task submission into args, saving the uploaded
+// dependency files in a new directory whose path is returned
+func parseTaskForm(r *http.Request, args *SubmitTaskArgs) (depDirPath string, err error) {
+	if err = r.ParseMultipartForm(MAX_FORM_MEMORY); err != nil {
+		return "", errors.New("Invalid task form: " + err.Error())
+	}
+	defer r.MultipartForm.RemoveAll()
+	if err = json.Unmarshal([]byte(r.FormValue("task")), args); err != nil {
+		return "", errors.New("Invalid task: " + err.Error())
+	}
+	if len(args.DepFiles) > 0 {
+		return "", errors.New("Invalid task: dependency files must be uploaded")
+	}
+
+	if depDirPath, err = ioutil.TempDir("", "geto-upload"); err != nil {
+		return "", errors.New("Failed to save dependency files: " + err.Error())
+	}
+	for _, fileHeader := range r.MultipartForm.File["deps"] {
+		name := filepath.Base(fileHeader.Filename)
+		if !isValidDepFileName(name) {
+			err = errors.New(fmt.Sprintf("Invalid dependency file name: %q", fileHeader.Filename))
+			break
+		}
+		path := filepath.Join(depDirPath, name)
+		if err = saveUploadedFile(fileHeader, path); err != nil {
+			err = errors.New("Failed to save dependency files: " + err.Error())
+			break
+		}
+		args.DepFiles = append(args.DepFiles, path)
+	}
+	if err != nil {
+		os.RemoveAll(depDirPath)
+		return "", err
+	}
+	return depDirPath, nil
+}
+
+func saveUploadedFile(fileHeader *multipart.FileHeader, path string) error {
+	src, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// /tasks/{id}, /tasks/{id}/output and /tasks/{id}/outputs/{path}
+func (h httpHandler) task(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/tasks/")
+	var outputPath string
+	streamOutput := false
+	if i := strings.Index(id, "/"); i >= 0 {
+		rest := id[i:]
+		id = id[:i]
+		switch {
+		case rest == "/output":
+			streamOutput = true
+		case strings.HasPrefix(rest, "/outputs/"):
+			outputPath = strings.TrimPrefix(rest, "/outputs/")
+		default:
+			writeError(w, http.StatusNotFound, errors.New("Not found"))
+			return
+		}
+	}
+	if id == "" {
+		writeError(w, http.StatusNotFound, errors.New("Not found"))
+		return
+	}
+
+	switch {
+	case streamOutput && r.Method == http.MethodGet:
+		h.streamOutput(w, r, id)
+	case streamOutput:
+		writeMethodNotAllowed(w, http.MethodGet)
+	case outputPath != "" && r.Method == http.MethodGet:
+		h.getOutput(w, r, id, outputPath)
+	case outputPath != "":
+		writeMethodNotAllowed(w, http.MethodGet)
+	case r.Method == http.MethodGet:
+		h.getTask(w, r, id)
+	case r.Method == http.MethodDelete:
+		var reply TaskReply
+		if err := h.rpc.CancelTask(&id, &reply); err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, reply)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (h httpHandler) getTask(w http.ResponseWriter, r *http.Request, id string) {
+	var reply TaskReply
+	var err error
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		seconds, parseErr := strconv.ParseUint(wait, 10, 32)
+		if parseErr != nil || seconds == 0 {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid wait: %s", wait)))
+			return
+		}
+		err = h.rpc.WaitTask(&WaitTaskArgs{id, uint32(seconds)}, &reply)
+	} else {
+		err = h.rpc.GetTaskStatus(&id, &reply)
+	}
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// Download a collected output file of a task.  Only the files listed in the
+// task's result are served.
+func (h httpHandler) getOutput(w http.ResponseWriter, r *http.Request, id string, outputPath string) {
+	var reply TaskReply
+	if err := h.rpc.GetTaskStatus(&id, &reply); err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	var output *task.OutputFile
+	if reply.Result != nil {
+		for i := range reply.Result.Outputs {
+			if reply.Result.Outputs[i].Path == outputPath {
+				output = &reply.Result.Outputs[i]
+			}
+		}
+	}
+	if output == nil {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("No such output file: %s", outputPath)))
+		return
+	}
+	path := filepath.Join(config.GetParsedConfig().LocalWorkPath, id,
+		task.RESULTS_DIR, filepath.FromSlash(output.Path))
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("No such output file: %s", outputPath)))
+		return
+	}
+	defer f.Close()
+	w.Header().Set("X-Content-SHA256", output.SHA256)
+	http.ServeContent(w, r, filepath.Base(path), time.Time{}, f)
+}
+
+// Write a Server-Sent Event whose data is the JSON of v
+func writeEvent(w http.ResponseWriter, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// Stream a task's stdout and stderr as Server-Sent Events: an "output" event
+// per chunk (a task.OutputChunk, whose Data is base64-encoded) and, once the
+// task is done, a "done" event with the task's TaskReply.  With
+// ?follow=false, only the output so far is sent.
+func (h httpHandler) streamOutput(w http.ResponseWriter, r *http.Request, id string) {
+	follow := r.URL.Query().Get("follow") != "false"
+	ch, unsubscribe, err := h.rpc.subscribe(id)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	// Without following, the chunks already buffered are the output so far
+	nBuffered := len(ch)
+	for i := 0; follow || i < nBuffered; i++ {
+		var chunk task.OutputChunk
+		var ok bool
+		select {
+		case chunk, ok = <-ch:
+		case <-r.Context().Done():
+			return
+		}
+		if !ok {
+			break
+		}
+		if writeEvent(w, "output", chunk) != nil {
+			return
+		}
+	}
+
+	var reply TaskReply
+	if err = h.rpc.GetTaskStatus(&id, &reply); err == nil && reply.Result != nil {
+		writeEvent(w, "done", reply)
+	}
+}
@@ -0,0 +1,195 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start an SSH server for the configured host and an HTTP API server.  The
+// returned function stops both.
+func startHTTPServer(t *testing.T) (*httptest.Server, func()) {
+	stopSSHServer := startSSHServer(t, "../test/data/geto-sshtest.ini")
+	server := httptest.NewServer(NewHTTPHandler(NewGetoRPC(ssh.New())))
+	return server, func() {
+		server.Close()
+		stopSSHServer()
+	}
+}
+
+// Send a request and decode its JSON reply into v, if v isn't nil.  The
+// reply's status is returned.
+func doRequest(t *testing.T, method string, url string, contentType string, body io.Reader, v interface{}) int {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err.Error())
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, url, err.Error())
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode reply of %s %s: %s", method, url, err.Error())
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHTTPSubmitAndDownload(t *testing.T) {
+	server, stop := startHTTPServer(t)
+	defer stop()
+
+	body, _ := json.Marshal(SubmitTaskArgs{
+		ScriptName: "test-http",
+		Script:     "mkdir -p out\necho result > out/a.txt\necho hello",
+		Outputs:    []string{"out/*.txt"}})
+	var submitted TaskReply
+	status := doRequest(t, "POST", server.URL+"/tasks", "application/json", bytes.NewReader(body), &submitted)
+	if status != http.StatusCreated || submitted.Id == "" {
+		t.Fatalf("Unexpected submission reply: %d %#v", status, submitted)
+	}
+
+	var reply TaskReply
+	status = doRequest(t, "GET", server.URL+"/tasks/"+submitted.Id+"?wait=30", "", nil, &reply)
+	if status != http.StatusOK || reply.State != "succeeded" || reply.Result.Stdout != "hello\n" {
+		t.Fatalf("Unexpected task reply: %d %#v", status, reply)
+	}
+
+	resp, err := http.Get(server.URL + "/tasks/" + submitted.Id + "/outputs/out/a.txt")
+	if err != nil {
+		t.Fatalf("Failed to download output file: %s", err.Error())
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(content) != "result\n" {
+		t.Errorf("Unexpected output file: %d %q", resp.StatusCode, content)
+	}
+	if resp.Header.Get("X-Content-SHA256") != reply.Result.Outputs[0].SHA256 {
+		t.Errorf("Expected the output file's SHA-256 in the reply")
+	}
+	status = doRequest(t, "GET", server.URL+"/tasks/"+submitted.Id+"/outputs/stdout", "", nil, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("Expected only output files to be downloadable, got %d", status)
+	}
+}
+
+func TestHTTPSubmitWithUploadedDeps(t *testing.T) {
+	server, stop := startHTTPServer(t)
+	defer stop()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	task, _ := json.Marshal(SubmitTaskArgs{ScriptName: "test-http-deps", Script: "cat DEPS/input.txt"})
+	form.WriteField("task", string(task))
+	part, _ := form.CreateFormFile("deps", "input.txt")
+	io.WriteString(part, "uploaded\n")
+	form.Close()
+
+	var submitted TaskReply
+	status := doRequest(t, "POST", server.URL+"/tasks", form.FormDataContentType(), &body, &submitted)
+	if status != http.StatusCreated {
+		t.Fatalf("Unexpected submission status: %d", status)
+	}
+	var reply TaskReply
+	doRequest(t, "GET", server.URL+"/tasks/"+submitted.Id+"?wait=30", "", nil, &reply)
+	if reply.Result == nil || reply.Result.Stdout != "uploaded\n" {
+		t.Errorf("Unexpected task reply: %#v", reply)
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	server, stop := startHTTPServer(t)
+	defer stop()
+
+	var reply map[string]string
+	status := doRequest(t, "DELETE", server.URL+"/tasks/no-such-task", "", nil, &reply)
+	if status != http.StatusNotFound || reply["error"] != "No such task" {
+		t.Errorf("Expected an unknown task error, got %d %#v", status, reply)
+	}
+	body := `{"ScriptName": "test-http", "Script": "true", "DepFiles": ["/etc/passwd"]}`
+	status = doRequest(t, "POST", server.URL+"/tasks", "application/json", strings.NewReader(body), &reply)
+	if status != http.StatusBadRequest || !strings.Contains(reply["error"], "must be uploaded") {
+		t.Errorf("Expected server paths to be refused, got %d %#v", status, reply)
+	}
+	status = doRequest(t, "PUT", server.URL+"/tasks", "", nil, &reply)
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected PUT to be refused, got %d", status)
+	}
+}
+
+func TestHTTPHostsAndHealth(t *testing.T) {
+	server, stop := startHTTPServer(t)
+	defer stop()
+
+	var hosts []HostReply
+	if status := doRequest(t, "GET", server.URL+"/hosts", "", nil, &hosts); status != http.StatusOK ||
+		len(hosts) != 1 || hosts[0].Name != "server1" {
+		t.Errorf("Unexpected hosts: %d %#v", status, hosts)
+	}
+	var results []HostConnectionReply
+	if status := doRequest(t, "GET", server.URL+"/hosts/test?host=server1", "", nil, &results); status != http.StatusOK ||
+		len(results) != 1 || !results[0].Ok {
+		t.Errorf("Unexpected connection test results: %d %#v", status, results)
+	}
+	if status := doRequest(t, "GET", server.URL+"/hosts/test?host=nope", "", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected testing an unknown host to fail, got %d", status)
+	}
+	if status := doRequest(t, "GET", server.URL+"/healthz", "", nil, nil); status != http.StatusOK {
+		t.Errorf("Unexpected health status: %d", status)
+	}
+}
+
+func TestHTTPHistory(t *testing.T) {
+	server, stop := startHTTPServer(t)
+	defer stop()
+
+	for _, script := range []string{"true", "exit 3", "exit 3"} {
+		body, _ := json.Marshal(SubmitTaskArgs{ScriptName: "test-history", Script: script, Host: "server1"})
+		var submitted TaskReply
+		doRequest(t, "POST", server.URL+"/tasks", "application/json", bytes.NewReader(body), &submitted)
+		doRequest(t, "GET", server.URL+"/tasks/"+submitted.Id+"?wait=30", "", nil, nil)
+	}
+
+	var reply HistoryReply
+	status := doRequest(t, "GET", server.URL+"/history?state=failed&exit_code=3&since="+
+		url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), "", nil, &reply)
+	if status != http.StatusOK || len(reply.Tasks) != 2 || reply.Tasks[0].Result.ExitCode != 3 {
+		t.Errorf("Unexpected history reply: %d %#v", status, reply)
+	}
+	if status = doRequest(t, "GET", server.URL+"/history", "", nil, &reply); status != http.StatusOK {
+		t.Fatalf("Unexpected status: %d", status)
+	}
+	stats := reply.ByScriptName["test-history"]
+	if reply.Total.Tasks != 3 || stats.Succeeded != 1 || stats.Failed != 2 || reply.ByHost["server1"].Tasks != 3 {
+		t.Errorf("Unexpected stats: %#v", reply)
+	}
+	if stats.SuccessRate < 0.33 || stats.SuccessRate > 0.34 || stats.P95Duration <= 0 {
+		t.Errorf("Unexpected script stats: %#v", stats)
+	}
+	if status = doRequest(t, "GET", server.URL+"/history?since=yesterday", "", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid time to be refused, got %d", status)
+	}
+	if status = doRequest(t, "GET", server.URL+"/history?until="+
+		url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), "", nil, &reply); status != http.StatusOK ||
+		len(reply.Tasks) != 0 {
+		t.Errorf("Expected no tasks before an hour ago, got %d %#v", status, reply.Tasks)
+	}
+}
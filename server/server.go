@@ -3,59 +3,828 @@
  * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
 
 /*
-Start a raw JSON RPC server
+Start a raw JSON RPC server and an HTTP API (see http.go)
 
-A client may call (via RPC) any of the GetoRPC functions exported here.
+A client may call (via RPC) any of the GetoRPC functions exported here.  Tasks
+are submitted with SubmitTask and then looked up, waited for and cancelled by
+their ID; every task method replies with a TaskReply.  QueryHistory selects
+tasks, including the ones recorded by an earlier server (see
+task.Manager.Reconcile), and sums them up.
 */
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/host"
+	"github.com/bgmerrell/geto/lib/remote"
+	"github.com/bgmerrell/geto/lib/task"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-type GetoRPC struct{}
+type GetoRPC struct {
+	conn    remote.Remote
+	manager *task.Manager
+	// The client of a connection or request (see auth.go), nil for a
+	// GetoRPC used by the server itself
+	session *session
+}
+
+// Return a GetoRPC that runs tasks on the hosts with conn
+func NewGetoRPC(conn remote.Remote) *GetoRPC {
+	return &GetoRPC{conn, task.NewManager(conn), nil}
+}
+
+// For RPCs without arguments
+type NoArgs struct{}
 
 // Echo a string
 // The incoming parameter is the string to echo
 // The echoed string is returned via the "outgoing" parameter
 // This RPC is useful to validate that the RPC server is working
-func (*GetoRPC) Echo(incoming *string, outgoing *string) error {
+func (g *GetoRPC) Echo(incoming *string, outgoing *string) error {
+	if _, err := g.getClient(); err != nil {
+		return err
+	}
 	log.Print("Echoing: ", *incoming)
 	*outgoing = *incoming
 	return nil
 }
 
+// A configured host
+type HostReply struct {
+	Name     string
+	Addr     string
+	Port     uint16
+	Username string
+}
+
+// List the configured hosts that the client may use
+func (g *GetoRPC) ListHosts(args *NoArgs, reply *[]HostReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	*reply = []HostReply{}
+	for _, h := range getPermittedHosts(client) {
+		*reply = append(*reply, HostReply{h.Name, h.Addr, h.PortNum, h.Username})
+	}
+	return nil
+}
+
+// The result of connecting to a host
+type HostConnectionReply struct {
+	Host  string
+	Ok    bool
+	Error string
+}
+
 // Attempt to connect to each host via SSH
-/*
-func (*GetoRPC) TestHostConnection(incoming *string, outgoing *string) error {
-	log.Print("Echoing: ", *incoming)
-	*outgoing = *incoming
+// The incoming parameter is the name of the host to connect to, "" for all of
+// them
+func (g *GetoRPC) TestHostConnection(hostName *string, reply *[]HostConnectionReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	hosts := []host.Host{}
+	for _, h := range getPermittedHosts(client) {
+		if *hostName == "" || h.Name == *hostName {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return errors.New(fmt.Sprintf("Unknown host: %q", *hostName))
+	}
+	results := make([]HostConnectionReply, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h host.Host) {
+			defer wg.Done()
+			results[i].Host = h.Name
+			if err := g.conn.TestConnection(h); err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Ok = true
+			}
+		}(i, h)
+	}
+	wg.Wait()
+	*reply = results
 	return nil
 }
-*/
 
-// Start the JSON RPC server
-func Serve() bool {
+// A task to run
+type SubmitTaskArgs struct {
+	// The name of the task's script (see task.Script)
+	ScriptName string
+	// The content of the script, "" to run the script named ScriptName in
+	// the server's scripts_path
+	Script string
+	// The command that runs the script, e.g., ["python3"]; empty to use
+	// the script's shebang
+	Interpreter []string
+	// Paths, on the geto server, of the files that the task requires.
+	// They can only be set by the HTTP API, for the uploaded files.
+	DepFiles []string
+	// The contents of the files that the task requires, by file name
+	// (available to the script as DEPS/<file name>).  Over JSON, the
+	// contents are base64-encoded.
+	Deps map[string][]byte
+	// The number of seconds before giving up on the task, 0 for no limit
+	Timeout uint32
+	// The number of scripts of the same name that can run on a host
+	// concurrently, nil for no limit
+	MaxConcurrent *uint32
+	// Globs of the files to collect after the script exits (see
+	// task.Task)
+	Outputs []string
+	// How the host is chosen: "host", "random" or "balanced".  The
+	// default is "host" if Host is set and "random" otherwise.
+	Strategy string
+	// The host to run the task on, for the "host" strategy
+	Host string
+}
+
+// The result of a task that is done
+type TaskResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// The resource limit that the task hit, if any (see task.Limit)
+	LimitHit string
+	// Why the task failed to run, if it did
+	Error string
+	// The phase of the run that failed (see task.Phase)
+	ErrorPhase string
+	// The kind of failure, if known: "lock_busy", "max_concurrent",
+	// "transfer", "timeout" or "host_unreachable"
+	ErrorKind string
+	// The collected output files
+	Outputs []task.OutputFile
+}
+
+// What is known of a task
+type TaskReply struct {
+	Id         string
+	ScriptName string
+	// The host the task runs on, "" until it's chosen
+	Host string
+	// One of the task.TaskState values
+	State string
+	// The client that submitted the task, "" if clients aren't
+	// authenticated
+	Owner string
+	// When the task was submitted, started and done; nil until then
+	Submitted *time.Time
+	Started   *time.Time
+	Finished  *time.Time
+	// The task's result, nil until it's done
+	Result *TaskResult
+}
+
+var errorKinds = []struct {
+	err  error
+	name string
+}{
+	{task.ErrLockBusy, "lock_busy"},
+	{task.ErrMaxConcurrent, "max_concurrent"},
+	{task.ErrTransfer, "transfer"},
+	{task.ErrTimeout, "timeout"},
+	{task.ErrHostUnreachable, "host_unreachable"},
+}
+
+// Return a time for a reply, nil if it's zero
+func getReplyTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func GetTaskReply(info task.TaskInfo) TaskReply {
+	reply := TaskReply{
+		Id:         info.Id,
+		ScriptName: info.ScriptName,
+		Host:       info.Host,
+		State:      string(info.State),
+		Owner:      info.Owner,
+		Submitted:  getReplyTime(info.Submitted),
+		Started:    getReplyTime(info.Started),
+		Finished:   getReplyTime(info.Finished)}
+	if info.Output == nil {
+		return reply
+	}
+	output := info.Output
+	reply.Result = &TaskResult{
+		Stdout:   output.Stdout,
+		Stderr:   output.Stderr,
+		ExitCode: output.ExitCode,
+		LimitHit: string(output.LimitHit),
+		Outputs:  output.Outputs}
+	if output.Err != nil {
+		reply.Result.Error = output.Err.Error()
+		var runErr *task.RunError
+		if errors.As(output.Err, &runErr) {
+			reply.Result.ErrorPhase = string(runErr.Phase)
+		}
+		for _, kind := range errorKinds {
+			if errors.Is(output.Err, kind.err) {
+				reply.Result.ErrorKind = kind.name
+				break
+			}
+		}
+	}
+	return reply
+}
+
+// Return the script named name in the server's scripts_path
+func getStoredScript(name string, maxConcurrent *uint32) (task.Script, error) {
+	scriptsPath := config.GetParsedConfig().ScriptsPath
+	if scriptsPath == "" {
+		return task.Script{}, errors.New("Invalid task: no script given")
+	}
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return task.Script{}, errors.New(fmt.Sprintf("Invalid script name: %q", name))
+	}
+	script, err := task.NewScriptFromPath(name, filepath.Join(scriptsPath, name), maxConcurrent)
+	if os.IsNotExist(err) {
+		return task.Script{}, errors.New(fmt.Sprintf("No such script: %q", name))
+	}
+	return script, err
+}
+
+// Return the task that args describe
+func getSubmittedTask(args *SubmitTaskArgs) (task.Task, error) {
+	var script task.Script
+	if args.Script == "" {
+		var err error
+		if script, err = getStoredScript(args.ScriptName, args.MaxConcurrent); err != nil {
+			return task.Task{}, err
+		}
+	} else {
+		commands := strings.Split(strings.TrimSuffix(args.Script, "\n"), "\n")
+		script = task.NewScriptWithCommands(args.ScriptName, commands, args.MaxConcurrent)
+	}
+	if len(args.Interpreter) > 0 {
+		script.SetInterpreter(task.NewInterpreter(args.Interpreter[0], args.Interpreter[1:]...))
+	}
+	t, err := task.New(args.DepFiles, script, args.Timeout)
+	if err != nil {
+		return task.Task{}, err
+	}
+	t.Outputs = args.Outputs
+	return t, nil
+}
+
+// Report whether name can be the name of a dependency file
+func isValidDepFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// Save the contents of dependency files, by file name, in a new directory
+// and return its path along with the paths of the files ("" and nil if there
+// are no files)
+func saveDepFiles(deps map[string][]byte) (depDirPath string, paths []string, err error) {
+	if len(deps) == 0 {
+		return "", nil, nil
+	}
+	names := []string{}
+	for name := range deps {
+		if !isValidDepFileName(name) {
+			return "", nil, errors.New(fmt.Sprintf("Invalid dependency file name: %q", name))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if depDirPath, err = ioutil.TempDir("", "geto-deps"); err != nil {
+		return "", nil, errors.New("Failed to save dependency files: " + err.Error())
+	}
+	for _, name := range names {
+		path := filepath.Join(depDirPath, name)
+		if err = ioutil.WriteFile(path, deps[name], 0644); err != nil {
+			os.RemoveAll(depDirPath)
+			return "", nil, errors.New("Failed to save dependency files: " + err.Error())
+		}
+		paths = append(paths, path)
+	}
+	return depDirPath, paths, nil
+}
+
+// Remove the directory of a task's saved dependency files once the task is
+// done
+func (g *GetoRPC) removeWhenDone(id string, depDirPath string) {
+	if _, err := g.manager.Wait(id, 0); err != nil {
+		log.Printf("Failed to wait for task %s: %s", id, err.Error())
+	}
+	os.RemoveAll(depDirPath)
+}
+
+// Submit a task to run in the background
+// The task is described by the "args" parameter, whose DepFiles must be empty;
+// the contents of its dependency files are sent in Deps
+// What is known of the new task (e.g., its ID) is returned via the "reply"
+// parameter
+func (g *GetoRPC) SubmitTask(args *SubmitTaskArgs, reply *TaskReply) error {
+	if len(args.DepFiles) > 0 {
+		return errors.New("Invalid task: dependency files must be uploaded")
+	}
+	return g.submitTask(args, reply)
+}
+
+// Submit a task as SubmitTask does, including the dependency files in
+// args.DepFiles, which must be the caller's own
+func (g *GetoRPC) submitTask(args *SubmitTaskArgs, reply *TaskReply) error {
+	depDirPath, paths, err := saveDepFiles(args.Deps)
+	if err != nil {
+		return err
+	}
+	submitted := *args
+	submitted.DepFiles = append(append([]string{}, args.DepFiles...), paths...)
+	if err = g.submitTaskWithDepFiles(&submitted, reply); err != nil {
+		os.RemoveAll(depDirPath)
+		return err
+	}
+	if depDirPath != "" {
+		go g.removeWhenDone(reply.Id, depDirPath)
+	}
+	return nil
+}
+
+func (g *GetoRPC) submitTaskWithDepFiles(args *SubmitTaskArgs, reply *TaskReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	opts := task.SubmitOptions{Host: args.Host, Hosts: getPermittedHosts(client)}
+	if client != nil {
+		// A client limited to some scripts may only run them as the
+		// server stores them
+		if client.Scripts != nil && (args.Script != "" || len(args.Interpreter) > 0) {
+			return ErrForbidden
+		}
+		if !client.MayRunScript(args.ScriptName) {
+			return ErrForbidden
+		}
+		opts.Owner = client.Name
+	}
+	t, err := getSubmittedTask(args)
+	if err != nil {
+		return err
+	}
+	opts.Strategy = task.Strategy(args.Strategy)
+	if opts.Strategy == "" {
+		opts.Strategy = task.StrategyRandom
+		if args.Host != "" {
+			opts.Strategy = task.StrategyHost
+		}
+	}
+	info, err := g.manager.Submit(t, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Submitted task %s (%s)", info.Id, info.ScriptName)
+	*reply = GetTaskReply(info)
+	return nil
+}
+
+// Get the status of a task
+// The incoming parameter is the task's ID
+func (g *GetoRPC) GetTaskStatus(id *string, reply *TaskReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	info, err := g.getTask(client, *id)
+	if err != nil {
+		return err
+	}
+	*reply = GetTaskReply(info)
+	return nil
+}
+
+type WaitTaskArgs struct {
+	Id string
+	// The number of seconds to wait for, 0 to wait until the task is done
+	Timeout uint32
+}
 
+// Wait for a task to be done
+// The task's state in the reply tells whether it's done
+func (g *GetoRPC) WaitTask(args *WaitTaskArgs, reply *TaskReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	if _, err = g.getTask(client, args.Id); err != nil {
+		return err
+	}
+	info, err := g.manager.Wait(args.Id, time.Duration(args.Timeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	*reply = GetTaskReply(info)
+	return nil
+}
+
+// Cancel a task
+// The incoming parameter is the task's ID
+// The task is only in the "cancelled" state once it's done (see WaitTask)
+func (g *GetoRPC) CancelTask(id *string, reply *TaskReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	if _, err = g.getTask(client, *id); err != nil {
+		return err
+	}
+	info, err := g.manager.Cancel(*id)
+	if err != nil {
+		return err
+	}
+	*reply = GetTaskReply(info)
+	return nil
+}
+
+// Subscribe to the output of a task that the client may see (see
+// task.Manager.Subscribe)
+func (g *GetoRPC) subscribe(id string) (<-chan task.OutputChunk, func(), error) {
+	client, err := g.getClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = g.getTask(client, id); err != nil {
+		return nil, nil, err
+	}
+	return g.manager.Subscribe(id)
+}
+
+// Which tasks to list; empty fields match any task
+type ListTasksArgs struct {
+	State      string
+	Host       string
+	ScriptName string
+}
+
+// List the submitted tasks that the client may see, in the order they were
+// submitted
+func (g *GetoRPC) ListTasks(args *ListTasksArgs, reply *[]TaskReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	*reply = []TaskReply{}
+	for _, info := range g.manager.List() {
+		if !mayAccessTask(client, info) ||
+			(args.State != "" && string(info.State) != args.State) ||
+			(args.Host != "" && info.Host != args.Host) ||
+			(args.ScriptName != "" && info.ScriptName != args.ScriptName) {
+			continue
+		}
+		*reply = append(*reply, GetTaskReply(info))
+	}
+	return nil
+}
+
+// Which tasks a history query selects; empty fields select any task
+type HistoryArgs struct {
+	State      string
+	Host       string
+	ScriptName string
+	// The tasks submitted at or after Since and before Until
+	Since *time.Time
+	Until *time.Time
+	// The tasks whose script exited with the code
+	ExitCode *int
+}
+
+// A summary of a set of tasks (see task.HistoryStats)
+type StatsReply struct {
+	Tasks     int
+	Succeeded int
+	Failed    int
+	Cancelled int
+	// The share of the succeeded and failed tasks that succeeded
+	SuccessRate float64
+	// The median and 95th percentile durations, in seconds, of the tasks
+	// that were started and are done
+	P50Duration float64
+	P95Duration float64
+}
+
+// The tasks selected by a history query and their summary
+type HistoryReply struct {
+	Tasks        []TaskReply
+	Total        StatsReply
+	ByScriptName map[string]StatsReply
+	ByHost       map[string]StatsReply
+}
+
+func getStatsReply(stats task.HistoryStats) StatsReply {
+	return StatsReply{
+		Tasks:       stats.Tasks,
+		Succeeded:   stats.Succeeded,
+		Failed:      stats.Failed,
+		Cancelled:   stats.Cancelled,
+		SuccessRate: stats.SuccessRate,
+		P50Duration: stats.P50Duration.Seconds(),
+		P95Duration: stats.P95Duration.Seconds()}
+}
+
+// Query the history of the tasks that the client may see
+func (g *GetoRPC) QueryHistory(args *HistoryArgs, reply *HistoryReply) error {
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	q := task.HistoryQuery{
+		State:      task.TaskState(args.State),
+		Host:       args.Host,
+		ScriptName: args.ScriptName,
+		ExitCode:   args.ExitCode}
+	if client != nil {
+		q.Owner = client.Name
+	}
+	if args.Since != nil {
+		q.Since = *args.Since
+	}
+	if args.Until != nil {
+		q.Until = *args.Until
+	}
+	infos := g.manager.History(q)
+	report := task.GetHistoryReport(infos)
+	*reply = HistoryReply{
+		Tasks:        []TaskReply{},
+		Total:        getStatsReply(report.Total),
+		ByScriptName: map[string]StatsReply{},
+		ByHost:       map[string]StatsReply{}}
+	for _, info := range infos {
+		reply.Tasks = append(reply.Tasks, GetTaskReply(info))
+	}
+	for name, stats := range report.ByScriptName {
+		reply.ByScriptName[name] = getStatsReply(stats)
+	}
+	for name, stats := range report.ByHost {
+		reply.ByHost[name] = getStatsReply(stats)
+	}
+	return nil
+}
+
+// A geto server: the JSON RPC listener and, unless it's disabled, the HTTP
+// API (see NewHTTPHandler), on the configured addresses
+type Server struct {
+	getoRPC      *GetoRPC
+	rpcListener  net.Listener
+	httpListener net.Listener
+	httpServer   *http.Server
+	lock         sync.Mutex
+	// The open JSON RPC connections
+	conns        map[net.Conn]struct{}
+	shuttingDown bool
+	// The accept loops
+	serving sync.WaitGroup
+	errs    chan error
+}
+
+// Return a server that runs tasks on the hosts with conn
+func NewServer(conn remote.Remote) *Server {
+	return &Server{
+		getoRPC: NewGetoRPC(conn),
+		conns:   map[net.Conn]struct{}{},
+		errs:    make(chan error, 2)}
+}
+
+// Start listening on the configured addresses and serving connections
+func (s *Server) Start() error {
 	log.Print("Starting server...")
-	listener, err := net.Listen("tcp", ":11102")
+	conf := config.GetParsedConfig()
+	tlsConfig, err := GetTLSConfig()
 	if err != nil {
-		log.Fatal("Failed to start server: %s\n", err.Error())
-		return false
+		return err
 	}
-	defer listener.Close()
-	log.Print("Listening on: ", listener.Addr())
-	rpc.Register(new(GetoRPC))
+	if conf.TaskStorePath != "" {
+		store, err := task.NewFileStore(conf.TaskStorePath)
+		if err == nil {
+			err = store.CheckWritable()
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Can't record tasks in %s: %s.  Set task_store_path to a "+
+				"directory that the server can write to, or to nothing to not record tasks (they're "+
+				"then lost on a restart).", conf.TaskStorePath, err.Error()))
+		}
+		s.getoRPC.manager = task.NewManagerWithStore(s.getoRPC.conn, store)
+		if err = s.getoRPC.manager.Reconcile(); err != nil {
+			return err
+		}
+	}
+	s.getoRPC.manager.SetRetention(conf.MaxFinishedTasks, time.Duration(conf.FinishedTaskHours)*time.Hour)
+	if conf.Clients == nil {
+		log.Print("WARNING: no clients are configured, anyone who can connect may run tasks")
+	} else if tlsConfig == nil && !strings.HasPrefix(conf.RPCListenAddr, UNIX_ADDR_PREFIX) {
+		log.Print("WARNING: TLS isn't configured, client tokens are sent in the clear")
+	}
+	if s.rpcListener, err = listen(conf.RPCListenAddr, tlsConfig); err != nil {
+		return err
+	}
+	log.Print("Listening on: ", s.rpcListener.Addr())
+	if conf.HTTPListenAddr != "" {
+		if s.httpListener, err = listen(conf.HTTPListenAddr, tlsConfig); err != nil {
+			s.rpcListener.Close()
+			return errors.New("Failed to start HTTP API: " + err.Error())
+		}
+		log.Print("HTTP API listening on: ", s.httpListener.Addr())
+		s.httpServer = &http.Server{Handler: NewHTTPHandler(s.getoRPC)}
+	}
+
+	s.serving.Add(1)
+	go func() {
+		defer s.serving.Done()
+		if err := s.serveRPC(s.rpcListener); err != nil {
+			s.errs <- errors.New("Failed connection acceptance: " + err.Error())
+		}
+	}()
+	if s.httpServer != nil {
+		s.serving.Add(1)
+		go func() {
+			defer s.serving.Done()
+			err := s.httpServer.Serve(s.httpListener)
+			if err != http.ErrServerClosed {
+				s.errs <- errors.New("HTTP server failed: " + err.Error())
+			}
+		}()
+	}
+	return nil
+}
+
+// Return the address that the server listens on for JSON RPC connections
+func (s *Server) RPCAddr() net.Addr {
+	return s.rpcListener.Addr()
+}
+
+// Return the address that the server listens on for HTTP requests, nil if
+// the HTTP API is disabled
+func (s *Server) HTTPAddr() net.Addr {
+	if s.httpListener == nil {
+		return nil
+	}
+	return s.httpListener.Addr()
+}
+
+// Return a channel that receives an error if the server stops accepting
+// connections on its own, in which case it should be shut down
+func (s *Server) Err() <-chan error {
+	return s.errs
+}
+
+// The longest time that accepting waits before retrying after a temporary
+// error
+const MAX_ACCEPT_DELAY = time.Second
+
+// Serve JSON RPC connections accepted by listener until the server is shut
+// down (nil is returned) or accepting fails.  Each connection has its own
+// session, authenticated by the connection's TLS client certificate or by
+// calling Authenticate.
+func (s *Server) serveRPC(listener net.Listener) error {
+	var delay time.Duration
 	for {
-		log.Printf("Waiting for connection...")
-		if conn, err := listener.Accept(); err == nil {
-			log.Printf("Connection started: %v", conn.RemoteAddr())
-			go jsonrpc.ServeConn(conn)
-		} else {
-			log.Fatal("Failed connection acceptance: ", err.Error())
+		conn, err := listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			shuttingDown := s.shuttingDown
+			s.lock.Unlock()
+			if shuttingDown {
+				return nil
+			}
+			// E.g., running out of file descriptors shouldn't stop
+			// the server
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > MAX_ACCEPT_DELAY {
+					delay = MAX_ACCEPT_DELAY
+				}
+				log.Printf("Failed connection acceptance: %s; retrying in %v", err.Error(), delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		log.Printf("Connection started: %v", conn.RemoteAddr())
+		s.lock.Lock()
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+		go func() {
+			serveRPCConn(conn, s.getoRPC)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+func serveRPCConn(conn net.Conn, getoRPC *GetoRPC) {
+	var client *config.Client
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %v failed: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			return
+		}
+		client = getClientByCert(tlsConn.ConnectionState())
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("GetoRPC", getoRPC.newSession(client)); err != nil {
+		log.Print("Failed to register RPCs: ", err.Error())
+		conn.Close()
+		return
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// The prefix of an address that is the path of a Unix socket
+const UNIX_ADDR_PREFIX = "unix:"
+
+// Listen on addr, a TCP address or UNIX_ADDR_PREFIX and the path of a Unix
+// socket, with TLS if tlsConfig isn't nil
+func listen(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, UNIX_ADDR_PREFIX) {
+		network, addr = "unix", strings.TrimPrefix(addr, UNIX_ADDR_PREFIX)
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
 		}
 	}
+	listener, err := net.Listen(network, addr)
+	if err != nil || tlsConfig == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// Remove the Unix socket at path if it's left over from a server that's no
+// longer running (i.e., nothing accepts connections on it)
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		// Listening fails if something else is in the way
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New(fmt.Sprintf("Socket %s is in use", path))
+	}
+	return os.Remove(path)
+}
+
+// Stop accepting connections, wait for the running tasks to be done (pending
+// tasks are cancelled) and then close the open connections.  If ctx is done
+// first, the tasks still running are left running on their hosts, their
+// remote runner locks are released and an error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Print("Shutting down server...")
+	s.lock.Lock()
+	s.shuttingDown = true
+	s.lock.Unlock()
+	if s.rpcListener != nil {
+		s.rpcListener.Close()
+	}
+	// Open connections can still wait for their tasks
+	httpDone := make(chan error, 1)
+	if s.httpServer != nil {
+		go func() { httpDone <- s.httpServer.Shutdown(ctx) }()
+	} else {
+		httpDone <- nil
+	}
+
+	var err error
+	if left := s.getoRPC.manager.Shutdown(ctx); len(left) > 0 {
+		err = errors.New(fmt.Sprintf("%d task(s) left running", len(left)))
+	}
+	if httpErr := <-httpDone; httpErr != nil {
+		s.httpServer.Close()
+	}
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.serving.Wait()
+	log.Print("Server shut down")
+	return err
 }
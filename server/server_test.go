@@ -0,0 +1,314 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"context"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"github.com/bgmerrell/geto/lib/ssh/sshtest"
+	"github.com/bgmerrell/geto/lib/task"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use the config at configPath and start an SSH server for its hosts.  The
+// returned function stops it.
+func startSSHServer(t *testing.T, configPath string) func() {
+	if _, err := config.ParseConfig(configPath); err != nil {
+		t.Fatalf("Failed to parse test config: %s", err.Error())
+	}
+	s, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start SSH server: %s", err.Error())
+	}
+	// The hosts share the config's backing array
+	hosts := config.GetParsedConfig().Hosts
+	for i := range hosts {
+		hosts[i].PortNum = s.Port
+		hosts[i].Password = &s.Password
+	}
+	return func() { s.Close() }
+}
+
+// Start an SSH server for the configured host and return a JSON RPC client
+// of a GetoRPC.  The returned function stops both.
+func startServer(t *testing.T) (*rpc.Client, func()) {
+	stopSSHServer := startSSHServer(t, "../test/data/geto-sshtest.ini")
+	server := rpc.NewServer()
+	if err := server.Register(NewGetoRPC(ssh.New())); err != nil {
+		t.Fatalf("Failed to register RPCs: %s", err.Error())
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+	client := jsonrpc.NewClient(clientConn)
+	return client, func() {
+		client.Close()
+		stopSSHServer()
+	}
+}
+
+func submitTask(t *testing.T, client *rpc.Client, args SubmitTaskArgs) TaskReply {
+	var reply TaskReply
+	if err := client.Call("GetoRPC.SubmitTask", &args, &reply); err != nil {
+		t.Fatalf("Failed to submit task: %s", err.Error())
+	}
+	if reply.Id == "" || reply.State != "pending" || reply.Submitted == nil {
+		t.Fatalf("Unexpected submission reply: %#v", reply)
+	}
+	return reply
+}
+
+func waitTask(t *testing.T, client *rpc.Client, id string) TaskReply {
+	var reply TaskReply
+	if err := client.Call("GetoRPC.WaitTask", &WaitTaskArgs{id, 30}, &reply); err != nil {
+		t.Fatalf("Failed to wait for task: %s", err.Error())
+	}
+	if reply.Result == nil {
+		t.Fatalf("Expected task %s to be done, got %#v", id, reply)
+	}
+	return reply
+}
+
+func TestSubmitAndWaitTask(t *testing.T) {
+	client, stop := startServer(t)
+	defer stop()
+
+	submitted := submitTask(t, client, SubmitTaskArgs{
+		ScriptName: "test-rpc",
+		Script:     "mkdir -p out\necho result > out/a.txt\necho hello\nexit 3\n",
+		Outputs:    []string{"out/*.txt"},
+		Host:       "server1"})
+	reply := waitTask(t, client, submitted.Id)
+	if reply.State != "failed" || reply.Host != "server1" {
+		t.Errorf("Unexpected reply: %#v", reply)
+	}
+	result := reply.Result
+	if result.Stdout != "hello\n" || result.ExitCode != 3 || result.Error != "" {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+	if len(result.Outputs) != 1 || result.Outputs[0].Path != "out/a.txt" {
+		t.Errorf("Unexpected output files: %#v", result.Outputs)
+	}
+
+	var status TaskReply
+	if err := client.Call("GetoRPC.GetTaskStatus", &submitted.Id, &status); err != nil {
+		t.Fatalf("Failed to get task status: %s", err.Error())
+	}
+	if status.State != "failed" || status.Finished == nil {
+		t.Errorf("Unexpected status: %#v", status)
+	}
+
+	var tasks []TaskReply
+	if err := client.Call("GetoRPC.ListTasks", &ListTasksArgs{State: "failed"}, &tasks); err != nil {
+		t.Fatalf("Failed to list tasks: %s", err.Error())
+	}
+	if len(tasks) != 1 || tasks[0].Id != submitted.Id {
+		t.Errorf("Unexpected tasks: %#v", tasks)
+	}
+	if err := client.Call("GetoRPC.ListTasks", &ListTasksArgs{State: "running"}, &tasks); err != nil || len(tasks) != 0 {
+		t.Errorf("Expected no running tasks, got %#v (%v)", tasks, err)
+	}
+}
+
+func TestSubmitTaskWithDeps(t *testing.T) {
+	client, stop := startServer(t)
+	defer stop()
+
+	submitted := submitTask(t, client, SubmitTaskArgs{
+		ScriptName: "test-rpc-deps",
+		Script:     "cat DEPS/data.txt DEPS/more.txt",
+		Deps:       map[string][]byte{"data.txt": []byte("hello\n"), "more.txt": []byte("world\n")},
+		Host:       "server1"})
+	reply := waitTask(t, client, submitted.Id)
+	if reply.State != "succeeded" || reply.Result.Stdout != "hello\nworld\n" {
+		t.Errorf("Expected the script to read its dependency files, got %#v (%#v)", reply, reply.Result)
+	}
+
+	for _, name := range []string{"", "..", "../data.txt", "sub/data.txt"} {
+		err := client.Call("GetoRPC.SubmitTask", &SubmitTaskArgs{
+			ScriptName: "test-rpc-deps", Script: "true", Deps: map[string][]byte{name: []byte("x")}}, &reply)
+		if err == nil || !strings.Contains(err.Error(), "Invalid dependency file name") {
+			t.Errorf("Expected %q to be refused, got %v", name, err)
+		}
+	}
+}
+
+func TestCancelTask(t *testing.T) {
+	client, stop := startServer(t)
+	defer stop()
+
+	submitted := submitTask(t, client, SubmitTaskArgs{
+		ScriptName: "test-rpc-cancel", Script: "sleep 30", Strategy: "random"})
+	var reply TaskReply
+	// Wait for the task to be started so that it's killed on the host
+	for reply.State != "running" {
+		time.Sleep(100 * time.Millisecond)
+		if err := client.Call("GetoRPC.GetTaskStatus", &submitted.Id, &reply); err != nil {
+			t.Fatalf("Failed to get task status: %s", err.Error())
+		}
+	}
+	if err := client.Call("GetoRPC.CancelTask", &submitted.Id, &reply); err != nil {
+		t.Fatalf("Failed to cancel task: %s", err.Error())
+	}
+	start := time.Now()
+	if reply = waitTask(t, client, submitted.Id); reply.State != "cancelled" {
+		t.Errorf("Expected the task to be cancelled, got %#v", reply)
+	}
+	if time.Since(start) > 20*time.Second {
+		t.Errorf("Expected the task to be killed")
+	}
+	if err := client.Call("GetoRPC.CancelTask", &submitted.Id, &reply); err == nil {
+		t.Errorf("Expected an error cancelling a task that is done")
+	}
+}
+
+func TestTaskErrors(t *testing.T) {
+	client, stop := startServer(t)
+	defer stop()
+
+	var reply TaskReply
+	id := "no-such-task"
+	err := client.Call("GetoRPC.GetTaskStatus", &id, &reply)
+	if err == nil || err.Error() != "No such task" {
+		t.Errorf("Expected an unknown task error, got %v", err)
+	}
+	err = client.Call("GetoRPC.SubmitTask", &SubmitTaskArgs{
+		ScriptName: "test-rpc", Script: "true", Host: "nope"}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Unknown host") {
+		t.Errorf("Expected an unknown host error, got %v", err)
+	}
+	err = client.Call("GetoRPC.SubmitTask", &SubmitTaskArgs{
+		ScriptName: "test-rpc", Script: "true", Strategy: "nope"}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Unknown strategy") {
+		t.Errorf("Expected an unknown strategy error, got %v", err)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	client, stop := startServer(t)
+	defer stop()
+
+	var hosts []HostReply
+	if err := client.Call("GetoRPC.ListHosts", &NoArgs{}, &hosts); err != nil {
+		t.Fatalf("Failed to list hosts: %s", err.Error())
+	}
+	if len(hosts) != 1 || hosts[0].Name != "server1" || hosts[0].Username != "geto" {
+		t.Errorf("Unexpected hosts: %#v", hosts)
+	}
+
+	var results []HostConnectionReply
+	hostName := ""
+	if err := client.Call("GetoRPC.TestHostConnection", &hostName, &results); err != nil {
+		t.Fatalf("Failed to test host connections: %s", err.Error())
+	}
+	if len(results) != 1 || !results[0].Ok || results[0].Error != "" {
+		t.Errorf("Unexpected results: %#v", results)
+	}
+	hostName = "nope"
+	if err := client.Call("GetoRPC.TestHostConnection", &hostName, &results); err == nil {
+		t.Errorf("Expected an unknown host error")
+	}
+}
+
+func TestServerShutdownBeforeStart(t *testing.T) {
+	if err := NewServer(ssh.New()).Shutdown(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "geto-server")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dirPath)
+	socketPath := filepath.Join(dirPath, "geto.sock")
+	content, err := ioutil.ReadFile("../test/data/geto-sshtest.ini")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	configPath := filepath.Join(dirPath, "geto.ini")
+	err = ioutil.WriteFile(configPath, []byte(strings.Replace(string(content), "[geto]\n",
+		"[geto]\nrpc_listen_addr=unix:"+socketPath+"\nhttp_listen_addr=127.0.0.1:0\n"+
+			"task_store_path="+filepath.Join(dirPath, "tasks")+"\n", 1)), 0600)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer startSSHServer(t, configPath)()
+
+	// A socket left over from a server that didn't clean up is replaced
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := NewServer(ssh.New())
+	if err = s.Start(); err != nil {
+		t.Fatalf("Failed to start server: %s", err.Error())
+	}
+	if s.HTTPAddr() == nil {
+		t.Errorf("Expected the HTTP API to be listening")
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err.Error())
+	}
+	client := jsonrpc.NewClient(conn)
+	defer client.Close()
+	quick := submitTask(t, client, SubmitTaskArgs{ScriptName: "test-quick", Script: "sleep 1"})
+	slow := submitTask(t, client, SubmitTaskArgs{ScriptName: "test-slow", Script: "sleep 5"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(ctx) }()
+
+	// Open connections are served until the tasks are done, but no new
+	// tasks or connections are taken
+	time.Sleep(200 * time.Millisecond)
+	var reply TaskReply
+	err = client.Call("GetoRPC.SubmitTask", &SubmitTaskArgs{ScriptName: "test-late", Script: "true"}, &reply)
+	if err == nil || err.Error() != "Shutting down" {
+		t.Errorf("Expected a task submitted during shutdown to be refused, got %v", err)
+	}
+	if reply = waitTask(t, client, quick.Id); reply.State != "succeeded" {
+		t.Errorf("Expected the quick task to be drained, got %#v", reply)
+	}
+	if _, err = net.Dial("unix", socketPath); err == nil {
+		t.Errorf("Expected new connections to be refused")
+	}
+
+	if err = <-shutdownErr; err == nil || err.Error() != "1 task(s) left running" {
+		t.Errorf("Expected the slow task to be left running, got %v", err)
+	}
+	if info, _ := s.getoRPC.manager.Get(slow.Id); info.State != task.TaskRunning {
+		t.Errorf("Unexpected slow task: %#v", info)
+	}
+	// A restarted server picks the recorded tasks up
+	store, err := task.NewFileStore(filepath.Join(dirPath, "tasks"))
+	if err != nil {
+		t.Fatalf("Failed to open task store: %s", err.Error())
+	}
+	if record, err := store.Get(slow.Id); err != nil || record.Info.State != task.TaskRunning ||
+		record.Info.Host != "server1" {
+		t.Errorf("Unexpected record of the slow task: %#v (%v)", record, err)
+	}
+	if record, err := store.Get(quick.Id); err != nil || record.Info.State != task.TaskSucceeded {
+		t.Errorf("Unexpected record of the quick task: %#v (%v)", record, err)
+	}
+	if _, err = os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got %v", err)
+	}
+}
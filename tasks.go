@@ -0,0 +1,365 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+The commands that run tasks and look after them: run, status, cancel and logs
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/bgmerrell/geto/client"
+	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/remote/ssh"
+	"github.com/bgmerrell/geto/lib/task"
+	"github.com/bgmerrell/geto/server"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Prints a task's output as it's streamed, and once the task is done,
+// whatever of it wasn't streamed (e.g., because the stream fell behind)
+type outputPrinter struct {
+	offsets map[string]int64
+}
+
+func newOutputPrinter() *outputPrinter {
+	return &outputPrinter{map[string]int64{}}
+}
+
+func (p *outputPrinter) write(stream string, data []byte) {
+	if stream == task.STDERR {
+		os.Stderr.Write(data)
+	} else {
+		os.Stdout.Write(data)
+	}
+	p.offsets[stream] += int64(len(data))
+}
+
+// Print a chunk of the output, unless it doesn't follow on from what's been
+// printed, in which case it's left to finish
+func (p *outputPrinter) print(chunk task.OutputChunk) {
+	if chunk.Offset == p.offsets[chunk.Stream] {
+		p.write(chunk.Stream, chunk.Data)
+	}
+}
+
+// Print what's left of the output of a done task
+func (p *outputPrinter) finish(result *server.TaskResult) {
+	if result == nil {
+		return
+	}
+	for stream, content := range map[string]string{
+		task.STDOUT: result.Stdout, task.STDERR: result.Stderr} {
+		if offset := p.offsets[stream]; offset < int64(len(content)) {
+			p.write(stream, []byte(content[offset:]))
+		}
+	}
+}
+
+// Exit with the exit code of a done task's script, or 1 if the task failed
+// to run
+func exitWithResult(reply server.TaskReply) {
+	if reply.Result == nil {
+		fail(errors.New(fmt.Sprintf("Task %s isn't done", reply.Id)))
+	}
+	if reply.Result.Error != "" {
+		fail(errors.New(reply.Result.Error))
+	}
+	os.Exit(reply.Result.ExitCode)
+}
+
+// Call cancel once the first SIGINT is received, then let a second one stop
+// geto
+func cancelOnInterrupt(cancel func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		signal.Reset(os.Interrupt)
+		fmt.Fprintln(os.Stderr, "geto: cancelling the task (interrupt again to stop waiting)")
+		cancel()
+	}()
+}
+
+// Run a script on a host, print its output as it runs and exit with its exit
+// code
+func runTask(args []string) {
+	const usage = "geto run [-host HOST] [-strategy STRATEGY] [-dep FILE]... [-output GLOB]... " +
+		"[-name NAME] [-timeout SECONDS] [-detach] [-server URL] [-token TOKEN] [-ca-cert PATH] <script>"
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	hostName := flags.String("host", "", "Host to run the script on")
+	strategy := flags.String("strategy", "", `How the host is chosen: "host", "random" or "balanced" `+
+		`(default "host" with -host, "random" otherwise)`)
+	var depPaths, outputs stringList
+	flags.Var(&depPaths, "dep", "File that the script requires, available to it as DEPS/<file name> (repeatable)")
+	flags.Var(&outputs, "output", "Glob of the files to collect after the script exits (repeatable)")
+	name := flags.String("name", "", "Script name (default the script's file name)")
+	timeout := flags.Uint("timeout", 0, "Seconds before giving up on the task, 0 for no limit")
+	detach := flags.Bool("detach", false, "Print the task's ID instead of waiting for it (with a server)")
+	cf := addClientFlags(flags, "")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		failUsage(usage)
+	}
+	scriptPath := flags.Arg(0)
+	if *name == "" {
+		*name = filepath.Base(scriptPath)
+	}
+	if *strategy == "" {
+		*strategy = string(task.StrategyRandom)
+		if *hostName != "" {
+			*strategy = string(task.StrategyHost)
+		}
+	}
+
+	if cf.useServer() {
+		content, err := ioutil.ReadFile(scriptPath)
+		if err != nil {
+			fail(err)
+		}
+		runOnServer(cf.newClient(), server.SubmitTaskArgs{
+			ScriptName: *name,
+			Script:     string(content),
+			Timeout:    uint32(*timeout),
+			Outputs:    outputs,
+			Strategy:   *strategy,
+			Host:       *hostName}, depPaths, *detach)
+	}
+	if *detach {
+		fail(errors.New("-detach needs a geto server (-server)"))
+	}
+
+	loadConfig()
+	script, err := task.NewScriptFromPath(*name, scriptPath, nil)
+	if err != nil {
+		fail(err)
+	}
+	t, err := task.New(depPaths, script, uint32(*timeout))
+	if err != nil {
+		fail(err)
+	}
+	t.Outputs = outputs
+	m := task.NewManager(ssh.New())
+	info, err := m.Submit(t, task.SubmitOptions{Strategy: task.Strategy(*strategy), Host: *hostName})
+	if err != nil {
+		fail(err)
+	}
+	cancelOnInterrupt(func() { m.Cancel(info.Id) })
+	printer := newOutputPrinter()
+	if chunks, unsubscribe, err := m.Subscribe(info.Id); err == nil {
+		for chunk := range chunks {
+			printer.print(chunk)
+		}
+		unsubscribe()
+	}
+	if info, err = m.Wait(info.Id, 0); err != nil {
+		fail(err)
+	}
+	reply := server.GetTaskReply(info)
+	printer.finish(reply.Result)
+	exitWithResult(reply)
+}
+
+// Submit a task to a geto server and, unless detach is set, print its output
+// as it runs and exit with its exit code
+func runOnServer(c *client.Client, args server.SubmitTaskArgs, depPaths []string, detach bool) {
+	submitted, err := c.SubmitTask(args, depPaths)
+	if err != nil {
+		fail(err)
+	}
+	if detach {
+		fmt.Println(submitted.Id)
+		os.Exit(0)
+	}
+	fmt.Fprintf(os.Stderr, "geto: submitted task %s\n", submitted.Id)
+	cancelOnInterrupt(func() { c.CancelTask(submitted.Id) })
+	printer := newOutputPrinter()
+	reply, err := c.FollowOutput(submitted.Id, true, printer.print)
+	if err != nil {
+		fail(err)
+	}
+	// The output ended before the task was done
+	for reply == nil || reply.Result == nil {
+		if reply, err = c.GetTask(submitted.Id, 60); err != nil {
+			fail(err)
+		}
+	}
+	printer.finish(reply.Result)
+	exitWithResult(*reply)
+}
+
+// Print a task's status, with its state on its host if it's known
+func printTaskReply(reply server.TaskReply, hostState task.State) {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", reply.Id)
+	fmt.Fprintf(w, "Script:\t%s\n", reply.ScriptName)
+	fmt.Fprintf(w, "Host:\t%s\n", reply.Host)
+	if hostState != "" {
+		fmt.Fprintf(w, "State:\t%s (%s on the host)\n", reply.State, hostState)
+	} else {
+		fmt.Fprintf(w, "State:\t%s\n", reply.State)
+	}
+	if reply.Owner != "" {
+		fmt.Fprintf(w, "Owner:\t%s\n", reply.Owner)
+	}
+	fmt.Fprintf(w, "Submitted:\t%s\n", formatTime(reply.Submitted))
+	fmt.Fprintf(w, "Started:\t%s\n", formatTime(reply.Started))
+	fmt.Fprintf(w, "Finished:\t%s\n", formatTime(reply.Finished))
+	if r := reply.Result; r != nil {
+		fmt.Fprintf(w, "Exit code:\t%d\n", r.ExitCode)
+		if r.LimitHit != "" {
+			fmt.Fprintf(w, "Limit hit:\t%s\n", r.LimitHit)
+		}
+		if r.Error != "" {
+			fmt.Fprintf(w, "Error:\t%s\n", r.Error)
+		}
+		for _, output := range r.Outputs {
+			fmt.Fprintf(w, "Output file:\t%s (%d bytes)\n", output.Path, output.Size)
+		}
+	}
+	w.Flush()
+}
+
+// Return the record of a task in the configured task store, exiting if
+// there isn't one
+func getTaskRecord(id string) task.TaskRecord {
+	loadConfig()
+	storePath := config.GetParsedConfig().TaskStorePath
+	if storePath == "" {
+		fail(errors.New("The task store is disabled (task_store_path); use -server"))
+	}
+	store, err := task.NewFileStore(storePath)
+	if err != nil {
+		fail(err)
+	}
+	record, err := store.Get(id)
+	if err != nil {
+		fail(err)
+	}
+	return record
+}
+
+// Print the status of a task and exit
+func printStatus(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	cf := addClientFlags(flags, "")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		failUsage("geto status [-server URL] [-token TOKEN] [-ca-cert PATH] <task id>")
+	}
+
+	if cf.useServer() {
+		reply, err := cf.newClient().GetTask(flags.Arg(0), 0)
+		if err != nil {
+			fail(err)
+		}
+		printTaskReply(*reply, "")
+		os.Exit(0)
+	}
+
+	record := getTaskRecord(flags.Arg(0))
+	var hostState task.State
+	// The record of a running task may be out of date (e.g., if the
+	// server is down), so the task is looked up on its host
+	if record.Info.State == task.TaskRunning {
+		hosts := selectHosts([]string{record.Info.Host}, nil)
+		status, err := task.GetStatus(ssh.New(), record.GetTask(), hosts[0])
+		if err != nil {
+			fail(err)
+		}
+		hostState = status.State
+	}
+	printTaskReply(server.GetTaskReply(record.Info), hostState)
+	os.Exit(0)
+}
+
+// Cancel a task and exit
+func cancelTask(args []string) {
+	flags := flag.NewFlagSet("cancel", flag.ExitOnError)
+	cf := addClientFlags(flags, "")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		failUsage("geto cancel [-server URL] [-token TOKEN] [-ca-cert PATH] <task id>")
+	}
+
+	if cf.useServer() {
+		reply, err := cf.newClient().CancelTask(flags.Arg(0))
+		if err != nil {
+			fail(err)
+		}
+		printTaskReply(*reply, "")
+		os.Exit(0)
+	}
+
+	// Without the server, the task can only be killed on its host; the
+	// server records it as cancelled once it collects its result
+	record := getTaskRecord(flags.Arg(0))
+	switch {
+	case record.Info.State.Terminal():
+		fail(task.ErrTaskDone)
+	case record.Info.State == task.TaskPending:
+		fail(errors.New("The task hasn't been started on a host; cancel it with -server"))
+	}
+	hosts := selectHosts([]string{record.Info.Host}, nil)
+	if err := task.Kill(ssh.New(), record.GetTask(), hosts[0]); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Killed task %s on host %s\n", record.Info.Id, record.Info.Host)
+	os.Exit(0)
+}
+
+// Print the output of a task, from a geto server, and exit
+func printLogs(args []string) {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "Follow the output until the task is done")
+	cf := addClientFlags(flags, client.DEFAULT_SERVER_URL)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		failUsage("geto logs [-f] [-server URL] [-token TOKEN] [-ca-cert PATH] <task id>")
+	}
+
+	c := cf.newClient()
+	reply, err := c.FollowOutput(flags.Arg(0), *follow, func(chunk task.OutputChunk) {
+		if chunk.Stream == task.STDERR {
+			os.Stderr.Write(chunk.Data)
+		} else {
+			os.Stdout.Write(chunk.Data)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if reply != nil && reply.Result.Error != "" {
+		fmt.Fprintln(os.Stderr, "geto: "+reply.Result.Error)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -12,9 +12,12 @@ def test_echo(client, args):
         client.call("GetoRPC.Echo", args.string))
 
 
-def test_host_connection(args):
-    # TODO: Implement
-    pass
+def test_host_connection(client, args):
+    for result in client.call("GetoRPC.TestHostConnection", args.host):
+        if result["Ok"]:
+            print "{}: ok".format(result["Host"])
+        else:
+            print "{}: {}".format(result["Host"], result["Error"])
 
 
 def main():
@@ -36,14 +39,22 @@ def main():
     parser.add_argument(
             '--port', '-p', metavar='PORT', type=int, default=11102,
             help="The RPC server port")
+    parser.add_argument(
+            '--token', '-t', metavar='TOKEN', type=str,
+            help="The client's authentication token")
 
     parser_echo.add_argument(
             '--string', metavar='STRING', type=str,
             help='The string to echo', default="test")
+    parser_con_test.add_argument(
+            '--host', metavar='HOST', type=str, default="",
+            help='The host to connect to (default: all of them)')
 
     args = parser.parse_args()
 
     client = JSONClient((args.server, args.port))
+    if args.token:
+        client.call("GetoRPC.Authenticate", args.token)
     args.func(client, args)
 
     return 0
@@ -8,6 +8,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/bgmerrell/geto/lib/config"
+	"github.com/bgmerrell/geto/lib/shell"
 	"github.com/bgmerrell/geto/lib/ssh"
 	"os"
 	"time"
@@ -56,6 +57,8 @@ func testScpToRemote() (err error) {
 		err = ssh.ScpTo(
 			host.Addr,
 			host.Username,
+			host.Password,
+			conf.PrivKeyPath,
 			host.PortNum,
 			false,
 			SCP_TEST_PATH,
@@ -76,6 +79,8 @@ func testScpFromRemote() (err error) {
 		err = ssh.ScpFrom(
 			host.Addr,
 			host.Username,
+			host.Password,
+			conf.PrivKeyPath,
 			host.PortNum,
 			false,
 			SCP_TEST_PATH,
@@ -87,7 +92,7 @@ func testScpFromRemote() (err error) {
 			host.Password,
 			conf.PrivKeyPath,
 			host.PortNum,
-			fmt.Sprintf("rm %s", SCP_TEST_PATH),
+			shell.Command("rm", SCP_TEST_PATH),
 			0)
 		if err != nil {
 			fmt.Printf("FAIL (%s)\n", err.Error())
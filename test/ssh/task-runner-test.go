@@ -12,6 +12,7 @@ import (
 	"github.com/bgmerrell/geto/lib/remote/ssh"
 	"github.com/bgmerrell/geto/lib/task"
 	"os"
+	"time"
 )
 
 // Set by command line parsing
@@ -43,12 +44,12 @@ func testEchoTask() {
 	go task.RunOnHost(ssh.New(), t, testHost, c)
 	output := <-c
 
-	// TODO: fail the test if stdout isn't what we expect (after we start
-	// SCPing back the script stdout, and stderr in the task directory
-	fmt.Println("stdout: ", output.Stdout)
-	fmt.Println("stderr: ", output.Stderr)
-	if err != nil {
-		fmt.Println("err: ", output.Err.Error())
+	if output.Err != nil {
+		fmt.Printf("FAIL (%s)\n", output.Err.Error())
+	} else if output.Stdout != "hello\n" || output.Stderr != "" {
+		fmt.Printf("FAIL (stdout: %s, stderr: %s)\n", output.Stdout, output.Stderr)
+	} else {
+		fmt.Printf("PASS\n")
 	}
 }
 
@@ -130,13 +131,16 @@ func testRunOnHostBalancedByScriptName() {
 	go task.RunOnHost(ssh.New(), t2, testHost, c2)
 	go task.RunOnHost(ssh.New(), t3, testHost, c3)
 
-	<-c1
-	<-c2
-	<-c3
+	/* RunOnHost waits for the tasks to finish, so give them a moment to
+	start before load balancing */
+	time.Sleep(5 * time.Second)
 
 	/* Now run on host balanced by script name */
 	go task.RunOnHostBalancedByScriptName(ssh.New(), t4, c4)
 
+	<-c1
+	<-c2
+	<-c3
 	<-c4
 
 	// TODO: Fail the test if the correct server wasn't picked